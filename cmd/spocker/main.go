@@ -1,37 +1,120 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"net"
 	"os"
 	"os/exec"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
 	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"spocker/internal/container"
 	"spocker/internal/container/cgroup"
+	"spocker/internal/container/filesystem"
 	"spocker/internal/container/namespace"
 	"spocker/internal/container/network"
+	"spocker/internal/container/process"
+	"spocker/internal/daemon"
 
 	"go.uber.org/zap"
 )
 
 type Config struct {
 	MemoryLimit    int
+	Swappiness     int
+	MemorySwap     int
 	CPUShares      int
+	CPUPercent     float64
 	BlkioWeight    int
+	CpusetCPUs     string
+	CpusetMems     string
+	Profile        string
+	ProfilesFile   string
 	CgroupName     string
 	NamespaceName  string
 	NamespaceType  namespace.NamespaceType
+	UserNS         bool
 	FSRoot         string
+	Overlay        bool
+	RWSize         int64
+	NetworkMode    network.Mode
+	NetContainer   string
+	PIDContainer   string
 	NetworkName    string
 	NetworkIPCIDR  string
 	NetworkGateway string
+	Ports          []network.PortMapping
+	VerifyNetwork  bool
+	Devices        []*filesystem.DeviceMapping
+	ShmSize        int64
+	Sysctls        map[string]string
+	Labels         map[string]string
+	NetworkLabel   string
+	NetworkAliases []string
+	CapAdd         []string
+	CapDrop        []string
+	SchedPolicy    string
+	SchedPriority  int
+	StopSignal     string
+	Init           bool
+	Remove         bool
+	KeepOnFailure  bool
+	MaxStarts      int
+	Host           string
+	PIDFile        string
+	WorkDir        string
+	WorkDirCreate  bool
+	WorkDirMode    uint
+	WorkDirUID     int
+	WorkDirGID     int
+	HealthCmd      string
+	HealthInterval time.Duration
+	HealthTimeout  time.Duration
+	StartPeriod    time.Duration
+	ExitUnhealthy  bool
+}
+
+// stringSliceFlag is a flag.Value that collects every occurrence of a repeatable flag.
+type stringSliceFlag []string
+
+// String returns the collected values joined by commas.
+func (s *stringSliceFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+// Set appends a value each time the flag is given.
+func (s *stringSliceFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
 }
 
 // usage prints the command usage information.
 func usage() {
-	fmt.Fprintf(os.Stderr, "Usage: %s COMMAND\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] COMMAND\n\nCommands:\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  run <command> [args...]\tRun a command in a new container\n")
+	fmt.Fprintf(os.Stderr, "  create <command> [args...]\tCreate a container without starting it and print its ID\n")
+	fmt.Fprintf(os.Stderr, "  start <id>\t\t\tStart a created container\n")
+	fmt.Fprintf(os.Stderr, "  stop [-t TIMEOUT] <id>\t\tStop a running container with its stop signal, then SIGKILL\n")
+	fmt.Fprintf(os.Stderr, "  rm <id>\t\t\tRemove a container that is not running\n")
+	fmt.Fprintf(os.Stderr, "  up [-f FILE]\t\t\tStart the services of a stack file in dependency order\n")
+	fmt.Fprintf(os.Stderr, "  down [-f FILE]\t\tStop and remove the services of a stack file\n")
+	fmt.Fprintf(os.Stderr, "  exec [-it] <id> <command>\tRun a command in a running container\n")
+	fmt.Fprintf(os.Stderr, "  inspect [-env] <id>\t\tPrint the state of a container as JSON, or its environment\n")
+	fmt.Fprintf(os.Stderr, "  inspect -size <id>\t\tPrint the state, current stats, and disk usage of a container as JSON\n")
+	fmt.Fprintf(os.Stderr, "  inspect -all [-size]\t\tPrint the state and current stats of every container as JSON\n")
+	fmt.Fprintf(os.Stderr, "  diff <id>\t\t\tList the files a container added, changed, or deleted\n")
+	fmt.Fprintf(os.Stderr, "  top <id>\t\t\tList the processes running in a container\n")
+	fmt.Fprintf(os.Stderr, "  ps\t\t\t\tList the containers with their status\n")
+	fmt.Fprintf(os.Stderr, "  logs <id>\t\t\tPrint the output of a container run by the daemon\n")
+	fmt.Fprintf(os.Stderr, "  gc\t\t\t\tDetach loop devices and remove temporary directories left behind by containers that no longer exist\n")
+	fmt.Fprintf(os.Stderr, "  daemon\t\t\tServe run, stop, ps, inspect, and logs on the -host socket\n\n")
 	flag.PrintDefaults()
 }
 
@@ -50,10 +133,60 @@ func main() {
 		usage()
 		os.Exit(1)
 	}
+	if err := container.SetMaxConcurrentStarts(config.MaxStarts); err != nil {
+		logger.Error("Invalid start limit", zap.Error(err))
+		os.Exit(1)
+	}
+	container.NetworkLabel = config.NetworkLabel
 
+	if config.Host != "" && flag.Args()[0] != "daemon" {
+		remoteCommand(config, logger)
+		return
+	}
 	switch flag.Args()[0] {
 	case "run":
 		runContainer(config, logger)
+	case "create":
+		createContainer(config, logger)
+	case "start":
+		startContainer(flag.Args()[1:], logger)
+	case "stop":
+		stopContainer(flag.Args()[1:], logger)
+	case "rm":
+		removeContainer(flag.Args()[1:], logger)
+	case "gc":
+		gcContainers(logger)
+	case "up":
+		upStack(flag.Args()[1:], logger)
+	case "down":
+		downStack(flag.Args()[1:], logger)
+	case process.InitCommand:
+		runInit(flag.Args()[1:], logger)
+	case process.WaitStartCommand:
+		waitStart(flag.Args()[1:], logger)
+	case namespace.HolderCommand:
+		// The holder only keeps its namespaces alive until it is killed
+		for {
+			time.Sleep(time.Hour)
+		}
+	case "exec":
+		execContainer(flag.Args()[1:], logger)
+	case process.ExecCommand:
+		execHelper(flag.Args()[1:], logger)
+	case "inspect":
+		inspectContainer(flag.Args()[1:], logger)
+	case "diff":
+		diffContainer(flag.Args()[1:], logger)
+	case "top":
+		topContainer(flag.Args()[1:], logger)
+	case "ps":
+		listContainers(daemon.DefaultBackend{}, logger)
+	case "logs":
+		printLogs(daemon.DefaultBackend{}, flag.Args()[1:], logger)
+	case "daemon":
+		runDaemon(config, logger)
+	case container.ResolverCommand:
+		serveResolver(flag.Args()[1:], logger)
 	default:
 		usage()
 		os.Exit(1)
@@ -65,83 +198,847 @@ func parseFlags() (*Config, error) {
 	flag.Usage = usage
 
 	memoryLimitFlag := flag.Int("memory-limit", 0, "Memory limit for the container in bytes")
+	memorySwapFlag := flag.Int("memory-swap", 0, "limit on memory and swap together in bytes, at least -memory-limit (0 leaves swap uncapped)")
+	swappinessFlag := flag.Int("memory-swappiness", -1, "tendency, from 0 to 100, to swap out the container's memory; 0 avoids swapping (cgroup v1 only, -1 inherits)")
 	cpuSharesFlag := flag.Int("cpu-shares", 0, "CPU shares for the container")
+	cpuPercentFlag := flag.Float64("cpu-percent", 0, "hard cap on CPU time as a percentage of all online CPUs, e.g. 50 allows half the machine")
 	blkioWeightFlag := flag.Int("blkio-weight", 0, "Block I/O weight for the container")
-	cgroupNameFlag := flag.String("cgroup-name", "", "cgroup name for the container")
+	cpusetCPUsFlag := flag.String("cpuset-cpus", "", "CPUs the container is pinned to, e.g. 2-3 (needs -cpuset-mems)")
+	cpusetMemsFlag := flag.String("cpuset-mems", "", "NUMA memory nodes the container is pinned to, e.g. 0 (needs -cpuset-cpus)")
+	shmSizeFlag := flag.Int64("shm-size", filesystem.DefaultShmSize, "size of the container's /dev/shm in bytes")
+	profileFlag := flag.String("profile", "", "named resource profile, e.g. small, medium, or large; explicit limits override it")
+	profilesFileFlag := flag.String("profiles-file", "", "JSON file defining resource profiles (defaults to the built-in profiles)")
+	cgroupNameFlag := flag.String("cgroup-name", "", "cgroup name for the container (defaults to spocker- and the start of its ID)")
 	namespaceNameFlag := flag.String("namespace-name", "", "namespace name for the container")
 	namespaceTypeFlag := flag.Int("namespace-type", 0, "namespace type for the container")
+	userNSFlag := flag.Bool("userns", false, "run the container in a user namespace with its root mapped to the calling user, so it can be created without root")
 	fsRootFlag := flag.String("fs-root", "", "file system root path for the container")
+	overlayFlag := flag.Bool("overlay", false, "mount the file system root read-only under a writable layer of the container's own, removed with the container")
+	rwSizeFlag := flag.Int64("rw-size", 0, "keep the writable layer on an ext4 loopback image of this many bytes, capping what the container can write; implies -overlay")
+	networkModeFlag := flag.String("network", string(network.ModeBridge), "network mode: bridge, host (no network isolation), none (loopback only), or container:<id> to share a running container's network")
+	pidFlag := flag.String("pid", "", "container:<id> to share a running container's PID namespace instead of getting a new one")
 	networkNameFlag := flag.String("network-name", "", "network name")
 	networkIPCIDRFlag := flag.String("network-ip-cidr", "", "network IP CIDR")
 	networkGatewayFlag := flag.String("network-gateway", "", "network gateway")
+	var publishFlags stringSliceFlag
+	flag.Var(&publishFlags, "publish", "publish a container port on the host as [[HOST_IP:]HOST_PORT:]CONTAINER_PORT[/PROTOCOL]; an empty host port, as in :8080, gets a free one (repeatable)")
+	verifyNetworkFlag := flag.Bool("verify-network", false, "read back the container's network configuration once it is set up and fail if it does not match")
+	var deviceFlags stringSliceFlag
+	var sysctlFlags stringSliceFlag
+	var labelFlags stringSliceFlag
+	flag.Var(&labelFlags, "label", "label to record on the container as KEY=VALUE (repeatable)")
+	var networkAliasFlags stringSliceFlag
+	flag.Var(&networkAliasFlags, "network-alias", "name the container can be reached by on its labeled network, besides its ID (repeatable)")
+	networkLabelFlag := flag.String("network-label", "", "label key whose value attaches the container to a network shared with every container with the same value, e.g. app")
+	schedPolicyFlag := flag.String("sched-policy", "", "scheduling policy of the command: SCHED_OTHER, SCHED_BATCH, SCHED_IDLE, SCHED_FIFO, or SCHED_RR")
+	schedPriorityFlag := flag.Int("sched-priority", 0, "real-time scheduling priority, from 1 to 99, for SCHED_FIFO and SCHED_RR")
+	var capAddFlags stringSliceFlag
+	var capDropFlags stringSliceFlag
+	flag.Var(&capAddFlags, "cap-add", "capability to add to the default set, e.g. CAP_NET_ADMIN, or ALL (repeatable)")
+	flag.Var(&capDropFlags, "cap-drop", "capability to drop from the default set, e.g. CAP_CHOWN, or ALL; drops apply before adds (repeatable)")
+	flag.Var(&sysctlFlags, "sysctl", "namespaced sysctl to set in the container as KEY=VALUE (repeatable)")
+	flag.Var(&deviceFlags, "device", "host device to expose as HOST[:CONTAINER[:PERMISSIONS]] (repeatable)")
+	stopSignalFlag := flag.String("stop-signal", "SIGTERM", "signal sent to ask the container to exit before it is killed, e.g. SIGQUIT")
+	initFlag := flag.Bool("init", false, "run an init process as PID 1 that forwards signals and reaps zombies")
+	removeFlag := flag.Bool("rm", false, "remove the container, including its state and cgroup, as soon as it exits")
+	keepOnFailureFlag := flag.Bool("keep-on-failure", false, "keep a container that fails to start, with its cgroup, namespaces, and mounts, for debugging until it is removed with rm")
+	pidFileFlag := flag.String("pidfile", "", "file to write the container's PID to once it is started, removed when it exits")
+	hostFlag := flag.String("host", "", "daemon socket to send run, stop, ps, inspect, and logs to, e.g. "+daemon.DefaultHost+"; the daemon command listens on it")
+	maxStartsFlag := flag.Int("max-concurrent-starts", 0, "maximum number of containers set up at the same time by this process, 0 for no limit")
+	workDirFlag := flag.String("workdir", "", "working directory of the command inside the container")
+	workDirCreateFlag := flag.Bool("workdir-create", false, "create the working directory if it does not exist in the rootfs")
+	workDirModeFlag := flag.Uint("workdir-mode", 0755, "permissions of a created working directory")
+	workDirUIDFlag := flag.Int("workdir-uid", 0, "owner of a created working directory")
+	workDirGIDFlag := flag.Int("workdir-gid", 0, "group of a created working directory")
+	healthCmdFlag := flag.String("health-cmd", "", "command run with /bin/sh -c inside the container to check health")
+	healthIntervalFlag := flag.Duration("health-interval", container.DefaultHealthInterval, "time between health checks")
+	healthTimeoutFlag := flag.Duration("health-timeout", container.DefaultHealthTimeout, "maximum time a single health check may take")
+	healthStartPeriodFlag := flag.Duration("health-start-period", 30*time.Second, "time the container has to become healthy")
+	healthExitFlag := flag.Bool("health-exit-on-unhealthy", false, "stop the container and fail if it is not healthy within the start period")
 
 	flag.Parse()
 
+	networkModeName, netContainer := parseContainerRef(*networkModeFlag)
+	networkMode, err := network.ParseMode(networkModeName)
+	if err != nil {
+		return nil, err
+	}
+	pidContainer := ""
+	if *pidFlag != "" {
+		var mode string
+		if mode, pidContainer = parseContainerRef(*pidFlag); mode != "container" {
+			return nil, fmt.Errorf("invalid PID namespace %q: expected container:<id>", *pidFlag)
+		}
+	}
+
+	var ports []network.PortMapping
+	for _, spec := range publishFlags {
+		mapping, err := network.ParsePortMapping(spec)
+		if err != nil {
+			return nil, err
+		}
+		ports = append(ports, mapping)
+	}
+
+	var devices []*filesystem.DeviceMapping
+	for _, spec := range deviceFlags {
+		device, err := filesystem.ParseDeviceMapping(spec)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+
+	sysctls := map[string]string{}
+	for _, spec := range sysctlFlags {
+		key, value, err := namespace.ParseSysctl(spec)
+		if err != nil {
+			return nil, err
+		}
+		sysctls[key] = value
+	}
+
+	labels := map[string]string{}
+	for _, spec := range labelFlags {
+		key, value, ok := strings.Cut(spec, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid label %q: expected KEY=VALUE", spec)
+		}
+		labels[key] = value
+	}
+
+	for _, name := range append(append([]string{}, capAddFlags...), capDropFlags...) {
+		if _, err := process.ParseCapability(name); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := process.ValidateScheduler(*schedPolicyFlag, *schedPriorityFlag); err != nil {
+		return nil, err
+	}
+	if _, err := process.ParseSignal(*stopSignalFlag); err != nil {
+		return nil, err
+	}
+	if err := filesystem.ValidateShmSize(*shmSizeFlag); err != nil {
+		return nil, err
+	}
+	if *rwSizeFlag != 0 && *rwSizeFlag < filesystem.MinLoopbackSize {
+		return nil, fmt.Errorf("invalid -rw-size %d: must be at least %d bytes", *rwSizeFlag, filesystem.MinLoopbackSize)
+	}
+
 	return &Config{
 		MemoryLimit:    *memoryLimitFlag,
+		Swappiness:     *swappinessFlag,
+		MemorySwap:     *memorySwapFlag,
 		CPUShares:      *cpuSharesFlag,
+		CPUPercent:     *cpuPercentFlag,
 		BlkioWeight:    *blkioWeightFlag,
+		CpusetCPUs:     *cpusetCPUsFlag,
+		CpusetMems:     *cpusetMemsFlag,
+		Profile:        *profileFlag,
+		ProfilesFile:   *profilesFileFlag,
 		CgroupName:     *cgroupNameFlag,
 		NamespaceName:  *namespaceNameFlag,
 		NamespaceType:  namespace.NamespaceType(*namespaceTypeFlag),
+		UserNS:         *userNSFlag,
 		FSRoot:         *fsRootFlag,
+		Overlay:        *overlayFlag,
+		RWSize:         *rwSizeFlag,
+		NetworkMode:    networkMode,
+		NetContainer:   netContainer,
+		PIDContainer:   pidContainer,
 		NetworkName:    *networkNameFlag,
 		NetworkIPCIDR:  *networkIPCIDRFlag,
 		NetworkGateway: *networkGatewayFlag,
+		Ports:          ports,
+		VerifyNetwork:  *verifyNetworkFlag,
+		Devices:        devices,
+		ShmSize:        *shmSizeFlag,
+		Sysctls:        sysctls,
+		Labels:         labels,
+		NetworkLabel:   *networkLabelFlag,
+		NetworkAliases: networkAliasFlags,
+		CapAdd:         capAddFlags,
+		SchedPolicy:    *schedPolicyFlag,
+		SchedPriority:  *schedPriorityFlag,
+		StopSignal:     *stopSignalFlag,
+		CapDrop:        capDropFlags,
+		Init:           *initFlag,
+		Remove:         *removeFlag,
+		KeepOnFailure:  *keepOnFailureFlag,
+		MaxStarts:      *maxStartsFlag,
+		Host:           *hostFlag,
+		PIDFile:        *pidFileFlag,
+		WorkDir:        *workDirFlag,
+		WorkDirCreate:  *workDirCreateFlag,
+		WorkDirMode:    *workDirModeFlag,
+		WorkDirUID:     *workDirUIDFlag,
+		WorkDirGID:     *workDirGIDFlag,
+		HealthCmd:      *healthCmdFlag,
+		HealthInterval: *healthIntervalFlag,
+		HealthTimeout:  *healthTimeoutFlag,
+		StartPeriod:    *healthStartPeriodFlag,
+		ExitUnhealthy:  *healthExitFlag,
 	}, nil
 }
 
 // runContainer runs a container using the provided configuration and logger.
 func runContainer(config *Config, logger *zap.Logger) {
+	containerConfig, err := newContainerConfig(config)
+	if err != nil {
+		logger.Error("Invalid container configuration", zap.Error(err))
+		_ = logger.Sync()
+		os.Exit(1)
+	}
+	logger.Info("Starting container", zap.String("id", containerConfig.ID))
+
+	if err := container.Run(containerConfig); err != nil {
+		logger.Error("Failed to run container", zap.Error(err))
+		_ = logger.Sync()
+		os.Exit(1)
+	}
+}
+
+// createContainer creates a container using the provided configuration without starting it, and prints its ID.
+func createContainer(config *Config, logger *zap.Logger) {
+	containerConfig, err := newContainerConfig(config)
+	if err != nil {
+		logger.Error("Invalid container configuration", zap.Error(err))
+		_ = logger.Sync()
+		os.Exit(1)
+	}
+
+	id, err := container.Create(containerConfig)
+	if err != nil {
+		logger.Error("Failed to create container", zap.Error(err))
+		_ = logger.Sync()
+		os.Exit(1)
+	}
+	fmt.Println(id)
+}
+
+// parseContainerRef splits a value like "container:<id>" into "container" and the ID. Other values are returned
+// unchanged, with an empty ID.
+func parseContainerRef(value string) (string, string) {
+	if id, ok := strings.CutPrefix(value, "container:"); ok {
+		return "container", id
+	}
+	return value, ""
+}
+
+// newContainerConfig builds the container configuration from the flags and the command after the subcommand.
+func newContainerConfig(config *Config) (*container.Config, error) {
+	if len(flag.Args()) < 2 {
+		return nil, fmt.Errorf("no command given")
+	}
+	resources, err := resolveResources(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve resource limits: %v", err)
+	}
 	cgroupSpec := &cgroup.Spec{
-		Name: config.CgroupName,
-		Resources: &cgroup.Resources{
-			Memory: &cgroup.Memory{
-				Limit: config.MemoryLimit,
-			},
-			CPU: &cgroup.CPU{
-				Shares: config.CPUShares,
-			},
-			BlkIO: &cgroup.BlkIO{
-				Weight: config.BlkioWeight,
-			},
-		},
+		Name:      config.CgroupName,
+		Resources: resources,
 	}
 
 	namespaceSpec := &namespace.NamespaceSpec{
 		Name: config.NamespaceName,
 		Type: config.NamespaceType,
 	}
-
-	_, ipNet, err := net.ParseCIDR(config.NetworkIPCIDR)
-	if err != nil {
-		logger.Error("Invalid CIDR", zap.String("CIDR", config.NetworkIPCIDR), zap.Error(err))
-		return
+	if config.UserNS {
+		namespaceSpec.Types = append(namespaceSpec.Types, namespace.NamespaceTypeUser)
 	}
 
 	networkConfig := &network.Config{
+		Mode:    config.NetworkMode,
 		Name:    config.NetworkName,
-		IPNet:   ipNet,
 		Gateway: net.ParseIP(config.NetworkGateway),
 	}
+	if config.NetworkMode == network.ModeBridge {
+		_, ipNet, err := net.ParseCIDR(config.NetworkIPCIDR)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %v", config.NetworkIPCIDR, err)
+		}
+		networkConfig.IPNet = ipNet
+	}
 
 	cmd := exec.Command(flag.Args()[1], flag.Args()[2:]...)
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Cloneflags: syscall.CLONE_NEWUTS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNS | syscall.CLONE_NEWNET,
-	}
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
-	err = container.Run(
-		cmd,
-		cgroupSpec,
-		namespaceSpec,
-		config.FSRoot,
-		networkConfig,
-	)
+	var healthCheck *container.HealthCheck
+	if config.HealthCmd != "" {
+		healthCheck = &container.HealthCheck{
+			Command:  []string{"/bin/sh", "-c", config.HealthCmd},
+			Interval: config.HealthInterval,
+			Timeout:  config.HealthTimeout,
+		}
+	}
+
+	id, err := container.NewID()
 	if err != nil {
-		logger.Error("Failed to run container", zap.Error(err))
+		return nil, err
+	}
+	if cgroupSpec.Name == "" {
+		cgroupSpec.Name = "spocker-" + id[:12]
+	}
+
+	return &container.Config{
+		ID:                    id,
+		Cmd:                   cmd,
+		Cgroup:                cgroupSpec,
+		Namespace:             namespaceSpec,
+		FSRoot:                config.FSRoot,
+		Overlay:               config.Overlay,
+		WritableLayerSize:     config.RWSize,
+		Network:               networkConfig,
+		NetNamespaceOf:        config.NetContainer,
+		PIDNamespaceOf:        config.PIDContainer,
+		Ports:                 config.Ports,
+		VerifyNetwork:         config.VerifyNetwork,
+		Devices:               config.Devices,
+		ShmSize:               config.ShmSize,
+		Sysctls:               config.Sysctls,
+		Labels:                config.Labels,
+		NetworkAliases:        config.NetworkAliases,
+		CapAdd:                config.CapAdd,
+		SchedPolicy:           config.SchedPolicy,
+		SchedPriority:         config.SchedPriority,
+		StopSignal:            config.StopSignal,
+		CapDrop:               config.CapDrop,
+		Init:                  config.Init,
+		Remove:                config.Remove,
+		KeepOnFailure:         config.KeepOnFailure,
+		PIDFile:               config.PIDFile,
+		WorkDir:               config.WorkDir,
+		WorkDirCreate:         config.WorkDirCreate,
+		WorkDirMode:           os.FileMode(config.WorkDirMode),
+		WorkDirUID:            config.WorkDirUID,
+		WorkDirGID:            config.WorkDirGID,
+		HealthCheck:           healthCheck,
+		StartPeriod:           config.StartPeriod,
+		HealthExitOnUnhealthy: config.ExitUnhealthy,
+	}, nil
+}
+
+// resolveResources returns the container's resource limits: the selected profile, if any, with the
+// limits given explicitly on the command line taking precedence.
+func resolveResources(config *Config) (*cgroup.Resources, error) {
+	flagResources := &cgroup.Resources{
+		Memory: &cgroup.Memory{
+			Limit:     config.MemoryLimit,
+			SwapLimit: config.MemorySwap,
+		},
+		CPU: &cgroup.CPU{
+			Shares: config.CPUShares,
+		},
+		BlkIO: &cgroup.BlkIO{
+			Weight: config.BlkioWeight,
+		},
+	}
+	if config.Swappiness != -1 {
+		if err := cgroup.ValidateSwappiness(config.Swappiness); err != nil {
+			return nil, err
+		}
+		swappiness := config.Swappiness
+		flagResources.Memory.Swappiness = &swappiness
+	}
+	if config.CpusetCPUs != "" || config.CpusetMems != "" {
+		if config.CpusetCPUs == "" || config.CpusetMems == "" {
+			return nil, fmt.Errorf("-cpuset-cpus and -cpuset-mems must be given together")
+		}
+		flagResources.Cpuset = &cgroup.Cpuset{CPUs: config.CpusetCPUs, Mems: config.CpusetMems}
+	}
+	if config.CPUPercent != 0 {
+		numCPUs := runtime.NumCPU()
+		if err := cgroup.ValidateCPUPercent(config.CPUPercent, numCPUs); err != nil {
+			return nil, err
+		}
+		flagResources.CPU.QuotaUs, flagResources.CPU.PeriodUs = cgroup.CPUPercentToQuota(config.CPUPercent, numCPUs)
+	}
+	if config.Profile == "" {
+		return flagResources, nil
+	}
+
+	profiles, err := cgroup.LoadProfiles(config.ProfilesFile)
+	if err != nil {
+		return nil, err
+	}
+	profile, ok := profiles[config.Profile]
+	if !ok {
+		return nil, fmt.Errorf("unknown resource profile: %s", config.Profile)
+	}
+	return cgroup.MergeResources(profile, flagResources), nil
+}
+
+// execContainer runs a command in a running container and exits with the command's exit code.
+// Stdin is always attached; -t (or -it) also gives the command the caller's terminal.
+func execContainer(args []string, logger *zap.Logger) {
+	execFlags := flag.NewFlagSet("exec", flag.ExitOnError)
+	execFlags.Bool("i", false, "keep stdin attached (always on)")
+	ttyFlag := execFlags.Bool("t", false, "run the command in the foreground of the caller's terminal")
+	interactiveTTYFlag := execFlags.Bool("it", false, "shorthand for -i -t")
+	if err := execFlags.Parse(args); err != nil || execFlags.NArg() < 2 {
+		usage()
+		os.Exit(1)
+	}
+
+	execArgs := execFlags.Args()
+	spec := &process.ProcessSpec{Path: execArgs[1], Args: execArgs[2:]}
+	code, err := container.Exec(execArgs[0], spec, *ttyFlag || *interactiveTTYFlag)
+	if err != nil {
+		logger.Error("Failed to exec in container", zap.Error(err))
+		_ = logger.Sync()
+		os.Exit(1)
+	}
+	_ = logger.Sync()
+	os.Exit(code)
+}
+
+// execHelper runs a command inside a running container, as started by container.Exec, and exits with its code.
+func execHelper(args []string, logger *zap.Logger) {
+	code, err := container.RunExecHelper(args)
+	if err != nil {
+		logger.Error("Failed to run command in container", zap.Error(err))
+	}
+	_ = logger.Sync()
+	os.Exit(code)
+}
+
+// inspectContainer prints the recorded state of the container with the given ID as JSON, or with -env the
+// environment its command was started with, one variable per line. With -size the current stats and the disk
+// space taken by the container's rootfs are printed along with the state.
+func inspectContainer(args []string, logger *zap.Logger) {
+	inspectFlags := flag.NewFlagSet("inspect", flag.ExitOnError)
+	envFlag := inspectFlags.Bool("env", false, "print the environment of the running container's command")
+	allFlag := inspectFlags.Bool("all", false, "print the state and current stats of every container")
+	sizeFlag := inspectFlags.Bool("size", false, "print the current stats and the disk space taken by the rootfs")
+	if err := inspectFlags.Parse(args); err != nil {
+		usage()
+		os.Exit(1)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if *allFlag {
+		infos, err := container.InspectAll(*sizeFlag)
+		if err != nil {
+			logger.Error("Failed to inspect containers", zap.Error(err))
+			_ = logger.Sync()
+			os.Exit(1)
+		}
+		if infos == nil {
+			infos = []*container.ContainerInfo{}
+		}
+		if err := encoder.Encode(infos); err != nil {
+			logger.Error("Failed to encode container info", zap.Error(err))
+			_ = logger.Sync()
+			os.Exit(1)
+		}
+		return
+	}
+	if inspectFlags.NArg() != 1 {
+		usage()
+		os.Exit(1)
+	}
+	id := inspectFlags.Arg(0)
+
+	if *envFlag {
+		env, err := container.Environ(id)
+		if err != nil {
+			logger.Error("Failed to read container environment", zap.Error(err))
+			_ = logger.Sync()
+			os.Exit(1)
+		}
+		for _, variable := range env {
+			fmt.Println(variable)
+		}
 		return
 	}
+
+	if *sizeFlag {
+		info, err := container.Inspect(id, true)
+		if err != nil {
+			logger.Error("Failed to inspect container", zap.Error(err))
+			_ = logger.Sync()
+			os.Exit(1)
+		}
+		if err := encoder.Encode(info); err != nil {
+			logger.Error("Failed to encode container info", zap.Error(err))
+			_ = logger.Sync()
+			os.Exit(1)
+		}
+		return
+	}
+
+	state, err := container.LoadState(id)
+	if err != nil {
+		logger.Error("Failed to inspect container", zap.Error(err))
+		_ = logger.Sync()
+		os.Exit(1)
+	}
+
+	if err := encoder.Encode(state); err != nil {
+		logger.Error("Failed to encode container state", zap.Error(err))
+		_ = logger.Sync()
+		os.Exit(1)
+	}
+}
+
+// diffContainer prints the filesystem changes of the container with the given ID, one per line.
+func diffContainer(args []string, logger *zap.Logger) {
+	if len(args) != 1 {
+		usage()
+		os.Exit(1)
+	}
+
+	changes, err := container.Diff(args[0])
+	if err != nil {
+		logger.Error("Failed to diff container", zap.Error(err))
+		_ = logger.Sync()
+		os.Exit(1)
+	}
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+}
+
+// topContainer prints the processes in the cgroup of the container with the given ID, one per line.
+func topContainer(args []string, logger *zap.Logger) {
+	if len(args) != 1 {
+		usage()
+		os.Exit(1)
+	}
+
+	processes, err := container.Top(args[0])
+	if err != nil {
+		logger.Error("Failed to list container processes", zap.Error(err))
+		_ = logger.Sync()
+		os.Exit(1)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PID\tNSPID\tPPID\tUSER\t%CPU\t%MEM\tRSS\tCOMMAND")
+	for _, p := range processes {
+		fmt.Fprintf(w, "%d\t%d\t%d\t%s\t%.1f\t%.1f\t%d\t%s\n", p.PID, p.NSPID, p.PPID, p.User, p.CPUPercent, p.MemPercent, p.RSS/1024, p.Command)
+	}
+	_ = w.Flush()
+}
+
+// listContainers prints the ID, status, and PID of every container of backend, one per line.
+func listContainers(backend daemon.Backend, logger *zap.Logger) {
+	infos, err := backend.List()
+	if err != nil {
+		logger.Error("Failed to list containers", zap.Error(err))
+		_ = logger.Sync()
+		os.Exit(1)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATUS\tPID")
+	for _, info := range infos {
+		status := string(info.Status)
+		if info.Status == container.StatusRunning && !info.Running {
+			status = "exited"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\n", info.ID, status, info.PID)
+	}
+	_ = w.Flush()
+}
+
+// printLogs prints the output so far of the container with the given ID, as kept by backend.
+func printLogs(backend daemon.Backend, args []string, logger *zap.Logger) {
+	if len(args) != 1 {
+		usage()
+		os.Exit(1)
+	}
+
+	logs, err := backend.Logs(args[0])
+	if err != nil {
+		logger.Error("Failed to read container logs", zap.Error(err))
+		_ = logger.Sync()
+		os.Exit(1)
+	}
+	_, _ = os.Stdout.Write(logs)
+}
+
+// runDaemon serves container operations on the -host socket, or daemon.DefaultHost, until it is interrupted.
+func runDaemon(config *Config, logger *zap.Logger) {
+	host := config.Host
+	if host == "" {
+		host = daemon.DefaultHost
+	}
+	path, err := daemon.SocketPath(host)
+	if err != nil {
+		logger.Error("Invalid daemon host", zap.Error(err))
+		_ = logger.Sync()
+		os.Exit(1)
+	}
+	listener, err := daemon.Listen(path)
+	if err != nil {
+		logger.Error("Failed to listen", zap.Error(err))
+		_ = logger.Sync()
+		os.Exit(1)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		// Closing the listener removes its socket
+		listener.Close()
+	}()
+	logger.Info("Daemon listening", zap.String("socket", path))
+	if err := daemon.NewServer(daemon.DefaultBackend{}, logger).Serve(listener); err != nil {
+		logger.Error("Daemon failed", zap.Error(err))
+		_ = logger.Sync()
+		os.Exit(1)
+	}
+}
+
+// remoteCommand sends the command to the daemon at the -host socket. Only run, stop, ps, inspect, and logs are
+// served by the daemon; a container run through it runs in the background, and its ID is printed.
+func remoteCommand(config *Config, logger *zap.Logger) {
+	client, err := daemon.NewClient(config.Host)
+	if err != nil {
+		logger.Error("Invalid daemon host", zap.Error(err))
+		_ = logger.Sync()
+		os.Exit(1)
+	}
+
+	args := flag.Args()[1:]
+	switch flag.Args()[0] {
+	case "run":
+		containerConfig, err := newContainerConfig(config)
+		if err != nil {
+			logger.Error("Invalid container configuration", zap.Error(err))
+			_ = logger.Sync()
+			os.Exit(1)
+		}
+		id, err := client.Run(containerConfig, args)
+		if err != nil {
+			logger.Error("Failed to run container", zap.Error(err))
+			_ = logger.Sync()
+			os.Exit(1)
+		}
+		fmt.Println(id)
+	case "stop":
+		stopFlags := flag.NewFlagSet("stop", flag.ExitOnError)
+		timeoutFlag := stopFlags.Duration("t", container.DefaultStopTimeout, "time to wait after the stop signal before killing the container")
+		if err := stopFlags.Parse(args); err != nil || stopFlags.NArg() != 1 {
+			usage()
+			os.Exit(1)
+		}
+		if err := client.Stop(stopFlags.Arg(0), *timeoutFlag); err != nil {
+			logger.Error("Failed to stop container", zap.Error(err))
+			_ = logger.Sync()
+			os.Exit(1)
+		}
+	case "ps":
+		listContainers(client, logger)
+	case "inspect":
+		if len(args) != 1 {
+			usage()
+			os.Exit(1)
+		}
+		info, err := client.Inspect(args[0])
+		if err != nil {
+			logger.Error("Failed to inspect container", zap.Error(err))
+			_ = logger.Sync()
+			os.Exit(1)
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(info)
+	case "logs":
+		printLogs(client, args, logger)
+	default:
+		logger.Error("Command is not served by the daemon", zap.String("command", flag.Args()[0]))
+		_ = logger.Sync()
+		os.Exit(1)
+	}
+}
+
+// startContainer starts the created container with the given ID.
+func startContainer(args []string, logger *zap.Logger) {
+	if len(args) != 1 {
+		usage()
+		os.Exit(1)
+	}
+
+	if err := container.Start(args[0]); err != nil {
+		logger.Error("Failed to start container", zap.Error(err))
+		_ = logger.Sync()
+		os.Exit(1)
+	}
+}
+
+// stopContainer stops the running container with the given ID, killing it if it outlasts the -t timeout.
+func stopContainer(args []string, logger *zap.Logger) {
+	stopFlags := flag.NewFlagSet("stop", flag.ExitOnError)
+	timeoutFlag := stopFlags.Duration("t", container.DefaultStopTimeout, "time to wait after the stop signal before killing the container")
+	if err := stopFlags.Parse(args); err != nil || stopFlags.NArg() != 1 {
+		usage()
+		os.Exit(1)
+	}
+
+	if err := container.Stop(stopFlags.Arg(0), *timeoutFlag); err != nil {
+		logger.Error("Failed to stop container", zap.Error(err))
+		_ = logger.Sync()
+		os.Exit(1)
+	}
+}
+
+// removeContainer tears down the container with the given ID and deletes its state.
+func removeContainer(args []string, logger *zap.Logger) {
+	if len(args) != 1 {
+		usage()
+		os.Exit(1)
+	}
+
+	if err := container.Remove(args[0]); err != nil {
+		logger.Error("Failed to remove container", zap.Error(err))
+		_ = logger.Sync()
+		os.Exit(1)
+	}
+}
+
+// gcContainers detaches the loop devices left attached by containers that no longer exist, e.g. after a crash, and
+// prints each device it detached, then removes the temporary directories of those containers and prints their IDs.
+// The loop devices go first, since their backing files can be in the temporary directories.
+func gcContainers(logger *zap.Logger) {
+	detached, err := container.GCLoopDevices()
+	for _, device := range detached {
+		fmt.Println(device)
+	}
+	if err != nil {
+		logger.Error("Failed to detach leftover loop devices", zap.Error(err))
+		_ = logger.Sync()
+		os.Exit(1)
+	}
+
+	removed, err := container.GCTempDirs()
+	for _, id := range removed {
+		fmt.Println(id)
+	}
+	if err != nil {
+		logger.Error("Failed to remove leftover temporary directories", zap.Error(err))
+		_ = logger.Sync()
+		os.Exit(1)
+	}
+}
+
+// loadStackFile parses the -f flag of the up and down commands and loads the stack file it names.
+func loadStackFile(command string, args []string) (*container.Stack, error) {
+	stackFlags := flag.NewFlagSet(command, flag.ExitOnError)
+	fileFlag := stackFlags.String("f", "stack.yaml", "stack file defining the services")
+	if err := stackFlags.Parse(args); err != nil || stackFlags.NArg() != 0 {
+		usage()
+		os.Exit(1)
+	}
+	return container.LoadStack(*fileFlag)
+}
+
+// upStack starts the services of a stack file.
+func upStack(args []string, logger *zap.Logger) {
+	stack, err := loadStackFile("up", args)
+	if err != nil {
+		logger.Error("Failed to load stack", zap.Error(err))
+		_ = logger.Sync()
+		os.Exit(1)
+	}
+
+	if err := container.Up(stack); err != nil {
+		logger.Error("Failed to start stack", zap.String("stack", stack.Name), zap.Error(err))
+		_ = logger.Sync()
+		os.Exit(1)
+	}
+}
+
+// downStack stops and removes the services of a stack file.
+func downStack(args []string, logger *zap.Logger) {
+	stack, err := loadStackFile("down", args)
+	if err != nil {
+		logger.Error("Failed to load stack", zap.Error(err))
+		_ = logger.Sync()
+		os.Exit(1)
+	}
+
+	if err := container.Down(stack); err != nil {
+		logger.Error("Failed to stop stack", zap.String("stack", stack.Name), zap.Error(err))
+		_ = logger.Sync()
+		os.Exit(1)
+	}
+}
+
+// waitStart mounts /proc and /dev/shm for a created container's process and holds it until the container is
+// started, then execs its command. It is invoked by re-executing spocker as
+// FIFO ROOTFS CAPS SHMSIZE HOSTNAME WORKDIR PATH -- ARGV..., where CAPS is the comma-separated capability set,
+// SHMSIZE the size of /dev/shm in bytes, HOSTNAME the container's hostname, and WORKDIR the directory the command
+// starts in, and only returns if that fails.
+func waitStart(args []string, logger *zap.Logger) {
+	if len(args) < 9 || args[7] != "--" {
+		logger.Error("Invalid wait-start arguments", zap.Strings("args", args))
+		_ = logger.Sync()
+		os.Exit(1)
+	}
+	shmSize, err := strconv.ParseInt(args[3], 10, 64)
+	if err != nil {
+		logger.Error("Invalid shm size", zap.String("size", args[3]), zap.Error(err))
+		_ = logger.Sync()
+		os.Exit(1)
+	}
+
+	fs := &filesystem.Filesystem{Root: args[1]}
+	if err := fs.MountDefaults(); err != nil {
+		logger.Error("Failed to mount default filesystems in container", zap.Error(err))
+		_ = logger.Sync()
+		os.Exit(1)
+	}
+	if err := fs.MountShm(shmSize); err != nil {
+		logger.Error("Failed to mount /dev/shm in container", zap.Error(err))
+		_ = logger.Sync()
+		os.Exit(1)
+	}
+	if err := namespace.SetHostname(args[4]); err != nil {
+		logger.Error("Failed to set container hostname", zap.Error(err))
+		_ = logger.Sync()
+		os.Exit(1)
+	}
+	caps := []string{}
+	if args[2] != "" {
+		caps = strings.Split(args[2], ",")
+	}
+	enter := func() error { return fs.Enter(args[5]) }
+	err = process.WaitStart(args[0], enter, caps, args[6], args[8:])
+	logger.Error("Failed to start container command", zap.Error(err))
+	_ = logger.Sync()
+	os.Exit(127)
+}
+
+// serveResolver runs the DNS resolver of a labeled network, as started by container.JoinLabeledNetwork.
+func serveResolver(args []string, logger *zap.Logger) {
+	if len(args) != 2 {
+		logger.Error("Invalid resolve arguments", zap.Strings("args", args))
+		_ = logger.Sync()
+		os.Exit(1)
+	}
+	if err := container.ServeLabeledNetwork(args[0], args[1]); err != nil {
+		logger.Error("Resolver failed", zap.Error(err))
+		_ = logger.Sync()
+		os.Exit(1)
+	}
+}
+
+// runInit acts as the container's init process, running the given command as its child.
+// It is invoked by re-executing spocker inside the container and exits with the command's exit code.
+func runInit(args []string, logger *zap.Logger) {
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+
+	code, err := process.RunInit(args)
+	if err != nil {
+		logger.Error("Init failed", zap.Error(err))
+	}
+	_ = logger.Sync()
+	os.Exit(code)
 }
@@ -4,25 +4,62 @@ package cgroup
 import (
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"go.uber.org/zap"
 )
 
 // NewCgroup returns a new cgroup object based on the given specification.
 // The cgroup will be created with the specified name, and resources will be limited according to the given resource allocation.
-func NewCgroup(spec *Spec, subsystems []Subsystem, fileHandler FileHandler) (*Cgroup, error) {
+// On cgroup v2 every subsystem is configured in the cgroup's own directory, with the controllers enabled for it in
+// its parent; on v1 each subsystem has a directory of the same name under the root.
+// Creation is all or nothing: if any step fails, the calling process is moved back out of the cgroup and the
+// directories created for it are removed, so a retry starts clean.
+func NewCgroup(spec *Spec, subsystems []Subsystem, fileHandler FileHandler) (_ *Cgroup, err error) {
+	if err := ValidateName(spec.Name); err != nil {
+		return nil, err
+	}
+	version, err := CgroupVersion()
+	if err != nil {
+		return nil, err
+	}
 	cgroupRoot := spec.CgroupRoot
 	if cgroupRoot == "" {
-		cgroupRoot = "/sys/fs/cgroup"
+		cgroupRoot = cgroupMountpoint
 	}
 	cgroupPath := filepath.Join(cgroupRoot, spec.Name)
-	if err := fileHandler.MkdirAll(cgroupPath, 0755); err != nil {
+
+	var created []string
+	joined := false
+	defer func() {
+		if err != nil {
+			if rollbackErr := rollbackCgroup(fileHandler, cgroupPath, version, joined, created); rollbackErr != nil {
+				err = fmt.Errorf("%v (and failed to roll back: %v)", err, rollbackErr)
+			}
+		}
+	}()
+	mkdir := func(path string) error {
+		if _, err := fileHandler.ReadDir(path); os.IsNotExist(err) {
+			created = append(created, path)
+		}
+		return fileHandler.MkdirAll(path, 0755)
+	}
+
+	if err := mkdir(cgroupPath); err != nil {
 		zap.L().Error("failed to create cgroup directory", zap.String("cgroupPath", cgroupPath), zap.Error(err))
 		return nil, fmt.Errorf("failed to create cgroup directory %q: %v", cgroupPath, err)
 	}
+	if version == 2 {
+		if err := enableControllers(fileHandler, filepath.Dir(cgroupPath), subsystems); err != nil {
+			return nil, err
+		}
+	}
 
-	tasksFilePath := filepath.Join(cgroupPath, "tasks")
+	tasksFilePath := filepath.Join(cgroupPath, procsFile(version))
 	tasksFile, err := fileHandler.OpenFile(tasksFilePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 	if err != nil {
 		zap.L().Error("failed to create tasks file for cgroup", zap.String("cgroupName", spec.Name), zap.Error(err))
@@ -35,19 +72,25 @@ func NewCgroup(spec *Spec, subsystems []Subsystem, fileHandler FileHandler) (*Cg
 		zap.L().Error("failed to add process to cgroup", zap.Int("pid", pid), zap.String("cgroupName", spec.Name), zap.Error(err))
 		return nil, fmt.Errorf("failed to add process %d to cgroup %q: %v", pid, spec.Name, err)
 	}
+	joined = true
 
+	subsystemNames := make([]string, 0, len(subsystems))
 	for _, subsystem := range subsystems {
+		subsystemNames = append(subsystemNames, subsystem.Name())
 		subsystemPath := filepath.Join(cgroupRoot, subsystem.Name(), spec.Name)
+		if version == 2 {
+			subsystemPath = cgroupPath
+		}
 
 		// Create subsystem directory if it doesn't exist
-		if err := fileHandler.MkdirAll(subsystemPath, 0755); err != nil {
-			zap.L().Error("failed to create subsystem directory", zap.String("subsystemPath", subsystemPath), zap.Error(err))
-			return nil, fmt.Errorf("failed to create subsystem directory %q: %v", subsystemPath, err)
+		if err := mkdir(subsystemPath); err != nil {
+			zap.L().Error("failed to create subsystem directory", zap.String("subsystem", subsystem.Name()), zap.String("subsystemPath", subsystemPath), zap.Error(err))
+			return nil, fmt.Errorf("failed to create %s subsystem directory %q: %v", subsystem.Name(), subsystemPath, err)
 		}
 
 		if err := subsystem.ApplySettings(subsystemPath, spec.Resources); err != nil {
-			zap.L().Error("failed to apply subsystem settings", zap.Error(err))
-			return nil, err
+			zap.L().Error("failed to apply subsystem settings", zap.String("subsystem", subsystem.Name()), zap.String("subsystemPath", subsystemPath), zap.Error(err))
+			return nil, fmt.Errorf("failed to configure %s subsystem of cgroup %q at %s: %v", subsystem.Name(), spec.Name, subsystemPath, err)
 		}
 	}
 
@@ -56,13 +99,87 @@ func NewCgroup(spec *Spec, subsystems []Subsystem, fileHandler FileHandler) (*Cg
 		File:        tasksFile,
 		CgroupRoot:  cgroupRoot,
 		fileHandler: fileHandler,
+		subsystems:  subsystemNames,
+		version:     version,
 	}, nil
 }
 
+// ValidateName checks that name can be used as a cgroup name: a single path element that is not hidden, so the
+// cgroup's directories stay inside the cgroup root.
+func ValidateName(name string) error {
+	if name == "" {
+		return fmt.Errorf("invalid cgroup name: the name is empty")
+	}
+	if strings.Contains(name, "/") || strings.Contains(name, "..") || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("invalid cgroup name %q: must not contain '/' or '..' or start with '.'", name)
+	}
+	return nil
+}
+
+// rollbackCgroup undoes a NewCgroup that failed part way: the calling process is moved back to the parent cgroup if
+// it joined the one at cgroupPath, since a cgroup with processes in it cannot be removed, and the directories created
+// are removed, newest first. Every directory is tried; the first error is returned.
+func rollbackCgroup(fileHandler FileHandler, cgroupPath string, version int, joined bool, created []string) error {
+	if joined {
+		// The parent's procs file only exists on a real cgroup hierarchy; elsewhere there is nothing to leave
+		parentProcs := filepath.Join(filepath.Dir(cgroupPath), procsFile(version))
+		if parent, err := fileHandler.OpenFile(parentProcs, os.O_WRONLY|os.O_APPEND, 0644); err == nil {
+			_, _ = fmt.Fprintf(parent, "%d\n", os.Getpid())
+			parent.Close()
+		}
+	}
+
+	var firstErr error
+	for i := len(created) - 1; i >= 0; i-- {
+		if err := fileHandler.RemoveAll(created[i]); err != nil {
+			zap.L().Error("failed to remove cgroup directory", zap.String("path", created[i]), zap.Error(err))
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to remove %q: %v", created[i], err)
+			}
+		}
+	}
+	return firstErr
+}
+
+// procsFile returns the name of the file processes are moved into a cgroup through. The v1 tasks file takes
+// threads; cgroup v2 only has cgroup.procs, which moves whole processes.
+func procsFile(version int) string {
+	if version == 2 {
+		return "cgroup.procs"
+	}
+	return "tasks"
+}
+
+// v2Controllers maps subsystem names to the cgroup v2 controllers that implement them.
+var v2Controllers = map[string]string{
+	"cpu":    "cpu",
+	"memory": "memory",
+	"blkio":  "io",
+	"cpuset": "cpuset",
+}
+
+// enableControllers enables the v2 controllers of the subsystems for the children of the cgroup at parentPath,
+// which is needed before their interface files exist in a child cgroup.
+func enableControllers(fileHandler FileHandler, parentPath string, subsystems []Subsystem) error {
+	var controllers []string
+	for _, subsystem := range subsystems {
+		if controller, ok := v2Controllers[subsystem.Name()]; ok {
+			controllers = append(controllers, "+"+controller)
+		}
+	}
+	if len(controllers) == 0 {
+		return nil
+	}
+	return setSubsystemString(fileHandler, parentPath, "cgroup.subtree_control", strings.Join(controllers, " "))
+}
+
 // Set sets the value of the specified control for the cgroup.
 // This function takes a control (e.g. "memory.limit_in_bytes") and a value (e.g. "1024") as arguments,
 // and writes the value to the control file.
 func (cg *Cgroup) Set(control string, value string) error {
+	if err := ValidateName(cg.Name); err != nil {
+		return err
+	}
 	controlFile := filepath.Join(cg.CgroupRoot, cg.Name, control)
 	f, err := cg.fileHandler.OpenFile(controlFile, os.O_WRONLY|os.O_TRUNC, 0644)
 	if err != nil {
@@ -77,6 +194,124 @@ func (cg *Cgroup) Set(control string, value string) error {
 	return nil
 }
 
+// SetAndVerify sets the value of the specified control and reads it back to confirm the kernel accepted it.
+// Some controls silently clamp or round what is written (e.g. memory limits are rounded to the page size),
+// so a value that reads back differently is reported as an error.
+func (cg *Cgroup) SetAndVerify(control string, value string) error {
+	if err := cg.Set(control, value); err != nil {
+		return err
+	}
+
+	controlFile := filepath.Join(cg.CgroupRoot, cg.Name, control)
+	actual, err := cg.fileHandler.ReadFile(controlFile)
+	if err != nil {
+		zap.L().Error("failed to read back control file", zap.String("controlFile", controlFile), zap.Error(err))
+		return fmt.Errorf("failed to read back control file %s: %v", controlFile, err)
+	}
+
+	if got := strings.TrimSpace(string(actual)); got != strings.TrimSpace(value) {
+		zap.L().Warn("cgroup control value was not applied as written", zap.String("controlFile", controlFile), zap.String("want", value), zap.String("got", got))
+		return fmt.Errorf("control %s was set to %q but reads back %q", control, value, got)
+	}
+	return nil
+}
+
+// freezeTimeout bounds how long Freeze waits for every process in the cgroup to be frozen, and freezePollInterval is
+// how often it checks.
+var (
+	freezeTimeout      = 5 * time.Second
+	freezePollInterval = 10 * time.Millisecond
+)
+
+// Freeze stops every process in the cgroup, e.g. to pause a container, through the freezer controller:
+// freezer.state in the cgroup's freezer directory on v1, and cgroup.freeze in its own directory on v2. Freezing
+// is asynchronous, so Freeze waits until the kernel reports the cgroup frozen. If it does not settle within
+// freezeTimeout, the cgroup is thawed again and an error is returned.
+func (cg *Cgroup) Freeze() error {
+	if err := cg.setFreezerState(true); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(freezeTimeout)
+	for {
+		frozen, err := cg.frozen()
+		if err != nil {
+			return err
+		}
+		if frozen {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			zap.L().Error("cgroup did not freeze in time", zap.String("cgroupName", cg.Name), zap.Duration("timeout", freezeTimeout))
+			if err := cg.setFreezerState(false); err != nil {
+				return fmt.Errorf("cgroup %q did not freeze within %s (and failed to thaw it: %v)", cg.Name, freezeTimeout, err)
+			}
+			return fmt.Errorf("cgroup %q did not freeze within %s", cg.Name, freezeTimeout)
+		}
+		time.Sleep(freezePollInterval)
+	}
+}
+
+// Thaw resumes the processes in the cgroup after Freeze. Thawing takes effect at once.
+func (cg *Cgroup) Thaw() error {
+	return cg.setFreezerState(false)
+}
+
+// freezerPath returns the directory of the cgroup's freezer controls.
+func (cg *Cgroup) freezerPath() string {
+	if cg.version == 2 {
+		return filepath.Join(cg.CgroupRoot, cg.Name)
+	}
+	return filepath.Join(cg.CgroupRoot, "freezer", cg.Name)
+}
+
+// setFreezerState asks the kernel to freeze or thaw the cgroup.
+func (cg *Cgroup) setFreezerState(freeze bool) error {
+	control, value := "freezer.state", "THAWED"
+	if cg.version == 2 {
+		control, value = "cgroup.freeze", "0"
+		if freeze {
+			value = "1"
+		}
+	} else if freeze {
+		value = "FROZEN"
+	}
+	controlFile := filepath.Join(cg.freezerPath(), control)
+	f, err := cg.fileHandler.OpenFile(controlFile, os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		zap.L().Error("failed to open freezer control file", zap.String("controlFile", controlFile), zap.Error(err))
+		return fmt.Errorf("failed to open freezer control file %s: %v", controlFile, err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(value); err != nil {
+		zap.L().Error("failed to write freezer state", zap.String("controlFile", controlFile), zap.String("value", value), zap.Error(err))
+		return fmt.Errorf("failed to write %q to %s: %v", value, controlFile, err)
+	}
+	return nil
+}
+
+// frozen reports whether the kernel has finished freezing the cgroup: freezer.state reads FROZEN rather than
+// FREEZING on v1, and cgroup.events has "frozen 1" on v2.
+func (cg *Cgroup) frozen() (bool, error) {
+	control := "freezer.state"
+	if cg.version == 2 {
+		control = "cgroup.events"
+	}
+	controlFile := filepath.Join(cg.freezerPath(), control)
+	content, err := cg.fileHandler.ReadFile(controlFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to read freezer state from %s: %v", controlFile, err)
+	}
+	if cg.version != 2 {
+		return strings.TrimSpace(string(content)) == "FROZEN", nil
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.TrimSpace(line) == "frozen 1" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 // Close releases the cgroup's resources.
 // This function closes the file descriptor for the cgroup's tasks file.
 func (cg *Cgroup) Close() error {
@@ -88,19 +323,46 @@ func (cg *Cgroup) Close() error {
 }
 
 // Remove deletes the cgroup after closing its resources.
-// This function removes the cgroup directory from the filesystem.
+// This function removes the cgroup directory from the filesystem, as RemoveCgroup does.
 func (cg *Cgroup) Remove() error {
-	cgroupPath := filepath.Join(cg.CgroupRoot, cg.Name)
-	if err := cg.fileHandler.RemoveAll(cgroupPath); err != nil {
+	return RemoveCgroup(cg.fileHandler, filepath.Join(cg.CgroupRoot, cg.Name))
+}
+
+// RemoveCgroup removes the cgroup at cgroupPath, which is CgroupRoot/Name, e.g. once the Cgroup that created it is
+// gone. On cgroup v1 the cgroup's directory in each subsystem hierarchy below CgroupRoot is removed too.
+func RemoveCgroup(fileHandler FileHandler, cgroupPath string) error {
+	if err := fileHandler.RemoveAll(cgroupPath); err != nil {
 		zap.L().Error("failed to remove cgroup directory", zap.String("cgroupPath", cgroupPath), zap.Error(err))
 		return fmt.Errorf("failed to remove cgroup directory %q: %v", cgroupPath, err)
 	}
+	if version, err := CgroupVersion(); err != nil || version != 1 {
+		return nil
+	}
+
+	root, name := filepath.Dir(cgroupPath), filepath.Base(cgroupPath)
+	entries, err := fileHandler.ReadDir(root)
+	if err != nil {
+		return fmt.Errorf("failed to list cgroup hierarchies in %q: %v", root, err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		subsystemPath := filepath.Join(root, entry.Name(), name)
+		if err := fileHandler.RemoveAll(subsystemPath); err != nil {
+			zap.L().Error("failed to remove subsystem directory", zap.String("subsystemPath", subsystemPath), zap.Error(err))
+			return fmt.Errorf("failed to remove subsystem directory %q: %v", subsystemPath, err)
+		}
+	}
 	return nil
 }
 
-// AddProcess adds a process to the cgroup by writing the process ID to the tasks file.
+// AddProcess adds a process to the cgroup by writing the process ID to the tasks file, or cgroup.procs on cgroup v2.
 func (cg *Cgroup) AddProcess(pid int, fileHandler FileHandler) error {
-	tasksFilePath := filepath.Join(cg.CgroupRoot, cg.Name, "tasks")
+	if err := ValidateName(cg.Name); err != nil {
+		return err
+	}
+	tasksFilePath := filepath.Join(cg.CgroupRoot, cg.Name, procsFile(cg.version))
 	tasksFile, err := fileHandler.OpenFile(tasksFilePath, os.O_WRONLY|os.O_APPEND, 0644)
 	if err != nil {
 		return fmt.Errorf("failed to open tasks file for cgroup %q: %v", cg.Name, err)
@@ -113,3 +375,127 @@ func (cg *Cgroup) AddProcess(pid int, fileHandler FileHandler) error {
 
 	return nil
 }
+
+// AddProcessToCgroup adds a process to the cgroup at cgroupPath, which is CgroupRoot/Name, like AddProcess does,
+// e.g. once the Cgroup that created it is gone.
+func AddProcessToCgroup(fileHandler FileHandler, cgroupPath string, pid int) error {
+	version, err := CgroupVersion()
+	if err != nil {
+		return err
+	}
+	procsPath := filepath.Join(cgroupPath, procsFile(version))
+	f, err := fileHandler.OpenFile(procsPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open processes file of cgroup %q: %v", cgroupPath, err)
+	}
+	defer f.Close()
+
+	if _, err := fmt.Fprintf(f, "%d\n", pid); err != nil {
+		return fmt.Errorf("failed to add process %d to cgroup %q: %v", pid, cgroupPath, err)
+	}
+	return nil
+}
+
+// Contains reports whether the process with the given PID is a member of the cgroup.
+// It reads the tasks file AddProcess writes to, falling back to cgroup.procs when there is none.
+func (cg *Cgroup) Contains(pid int) (bool, error) {
+	var content []byte
+	var err error
+	for _, name := range []string{"tasks", "cgroup.procs"} {
+		content, err = cg.fileHandler.ReadFile(filepath.Join(cg.CgroupRoot, cg.Name, name))
+		if err == nil || !os.IsNotExist(err) {
+			break
+		}
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read processes of cgroup %q: %v", cg.Name, err)
+	}
+
+	want := strconv.Itoa(pid)
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.TrimSpace(line) == want {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ListProcesses returns the PIDs in the cgroup, read from the file AddProcess writes to: tasks on cgroup v1, which
+// lists threads, and cgroup.procs on v2. A cgroup without members gives an empty slice.
+func (cg *Cgroup) ListProcesses() ([]int, error) {
+	return listProcesses(cg.fileHandler, filepath.Join(cg.CgroupRoot, cg.Name), cg.version)
+}
+
+// ListCgroupProcesses returns the PIDs in the cgroup at cgroupPath, which is CgroupRoot/Name, like ListProcesses
+// does, e.g. once the Cgroup that created it is gone.
+func ListCgroupProcesses(fileHandler FileHandler, cgroupPath string) ([]int, error) {
+	version, err := CgroupVersion()
+	if err != nil {
+		return nil, err
+	}
+	return listProcesses(fileHandler, cgroupPath, version)
+}
+
+// listProcesses returns the PIDs in the processes file of the cgroup at cgroupPath for the given cgroup version.
+func listProcesses(fileHandler FileHandler, cgroupPath string, version int) ([]int, error) {
+	procsPath := filepath.Join(cgroupPath, procsFile(version))
+	content, err := fileHandler.ReadFile(procsPath)
+	if err != nil {
+		zap.L().Error("failed to read processes of cgroup", zap.String("procsPath", procsPath), zap.Error(err))
+		return nil, fmt.Errorf("failed to read processes of cgroup %q: %v", cgroupPath, err)
+	}
+
+	pids := []int{}
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		pid, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid process ID %q in %s: %v", line, procsPath, err)
+		}
+		pids = append(pids, pid)
+	}
+	return pids, nil
+}
+
+// AllParams returns the current value of every readable control file of the cgroup.
+// Files in the cgroup's own directory are keyed by name, e.g. "tasks", and files in its subsystem
+// directories by subsystem and name, e.g. "memory/memory.limit_in_bytes". Write-only files such as
+// cgroup.event_control are skipped, as are files the kernel refuses to read.
+func (cg *Cgroup) AllParams() (map[string]string, error) {
+	params := map[string]string{}
+	dirs := map[string]string{"": filepath.Join(cg.CgroupRoot, cg.Name)}
+	// On cgroup v2 the subsystems' files are all in the cgroup's own directory
+	if cg.version != 2 {
+		for _, subsystem := range cg.subsystems {
+			dirs[subsystem] = filepath.Join(cg.CgroupRoot, subsystem, cg.Name)
+		}
+	}
+
+	for prefix, dir := range dirs {
+		entries, err := cg.fileHandler.ReadDir(dir)
+		if err != nil {
+			zap.L().Error("failed to list cgroup directory", zap.String("dir", dir), zap.Error(err))
+			return nil, fmt.Errorf("failed to list cgroup directory %s: %v", dir, err)
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil || info.Mode().Perm()&0444 == 0 {
+				continue
+			}
+
+			value, err := cg.fileHandler.ReadFile(filepath.Join(dir, entry.Name()))
+			if err != nil {
+				zap.L().Debug("skipping unreadable cgroup control file", zap.String("dir", dir), zap.String("file", entry.Name()), zap.Error(err))
+				continue
+			}
+			params[path.Join(prefix, entry.Name())] = strings.TrimSpace(string(value))
+		}
+	}
+	return params, nil
+}
@@ -2,10 +2,15 @@
 package cgroup
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestCgroup(t *testing.T) {
@@ -88,3 +93,1050 @@ func readInt(path string) (int64, error) {
 
 	return n, nil
 }
+
+func TestDevicesSubsystem(t *testing.T) {
+	cgroupPath := t.TempDir()
+	allowPath := filepath.Join(cgroupPath, "devices.allow")
+	if err := os.WriteFile(allowPath, nil, 0644); err != nil {
+		t.Fatalf("failed to create devices.allow: %v", err)
+	}
+
+	subsystem := NewDevicesSubsystem(&DefaultFileHandler{})
+	resources := &Resources{
+		Devices: []DeviceRule{{Type: 'c', Major: 188, Minor: 0, Access: "rwm"}},
+	}
+	if err := subsystem.ApplySettings(cgroupPath, resources); err != nil {
+		t.Fatalf("failed to apply device rules: %v", err)
+	}
+
+	content, err := os.ReadFile(allowPath)
+	if err != nil {
+		t.Fatalf("failed to read devices.allow: %v", err)
+	}
+	if string(content) != "c 188:0 rwm" {
+		t.Errorf("unexpected devices.allow content: %q", content)
+	}
+}
+
+func TestMemorySwappiness(t *testing.T) {
+	subsystem := NewMemorySubsystem(&DefaultFileHandler{})
+	for _, swappiness := range []int{-1, 101} {
+		resources := &Resources{Memory: &Memory{Swappiness: &swappiness}}
+		if err := subsystem.ApplySettings(t.TempDir(), resources); err == nil {
+			t.Errorf("expected swappiness %d to be rejected", swappiness)
+		}
+	}
+
+	if version, err := CgroupVersion(); err != nil || version != 1 {
+		t.Skip("memory.swappiness only exists on cgroup v1")
+	}
+	cgroupPath := t.TempDir()
+	for _, control := range []string{"memory.limit_in_bytes", "memory.swappiness"} {
+		if err := os.WriteFile(filepath.Join(cgroupPath, control), nil, 0644); err != nil {
+			t.Fatalf("failed to create %s: %v", control, err)
+		}
+	}
+	swappiness := 0
+	if err := subsystem.ApplySettings(cgroupPath, &Resources{Memory: &Memory{Limit: 1 << 20, Swappiness: &swappiness}}); err != nil {
+		t.Fatalf("failed to apply swappiness: %v", err)
+	}
+	content, err := os.ReadFile(filepath.Join(cgroupPath, "memory.swappiness"))
+	if err != nil {
+		t.Fatalf("failed to read memory.swappiness: %v", err)
+	}
+	if string(content) != "0" {
+		t.Errorf("unexpected memory.swappiness content: %q", content)
+	}
+}
+
+func TestMemorySwapLimit(t *testing.T) {
+	subsystem := NewMemorySubsystem(&DefaultFileHandler{})
+	for _, memory := range []Memory{{Limit: 2 << 20, SwapLimit: 1 << 20}, {SwapLimit: 1 << 20}, {Limit: 1 << 20, SwapLimit: -1}} {
+		if err := subsystem.ApplySettings(t.TempDir(), &Resources{Memory: &memory}); err == nil {
+			t.Errorf("expected swap limit %d with memory limit %d to be rejected", memory.SwapLimit, memory.Limit)
+		}
+	}
+
+	version, err := CgroupVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	limitFile, swapFile := "memory.limit_in_bytes", "memory.memsw.limit_in_bytes"
+	if version == 2 {
+		limitFile, swapFile = "memory.max", "memory.swap.max"
+	}
+	// The file handler tells whether the kernel accounts swap: a swap control file it cannot find skips the limit,
+	// while one it cannot open for another reason fails it
+	cgroupPath := t.TempDir()
+	for _, name := range []string{limitFile, swapFile} {
+		if err := os.WriteFile(filepath.Join(cgroupPath, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resources := &Resources{Memory: &Memory{Limit: 1 << 20, SwapLimit: 2 << 20}}
+	missing := NewMemorySubsystem(&failingFileHandler{control: swapFile, err: os.ErrNotExist})
+	if err := missing.ApplySettings(cgroupPath, resources); err != nil {
+		t.Errorf("expected the swap limit to be skipped when the handler cannot find %s, got: %v", swapFile, err)
+	}
+	denied := NewMemorySubsystem(&failingFileHandler{control: swapFile})
+	if err := denied.ApplySettings(cgroupPath, resources); err == nil || !strings.Contains(err.Error(), swapFile) {
+		t.Errorf("expected an error naming %s when it cannot be opened, got: %v", swapFile, err)
+	}
+
+	if version != 1 {
+		t.Skip("memory.memsw.limit_in_bytes only exists on cgroup v1")
+	}
+	// Without swap accounting there is no memsw control file, and the swap limit is skipped
+	cgroupPath = t.TempDir()
+	if err := os.WriteFile(filepath.Join(cgroupPath, "memory.limit_in_bytes"), nil, 0644); err != nil {
+		t.Fatalf("failed to create memory.limit_in_bytes: %v", err)
+	}
+	if err := subsystem.ApplySettings(cgroupPath, resources); err != nil {
+		t.Fatalf("expected the swap limit to be skipped without swap accounting, got: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(cgroupPath, "memory.memsw.limit_in_bytes")); !os.IsNotExist(err) {
+		t.Errorf("expected memory.memsw.limit_in_bytes not to be created, got %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(cgroupPath, "memory.memsw.limit_in_bytes"), nil, 0644); err != nil {
+		t.Fatalf("failed to create memory.memsw.limit_in_bytes: %v", err)
+	}
+	if err := subsystem.ApplySettings(cgroupPath, resources); err != nil {
+		t.Fatalf("failed to apply swap limit: %v", err)
+	}
+	content, err := os.ReadFile(filepath.Join(cgroupPath, "memory.memsw.limit_in_bytes"))
+	if err != nil {
+		t.Fatalf("failed to read memory.memsw.limit_in_bytes: %v", err)
+	}
+	if string(content) != "2097152" {
+		t.Errorf("unexpected memory.memsw.limit_in_bytes content: %q", content)
+	}
+}
+
+func TestCPUQuota(t *testing.T) {
+	if version, err := CgroupVersion(); err != nil || version != 1 {
+		t.Skip("cpu.cfs_quota_us and cpu.cfs_period_us only exist on cgroup v1")
+	}
+	subsystem := NewCPUSubsystem(&DefaultFileHandler{})
+	cgroupPath := t.TempDir()
+	controls := []string{"cpu.shares", "cpu.cfs_quota_us", "cpu.cfs_period_us"}
+	for _, control := range controls {
+		if err := os.WriteFile(filepath.Join(cgroupPath, control), nil, 0644); err != nil {
+			t.Fatalf("failed to create %s: %v", control, err)
+		}
+	}
+	readControls := func() []string {
+		var values []string
+		for _, control := range controls {
+			content, err := os.ReadFile(filepath.Join(cgroupPath, control))
+			if err != nil {
+				t.Fatalf("failed to read %s: %v", control, err)
+			}
+			values = append(values, string(content))
+		}
+		return values
+	}
+
+	// Without a quota or period only the shares are written
+	if err := subsystem.ApplySettings(cgroupPath, &Resources{CPU: &CPU{Shares: 512}}); err != nil {
+		t.Fatalf("failed to apply shares: %v", err)
+	}
+	if got, want := readControls(), []string{"512", "", ""}; !reflect.DeepEqual(got, want) {
+		t.Errorf("controls = %q, want %q", got, want)
+	}
+
+	// Half a core
+	if err := subsystem.ApplySettings(cgroupPath, &Resources{CPU: &CPU{Shares: 512, QuotaUs: 50000, PeriodUs: 100000}}); err != nil {
+		t.Fatalf("failed to apply quota: %v", err)
+	}
+	if got, want := readControls(), []string{"512", "50000", "100000"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("controls = %q, want %q", got, want)
+	}
+}
+
+func TestBlkIOThrottles(t *testing.T) {
+	if _, err := DeviceNumber("/dev/null"); err == nil {
+		t.Error("expected a character device to be refused")
+	}
+	if device, err := DeviceNumber("/dev/loop0"); err == nil && device != "7:0" {
+		t.Errorf("DeviceNumber(/dev/loop0) = %q, want 7:0", device)
+	}
+
+	subsystem := NewBlkIOSubsystem(&DefaultFileHandler{})
+	for _, device := range []string{"sda", "8:", "8:0:1", "a:0"} {
+		resources := &Resources{BlkIO: &BlkIO{ReadBpsDevice: map[string]uint64{device: 1 << 20}}}
+		if err := subsystem.ApplySettings(t.TempDir(), resources); err == nil {
+			t.Errorf("expected device number %q to be rejected", device)
+		}
+	}
+
+	if version, err := CgroupVersion(); err != nil || version != 1 {
+		t.Skip("blkio.throttle control files only exist on cgroup v1")
+	}
+	cgroupPath := t.TempDir()
+	controls := []string{"blkio.weight", "blkio.throttle.read_bps_device", "blkio.throttle.write_bps_device"}
+	for _, control := range controls {
+		if err := os.WriteFile(filepath.Join(cgroupPath, control), nil, 0644); err != nil {
+			t.Fatalf("failed to create %s: %v", control, err)
+		}
+	}
+	resources := &Resources{BlkIO: &BlkIO{
+		Weight:         500,
+		ReadBpsDevice:  map[string]uint64{"8:0": 1 << 20},
+		WriteBpsDevice: map[string]uint64{"8:16": 512 << 10},
+	}}
+	if err := subsystem.ApplySettings(cgroupPath, resources); err != nil {
+		t.Fatalf("failed to apply blkio throttles: %v", err)
+	}
+	for control, want := range map[string]string{
+		"blkio.throttle.read_bps_device":  "8:0 1048576",
+		"blkio.throttle.write_bps_device": "8:16 524288",
+	} {
+		content, err := os.ReadFile(filepath.Join(cgroupPath, control))
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", control, err)
+		}
+		if string(content) != want {
+			t.Errorf("%s = %q, want %q", control, content, want)
+		}
+	}
+}
+
+func TestCpusetSubsystem(t *testing.T) {
+	subsystem := NewCpusetSubsystem(&DefaultFileHandler{})
+	if subsystem.Name() != "cpuset" {
+		t.Errorf("unexpected subsystem name %q", subsystem.Name())
+	}
+	if err := subsystem.ApplySettings(filepath.Join(t.TempDir(), "missing"), &Resources{}); err != nil {
+		t.Errorf("a cgroup without a cpuset should be left alone, got %v", err)
+	}
+	if err := subsystem.ApplySettings(t.TempDir(), &Resources{Cpuset: &Cpuset{CPUs: "2-3"}}); err == nil {
+		t.Error("expected a cpuset without memory nodes to be rejected")
+	}
+	err := subsystem.ApplySettings(filepath.Join(t.TempDir(), "missing"), &Resources{Cpuset: &Cpuset{CPUs: "2-3", Mems: "0"}})
+	if err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Errorf("expected a missing cpuset directory to be reported, got %v", err)
+	}
+
+	spec := NewSpecBuilder().WithName("pinned").WithCpuset("2-3", "0").Build()
+	cgroupPath := t.TempDir()
+	for _, control := range []string{"cpuset.cpus", "cpuset.mems"} {
+		if err := os.WriteFile(filepath.Join(cgroupPath, control), nil, 0644); err != nil {
+			t.Fatalf("failed to create %s: %v", control, err)
+		}
+	}
+	if err := subsystem.ApplySettings(cgroupPath, spec.Resources); err != nil {
+		t.Fatalf("failed to apply cpuset: %v", err)
+	}
+	for control, want := range map[string]string{"cpuset.cpus": "2-3", "cpuset.mems": "0"} {
+		content, err := os.ReadFile(filepath.Join(cgroupPath, control))
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", control, err)
+		}
+		if string(content) != want {
+			t.Errorf("%s = %q, want %q", control, content, want)
+		}
+	}
+}
+
+// clampingFileHandler is a FileHandler that reads back every control with a fixed value, simulating a kernel
+// that clamps what is written.
+type clampingFileHandler struct {
+	DefaultFileHandler
+	readBack string
+}
+
+func (c *clampingFileHandler) ReadFile(filename string) ([]byte, error) {
+	return []byte(c.readBack + "\n"), nil
+}
+
+func TestFreezeThaw(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{filepath.Join(root, "freezer", "test"), filepath.Join(root, "test")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readControl := func(path string) string {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", path, err)
+		}
+		return string(content)
+	}
+
+	v1 := &Cgroup{Name: "test", CgroupRoot: root, fileHandler: &DefaultFileHandler{}, version: 1}
+	stateFile := filepath.Join(root, "freezer", "test", "freezer.state")
+	if err := os.WriteFile(stateFile, []byte("THAWED"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := v1.Freeze(); err != nil {
+		t.Fatalf("Freeze returned an error: %v", err)
+	}
+	if got := readControl(stateFile); got != "FROZEN" {
+		t.Errorf("freezer.state = %q after Freeze", got)
+	}
+	if err := v1.Thaw(); err != nil {
+		t.Fatalf("Thaw returned an error: %v", err)
+	}
+	if got := readControl(stateFile); got != "THAWED" {
+		t.Errorf("freezer.state = %q after Thaw", got)
+	}
+
+	v2 := &Cgroup{Name: "test", CgroupRoot: root, fileHandler: &DefaultFileHandler{}, version: 2}
+	freezeFile := filepath.Join(root, "test", "cgroup.freeze")
+	if err := os.WriteFile(freezeFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "test", "cgroup.events"), []byte("populated 1\nfrozen 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := v2.Freeze(); err != nil {
+		t.Fatalf("Freeze returned an error: %v", err)
+	}
+	if got := readControl(freezeFile); got != "1" {
+		t.Errorf("cgroup.freeze = %q after Freeze", got)
+	}
+	if err := v2.Thaw(); err != nil {
+		t.Fatalf("Thaw returned an error: %v", err)
+	}
+	if got := readControl(freezeFile); got != "0" {
+		t.Errorf("cgroup.freeze = %q after Thaw", got)
+	}
+
+	// A cgroup that never gets past FREEZING is reported, and thawed again
+	defer func(timeout time.Duration) { freezeTimeout = timeout }(freezeTimeout)
+	freezeTimeout = 50 * time.Millisecond
+	stuck := &Cgroup{Name: "test", CgroupRoot: root, fileHandler: &clampingFileHandler{readBack: "FREEZING"}, version: 1}
+	if err := stuck.Freeze(); err == nil || !strings.Contains(err.Error(), "did not freeze") {
+		t.Errorf("expected a cgroup stuck freezing to be reported, got %v", err)
+	}
+	if got := readControl(stateFile); got != "THAWED" {
+		t.Errorf("freezer.state = %q after a failed Freeze, want it thawed", got)
+	}
+}
+
+func TestOOM(t *testing.T) {
+	root := t.TempDir()
+	memoryPath := filepath.Join(root, "memory", "test")
+	if err := os.MkdirAll(memoryPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	controlFile := filepath.Join(memoryPath, "memory.oom_control")
+	if err := os.WriteFile(controlFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	v1 := &Cgroup{Name: "test", CgroupRoot: root, fileHandler: &DefaultFileHandler{}, version: 1}
+	if err := v1.SetOOMControl(true); err != nil {
+		t.Fatalf("SetOOMControl returned an error: %v", err)
+	}
+	if content, err := os.ReadFile(controlFile); err != nil || string(content) != "1" {
+		t.Errorf("memory.oom_control = %q after disabling the OOM killer, err %v", content, err)
+	}
+	v2 := &Cgroup{Name: "test", CgroupRoot: root, fileHandler: &DefaultFileHandler{}, version: 2}
+	if err := v2.SetOOMControl(true); err == nil {
+		t.Error("expected disabling the OOM killer to be refused on cgroup v2")
+	}
+
+	if os.Geteuid() != 0 {
+		t.Skip("watching for OOMs needs root to create a real cgroup")
+	}
+	if version, err := CgroupVersion(); err != nil || version != 1 {
+		t.Skip("the OOM watch test runs on cgroup v1")
+	}
+	fileHandler := &DefaultFileHandler{}
+	spec := &Spec{
+		Name:       "spocker-test-oom",
+		CgroupRoot: "/sys/fs/cgroup",
+		Resources:  &Resources{Memory: &Memory{Limit: 8 << 20, SwapLimit: 8 << 20}},
+	}
+	cg, err := NewCgroup(spec, []Subsystem{NewMemorySubsystem(fileHandler)}, fileHandler)
+	if err != nil {
+		t.Fatalf("failed to create cgroup: %v", err)
+	}
+	defer cg.Remove()
+	defer cg.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := cg.WatchOOM(ctx)
+	if err != nil {
+		t.Fatalf("WatchOOM returned an error: %v", err)
+	}
+
+	// The process waits to be moved into the cgroup before it starts using memory without bound
+	cmd := exec.Command("sh", "-c", "read _; exec tail /dev/zero")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start process: %v", err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+	if err := setSubsystemValue(fileHandler, cg.memoryPath(), "cgroup.procs", cmd.Process.Pid); err != nil {
+		t.Fatalf("failed to add process to the memory cgroup: %v", err)
+	}
+	stdin.Write([]byte("\n"))
+
+	select {
+	case <-events:
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected an OOM event")
+	}
+	cancel()
+	select {
+	case _, ok := <-events:
+		if ok {
+			// A second OOM may have been reported first
+			for range events {
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the OOM channel to close once the context is cancelled")
+	}
+}
+
+func TestSetAndVerify(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "test"), 0755); err != nil {
+		t.Fatalf("failed to create cgroup dir: %v", err)
+	}
+	controlFile := filepath.Join(root, "test", "memory.limit_in_bytes")
+	if err := os.WriteFile(controlFile, nil, 0644); err != nil {
+		t.Fatalf("failed to create control file: %v", err)
+	}
+
+	t.Run("accepted value", func(t *testing.T) {
+		cg := &Cgroup{Name: "test", CgroupRoot: root, fileHandler: &DefaultFileHandler{}}
+		if err := cg.SetAndVerify("memory.limit_in_bytes", "8192"); err != nil {
+			t.Errorf("SetAndVerify returned an error: %v", err)
+		}
+	})
+
+	t.Run("clamped value", func(t *testing.T) {
+		cg := &Cgroup{Name: "test", CgroupRoot: root, fileHandler: &clampingFileHandler{readBack: "4096"}}
+		err := cg.SetAndVerify("memory.limit_in_bytes", "5000")
+		if err == nil {
+			t.Fatal("expected SetAndVerify to report the clamped value")
+		}
+		if !strings.Contains(err.Error(), `"5000"`) || !strings.Contains(err.Error(), `"4096"`) {
+			t.Errorf("error should mention both the written and actual values: %v", err)
+		}
+	})
+}
+
+func TestLoadProfiles(t *testing.T) {
+	defaults, err := LoadProfiles("")
+	if err != nil {
+		t.Fatalf("LoadProfiles returned an error for the built-in profiles: %v", err)
+	}
+	for _, name := range []string{"small", "medium", "large"} {
+		if defaults[name] == nil {
+			t.Errorf("expected a built-in %s profile", name)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "profiles.json")
+	data := `{"tiny": {"memory": {"limit": 67108864}, "cpu": {"shares": 128}, "blkio": {"weight": 10}}}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatalf("failed to write profiles file: %v", err)
+	}
+	profiles, err := LoadProfiles(path)
+	if err != nil {
+		t.Fatalf("LoadProfiles returned an error: %v", err)
+	}
+	tiny, ok := profiles["tiny"]
+	if !ok {
+		t.Fatalf("expected a tiny profile, got %v", profiles)
+	}
+	if tiny.Memory.Limit != 64<<20 || tiny.CPU.Shares != 128 || tiny.BlkIO.Weight != 10 {
+		t.Errorf("unexpected tiny profile: memory %d, shares %d, weight %d", tiny.Memory.Limit, tiny.CPU.Shares, tiny.BlkIO.Weight)
+	}
+
+	if err := os.WriteFile(path, []byte("not json"), 0644); err != nil {
+		t.Fatalf("failed to write profiles file: %v", err)
+	}
+	if _, err := LoadProfiles(path); err == nil {
+		t.Error("expected an error loading a malformed profiles file")
+	}
+}
+
+func TestMergeResources(t *testing.T) {
+	profile := DefaultProfiles()["small"]
+	overrides := &Resources{
+		Memory: &Memory{Limit: 512 << 20},
+		CPU:    &CPU{Shares: 0},
+		BlkIO:  &BlkIO{Weight: 0},
+	}
+
+	merged := MergeResources(profile, overrides)
+	if merged.Memory.Limit != 512<<20 {
+		t.Errorf("expected the explicit memory limit to win, got %d", merged.Memory.Limit)
+	}
+	if merged.CPU.Shares != profile.CPU.Shares {
+		t.Errorf("expected the profile's CPU shares %d, got %d", profile.CPU.Shares, merged.CPU.Shares)
+	}
+	if merged.BlkIO.Weight != profile.BlkIO.Weight {
+		t.Errorf("expected the profile's blkio weight %d, got %d", profile.BlkIO.Weight, merged.BlkIO.Weight)
+	}
+	throttled := MergeResources(profile, &Resources{BlkIO: &BlkIO{ReadBpsDevice: map[string]uint64{"8:0": 1 << 20}}})
+	if throttled.BlkIO.Weight != profile.BlkIO.Weight || throttled.BlkIO.ReadBpsDevice["8:0"] != 1<<20 {
+		t.Errorf("expected a device throttle to be added to the profile's blkio weight, got %+v", throttled.BlkIO)
+	}
+	if profile.Memory.Limit != 256<<20 {
+		t.Errorf("MergeResources modified the profile: memory limit %d", profile.Memory.Limit)
+	}
+}
+
+func TestContains(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "test"), 0755); err != nil {
+		t.Fatalf("failed to create cgroup dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "test", "tasks"), nil, 0644); err != nil {
+		t.Fatalf("failed to create tasks file: %v", err)
+	}
+
+	fileHandler := &DefaultFileHandler{}
+	cg := &Cgroup{Name: "test", CgroupRoot: root, fileHandler: fileHandler}
+	if err := cg.AddProcess(1234, fileHandler); err != nil {
+		t.Fatalf("AddProcess returned an error: %v", err)
+	}
+
+	member, err := cg.Contains(1234)
+	if err != nil {
+		t.Fatalf("Contains returned an error: %v", err)
+	}
+	if !member {
+		t.Error("expected the added process to be a member of the cgroup")
+	}
+
+	for _, pid := range []int{123, 4321} {
+		member, err := cg.Contains(pid)
+		if err != nil {
+			t.Fatalf("Contains returned an error: %v", err)
+		}
+		if member {
+			t.Errorf("expected process %d not to be a member of the cgroup", pid)
+		}
+	}
+
+	missing := &Cgroup{Name: "missing", CgroupRoot: root, fileHandler: fileHandler}
+	if _, err := missing.Contains(1234); err == nil {
+		t.Error("expected an error for a cgroup without a tasks or cgroup.procs file")
+	}
+}
+
+// fakeDirEntry is a directory entry with a fixed name and mode.
+type fakeDirEntry struct {
+	name string
+	mode os.FileMode
+}
+
+func (e fakeDirEntry) Name() string               { return e.name }
+func (e fakeDirEntry) IsDir() bool                { return e.mode.IsDir() }
+func (e fakeDirEntry) Type() os.FileMode          { return e.mode.Type() }
+func (e fakeDirEntry) Info() (os.FileInfo, error) { return fakeFileInfo{e}, nil }
+
+// fakeFileInfo describes a fakeDirEntry.
+type fakeFileInfo struct {
+	entry fakeDirEntry
+}
+
+func (i fakeFileInfo) Name() string       { return i.entry.name }
+func (i fakeFileInfo) Size() int64        { return 0 }
+func (i fakeFileInfo) Mode() os.FileMode  { return i.entry.mode }
+func (i fakeFileInfo) ModTime() time.Time { return time.Time{} }
+func (i fakeFileInfo) IsDir() bool        { return i.entry.mode.IsDir() }
+func (i fakeFileInfo) Sys() interface{}   { return nil }
+
+// fakeDirFileHandler serves directory listings and file contents from memory.
+type fakeDirFileHandler struct {
+	DefaultFileHandler
+	dirs  map[string][]os.DirEntry
+	files map[string]string
+	reads []string
+}
+
+func (f *fakeDirFileHandler) ReadDir(name string) ([]os.DirEntry, error) {
+	entries, ok := f.dirs[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return entries, nil
+}
+
+func (f *fakeDirFileHandler) ReadFile(filename string) ([]byte, error) {
+	f.reads = append(f.reads, filename)
+	content, ok := f.files[filename]
+	if !ok {
+		return nil, fmt.Errorf("unexpected read of %s", filename)
+	}
+	return []byte(content), nil
+}
+
+func TestValidateName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"my-container", true},
+		{"spocker-shop-web", true},
+		{"../escape", false},
+		{"foo/bar", false},
+		{"", false},
+		{"..", false},
+		{".hidden", false},
+	}
+	root := t.TempDir()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateName(tt.name); (err == nil) != tt.valid {
+				t.Errorf("ValidateName(%q) = %v, want valid %v", tt.name, err, tt.valid)
+			}
+			if tt.valid {
+				return
+			}
+			spec := &Spec{Name: tt.name, CgroupRoot: root, Resources: &Resources{}}
+			if _, err := NewCgroup(spec, nil, &DefaultFileHandler{}); err == nil {
+				t.Errorf("NewCgroup accepted the name %q", tt.name)
+			}
+			cg := &Cgroup{Name: tt.name, CgroupRoot: root, fileHandler: &DefaultFileHandler{}}
+			if err := cg.AddProcess(os.Getpid(), &DefaultFileHandler{}); err == nil {
+				t.Errorf("AddProcess accepted the name %q", tt.name)
+			}
+			if err := cg.Set("memory.limit_in_bytes", "1024"); err == nil {
+				t.Errorf("Set accepted the name %q", tt.name)
+			}
+		})
+	}
+	if entries, err := os.ReadDir(filepath.Dir(root)); err != nil || len(entries) != 1 {
+		t.Errorf("invalid names created files next to the cgroup root: %v (%v)", entries, err)
+	}
+}
+
+func TestListProcesses(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "test"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		version int
+		file    string
+		content string
+		want    []int
+	}{
+		{1, "tasks", "1234\n\n1235\n", []int{1234, 1235}},
+		{2, "cgroup.procs", "42\n", []int{42}},
+		{1, "tasks", "", []int{}},
+	}
+	for _, tt := range tests {
+		if err := os.WriteFile(filepath.Join(root, "test", tt.file), []byte(tt.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cg := &Cgroup{Name: "test", CgroupRoot: root, fileHandler: &DefaultFileHandler{}, version: tt.version}
+		pids, err := cg.ListProcesses()
+		if err != nil {
+			t.Fatalf("ListProcesses returned an error: %v", err)
+		}
+		if pids == nil || !reflect.DeepEqual(pids, tt.want) {
+			t.Errorf("ListProcesses of %q = %#v, want %#v", tt.content, pids, tt.want)
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(root, "test", "tasks"), []byte("12ab\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cg := &Cgroup{Name: "test", CgroupRoot: root, fileHandler: &DefaultFileHandler{}}
+	if _, err := cg.ListProcesses(); err == nil {
+		t.Error("expected an invalid PID to be reported")
+	}
+
+	// Listing by path reads the processes file of the host's cgroup version
+	version, err := CgroupVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "test", procsFile(version)), []byte("7\n8\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if pids, err := ListCgroupProcesses(&DefaultFileHandler{}, filepath.Join(root, "test")); err != nil || !reflect.DeepEqual(pids, []int{7, 8}) {
+		t.Errorf("ListCgroupProcesses = %v (%v), want [7 8]", pids, err)
+	}
+}
+
+func TestAllParams(t *testing.T) {
+	fileHandler := &fakeDirFileHandler{
+		dirs: map[string][]os.DirEntry{
+			"/cg/test": {
+				fakeDirEntry{name: "tasks", mode: 0644},
+			},
+			"/cg/memory/test": {
+				fakeDirEntry{name: "memory.limit_in_bytes", mode: 0644},
+				fakeDirEntry{name: "memory.usage_in_bytes", mode: 0444},
+				fakeDirEntry{name: "cgroup.event_control", mode: 0222},
+				fakeDirEntry{name: "memory.force_empty", mode: 0200},
+				fakeDirEntry{name: "child", mode: os.ModeDir | 0755},
+			},
+		},
+		files: map[string]string{
+			"/cg/test/tasks":                        "1234\n",
+			"/cg/memory/test/memory.limit_in_bytes": "1048576\n",
+			"/cg/memory/test/memory.usage_in_bytes": "4096\n",
+		},
+	}
+	cg := &Cgroup{Name: "test", CgroupRoot: "/cg", fileHandler: fileHandler, subsystems: []string{"memory"}}
+
+	params, err := cg.AllParams()
+	if err != nil {
+		t.Fatalf("AllParams returned an error: %v", err)
+	}
+	expected := map[string]string{
+		"tasks":                        "1234",
+		"memory/memory.limit_in_bytes": "1048576",
+		"memory/memory.usage_in_bytes": "4096",
+	}
+	if !reflect.DeepEqual(params, expected) {
+		t.Errorf("expected params %v, got %v", expected, params)
+	}
+	for _, read := range fileHandler.reads {
+		if _, ok := fileHandler.files[read]; !ok {
+			t.Errorf("AllParams read %s, which is write-only or a directory", read)
+		}
+	}
+}
+
+func TestUsage(t *testing.T) {
+	writeControls := func(t *testing.T, files map[string]string) string {
+		root := t.TempDir()
+		for name, content := range files {
+			path := filepath.Join(root, name)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return root
+	}
+	memory := map[string]string{
+		"memory/test/memory.usage_in_bytes":     "4096\n",
+		"memory/test/memory.max_usage_in_bytes": "8192\n",
+	}
+
+	tests := []struct {
+		name    string
+		version int
+		files   map[string]string
+		want    Usage
+	}{
+		{"v1 with cpuacct", 1, map[string]string{"cpuacct/test/cpuacct.usage": "123456789\n"}, Usage{4096, 8192, 123456789}},
+		{"v1 with cpuacct co-mounted with cpu", 1, map[string]string{"cpu,cpuacct/test/cpuacct.usage": "42\n"}, Usage{4096, 8192, 42}},
+		{"v1 without cpuacct", 1, nil, Usage{4096, 8192, 0}},
+		{"v2", 2, map[string]string{
+			"test/memory.current": "2048\n",
+			"test/memory.peak":    "3072\n",
+			"test/cpu.stat":       "usage_usec 1500\nuser_usec 1000\nsystem_usec 500\n",
+		}, Usage{2048, 3072, 1500000}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := map[string]string{}
+			if tt.version == 1 {
+				for name, content := range memory {
+					files[name] = content
+				}
+			}
+			for name, content := range tt.files {
+				files[name] = content
+			}
+			cg := &Cgroup{Name: "test", CgroupRoot: writeControls(t, files), fileHandler: &DefaultFileHandler{}, version: tt.version}
+			usage, err := cg.Usage()
+			if err != nil {
+				t.Fatalf("Usage returned an error: %v", err)
+			}
+			if *usage != tt.want {
+				t.Errorf("Usage = %+v, want %+v", *usage, tt.want)
+			}
+		})
+	}
+
+	cg := &Cgroup{Name: "test", CgroupRoot: t.TempDir(), fileHandler: &DefaultFileHandler{}, version: 1}
+	if _, err := cg.Usage(); err == nil {
+		t.Error("expected a cgroup without memory accounting to be reported")
+	}
+}
+
+func TestCPUPercentToQuota(t *testing.T) {
+	tests := []struct {
+		percent float64
+		numCPUs int
+		quota   int
+	}{
+		{percent: 50, numCPUs: 4, quota: 200000},
+		{percent: 100, numCPUs: 4, quota: 400000},
+		{percent: 100, numCPUs: 1, quota: 100000},
+		{percent: 25, numCPUs: 2, quota: 50000},
+		{percent: 12.5, numCPUs: 3, quota: 37500},
+		{percent: 10, numCPUs: 1, quota: 10000},
+		{percent: 0.1, numCPUs: 1, quota: 1000},
+		{percent: 0.01, numCPUs: 1, quota: 1000},
+	}
+	for _, tt := range tests {
+		if err := ValidateCPUPercent(tt.percent, tt.numCPUs); err != nil {
+			t.Errorf("ValidateCPUPercent(%v, %d) returned an error: %v", tt.percent, tt.numCPUs, err)
+		}
+		quota, period := CPUPercentToQuota(tt.percent, tt.numCPUs)
+		if quota != tt.quota || period != DefaultCFSPeriodUs {
+			t.Errorf("CPUPercentToQuota(%v, %d) = %d/%d, want %d/%d", tt.percent, tt.numCPUs, quota, period, tt.quota, DefaultCFSPeriodUs)
+		}
+	}
+
+	for _, tt := range []struct {
+		percent float64
+		numCPUs int
+	}{
+		{percent: 0, numCPUs: 4},
+		{percent: -10, numCPUs: 4},
+		{percent: 101, numCPUs: 4},
+		{percent: 50, numCPUs: 0},
+	} {
+		if err := ValidateCPUPercent(tt.percent, tt.numCPUs); err == nil {
+			t.Errorf("ValidateCPUPercent(%v, %d) should fail", tt.percent, tt.numCPUs)
+		}
+	}
+}
+
+func TestPressure(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "test"), 0755); err != nil {
+		t.Fatalf("failed to create cgroup dir: %v", err)
+	}
+	sample := "some avg10=1.50 avg60=0.75 avg300=0.10 total=123456\nfull avg10=0.50 avg60=0.25 avg300=0.05 total=65432\n"
+	if err := os.WriteFile(filepath.Join(root, "test", "memory.pressure"), []byte(sample), 0644); err != nil {
+		t.Fatalf("failed to write memory.pressure: %v", err)
+	}
+
+	cg := &Cgroup{Name: "test", CgroupRoot: root, fileHandler: &DefaultFileHandler{}}
+	psi, err := cg.Pressure("memory")
+	if err != nil {
+		t.Fatalf("Pressure returned an error: %v", err)
+	}
+	want := &PSI{
+		Some: &PSIStats{Avg10: 1.5, Avg60: 0.75, Avg300: 0.1, Total: 123456},
+		Full: &PSIStats{Avg10: 0.5, Avg60: 0.25, Avg300: 0.05, Total: 65432},
+	}
+	if !reflect.DeepEqual(psi, want) {
+		t.Errorf("Pressure(memory) = %+v %+v, want %+v %+v", psi.Some, psi.Full, want.Some, want.Full)
+	}
+
+	if _, err := cg.Pressure("cpu"); err == nil || !strings.Contains(err.Error(), "not available") {
+		t.Errorf("expected a not available error without cpu.pressure, got %v", err)
+	}
+	if _, err := cg.Pressure("disk"); err == nil {
+		t.Error("expected an error for an unknown resource")
+	}
+}
+
+// failingFileHandler is a FileHandler that fails to open the named control file.
+type failingFileHandler struct {
+	DefaultFileHandler
+	control string
+	// err is what opening control fails with, os.ErrPermission if nil.
+	err error
+}
+
+func (f *failingFileHandler) OpenFile(name string, flag int, perm os.FileMode) (*os.File, error) {
+	if filepath.Base(name) == f.control {
+		if f.err != nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: f.err}
+		}
+		return nil, os.ErrPermission
+	}
+	return f.DefaultFileHandler.OpenFile(name, flag, perm)
+}
+
+func TestNewCgroupErrorNamesSubsystem(t *testing.T) {
+	root := t.TempDir()
+	cpuPath := filepath.Join(root, "cpu", "test")
+	if err := os.MkdirAll(cpuPath, 0755); err != nil {
+		t.Fatalf("failed to create cpu cgroup dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(cpuPath, "cpu.shares"), nil, 0644); err != nil {
+		t.Fatalf("failed to create cpu.shares: %v", err)
+	}
+
+	fileHandler := &failingFileHandler{control: "memory.limit_in_bytes"}
+	subsystems := []Subsystem{NewCPUSubsystem(fileHandler), NewMemorySubsystem(fileHandler)}
+	spec := &Spec{
+		Name:       "test",
+		CgroupRoot: root,
+		Resources:  &Resources{CPU: &CPU{Shares: 512}, Memory: &Memory{Limit: 1 << 20}},
+	}
+
+	_, err := NewCgroup(spec, subsystems, fileHandler)
+	if err == nil {
+		t.Fatal("expected NewCgroup to fail when the memory limit cannot be written")
+	}
+	memoryPath := filepath.Join(root, "memory", "test")
+	for _, want := range []string{"memory subsystem", memoryPath, "memory.limit_in_bytes", "permission denied"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected the error to mention %q, got: %v", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), "cpu subsystem") {
+		t.Errorf("the error blames the cpu subsystem, which was configured successfully: %v", err)
+	}
+}
+
+func TestNewCgroupRollsBack(t *testing.T) {
+	root := t.TempDir()
+	// A subsystem directory that was there before is left alone
+	cpuPath := filepath.Join(root, "cpu", "test")
+	if err := os.MkdirAll(cpuPath, 0755); err != nil {
+		t.Fatalf("failed to create cpu cgroup dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(cpuPath, "cpu.shares"), nil, 0644); err != nil {
+		t.Fatalf("failed to create cpu.shares: %v", err)
+	}
+
+	fileHandler := &failingFileHandler{control: "memory.limit_in_bytes"}
+	subsystems := []Subsystem{NewCPUSubsystem(fileHandler), NewMemorySubsystem(fileHandler), NewBlkIOSubsystem(fileHandler)}
+	spec := &Spec{
+		Name:       "test",
+		CgroupRoot: root,
+		Resources:  &Resources{CPU: &CPU{Shares: 512}, Memory: &Memory{Limit: 1 << 20}, BlkIO: &BlkIO{Weight: 500}},
+	}
+
+	_, err := NewCgroup(spec, subsystems, fileHandler)
+	if err == nil {
+		t.Fatal("expected NewCgroup to fail when the memory limit cannot be written")
+	}
+	if !strings.Contains(err.Error(), "memory subsystem") || strings.Contains(err.Error(), "roll back") {
+		t.Errorf("expected a memory subsystem error with a clean roll back, got: %v", err)
+	}
+	for _, path := range []string{filepath.Join(root, "test"), filepath.Join(root, "memory", "test"), filepath.Join(root, "blkio", "test")} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed after the failure, got %v", path, err)
+		}
+	}
+	if _, err := os.Stat(cpuPath); err != nil {
+		t.Errorf("expected the existing cpu cgroup dir to be kept, got %v", err)
+	}
+
+	// A retry with every control file writable starts clean and succeeds
+	for _, control := range []string{"memory/test/memory.limit_in_bytes", "blkio/test/blkio.weight"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(root, control)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, control), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fileHandler.control = ""
+	cg, err := NewCgroup(spec, subsystems, fileHandler)
+	if err != nil {
+		t.Fatalf("NewCgroup failed on retry: %v", err)
+	}
+	cg.Close()
+}
+
+func TestNewCgroupWithoutResources(t *testing.T) {
+	root := t.TempDir()
+	fileHandler := &failingFileHandler{}
+	subsystems := []Subsystem{
+		NewCPUSubsystem(fileHandler),
+		NewMemorySubsystem(fileHandler),
+		NewBlkIOSubsystem(fileHandler),
+		NewDevicesSubsystem(fileHandler),
+		NewCpusetSubsystem(fileHandler),
+	}
+
+	// Neither missing resources nor a missing section of them is written, so no control file is needed
+	for _, resources := range []*Resources{nil, {}} {
+		cg, err := NewCgroup(&Spec{Name: "test", CgroupRoot: root, Resources: resources}, subsystems, fileHandler)
+		if err != nil {
+			t.Fatalf("NewCgroup with resources %+v returned an error: %v", resources, err)
+		}
+		cg.Close()
+		for _, subsystem := range subsystems {
+			entries, err := os.ReadDir(filepath.Join(root, subsystem.Name(), "test"))
+			if err != nil || len(entries) != 0 {
+				t.Errorf("expected an empty %s cgroup directory, got %v (%v)", subsystem.Name(), entries, err)
+			}
+		}
+	}
+}
+
+func TestParseCgroupVersion(t *testing.T) {
+	tests := []struct {
+		name      string
+		mountinfo string
+		want      int
+	}{
+		{
+			name: "unified",
+			mountinfo: `22 1 0:21 / /sys rw,nosuid,nodev,noexec,relatime shared:7 - sysfs sysfs rw
+30 22 0:26 / /sys/fs/cgroup rw,nosuid,nodev,noexec,relatime shared:4 - cgroup2 cgroup2 rw,nsdelegate,memory_recursiveprot
+`,
+			want: 2,
+		},
+		{
+			name: "legacy",
+			mountinfo: `32 24 0:28 / /sys/fs/cgroup rw,relatime - tmpfs tmpfs rw,mode=755
+33 32 0:29 / /sys/fs/cgroup/cpu rw,relatime - cgroup cgroup rw,cpu
+36 32 0:32 / /sys/fs/cgroup/memory rw,relatime - cgroup cgroup rw,memory
+`,
+			want: 1,
+		},
+		{
+			name: "hybrid",
+			mountinfo: `25 22 0:23 / /sys/fs/cgroup ro,nosuid,nodev,noexec shared:8 - tmpfs tmpfs ro,mode=755
+26 25 0:24 / /sys/fs/cgroup/unified rw,nosuid,nodev,noexec,relatime shared:9 - cgroup2 cgroup2 rw,nsdelegate
+27 25 0:25 / /sys/fs/cgroup/systemd rw,nosuid,nodev,noexec,relatime shared:10 - cgroup cgroup rw,xattr,name=systemd
+30 25 0:28 / /sys/fs/cgroup/cpu,cpuacct rw,nosuid,nodev,noexec,relatime shared:13 - cgroup cgroup rw,cpu,cpuacct
+31 25 0:29 / /sys/fs/cgroup/memory rw,nosuid,nodev,noexec,relatime shared:14 - cgroup cgroup rw,memory
+`,
+			want: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCgroupVersion(strings.NewReader(tt.mountinfo))
+			if err != nil {
+				t.Fatalf("parseCgroupVersion returned an error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("parseCgroupVersion() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := parseCgroupVersion(strings.NewReader("22 1 0:21 / /sys rw - sysfs sysfs rw\n")); err == nil {
+		t.Error("expected an error without a cgroup mount")
+	}
+	if _, err := parseCgroupVersion(strings.NewReader("25 22 0:23 / /sys/fs/cgroup rw - tmpfs tmpfs rw\n")); err == nil {
+		t.Error("expected an error for a tmpfs without controllers")
+	}
+}
+
+func TestV2WeightConversions(t *testing.T) {
+	if got := sharesToWeight(1024); got != 39 {
+		t.Errorf("sharesToWeight(1024) = %d, want 39", got)
+	}
+	if got := sharesToWeight(2); got != 1 {
+		t.Errorf("sharesToWeight(2) = %d, want 1", got)
+	}
+	if got := sharesToWeight(262144); got != 10000 {
+		t.Errorf("sharesToWeight(262144) = %d, want 10000", got)
+	}
+	if got := blkioToIOWeight(10); got != 1 {
+		t.Errorf("blkioToIOWeight(10) = %d, want 1", got)
+	}
+	if got := blkioToIOWeight(1000); got != 10000 {
+		t.Errorf("blkioToIOWeight(1000) = %d, want 10000", got)
+	}
+}
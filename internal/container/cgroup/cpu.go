@@ -0,0 +1,37 @@
+// cgroup package manages Linux control groups (cgroups) and provides functionality to apply resource limitations.
+package cgroup
+
+import (
+	"fmt"
+	"math"
+)
+
+// These constants bound the CFS bandwidth settings the kernel accepts.
+const (
+	DefaultCFSPeriodUs = 100000
+	minCFSQuotaUs      = 1000
+)
+
+// CPUPercentToQuota converts a share of the machine's CPU capacity into a CFS quota and period in microseconds.
+// The percentage is of all numCPUs together, so 50 on a 4 CPU machine allows 2 full CPUs: a quota of 200000
+// per 100000 period. Very small percentages are raised to the kernel's minimum quota of 1ms.
+// The percentage should be checked with ValidateCPUPercent first.
+func CPUPercentToQuota(percent float64, numCPUs int) (quota, period int) {
+	period = DefaultCFSPeriodUs
+	quota = int(math.Round(percent / 100 * float64(numCPUs) * float64(period)))
+	if quota < minCFSQuotaUs {
+		quota = minCFSQuotaUs
+	}
+	return quota, period
+}
+
+// ValidateCPUPercent checks that percent is a usable share of the capacity of numCPUs CPUs.
+func ValidateCPUPercent(percent float64, numCPUs int) error {
+	if numCPUs <= 0 {
+		return fmt.Errorf("invalid number of CPUs: %d", numCPUs)
+	}
+	if math.IsNaN(percent) || percent <= 0 || percent > 100 {
+		return fmt.Errorf("invalid CPU percentage %v: must be greater than 0 and at most 100", percent)
+	}
+	return nil
+}
@@ -10,9 +10,9 @@ import (
 )
 
 // ExecContainer runs the container process inside its namespaces.
-func ExecContainer(containerID string, command []string) error {
+// The container process is killed if ctx is done before it exits.
+func ExecContainer(ctx context.Context, containerID string, command []string) error {
 	// Set up namespaces
-	ctx := context.Background()
 	cmd, err := util.CreateCommand(ctx, command[0], command[1:]...)
 	if err != nil {
 		return err
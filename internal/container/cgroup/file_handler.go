@@ -22,3 +22,8 @@ func (d *DefaultFileHandler) MkdirAll(path string, perm os.FileMode) error {
 func (d *DefaultFileHandler) RemoveAll(path string) error {
 	return os.RemoveAll(path)
 }
+
+// ReadDir wraps os.ReadDir, listing the entries of the specified directory.
+func (d *DefaultFileHandler) ReadDir(name string) ([]os.DirEntry, error) {
+	return os.ReadDir(name)
+}
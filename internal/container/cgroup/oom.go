@@ -0,0 +1,160 @@
+package cgroup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+// SetOOMControl disables or re-enables the OOM killer for the cgroup through memory.oom_control. With the killer
+// disabled, processes that hit the memory limit are paused until memory is freed or the limit is raised, instead
+// of being killed; WatchOOM reports when that happens. cgroup v2 has no way to disable the OOM killer.
+func (cg *Cgroup) SetOOMControl(disable bool) error {
+	if cg.version == 2 {
+		return fmt.Errorf("cgroup v2 cannot disable the OOM killer of cgroup %q", cg.Name)
+	}
+	value := 0
+	if disable {
+		value = 1
+	}
+	return setSubsystemValue(cg.fileHandler, cg.memoryPath(), "memory.oom_control", value)
+}
+
+// WatchOOM returns a channel that receives a value each time the cgroup runs out of memory. On cgroup v1 it
+// registers an eventfd for memory.oom_control through cgroup.event_control; on v2 it watches the oom count in
+// memory.events with inotify. The channel is closed when ctx is cancelled or the cgroup is removed.
+func (cg *Cgroup) WatchOOM(ctx context.Context) (<-chan struct{}, error) {
+	if cg.version == 2 {
+		return cg.watchOOMV2(ctx)
+	}
+
+	memoryPath := cg.memoryPath()
+	oomControl, err := cg.fileHandler.OpenFile(filepath.Join(memoryPath, "memory.oom_control"), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open memory.oom_control of cgroup %q: %v", cg.Name, err)
+	}
+	// The eventfd is non-blocking so that closing it ends a pending read
+	efd, err := unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+	if err != nil {
+		oomControl.Close()
+		return nil, fmt.Errorf("failed to create eventfd: %v", err)
+	}
+	events := os.NewFile(uintptr(efd), "oom-eventfd")
+	registration := fmt.Sprintf("%d %d", efd, oomControl.Fd())
+	if err := setSubsystemString(cg.fileHandler, memoryPath, "cgroup.event_control", registration); err != nil {
+		events.Close()
+		oomControl.Close()
+		return nil, err
+	}
+
+	ch := make(chan struct{})
+	go func() {
+		defer oomControl.Close()
+		watchEvents(ctx, events, ch, func() (bool, bool) {
+			// The eventfd is also signalled when the cgroup is removed
+			_, err := os.Stat(memoryPath)
+			return err == nil, err != nil
+		})
+	}()
+	return ch, nil
+}
+
+// watchOOMV2 implements WatchOOM on cgroup v2, where every OOM increments the oom count in memory.events.
+func (cg *Cgroup) watchOOMV2(ctx context.Context) (<-chan struct{}, error) {
+	eventsFile := filepath.Join(cg.memoryPath(), "memory.events")
+	count, err := cg.oomCount(eventsFile)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create inotify instance: %v", err)
+	}
+	events := os.NewFile(uintptr(fd), "oom-inotify")
+	if _, err := unix.InotifyAddWatch(fd, eventsFile, unix.IN_MODIFY); err != nil {
+		events.Close()
+		return nil, fmt.Errorf("failed to watch %s: %v", eventsFile, err)
+	}
+
+	ch := make(chan struct{})
+	go watchEvents(ctx, events, ch, func() (bool, bool) {
+		latest, err := cg.oomCount(eventsFile)
+		if err != nil {
+			// memory.events is gone along with the cgroup
+			return false, true
+		}
+		oom := latest > count
+		count = latest
+		return oom, false
+	})
+	return ch, nil
+}
+
+// watchEvents reads events until ctx is cancelled or the cgroup is gone, and sends on ch whenever check reports
+// that an event was an OOM. ch and events are closed when the watch ends.
+func watchEvents(ctx context.Context, events *os.File, ch chan<- struct{}, check func() (oom, gone bool)) {
+	defer close(ch)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		events.Close()
+	}()
+
+	buf := make([]byte, unix.SizeofInotifyEvent+unix.NAME_MAX+1)
+	for {
+		if _, err := events.Read(buf); err != nil {
+			if ctx.Err() == nil {
+				zap.L().Error("failed to read OOM events", zap.String("file", events.Name()), zap.Error(err))
+			}
+			return
+		}
+		oom, gone := check()
+		if gone {
+			return
+		}
+		if !oom {
+			continue
+		}
+		select {
+		case ch <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// oomCount returns how often the cgroup has run out of memory, from the oom line of its memory.events.
+func (cg *Cgroup) oomCount(eventsFile string) (uint64, error) {
+	content, err := cg.fileHandler.ReadFile(eventsFile)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %s: %v", eventsFile, err)
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if value, ok := strings.CutPrefix(line, "oom "); ok {
+			count, err := strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid oom count in %s: %v", eventsFile, err)
+			}
+			return count, nil
+		}
+	}
+	return 0, nil
+}
+
+// memoryPath returns the directory of the cgroup's memory controls.
+func (cg *Cgroup) memoryPath() string {
+	if cg.version == 2 {
+		return filepath.Join(cg.CgroupRoot, cg.Name)
+	}
+	return filepath.Join(cg.CgroupRoot, "memory", cg.Name)
+}
@@ -0,0 +1,102 @@
+// cgroup package manages Linux control groups (cgroups) and provides functionality to apply resource limitations.
+package cgroup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// PSIStats is one line of pressure stall information: the percentage of time tasks were stalled, averaged over
+// the last 10, 60, and 300 seconds, and the total stall time in microseconds.
+type PSIStats struct {
+	Avg10  float64 `json:"avg10"`
+	Avg60  float64 `json:"avg60"`
+	Avg300 float64 `json:"avg300"`
+	Total  uint64  `json:"total"`
+}
+
+// PSI is the pressure stall information of a resource. Some covers time at least one task was stalled on the
+// resource, Full time all non-idle tasks were stalled at once. Full is nil where the kernel does not report it,
+// such as for cpu.pressure before Linux 5.13.
+type PSI struct {
+	Some *PSIStats `json:"some"`
+	Full *PSIStats `json:"full,omitempty"`
+}
+
+// Pressure returns the cgroup's pressure stall information for resource, which is "cpu", "memory", or "io".
+// PSI is only available on the unified (v2) hierarchy of kernels built with CONFIG_PSI.
+func (cg *Cgroup) Pressure(resource string) (*PSI, error) {
+	switch resource {
+	case "cpu", "memory", "io":
+	default:
+		return nil, fmt.Errorf("invalid pressure resource %q: must be cpu, memory, or io", resource)
+	}
+
+	pressureFile := filepath.Join(cg.CgroupRoot, cg.Name, resource+".pressure")
+	data, err := cg.fileHandler.ReadFile(pressureFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			if version, versionErr := CgroupVersion(); versionErr == nil && version == 1 {
+				return nil, fmt.Errorf("pressure stall information is not available for cgroup %q: PSI needs cgroup v2, but this host uses cgroup v1", cg.Name)
+			}
+			return nil, fmt.Errorf("pressure stall information is not available for cgroup %q: %s does not exist (PSI needs cgroup v2 and a kernel with PSI enabled)", cg.Name, pressureFile)
+		}
+		return nil, fmt.Errorf("failed to read %s: %v", pressureFile, err)
+	}
+	psi, err := parsePSI(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", pressureFile, err)
+	}
+	return psi, nil
+}
+
+// parsePSI parses the contents of a pressure file, e.g.
+//
+//	some avg10=0.00 avg60=0.00 avg300=0.00 total=0
+//	full avg10=0.00 avg60=0.00 avg300=0.00 total=0
+func parsePSI(data string) (*PSI, error) {
+	psi := &PSI{}
+	for _, line := range strings.Split(strings.TrimSpace(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		stats := &PSIStats{}
+		for _, field := range fields[1:] {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok {
+				return nil, fmt.Errorf("invalid field %q", field)
+			}
+			var err error
+			switch key {
+			case "avg10":
+				stats.Avg10, err = strconv.ParseFloat(value, 64)
+			case "avg60":
+				stats.Avg60, err = strconv.ParseFloat(value, 64)
+			case "avg300":
+				stats.Avg300, err = strconv.ParseFloat(value, 64)
+			case "total":
+				stats.Total, err = strconv.ParseUint(value, 10, 64)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for %s: %v", key, err)
+			}
+		}
+
+		switch fields[0] {
+		case "some":
+			psi.Some = stats
+		case "full":
+			psi.Full = stats
+		default:
+			return nil, fmt.Errorf("unknown pressure line %q", line)
+		}
+	}
+	if psi.Some == nil {
+		return nil, fmt.Errorf("no \"some\" line")
+	}
+	return psi, nil
+}
@@ -0,0 +1,149 @@
+// cgroup package manages Linux control groups (cgroups) and provides functionality to apply resource limitations.
+package cgroup
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// DefaultProfiles returns the built-in resource profiles used when no profiles file is given.
+func DefaultProfiles() map[string]*Resources {
+	return map[string]*Resources{
+		"small": {
+			Memory: &Memory{Limit: 256 << 20},
+			CPU:    &CPU{Shares: 256},
+			BlkIO:  &BlkIO{Weight: 100},
+		},
+		"medium": {
+			Memory: &Memory{Limit: 1 << 30},
+			CPU:    &CPU{Shares: 1024},
+			BlkIO:  &BlkIO{Weight: 500},
+		},
+		"large": {
+			Memory: &Memory{Limit: 4 << 30},
+			CPU:    &CPU{Shares: 4096},
+			BlkIO:  &BlkIO{Weight: 1000},
+		},
+	}
+}
+
+// LoadProfiles reads named resource profiles from a JSON file mapping each name to its resources, e.g.
+// {"small": {"memory": {"limit": 268435456}, "cpu": {"shares": 256}}}. An empty path returns DefaultProfiles.
+func LoadProfiles(path string) (map[string]*Resources, error) {
+	if path == "" {
+		return DefaultProfiles(), nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read profiles file %s: %v", path, err)
+	}
+
+	profiles := map[string]*Resources{}
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, fmt.Errorf("failed to parse profiles file %s: %v", path, err)
+	}
+	for name, resources := range profiles {
+		if resources == nil {
+			return nil, fmt.Errorf("profile %s in %s has no resources", name, path)
+		}
+	}
+
+	return profiles, nil
+}
+
+// MergeResources returns the profile's resources with every limit set in overrides taking precedence.
+// A zero value in overrides means unset, so the profile's value is kept unless the profile has none.
+// Neither argument is modified.
+func MergeResources(profile, overrides *Resources) *Resources {
+	merged := &Resources{}
+	if profile != nil {
+		merged.Devices = append(merged.Devices, profile.Devices...)
+		if profile.Memory != nil {
+			memory := *profile.Memory
+			if memory.Swappiness != nil {
+				swappiness := *memory.Swappiness
+				memory.Swappiness = &swappiness
+			}
+			merged.Memory = &memory
+		}
+		if profile.CPU != nil {
+			cpu := *profile.CPU
+			merged.CPU = &cpu
+		}
+		if profile.BlkIO != nil {
+			merged.BlkIO = &BlkIO{
+				Weight:         profile.BlkIO.Weight,
+				ReadBpsDevice:  mergeThrottles(nil, profile.BlkIO.ReadBpsDevice),
+				WriteBpsDevice: mergeThrottles(nil, profile.BlkIO.WriteBpsDevice),
+			}
+		}
+		if profile.Cpuset != nil {
+			cpuset := *profile.Cpuset
+			merged.Cpuset = &cpuset
+		}
+	}
+	if overrides == nil {
+		return merged
+	}
+
+	merged.Devices = append(merged.Devices, overrides.Devices...)
+	if overrides.Memory != nil {
+		if merged.Memory == nil {
+			merged.Memory = &Memory{}
+		}
+		if overrides.Memory.Limit != 0 {
+			merged.Memory.Limit = overrides.Memory.Limit
+		}
+		if overrides.Memory.SwapLimit != 0 {
+			merged.Memory.SwapLimit = overrides.Memory.SwapLimit
+		}
+		if overrides.Memory.Swappiness != nil {
+			swappiness := *overrides.Memory.Swappiness
+			merged.Memory.Swappiness = &swappiness
+		}
+	}
+	if overrides.CPU != nil {
+		if merged.CPU == nil {
+			merged.CPU = &CPU{}
+		}
+		if overrides.CPU.Shares != 0 {
+			merged.CPU.Shares = overrides.CPU.Shares
+		}
+		if overrides.CPU.QuotaUs != 0 {
+			merged.CPU.QuotaUs = overrides.CPU.QuotaUs
+			merged.CPU.PeriodUs = overrides.CPU.PeriodUs
+		}
+	}
+	if overrides.Cpuset != nil {
+		merged.Cpuset = &Cpuset{CPUs: overrides.Cpuset.CPUs, Mems: overrides.Cpuset.Mems}
+	}
+	if overrides.BlkIO != nil {
+		if merged.BlkIO == nil {
+			merged.BlkIO = &BlkIO{}
+		}
+		if overrides.BlkIO.Weight != 0 {
+			merged.BlkIO.Weight = overrides.BlkIO.Weight
+		}
+		merged.BlkIO.ReadBpsDevice = mergeThrottles(merged.BlkIO.ReadBpsDevice, overrides.BlkIO.ReadBpsDevice)
+		merged.BlkIO.WriteBpsDevice = mergeThrottles(merged.BlkIO.WriteBpsDevice, overrides.BlkIO.WriteBpsDevice)
+	}
+	return merged
+}
+
+// mergeThrottles returns a copy of base with the per-device throttles in overrides taking precedence, or nil if
+// both are empty.
+func mergeThrottles(base, overrides map[string]uint64) map[string]uint64 {
+	if len(base) == 0 && len(overrides) == 0 {
+		return nil
+	}
+	merged := make(map[string]uint64, len(base)+len(overrides))
+	for device, bps := range base {
+		merged[device] = bps
+	}
+	for device, bps := range overrides {
+		merged[device] = bps
+	}
+	return merged
+}
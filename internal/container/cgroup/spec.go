@@ -1,6 +1,8 @@
 // cgroup package manages Linux control groups (cgroups) and provides functionality to apply resource limitations.
 package cgroup
 
+import "fmt"
+
 // Spec represents the specification for a Linux control group.
 // It contains the name of the cgroup, resources to be allocated, and the root path to the cgroup.
 type Spec struct {
@@ -10,29 +12,61 @@ type Spec struct {
 }
 
 // Resources struct contains the resource allocations for a Linux control group.
-// It has fields for memory, CPU, and block I/O resources.
+// It has fields for memory, CPU, and block I/O resources, and the CPUs and memory nodes the group is pinned to.
 type Resources struct {
-	Memory *Memory
-	CPU    *CPU
-	BlkIO  *BlkIO
+	Memory  *Memory
+	CPU     *CPU
+	BlkIO   *BlkIO
+	Cpuset  *Cpuset
+	Devices []DeviceRule
 }
 
 // CPU struct represents the CPU resource allocation for a Linux control group.
-// It contains a field for CPU shares.
+// It contains fields for CPU shares and the CFS quota and period, in microseconds, that cap CPU time.
 type CPU struct {
-	Shares int
+	Shares   int
+	QuotaUs  int
+	PeriodUs int
+}
+
+// Cpuset struct represents the CPUs and NUMA memory nodes a Linux control group is pinned to.
+// Both are lists in the kernel's format, e.g. "0-3" or "0,2".
+type Cpuset struct {
+	CPUs string
+	Mems string
 }
 
 // BlkIO struct represents the block I/O resource allocation for a Linux control group.
-// It contains a field for block I/O weight.
+// It contains a field for block I/O weight, a proportion relative to other groups, and absolute throttles on the
+// bytes per second read from and written to individual devices, keyed by "major:minor" as DeviceNumber returns it.
 type BlkIO struct {
-	Weight int
+	Weight         int
+	ReadBpsDevice  map[string]uint64
+	WriteBpsDevice map[string]uint64
+}
+
+// DeviceRule represents an entry in the devices controller's allow list.
+// Type is 'c' for character or 'b' for block devices, and Access is a combination of r, w, and m.
+type DeviceRule struct {
+	Type   rune
+	Major  uint32
+	Minor  uint32
+	Access string
+}
+
+// String formats the rule the way the devices controller expects it, e.g. "c 188:0 rwm".
+func (r DeviceRule) String() string {
+	return fmt.Sprintf("%c %d:%d %s", r.Type, r.Major, r.Minor, r.Access)
 }
 
 // Memory struct represents the memory resource allocation for a Linux control group.
-// It contains a field for memory limit.
+// It contains fields for the memory limit and the swappiness, from 0 to 100, that biases the kernel towards or
+// away from swapping the group's memory out. A nil Swappiness inherits the parent's. SwapLimit caps memory and swap
+// together, so it must be at least Limit; 0 leaves swap uncapped.
 type Memory struct {
-	Limit int
+	Limit      int
+	Swappiness *int
+	SwapLimit  int
 }
 
 // SpecBuilder is a builder for Spec objects.
@@ -59,6 +93,15 @@ func (b *SpecBuilder) WithResources(resources *Resources) *SpecBuilder {
 	return b
 }
 
+// WithCpuset pins the cgroup spec to the given CPUs and memory nodes, e.g. "2-3" and "0".
+func (b *SpecBuilder) WithCpuset(cpus, mems string) *SpecBuilder {
+	if b.spec.Resources == nil {
+		b.spec.Resources = &Resources{}
+	}
+	b.spec.Resources.Cpuset = &Cpuset{CPUs: cpus, Mems: mems}
+	return b
+}
+
 // WithCgroupRoot sets the cgroup root of the cgroup spec.
 func (b *SpecBuilder) WithCgroupRoot(cgroupRoot string) *SpecBuilder {
 	b.spec.CgroupRoot = cgroupRoot
@@ -5,8 +5,13 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
 
 	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
 )
 
 // NewCPUSubsystem initializes a new CPUSubsystem instance with the provided fileHandler.
@@ -20,8 +25,63 @@ func (c *CPUSubsystem) Name() string {
 }
 
 // ApplySettings applies the provided CPU resources settings to the specified cgroup path.
+// The CFS period and quota are only written when set, the period first so the quota is checked against it.
+// On cgroup v2 the shares are converted to cpu.weight and the quota and period are written together to cpu.max.
+// Without CPU resources nothing is written.
 func (c *CPUSubsystem) ApplySettings(cgroupPath string, resources *Resources) error {
-	return setSubsystemValue(c.fileHandler, cgroupPath, "cpu.shares", resources.CPU.Shares)
+	if resources == nil || resources.CPU == nil {
+		return nil
+	}
+	version, err := CgroupVersion()
+	if err != nil {
+		return err
+	}
+	if version == 2 {
+		return c.applySettingsV2(cgroupPath, resources)
+	}
+	if err := setSubsystemValue(c.fileHandler, cgroupPath, "cpu.shares", resources.CPU.Shares); err != nil {
+		return err
+	}
+	if resources.CPU.PeriodUs != 0 {
+		if err := setSubsystemValue(c.fileHandler, cgroupPath, "cpu.cfs_period_us", resources.CPU.PeriodUs); err != nil {
+			return err
+		}
+	}
+	if resources.CPU.QuotaUs != 0 {
+		if err := setSubsystemValue(c.fileHandler, cgroupPath, "cpu.cfs_quota_us", resources.CPU.QuotaUs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applySettingsV2 applies the CPU settings through the cgroup v2 interface files.
+func (c *CPUSubsystem) applySettingsV2(cgroupPath string, resources *Resources) error {
+	if resources.CPU.Shares != 0 {
+		if err := setSubsystemValue(c.fileHandler, cgroupPath, "cpu.weight", sharesToWeight(resources.CPU.Shares)); err != nil {
+			return err
+		}
+	}
+	if resources.CPU.QuotaUs == 0 && resources.CPU.PeriodUs == 0 {
+		return nil
+	}
+	quota, period := "max", DefaultCFSPeriodUs
+	if resources.CPU.QuotaUs > 0 {
+		quota = strconv.Itoa(resources.CPU.QuotaUs)
+	}
+	if resources.CPU.PeriodUs != 0 {
+		period = resources.CPU.PeriodUs
+	}
+	return setSubsystemString(c.fileHandler, cgroupPath, "cpu.max", fmt.Sprintf("%s %d", quota, period))
+}
+
+// sharesToWeight converts cgroup v1 CPU shares, from 2 to 262144, to the cgroup v2 weight, from 1 to 10000,
+// by mapping one range linearly onto the other, as other runtimes do.
+func sharesToWeight(shares int) int {
+	if shares < 2 {
+		shares = 2
+	}
+	return 1 + ((shares-2)*9999)/262142
 }
 
 // NewMemorySubsystem initializes a new MemorySubsystem instance with the provided fileHandler.
@@ -35,8 +95,95 @@ func (m *MemorySubsystem) Name() string {
 }
 
 // ApplySettings applies the provided memory resources settings to the specified cgroup path.
+// The swappiness is only written when set. On cgroup v2 the limit is written to memory.max, and only when it is set;
+// v2 has no per-group swappiness, so a swappiness is skipped there with a note in the log.
+// A swap limit is written to memory.memsw.limit_in_bytes, after the memory limit it must not be below, or on v2 the
+// part of it above the memory limit to memory.swap.max. Where the kernel does not account swap the control file is
+// missing and the swap limit is skipped. Without memory resources nothing is written.
 func (m *MemorySubsystem) ApplySettings(cgroupPath string, resources *Resources) error {
-	return setSubsystemValue(m.fileHandler, cgroupPath, "memory.limit_in_bytes", resources.Memory.Limit)
+	if resources == nil || resources.Memory == nil {
+		return nil
+	}
+	if swappiness := resources.Memory.Swappiness; swappiness != nil {
+		if err := ValidateSwappiness(*swappiness); err != nil {
+			return err
+		}
+	}
+	if err := ValidateSwapLimit(resources.Memory.Limit, resources.Memory.SwapLimit); err != nil {
+		return err
+	}
+	version, err := CgroupVersion()
+	if err != nil {
+		return err
+	}
+	if version == 2 {
+		if resources.Memory.Swappiness != nil {
+			zap.L().Info("cgroup v2 has no memory swappiness control, skipping it", zap.String("cgroupPath", cgroupPath), zap.Int("swappiness", *resources.Memory.Swappiness))
+		}
+		if resources.Memory.Limit == 0 {
+			return nil
+		}
+		if err := setSubsystemValue(m.fileHandler, cgroupPath, "memory.max", resources.Memory.Limit); err != nil {
+			return err
+		}
+		return m.setSwapLimit(cgroupPath, "memory.swap.max", resources.Memory.SwapLimit-resources.Memory.Limit, resources.Memory.SwapLimit)
+	}
+	if err := setSubsystemValue(m.fileHandler, cgroupPath, "memory.limit_in_bytes", resources.Memory.Limit); err != nil {
+		return err
+	}
+	if err := m.setSwapLimit(cgroupPath, "memory.memsw.limit_in_bytes", resources.Memory.SwapLimit, resources.Memory.SwapLimit); err != nil {
+		return err
+	}
+	if resources.Memory.Swappiness != nil {
+		return setSubsystemValue(m.fileHandler, cgroupPath, "memory.swappiness", *resources.Memory.Swappiness)
+	}
+	return nil
+}
+
+// setSwapLimit writes value to the swap control file if a swap limit is set and the kernel accounts swap.
+func (m *MemorySubsystem) setSwapLimit(cgroupPath, controlFile string, value, swapLimit int) error {
+	if swapLimit == 0 {
+		return nil
+	}
+	path := filepath.Join(cgroupPath, controlFile)
+	subsystemFile, err := m.fileHandler.OpenFile(path, os.O_WRONLY, 0644)
+	if os.IsNotExist(err) {
+		zap.L().Debug("kernel does not account swap, skipping the swap limit", zap.String("cgroupPath", cgroupPath), zap.Int("swapLimit", swapLimit))
+		return nil
+	}
+	if err != nil {
+		zap.L().Error("failed to open cgroup subsystem file", zap.String("path", path), zap.Error(err))
+		return fmt.Errorf("failed to open %s for cgroup: %v", path, err)
+	}
+	defer subsystemFile.Close()
+	return writeSubsystemFile(subsystemFile, path, strconv.Itoa(value))
+}
+
+// ValidateSwapLimit checks that swapLimit, the cap on memory and swap together, is not below the memory limit it
+// includes. A swap limit of 0 is unset; any other needs a memory limit, since the kernel rejects one above an
+// unlimited memory limit.
+func ValidateSwapLimit(limit, swapLimit int) error {
+	if swapLimit == 0 {
+		return nil
+	}
+	if swapLimit < 0 {
+		return fmt.Errorf("invalid memory swap limit %d: must not be negative", swapLimit)
+	}
+	if limit <= 0 {
+		return fmt.Errorf("invalid memory swap limit %d: needs a memory limit", swapLimit)
+	}
+	if swapLimit < limit {
+		return fmt.Errorf("invalid memory swap limit %d: must be at least the memory limit %d", swapLimit, limit)
+	}
+	return nil
+}
+
+// ValidateSwappiness checks that swappiness is within the 0 to 100 range the memory controller accepts.
+func ValidateSwappiness(swappiness int) error {
+	if swappiness < 0 || swappiness > 100 {
+		return fmt.Errorf("invalid memory swappiness %d: must be between 0 and 100", swappiness)
+	}
+	return nil
 }
 
 // NewBlkIOSubsystem initializes a new BlkIOSubsystem instance with the provided fileHandler.
@@ -50,21 +197,183 @@ func (b *BlkIOSubsystem) Name() string {
 }
 
 // ApplySettings applies the provided block I/O resources settings to the specified cgroup path.
+// On cgroup v2 the weight is converted to the io controller's range and written to io.weight, only when it is set.
+// Each device throttle is written on its own, to blkio.throttle.read_bps_device and write_bps_device on v1 and as
+// the rbps and wbps of the device in io.max on v2. Without block I/O resources nothing is written.
 func (b *BlkIOSubsystem) ApplySettings(cgroupPath string, resources *Resources) error {
-	return setSubsystemValue(b.fileHandler, cgroupPath, "blkio.weight", resources.BlkIO.Weight)
+	if resources == nil || resources.BlkIO == nil {
+		return nil
+	}
+	blkio := resources.BlkIO
+	for _, throttles := range []map[string]uint64{blkio.ReadBpsDevice, blkio.WriteBpsDevice} {
+		for device := range throttles {
+			if err := validateDeviceNumber(device); err != nil {
+				return err
+			}
+		}
+	}
+	version, err := CgroupVersion()
+	if err != nil {
+		return err
+	}
+	if version == 2 {
+		if blkio.Weight != 0 {
+			if err := setSubsystemString(b.fileHandler, cgroupPath, "io.weight", fmt.Sprintf("default %d", blkioToIOWeight(blkio.Weight))); err != nil {
+				return err
+			}
+		}
+		if err := b.setThrottles(cgroupPath, "io.max", "%s rbps=%d", blkio.ReadBpsDevice); err != nil {
+			return err
+		}
+		return b.setThrottles(cgroupPath, "io.max", "%s wbps=%d", blkio.WriteBpsDevice)
+	}
+	if err := setSubsystemValue(b.fileHandler, cgroupPath, "blkio.weight", blkio.Weight); err != nil {
+		return err
+	}
+	if err := b.setThrottles(cgroupPath, "blkio.throttle.read_bps_device", "%s %d", blkio.ReadBpsDevice); err != nil {
+		return err
+	}
+	return b.setThrottles(cgroupPath, "blkio.throttle.write_bps_device", "%s %d", blkio.WriteBpsDevice)
+}
+
+// setThrottles writes each device's throttle to controlFile, formatted with the device number and the limit, in
+// device order. The controller only accepts one device per write.
+func (b *BlkIOSubsystem) setThrottles(cgroupPath, controlFile, format string, throttles map[string]uint64) error {
+	devices := make([]string, 0, len(throttles))
+	for device := range throttles {
+		devices = append(devices, device)
+	}
+	sort.Strings(devices)
+	for _, device := range devices {
+		if err := setSubsystemString(b.fileHandler, cgroupPath, controlFile, fmt.Sprintf(format, device, throttles[device])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeviceNumber returns the "major:minor" number of the block device at path, e.g. "8:0" for /dev/sda, as the
+// per-device throttles of BlkIO are keyed by.
+func DeviceNumber(path string) (string, error) {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(path, &stat); err != nil {
+		return "", fmt.Errorf("failed to stat device %s: %v", path, err)
+	}
+	if stat.Mode&syscall.S_IFMT != syscall.S_IFBLK {
+		return "", fmt.Errorf("%s is not a block device", path)
+	}
+	rdev := uint64(stat.Rdev)
+	return fmt.Sprintf("%d:%d", unix.Major(rdev), unix.Minor(rdev)), nil
+}
+
+// validateDeviceNumber checks that device is a "major:minor" device number.
+func validateDeviceNumber(device string) error {
+	major, minor, ok := strings.Cut(device, ":")
+	if !ok {
+		return fmt.Errorf("invalid device number %q: must be major:minor", device)
+	}
+	for _, number := range []string{major, minor} {
+		if _, err := strconv.ParseUint(number, 10, 32); err != nil {
+			return fmt.Errorf("invalid device number %q: must be major:minor", device)
+		}
+	}
+	return nil
+}
+
+// blkioToIOWeight converts a cgroup v1 block I/O weight, from 10 to 1000, to the cgroup v2 io weight, from 1 to 10000.
+func blkioToIOWeight(weight int) int {
+	if weight < 10 {
+		weight = 10
+	}
+	return 1 + ((weight-10)*9999)/990
+}
+
+// NewDevicesSubsystem initializes a new DevicesSubsystem instance with the provided fileHandler.
+func NewDevicesSubsystem(fileHandler FileHandler) *DevicesSubsystem {
+	return &DevicesSubsystem{fileHandler: fileHandler}
+}
+
+// Name returns the name of the DevicesSubsystem, which is "devices".
+func (d *DevicesSubsystem) Name() string {
+	return "devices"
+}
+
+// ApplySettings adds each of the provided device rules to the allow list of the specified cgroup path.
+// The controller only accepts one rule per write, so each rule is written separately.
+// Cgroup v2 has no devices controller; device access is controlled by eBPF programs there, which are not supported.
+func (d *DevicesSubsystem) ApplySettings(cgroupPath string, resources *Resources) error {
+	if resources == nil || len(resources.Devices) == 0 {
+		return nil
+	}
+	version, err := CgroupVersion()
+	if err != nil {
+		return err
+	}
+	if version == 2 {
+		return fmt.Errorf("device rules are not supported on cgroup v2")
+	}
+	for _, rule := range resources.Devices {
+		if err := setSubsystemString(d.fileHandler, cgroupPath, "devices.allow", rule.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewCpusetSubsystem initializes a new CpusetSubsystem instance with the provided fileHandler.
+func NewCpusetSubsystem(fileHandler FileHandler) *CpusetSubsystem {
+	return &CpusetSubsystem{fileHandler: fileHandler}
+}
+
+// Name returns the name of the CpusetSubsystem, which is "cpuset".
+func (c *CpusetSubsystem) Name() string {
+	return "cpuset"
+}
+
+// ApplySettings pins the specified cgroup path to the CPUs and memory nodes of the provided resources. Both must be
+// given: a cpuset cgroup with either left empty cannot have any processes. The files have the same names on cgroup
+// v1 and v2.
+func (c *CpusetSubsystem) ApplySettings(cgroupPath string, resources *Resources) error {
+	if resources == nil || resources.Cpuset == nil {
+		return nil
+	}
+	if resources.Cpuset.CPUs == "" || resources.Cpuset.Mems == "" {
+		return fmt.Errorf("invalid cpuset: both CPUs and memory nodes must be given, got cpus %q and mems %q", resources.Cpuset.CPUs, resources.Cpuset.Mems)
+	}
+	if _, err := c.fileHandler.ReadDir(cgroupPath); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("cpuset controller directory %s does not exist: is the cpuset controller mounted?", cgroupPath)
+		}
+		return fmt.Errorf("failed to read cpuset controller directory %s: %v", cgroupPath, err)
+	}
+	if err := setSubsystemString(c.fileHandler, cgroupPath, "cpuset.cpus", resources.Cpuset.CPUs); err != nil {
+		return err
+	}
+	return setSubsystemString(c.fileHandler, cgroupPath, "cpuset.mems", resources.Cpuset.Mems)
 }
 
 // setSubsystemValue sets the value of the specified cgroup subsystem file, handling errors if the file cannot be opened or written to.
 func setSubsystemValue(fileHandler FileHandler, subsystemPath, filename string, value int) error {
-	subsystemFile, err := fileHandler.OpenFile(filepath.Join(subsystemPath, filename), os.O_WRONLY, 0644)
+	return setSubsystemString(fileHandler, subsystemPath, filename, strconv.Itoa(value))
+}
+
+// setSubsystemString writes value to the specified cgroup subsystem file.
+func setSubsystemString(fileHandler FileHandler, subsystemPath, filename string, value string) error {
+	path := filepath.Join(subsystemPath, filename)
+	subsystemFile, err := fileHandler.OpenFile(path, os.O_WRONLY, 0644)
 	if err != nil {
-		zap.L().Error("failed to open cgroup subsystem file", zap.String("filename", filename), zap.Error(err))
-		return fmt.Errorf("failed to open %s for cgroup: %v", filename, err)
+		zap.L().Error("failed to open cgroup subsystem file", zap.String("path", path), zap.Error(err))
+		return fmt.Errorf("failed to open %s for cgroup: %v", path, err)
 	}
 	defer subsystemFile.Close()
-	if _, err := fmt.Fprintf(subsystemFile, "%d", value); err != nil {
-		zap.L().Error("failed to set cgroup subsystem value", zap.String("filename", filename), zap.Error(err))
-		return fmt.Errorf("failed to set %s value for cgroup: %v", filename, err)
+	return writeSubsystemFile(subsystemFile, path, value)
+}
+
+// writeSubsystemFile writes value to the cgroup subsystem file opened from path.
+func writeSubsystemFile(subsystemFile *os.File, path, value string) error {
+	if _, err := subsystemFile.WriteString(value); err != nil {
+		zap.L().Error("failed to set cgroup subsystem value", zap.String("path", path), zap.Error(err))
+		return fmt.Errorf("failed to set %s value %q for cgroup: %v", path, value, err)
 	}
 	return nil
 }
@@ -8,11 +8,13 @@ type FileHandler interface {
 	ReadFile(filename string) ([]byte, error)
 	MkdirAll(path string, perm os.FileMode) error
 	RemoveAll(path string) error
+	ReadDir(name string) ([]os.DirEntry, error)
 }
 
 type DefaultFileHandler struct{}
 
-// Subsystem represents a cgroup subsystem.
+// Subsystem represents a cgroup subsystem. ApplySettings leaves the subsystem's settings alone when resources, or
+// its section of them, is nil.
 type Subsystem interface {
 	Name() string
 	ApplySettings(cgroupPath string, resources *Resources) error
@@ -33,6 +35,16 @@ type BlkIOSubsystem struct {
 	fileHandler FileHandler
 }
 
+// DevicesSubsystem is an implementation of the Subsystem interface for the "devices" subsystem.
+type DevicesSubsystem struct {
+	fileHandler FileHandler
+}
+
+// CpusetSubsystem is an implementation of the Subsystem interface for the "cpuset" subsystem.
+type CpusetSubsystem struct {
+	fileHandler FileHandler
+}
+
 // Cgroup is an abstraction over a Linux control group.
 // It contains the name of the cgroup, a file descriptor for the tasks file, and the root path to the cgroup.
 type Cgroup struct {
@@ -40,6 +52,9 @@ type Cgroup struct {
 	File        *os.File
 	CgroupRoot  string
 	fileHandler FileHandler
+	subsystems  []string
+	// version is the cgroup version the cgroup was created on; 0 is treated as v1.
+	version int
 }
 
 // Factory is an interface for creating Cgroup objects with different configurations based on the Spec provided.
@@ -0,0 +1,93 @@
+// cgroup package manages Linux control groups (cgroups) and provides functionality to apply resource limitations.
+package cgroup
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Usage is what a cgroup's processes are currently consuming. MemoryBytes is the memory charged to the cgroup and
+// MaxMemoryBytes the most it has been charged since it was created, and CPUNanos the CPU time its processes have
+// used in total, in nanoseconds. CPUNanos is 0 where the CPU accounting controller is not available.
+type Usage struct {
+	MemoryBytes    uint64 `json:"memoryBytes"`
+	MaxMemoryBytes uint64 `json:"maxMemoryBytes"`
+	CPUNanos       uint64 `json:"cpuNanos"`
+}
+
+// Usage returns the cgroup's current resource usage. On cgroup v1 it reads memory.usage_in_bytes and
+// memory.max_usage_in_bytes from the memory hierarchy and cpuacct.usage from the cpuacct hierarchy, or the cpu
+// hierarchy where cpuacct is co-mounted with it; without cpuacct the CPU usage is left at 0. On v2 it reads
+// memory.current, memory.peak, which needs Linux 5.19, and the usage_usec of cpu.stat.
+func (cg *Cgroup) Usage() (*Usage, error) {
+	if cg.version == 2 {
+		return cg.usageV2()
+	}
+
+	usage := &Usage{}
+	memoryPath := filepath.Join(cg.CgroupRoot, "memory", cg.Name)
+	var err error
+	if usage.MemoryBytes, err = cg.readUint(filepath.Join(memoryPath, "memory.usage_in_bytes")); err != nil {
+		return nil, err
+	}
+	if usage.MaxMemoryBytes, err = cg.readUint(filepath.Join(memoryPath, "memory.max_usage_in_bytes")); err != nil {
+		return nil, err
+	}
+	for _, hierarchy := range []string{"cpuacct", "cpu,cpuacct", "cpu"} {
+		usage.CPUNanos, err = cg.readUint(filepath.Join(cg.CgroupRoot, hierarchy, cg.Name, "cpuacct.usage"))
+		if err == nil || !errors.Is(err, os.ErrNotExist) {
+			break
+		}
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// usageV2 returns the cgroup's current resource usage from the cgroup v2 interface files.
+func (cg *Cgroup) usageV2() (*Usage, error) {
+	usage := &Usage{}
+	cgroupPath := filepath.Join(cg.CgroupRoot, cg.Name)
+	var err error
+	if usage.MemoryBytes, err = cg.readUint(filepath.Join(cgroupPath, "memory.current")); err != nil {
+		return nil, err
+	}
+	if usage.MaxMemoryBytes, err = cg.readUint(filepath.Join(cgroupPath, "memory.peak")); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	statFile := filepath.Join(cgroupPath, "cpu.stat")
+	data, err := cg.fileHandler.ReadFile(statFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", statFile, err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if value, ok := strings.CutPrefix(line, "usage_usec "); ok {
+			usec, err := strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid usage_usec in %s: %v", statFile, err)
+			}
+			usage.CPUNanos = usec * 1000
+		}
+	}
+	return usage, nil
+}
+
+// readUint reads a control file holding a single unsigned number. If the file does not exist the error wraps
+// os.ErrNotExist.
+func (cg *Cgroup) readUint(controlFile string) (uint64, error) {
+	data, err := cg.fileHandler.ReadFile(controlFile)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %s: %w", controlFile, err)
+	}
+	value, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value in %s: %v", controlFile, err)
+	}
+	return value, nil
+}
@@ -0,0 +1,84 @@
+// cgroup package manages Linux control groups (cgroups) and provides functionality to apply resource limitations.
+package cgroup
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// cgroupMountpoint is where the cgroup hierarchies are mounted.
+const cgroupMountpoint = "/sys/fs/cgroup"
+
+// The detected version is cached, since the cgroup mode of a host does not change without a reboot.
+var (
+	versionOnce sync.Once
+	version     int
+	versionErr  error
+)
+
+// CgroupVersion returns 2 if /sys/fs/cgroup is the unified (v2) hierarchy and 1 if it holds v1 controller
+// hierarchies, as read from /proc/self/mountinfo. A hybrid host, with v1 controllers next to a unified hierarchy
+// that only tracks processes, is version 1, since that is where the controllers are. The result of the first call
+// is returned by every later call.
+func CgroupVersion() (int, error) {
+	versionOnce.Do(func() {
+		f, err := os.Open("/proc/self/mountinfo")
+		if err != nil {
+			versionErr = fmt.Errorf("failed to open mountinfo: %v", err)
+			return
+		}
+		defer f.Close()
+		version, versionErr = parseCgroupVersion(f)
+	})
+	return version, versionErr
+}
+
+// parseCgroupVersion returns the cgroup version of the mount table in r, which is in the format of
+// /proc/self/mountinfo, e.g.
+//
+//	32 24 0:28 / /sys/fs/cgroup rw,relatime - cgroup2 cgroup2 rw,nsdelegate
+func parseCgroupVersion(r io.Reader) (int, error) {
+	var rootType string
+	v1Controllers := false
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		// The optional fields end at a lone "-", which is followed by the filesystem type
+		fields := strings.Fields(s.Text())
+		separator := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				separator = i
+				break
+			}
+		}
+		if separator < 0 || separator+1 >= len(fields) {
+			continue
+		}
+		mountpoint, fsType := fields[4], fields[separator+1]
+
+		switch {
+		case mountpoint == cgroupMountpoint:
+			rootType = fsType
+		case strings.HasPrefix(mountpoint, cgroupMountpoint+"/") && fsType == "cgroup":
+			v1Controllers = true
+		}
+	}
+	if err := s.Err(); err != nil {
+		return 0, fmt.Errorf("failed to scan mountinfo: %v", err)
+	}
+
+	switch {
+	case rootType == "cgroup2":
+		return 2, nil
+	case v1Controllers:
+		return 1, nil
+	case rootType == "":
+		return 0, fmt.Errorf("no cgroup filesystem is mounted at %s", cgroupMountpoint)
+	default:
+		return 0, fmt.Errorf("no cgroup controllers are mounted under %s", cgroupMountpoint)
+	}
+}
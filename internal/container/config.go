@@ -0,0 +1,89 @@
+package container
+
+import (
+	"os"
+	"os/exec"
+	"time"
+
+	"spocker/internal/container/cgroup"
+	"spocker/internal/container/filesystem"
+	"spocker/internal/container/namespace"
+	"spocker/internal/container/network"
+)
+
+// Config holds everything Run needs to set up and start a container.
+type Config struct {
+	// ID identifies the container in the state store. Run generates one when it is empty.
+	ID string
+	// Cmd is the command to run. It is left out of the JSON form of the config, which a client sends to the daemon
+	// along with the command's arguments.
+	Cmd       *exec.Cmd `json:"-"`
+	Cgroup    *cgroup.Spec
+	Namespace *namespace.NamespaceSpec
+	FSRoot    string
+	// Overlay mounts FSRoot as the read-only lower layer of an overlay, so what the container writes goes to an upper
+	// layer of its own, which Diff reports and Remove deletes, and FSRoot can be shared by several containers.
+	Overlay bool
+	// WritableLayerSize, if not zero, keeps the overlay's upper layer on an ext4 loopback image of that many bytes,
+	// which caps how much the container can write. It implies Overlay.
+	WritableLayerSize int64
+
+	Network *network.Config
+	Devices []*filesystem.DeviceMapping
+	// ShmSize is the size in bytes of the tmpfs mounted at /dev/shm in the container, whatever its IPC namespace.
+	// It defaults to filesystem.DefaultShmSize.
+	ShmSize int64
+	// PIDNamespaceOf and NetNamespaceOf name running containers whose PID and network namespaces the container
+	// joins instead of getting its own, e.g. for a sidecar. Joining a network namespace needs network mode
+	// container, and no network is set up for the joining container.
+	PIDNamespaceOf string
+	NetNamespaceOf string
+	// Ports are the container ports published on the host. A mapping without a host port is given a free one.
+	// Ports can only be published from a container with a bridge network.
+	Ports []network.PortMapping
+	// VerifyNetwork reads back the configuration of the container's interface in its network namespace once a
+	// bridge network is set up, and fails the container if it is not what was asked for, as network.VerifyConnected
+	// does.
+	VerifyNetwork bool
+	// Init runs the command under spocker's minimal init, which forwards signals and reaps zombies.
+	Init bool
+	// WorkDir is the command's working directory inside the rootfs; it defaults to the rootfs root.
+	WorkDir string
+	// WorkDirCreate creates WorkDir when it does not exist, with WorkDirMode and WorkDirUID/WorkDirGID ownership.
+	WorkDirCreate bool
+	WorkDirMode   os.FileMode
+	WorkDirUID    int
+	WorkDirGID    int
+	// Sysctls are namespaced kernel parameters, keyed like "net.ipv4.ip_forward", set inside the container.
+	Sysctls map[string]string
+	// SchedPolicy and SchedPriority set the command's scheduling policy and priority, as in process.ProcessSpec.
+	SchedPolicy   string
+	SchedPriority int
+	// CapAdd and CapDrop adjust the container's capabilities, starting from process.DefaultCapabilities.
+	// Drops are applied before adds, so a capability in both lists is kept.
+	CapAdd  []string
+	CapDrop []string
+	// StopSignal is the signal Stop sends the container to ask it to exit, e.g. "SIGQUIT". It defaults to SIGTERM.
+	StopSignal string
+	// KeepOnFailure keeps a container that fails to be created or started, with its cgroup, network, mounts, and
+	// namespaces, recording the failure in its state instead of tearing it down. Remove cleans it up.
+	KeepOnFailure bool
+	// PIDFile, when set, is a file the container's PID is written to once it is started, for process supervisors.
+	// It is removed when the container exits. A pidfile that belongs to a running process is refused.
+	PIDFile string
+	// Labels are arbitrary key-value pairs recorded in the container's state, e.g. the stack a container belongs to.
+	Labels map[string]string
+	// NetworkAliases are names the container can be reached by, besides its ID, from the other containers on its
+	// labeled network, through the network's resolver.
+	NetworkAliases []string
+	// Remove deletes the container once it exits, whether it exited cleanly or was killed, instead of keeping its
+	// state and cgroup for inspection.
+	Remove bool
+
+	// HealthCheck, when set, describes how to probe the container's health.
+	HealthCheck *HealthCheck
+	// StartPeriod is how long a container has to become healthy after it starts.
+	StartPeriod time.Duration
+	// HealthExitOnUnhealthy makes Run stop the container and fail if it is not healthy by the end of StartPeriod.
+	HealthExitOnUnhealthy bool
+}
@@ -0,0 +1,273 @@
+// containertest package checks, for tests, that containers leave nothing behind once they are gone.
+//
+// A removed container must leave no state directory, no temporary directories, no cgroup directory in any hierarchy, no
+// host veth, bridge, or named network namespace, no mount under its state, temporary, or root directories, and no NAT
+// rule forwarding to it or masquerading its subnet. AssertClean checks all of these. It does not import the container
+// package, so the container package's own tests can use it; the directories it looks in are set through the variables
+// below.
+package containertest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Where AssertClean looks for a container's resources. Tests that move the container package's StateDir or
+// TempBaseDir, or network.NetnsDir, point these at the same directories.
+var (
+	StateDir    = "/run/spocker"
+	TempBaseDir = "/var/lib/spocker/tmp"
+	CgroupRoot  = "/sys/fs/cgroup"
+	NetnsDir    = "/var/run/netns"
+	// MountInfo is the mount table mounts are looked for in.
+	MountInfo = "/proc/self/mountinfo"
+	// IPTablesSave is the command that lists the iptables rules. Without it there are no rules to look at.
+	IPTablesSave = "iptables-save"
+)
+
+// Resources names what a container was set up with beyond its ID. Those names come from the container's config,
+// so AssertClean can only find them once the container's state is gone if they are tracked.
+type Resources struct {
+	// Cgroup is the name of the container's cgroup.
+	Cgroup string
+	// Network is the name of the container's network: its host veth and any network namespace bind in NetnsDir.
+	Network string
+	// Bridge is the bridge the container's network was attached to, which goes away with the last container on it.
+	Bridge string
+	// Rootfs is the container's root directory; nothing may stay mounted at or below it. The host's root, "/", is
+	// not checked.
+	Rootfs string
+	// Subnet is the subnet of the container's bridge network; no rule may masquerade it. Unless IP is set, no rule
+	// may forward a port to an address in it either, since the container's address goes away with its state.
+	Subnet *net.IPNet
+	// IP is the container's address on its bridge network; no rule may forward a port to it.
+	IP net.IP
+}
+
+var (
+	trackedMu sync.Mutex
+	tracked   = map[string]Resources{}
+)
+
+// Track records the resources of the container with the given ID for AssertClean. It is called when the container
+// is configured, before it is run.
+func Track(id string, resources Resources) {
+	trackedMu.Lock()
+	defer trackedMu.Unlock()
+	tracked[id] = resources
+}
+
+// AssertClean returns an error naming every resource of the container with the given ID that is left behind, or
+// nil if there is none.
+func AssertClean(id string) error {
+	if id == "" || filepath.Base(id) != id || id == "." || id == ".." {
+		return fmt.Errorf("invalid container ID: %q", id)
+	}
+	trackedMu.Lock()
+	resources := tracked[id]
+	trackedMu.Unlock()
+
+	var leaks []error
+	leak := func(format string, args ...interface{}) {
+		leaks = append(leaks, fmt.Errorf(format, args...))
+	}
+
+	for _, dir := range []string{filepath.Join(StateDir, id), filepath.Join(TempBaseDir, id)} {
+		if _, err := os.Lstat(dir); err == nil {
+			leak("directory %s is left behind", dir)
+		}
+	}
+
+	if resources.Cgroup != "" {
+		dirs, err := cgroupDirs(resources.Cgroup)
+		if err != nil {
+			return err
+		}
+		for _, dir := range dirs {
+			leak("cgroup %s is left behind", dir)
+		}
+	}
+
+	if resources.Network != "" {
+		if _, err := net.InterfaceByName(resources.Network); err == nil {
+			leak("interface %s is left behind", resources.Network)
+		}
+		if _, err := os.Lstat(filepath.Join(NetnsDir, resources.Network)); err == nil {
+			leak("network namespace %s is left behind", filepath.Join(NetnsDir, resources.Network))
+		}
+	}
+	if resources.Bridge != "" {
+		if _, err := net.InterfaceByName(resources.Bridge); err == nil {
+			leak("bridge %s is left behind", resources.Bridge)
+		}
+	}
+
+	prefixes := []string{filepath.Join(StateDir, id), filepath.Join(TempBaseDir, id)}
+	if resources.Rootfs != "" && filepath.Clean(resources.Rootfs) != "/" {
+		prefixes = append(prefixes, filepath.Clean(resources.Rootfs))
+	}
+	mounts, err := mountsUnder(prefixes)
+	if err != nil {
+		return err
+	}
+	for _, mount := range mounts {
+		leak("mount %s is left behind", mount)
+	}
+
+	rules, err := natRules(resources)
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		leak("iptables rule %q is left behind", rule)
+	}
+
+	if len(leaks) > 0 {
+		return fmt.Errorf("container %s is not cleaned up: %w", id, errors.Join(leaks...))
+	}
+	return nil
+}
+
+// cgroupDirs returns the directories of the cgroup named name that exist: the unified one in CgroupRoot and those
+// of each cgroup v1 hierarchy mounted below it.
+func cgroupDirs(name string) ([]string, error) {
+	var dirs []string
+	if _, err := os.Lstat(filepath.Join(CgroupRoot, name)); err == nil {
+		dirs = append(dirs, filepath.Join(CgroupRoot, name))
+	}
+	entries, err := os.ReadDir(CgroupRoot)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return dirs, nil
+		}
+		return nil, fmt.Errorf("failed to list %s: %v", CgroupRoot, err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.Name() == name {
+			continue
+		}
+		dir := filepath.Join(CgroupRoot, entry.Name(), name)
+		if _, err := os.Lstat(dir); err == nil {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs, nil
+}
+
+// mountsUnder returns the mount points in MountInfo that are at or below any of prefixes.
+func mountsUnder(prefixes []string) ([]string, error) {
+	file, err := os.Open(MountInfo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mount table: %v", err)
+	}
+	defer file.Close()
+
+	var mounts []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// The mount point is the fifth field, with spaces and other special characters escaped in octal
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		mountPoint := unescapeMountPath(fields[4])
+		for _, prefix := range prefixes {
+			if mountPoint == prefix || strings.HasPrefix(mountPoint, prefix+"/") {
+				mounts = append(mounts, mountPoint)
+				break
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read mount table: %v", err)
+	}
+	return mounts, nil
+}
+
+// unescapeMountPath undoes the octal escaping of a path in the mount table, e.g. "\040" for a space.
+func unescapeMountPath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if c, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+// natRules returns the rules of the nat table that forward a port to the container, as PublishPort installs, or
+// masquerade its subnet, as EnableMasquerade does.
+func natRules(resources Resources) ([]string, error) {
+	if resources.Subnet == nil && resources.IP == nil {
+		return nil, nil
+	}
+	path, err := exec.LookPath(IPTablesSave)
+	if err != nil {
+		return nil, nil
+	}
+	out, err := exec.Command(path, "-t", "nat").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list iptables rules: %v", err)
+	}
+	// The subnet may be given by any of its addresses, but rules name it by its first
+	var subnet string
+	if resources.Subnet != nil {
+		subnet = (&net.IPNet{IP: resources.Subnet.IP.Mask(resources.Subnet.Mask), Mask: resources.Subnet.Mask}).String()
+	}
+	var rules []string
+	for _, line := range strings.Split(string(out), "\n") {
+		args := strings.Fields(line)
+		switch ruleArg(args, "-j") {
+		case "DNAT":
+			if destination := dnatAddress(ruleArg(args, "--to-destination")); destination != nil && resources.forwardsTo(destination) {
+				rules = append(rules, line)
+			}
+		case "MASQUERADE":
+			if subnet != "" && ruleArg(args, "-s") == subnet {
+				rules = append(rules, line)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// forwardsTo reports whether a DNAT rule to destination forwards to the container: to its IP if that is known, or
+// else to any address in its subnet.
+func (r Resources) forwardsTo(destination net.IP) bool {
+	if r.IP != nil {
+		return r.IP.Equal(destination)
+	}
+	return r.Subnet != nil && r.Subnet.Contains(destination)
+}
+
+// ruleArg returns the value following flag in the arguments of an iptables rule, or "" if it has none.
+func ruleArg(args []string, flag string) string {
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] == flag {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+// dnatAddress returns the address of a DNAT destination, which is an address optionally followed by a port, e.g.
+// "10.0.0.2:80" or "[fd00::2]:80".
+func dnatAddress(destination string) net.IP {
+	if host, _, err := net.SplitHostPort(destination); err == nil {
+		return net.ParseIP(host)
+	}
+	return net.ParseIP(strings.Trim(destination, "[]"))
+}
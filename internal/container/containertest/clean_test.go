@@ -0,0 +1,135 @@
+package containertest
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAssertClean(t *testing.T) {
+	StateDir, TempBaseDir, CgroupRoot, NetnsDir = t.TempDir(), t.TempDir(), t.TempDir(), t.TempDir()
+	MountInfo = filepath.Join(t.TempDir(), "mountinfo")
+	rootfs := t.TempDir()
+	if err := os.WriteFile(MountInfo, []byte("22 1 0:21 / /proc rw,nosuid shared:5 - proc proc rw\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	const id = "c1"
+	Track(id, Resources{Cgroup: "spocker-c1", Network: "spocker-c1-veth", Rootfs: rootfs})
+	if err := AssertClean(id); err != nil {
+		t.Fatalf("AssertClean of a container that left nothing behind returned an error: %v", err)
+	}
+
+	// Leak each kind of resource in turn; every one must be reported, and named in the error
+	leaks := []struct {
+		name string
+		leak func() error
+		want string
+	}{
+		{"state", func() error { return os.MkdirAll(filepath.Join(StateDir, id), 0700) }, filepath.Join(StateDir, id)},
+		{"temp", func() error { return os.MkdirAll(filepath.Join(TempBaseDir, id, "tmp-1"), 0700) }, filepath.Join(TempBaseDir, id)},
+		{"cgroup v1", func() error { return os.MkdirAll(filepath.Join(CgroupRoot, "memory", "spocker-c1"), 0755) }, filepath.Join(CgroupRoot, "memory", "spocker-c1")},
+		{"cgroup v2", func() error { return os.MkdirAll(filepath.Join(CgroupRoot, "spocker-c1"), 0755) }, "cgroup " + filepath.Join(CgroupRoot, "spocker-c1") + " "},
+		{"netns", func() error { return os.WriteFile(filepath.Join(NetnsDir, "spocker-c1-veth"), nil, 0644) }, filepath.Join(NetnsDir, "spocker-c1-veth")},
+		{"mount", func() error {
+			line := "40 1 0:50 / " + strings.ReplaceAll(rootfs, " ", "\\040") + "/dev/shm rw - tmpfs tmpfs rw\n"
+			f, err := os.OpenFile(MountInfo, os.O_APPEND|os.O_WRONLY, 0)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = f.WriteString(line)
+			return err
+		}, "mount " + rootfs + "/dev/shm"},
+	}
+	for _, tt := range leaks {
+		if err := tt.leak(); err != nil {
+			t.Fatalf("failed to leak %s: %v", tt.name, err)
+		}
+		err := AssertClean(id)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("expected the leaked %s to be reported as %q, got %v", tt.name, tt.want, err)
+		}
+	}
+
+	// The host's loopback stands in for a leaked veth, since creating one needs root
+	Track("c2", Resources{Network: "lo"})
+	if err := AssertClean("c2"); err == nil || !strings.Contains(err.Error(), "interface lo") {
+		t.Errorf("expected the leaked interface to be reported, got %v", err)
+	}
+
+	if err := AssertClean("../c1"); err == nil {
+		t.Error("expected an invalid ID to be refused")
+	}
+}
+
+func TestAssertCleanNATRules(t *testing.T) {
+	StateDir, TempBaseDir, CgroupRoot, NetnsDir = t.TempDir(), t.TempDir(), t.TempDir(), t.TempDir()
+	MountInfo = filepath.Join(t.TempDir(), "mountinfo")
+	if err := os.WriteFile(MountInfo, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// A fake iptables-save lists the rules of the file next to it
+	dir := t.TempDir()
+	rulesFile := filepath.Join(dir, "rules")
+	IPTablesSave = filepath.Join(dir, "iptables-save")
+	defer func() { IPTablesSave = "iptables-save" }()
+	if err := os.WriteFile(IPTablesSave, []byte("#!/bin/sh\ncat "+rulesFile+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	setRules := func(rules ...string) {
+		t.Helper()
+		table := "*nat\n:PREROUTING ACCEPT [0:0]\n:POSTROUTING ACCEPT [0:0]\n" + strings.Join(rules, "\n") + "\nCOMMIT\n"
+		if err := os.WriteFile(rulesFile, []byte(table), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Rules of other containers are not the container's leaks
+	_, subnet, _ := net.ParseCIDR("10.7.0.5/24")
+	Track("c1", Resources{Subnet: &net.IPNet{IP: net.IPv4(10, 7, 0, 5), Mask: subnet.Mask}})
+	Track("c2", Resources{Subnet: subnet, IP: net.IPv4(10, 7, 0, 2)})
+	setRules(
+		"-A PREROUTING -p tcp -m tcp --dport 8080 -j DNAT --to-destination 10.8.0.2:80",
+		"-A POSTROUTING -s 10.8.0.0/24 ! -d 10.8.0.0/24 -o eth0 -j MASQUERADE",
+	)
+	for _, id := range []string{"c1", "c2"} {
+		if err := AssertClean(id); err != nil {
+			t.Errorf("AssertClean of %s with only other containers' rules returned an error: %v", id, err)
+		}
+	}
+
+	dnat := "-A PREROUTING -p tcp -m tcp --dport 8080 -j DNAT --to-destination 10.7.0.2:80"
+	masquerade := "-A POSTROUTING -s 10.7.0.0/24 ! -d 10.7.0.0/24 -o eth0 -j MASQUERADE"
+	setRules(dnat, masquerade)
+	for _, id := range []string{"c1", "c2"} {
+		err := AssertClean(id)
+		if err == nil || !strings.Contains(err.Error(), dnat) || !strings.Contains(err.Error(), masquerade) {
+			t.Errorf("expected the leaked DNAT and MASQUERADE rules of %s to be reported, got %v", id, err)
+		}
+	}
+
+	// With its address known, only a DNAT rule to that address is the container's
+	setRules("-A PREROUTING -p udp -m udp --dport 5353 -j DNAT --to-destination 10.7.0.3:53")
+	if err := AssertClean("c1"); err == nil {
+		t.Error("expected a DNAT rule into the subnet to be reported when the address is unknown")
+	}
+	if err := AssertClean("c2"); err != nil {
+		t.Errorf("AssertClean reported a DNAT rule to another address of the subnet: %v", err)
+	}
+}
+
+func TestUnescapeMountPath(t *testing.T) {
+	for escaped, want := range map[string]string{
+		`/var/lib/my\040root`: "/var/lib/my root",
+		`/a\134b`:             `/a\b`,
+		`/plain`:              "/plain",
+		`/short\04`:           `/short\04`,
+	} {
+		if got := unescapeMountPath(escaped); got != want {
+			t.Errorf("unescapeMountPath(%q) = %q, want %q", escaped, got, want)
+		}
+	}
+}
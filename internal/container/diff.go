@@ -0,0 +1,156 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"spocker/internal/container/filesystem"
+
+	"golang.org/x/sys/unix"
+)
+
+// ChangeKind describes how a path in the container's filesystem differs from its image.
+type ChangeKind int
+
+// These constants define the kinds of filesystem change Diff reports.
+const (
+	ChangeModified ChangeKind = iota
+	ChangeAdded
+	ChangeDeleted
+)
+
+// String returns the single letter docker diff uses for the kind: C, A, or D.
+func (k ChangeKind) String() string {
+	switch k {
+	case ChangeModified:
+		return "C"
+	case ChangeAdded:
+		return "A"
+	case ChangeDeleted:
+		return "D"
+	}
+	return "?"
+}
+
+// Change is a single path the container added, modified, or deleted, relative to the container root.
+type Change struct {
+	Path string
+	Kind ChangeKind
+}
+
+// String formats the change like a line of docker diff output, e.g. "A /tmp/new".
+func (c Change) String() string {
+	return fmt.Sprintf("%s %s", c.Kind, c.Path)
+}
+
+// overlayOpaqueXattr marks an upper directory that hides everything beneath it in the lower layers.
+const overlayOpaqueXattr = "trusted.overlay.opaque"
+
+// Diff reports the filesystem changes the container made on top of its image.
+// It compares the overlay upperdir recorded in the container's state with the lowerdir, treating
+// overlay whiteouts as deletions. The changes are sorted by path.
+func Diff(id string) ([]Change, error) {
+	state, err := LoadState(id)
+	if err != nil {
+		return nil, err
+	}
+	if state.UpperDir == "" || state.LowerDir == "" {
+		return nil, fmt.Errorf("container %s does not use an overlay filesystem", id)
+	}
+	return diffLayers(strings.Split(state.LowerDir, ":"), state.UpperDir)
+}
+
+// diffLayers walks upper and classifies each entry against the lower layers.
+func diffLayers(lowers []string, upper string) ([]Change, error) {
+	var changes []Change
+	upperFS := &filesystem.Filesystem{Root: upper}
+	err := upperFS.Walk(func(relPath string, info os.FileInfo) error {
+		path := filepath.Join("/", relPath)
+
+		if isWhiteout(info) {
+			changes = append(changes, Change{Path: path, Kind: ChangeDeleted})
+			return nil
+		}
+
+		if !existsInLayers(lowers, path) {
+			changes = append(changes, Change{Path: path, Kind: ChangeAdded})
+			return nil
+		}
+		changes = append(changes, Change{Path: path, Kind: ChangeModified})
+
+		// An opaque directory replaces the lower directory, so anything only the lower layers had is gone.
+		if info.IsDir() && isOpaque(filepath.Join(upper, relPath)) {
+			deleted, err := hiddenEntries(lowers, upper, path)
+			if err != nil {
+				return err
+			}
+			changes = append(changes, deleted...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to diff %s: %v", upper, err)
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, nil
+}
+
+// isWhiteout reports whether info is an overlay whiteout, a character device with device number 0/0.
+func isWhiteout(info os.FileInfo) bool {
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && stat.Rdev == 0
+}
+
+// isOpaque reports whether the upper directory at hostPath is marked opaque.
+func isOpaque(hostPath string) bool {
+	value := make([]byte, 1)
+	n, err := unix.Lgetxattr(hostPath, overlayOpaqueXattr, value)
+	return err == nil && n == 1 && value[0] == 'y'
+}
+
+// existsInLayers reports whether the container path exists in any of the lower layers.
+func existsInLayers(lowers []string, path string) bool {
+	for _, lower := range lowers {
+		if _, err := os.Lstat(filepath.Join(lower, path)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// hiddenEntries returns a deletion for each entry the lower layers have under the opaque directory dir
+// that the upper layer does not.
+func hiddenEntries(lowers []string, upper, dir string) ([]Change, error) {
+	var changes []Change
+	seen := map[string]bool{}
+	for _, lower := range lowers {
+		entries, err := os.ReadDir(filepath.Join(lower, dir))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, entry := range entries {
+			path := filepath.Join(dir, entry.Name())
+			if seen[path] {
+				continue
+			}
+			seen[path] = true
+			if _, err := os.Lstat(filepath.Join(upper, path)); os.IsNotExist(err) {
+				changes = append(changes, Change{Path: path, Kind: ChangeDeleted})
+			}
+		}
+	}
+	return changes, nil
+}
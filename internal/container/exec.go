@@ -0,0 +1,184 @@
+package container
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"spocker/internal/container/cgroup"
+	"spocker/internal/container/namespace"
+	"spocker/internal/container/process"
+
+	"golang.org/x/sys/unix"
+)
+
+// execNamespaces maps the /proc/<pid>/ns entries Exec can join to their namespace types.
+var execNamespaces = []struct {
+	name   string
+	nsType namespace.NamespaceType
+}{
+	{"mnt", namespace.NamespaceTypeMount},
+	{"uts", namespace.NamespaceTypeUTS},
+	{"ipc", namespace.NamespaceTypeIPC},
+	{"net", namespace.NamespaceTypeNet},
+	{"pid", namespace.NamespaceTypePID},
+	{"cgroup", namespace.NamespaceTypeCgroup},
+}
+
+// Exec runs a command inside the namespaces of a running container, with the caller's standard streams
+// wired to it, and returns the command's exit code. With tty set, the command is put in the foreground of
+// the caller's terminal so it receives keyboard input and job control signals.
+func Exec(id string, spec *process.ProcessSpec, tty bool) (int, error) {
+	return ExecContext(context.Background(), id, spec, tty)
+}
+
+// ExecContext runs the command like Exec, and kills it if ctx is done before it exits.
+func ExecContext(ctx context.Context, id string, spec *process.ProcessSpec, tty bool) (int, error) {
+	return runExec(ctx, id, spec, tty, os.Stdin, os.Stdout, os.Stderr)
+}
+
+// runExec runs the command like ExecContext, wiring it to the given streams.
+func runExec(ctx context.Context, id string, spec *process.ProcessSpec, tty bool, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	if spec == nil || spec.Path == "" {
+		return -1, fmt.Errorf("no command given to exec")
+	}
+
+	state, err := LoadState(id)
+	if err != nil {
+		return -1, err
+	}
+	if err := checkRunning(state); err != nil {
+		return -1, err
+	}
+
+	target := process.ExecTarget{PID: state.PID, CgroupPath: state.CgroupPath, Caps: state.Caps}
+	for _, ns := range execNamespaces {
+		// Only namespaces the container does not share with us are joined; re-entering our own is pointless.
+		if namespaceDiffers(state.PID, ns.name) {
+			target.Types = append(target.Types, ns.nsType)
+		}
+	}
+	// Containers created before their capabilities were recorded ran with the default set
+	if target.Caps == nil {
+		if target.Caps, err = process.Capabilities(nil, nil); err != nil {
+			return -1, err
+		}
+	}
+
+	// The command is run by a re-executed spocker, which moves into the container's cgroup and namespaces and
+	// drops to its capabilities before forking the command, so the command never runs outside the container.
+	args := append([]string{process.ExecCommand}, target.Args(spec.Path, append([]string{spec.Path}, spec.Args...))...)
+	cmd := exec.CommandContext(ctx, "/proc/self/exe", args...)
+	// The helper forks the command, so killing it alone would leave the command running
+	cmd.Cancel = func() error {
+		return killWithChildren(cmd.Process)
+	}
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if tty {
+		terminal, ok := stdin.(*os.File)
+		if !ok || !isTerminal(terminal) {
+			return -1, fmt.Errorf("a tty was requested but stdin is not a terminal")
+		}
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Setpgid:    true,
+			Foreground: true,
+			Ctty:       int(terminal.Fd()),
+		}
+	}
+
+	if err := process.StartWithScheduler(cmd, spec.SchedPolicy, spec.SchedPriority); err != nil {
+		return -1, fmt.Errorf("failed to exec in container %s: %v", id, err)
+	}
+	if err := cmd.Wait(); err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			return -1, fmt.Errorf("failed to wait for exec in container %s: %v", id, err)
+		}
+	}
+	return exitStatus(cmd.ProcessState), nil
+}
+
+// RunExecHelper runs the command given by the arguments after process.ExecCommand in the running container they
+// name, as started by Exec, and returns the command's exit code. The helper moves into the container's cgroup
+// before the command is forked, so the command is accounted and limited with the container from the start.
+func RunExecHelper(args []string) (int, error) {
+	target, path, argv, err := process.ParseExecArgs(args)
+	if err != nil {
+		return 127, err
+	}
+	if target.CgroupPath != "" {
+		if err := cgroup.AddProcessToCgroup(&cgroup.DefaultFileHandler{}, target.CgroupPath, os.Getpid()); err != nil {
+			return 127, err
+		}
+	}
+	return process.ExecIn(target, path, argv)
+}
+
+// killWithChildren kills p and the processes it has forked.
+func killWithChildren(p *os.Process) error {
+	children, err := os.ReadFile(fmt.Sprintf("/proc/%d/task/%d/children", p.Pid, p.Pid))
+	if err == nil {
+		for _, field := range strings.Fields(string(children)) {
+			if pid, err := strconv.Atoi(field); err == nil {
+				_ = syscall.Kill(pid, syscall.SIGKILL)
+			}
+		}
+	}
+	return p.Kill()
+}
+
+// checkRunning returns an error unless the container's process is still the one recorded in its state.
+func checkRunning(state *ContainerState) error {
+	if state.Status != StatusRunning || state.PID == 0 {
+		return fmt.Errorf("container %s is not running", state.ID)
+	}
+	startTime, err := process.ProcessStartTime(state.PID)
+	if err != nil || (state.StartTime != 0 && startTime != state.StartTime) {
+		return fmt.Errorf("container %s is not running", state.ID)
+	}
+	return nil
+}
+
+// Environ returns the environment the running container's command was started with, as KEY=VALUE strings.
+// It shows what the container actually got, after everything that sets or filters its environment.
+func Environ(id string) ([]string, error) {
+	state, err := LoadState(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRunning(state); err != nil {
+		return nil, err
+	}
+	env, err := process.Environ(state.PID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read environment of container %s: %w", id, err)
+	}
+	return env, nil
+}
+
+// namespaceDiffers reports whether the process is in a different namespace of the named type than the caller.
+// It returns false when either namespace cannot be read, e.g. because the kernel lacks that namespace type.
+func namespaceDiffers(pid int, name string) bool {
+	ours, err := os.Readlink(filepath.Join("/proc/self/ns", name))
+	if err != nil {
+		return false
+	}
+	theirs, err := os.Readlink(filepath.Join("/proc", strconv.Itoa(pid), "ns", name))
+	if err != nil {
+		return false
+	}
+	return ours != theirs
+}
+
+// isTerminal reports whether the file is a terminal.
+func isTerminal(f *os.File) bool {
+	_, err := unix.IoctlGetTermios(int(f.Fd()), unix.TCGETS)
+	return err == nil
+}
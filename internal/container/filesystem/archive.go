@@ -0,0 +1,220 @@
+package filesystem
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// gzipMagic starts every gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// ExtractTar unpacks the tar archive at tarPath into the root, such as one made by "docker export". A
+// gzip-compressed archive is recognized by its magic bytes. Directories, regular files, symlinks, and hardlinks are
+// recreated with their stored permissions, and with their stored ownership where the caller is allowed to set it;
+// other entry types are skipped. Entries are kept inside the root: names are taken relative to it, a name that
+// climbs out of it with ".." is rejected, and symlinks already extracted are resolved as if the root were "/".
+func (fs *Filesystem) ExtractTar(tarPath string) error {
+	f, err := os.Open(tarPath)
+	if err != nil {
+		return fmt.Errorf("failed to open archive %s: %v", tarPath, err)
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	magic, err := br.Peek(len(gzipMagic))
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("failed to read archive %s: %v", tarPath, err)
+	}
+	var r io.Reader = br
+	if bytes.Equal(magic, gzipMagic) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("failed to decompress archive %s: %v", tarPath, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	// Directory permissions are applied once everything is extracted, so a read-only directory can still be filled
+	type dirMode struct {
+		path string
+		mode os.FileMode
+	}
+	var dirs []dirMode
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive %s: %v", tarPath, err)
+		}
+
+		target, err := fs.archiveEntryPath(hdr.Name)
+		if err != nil {
+			return err
+		}
+		if target == fs.Root {
+			// The archive's "./" entry describes the root itself, which already exists
+			continue
+		}
+		// A symlink left at the target by an earlier entry must not be followed, whatever the entry's type
+		if err := removeNonDir(target); err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			created, err := createDir(target)
+			if err != nil {
+				return fmt.Errorf("failed to create directory %s: %v", hdr.Name, err)
+			}
+			if !created {
+				// The directory was made by an earlier entry or is the parent of one, and keeps what it has
+				continue
+			}
+			dirs = append(dirs, dirMode{target, hdr.FileInfo().Mode()})
+		case tar.TypeReg, tar.TypeRegA:
+			if err := extractFile(tr, target, hdr); err != nil {
+				return err
+			}
+			continue
+		case tar.TypeSymlink:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return fmt.Errorf("failed to create parent directory for %s: %v", hdr.Name, err)
+			}
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return fmt.Errorf("failed to create symlink %s: %v", hdr.Name, err)
+			}
+		case tar.TypeLink:
+			source, err := fs.archiveEntryPath(hdr.Linkname)
+			if err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return fmt.Errorf("failed to create parent directory for %s: %v", hdr.Name, err)
+			}
+			if err := os.Link(source, target); err != nil {
+				return fmt.Errorf("failed to create hardlink %s to %s: %v", hdr.Name, hdr.Linkname, err)
+			}
+			// A hardlink shares its inode, and so its mode and owner, with the file it links to
+			continue
+		default:
+			continue
+		}
+		// Directories get their mode at the end and symlinks have none, so only their owner is left to set
+		if err := chownIfPermitted(target, hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := chmodDir(dirs[i].path, dirs[i].mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createDir creates the directory at path, and its parents if needed, reporting whether path itself was created.
+// An existing directory at path is left alone.
+func createDir(path string) (bool, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return false, err
+	}
+	if err := os.Mkdir(path, 0700); err != nil {
+		if os.IsExist(err) {
+			if info, statErr := os.Lstat(path); statErr == nil && info.IsDir() {
+				return false, nil
+			}
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// chmodDir sets the permissions of the directory at path without following a symlink that took its place.
+func chmodDir(path string, mode os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open directory %s: %v", path, err)
+	}
+	defer f.Close()
+	if err := f.Chmod(mode); err != nil {
+		return fmt.Errorf("failed to set permissions of %s: %v", path, err)
+	}
+	return nil
+}
+
+// archiveEntryPath returns the host path an archive entry named name is extracted to. The name's parent is resolved
+// inside the root, while its last component is not, so an entry replaces a symlink rather than writing through it.
+func (fs *Filesystem) archiveEntryPath(name string) (string, error) {
+	rel := filepath.Clean(strings.TrimLeft(name, "/"))
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("archive entry %s escapes the root", name)
+	}
+	if rel == "." {
+		return fs.Root, nil
+	}
+	parent, err := SecureJoin(fs.Root, filepath.Dir(rel))
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve archive entry %s: %v", name, err)
+	}
+	return filepath.Join(parent, filepath.Base(rel)), nil
+}
+
+// extractFile writes the contents of the current archive entry to a regular file at path, with the entry's mode and
+// owner.
+func extractFile(r io.Reader, path string, hdr *tar.Header) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create parent directory for %s: %v", hdr.Name, err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", hdr.Name, err)
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to extract %s: %v", hdr.Name, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to extract %s: %v", hdr.Name, err)
+	}
+	// The mode is set last, since the umask applies at creation and setuid bits are cleared by writes and chown
+	if err := chownIfPermitted(path, hdr.Uid, hdr.Gid); err != nil {
+		return err
+	}
+	if err := os.Chmod(path, hdr.FileInfo().Mode()); err != nil {
+		return fmt.Errorf("failed to set permissions of %s: %v", hdr.Name, err)
+	}
+	return nil
+}
+
+// removeNonDir removes whatever is at path so an archive entry can take its place, unless it is a directory.
+func removeNonDir(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to stat %s: %v", path, err)
+	}
+	if info.IsDir() {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to replace %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package filesystem
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// DeviceMapping describes a host device node exposed inside the container.
+type DeviceMapping struct {
+	HostPath      string
+	ContainerPath string
+	Permissions   string
+
+	// Type, Major, Minor, and Mode describe the host device and are filled in by Inspect.
+	Type  rune
+	Major uint32
+	Minor uint32
+	Mode  os.FileMode
+}
+
+// ParseDeviceMapping parses a device spec of the form HOST[:CONTAINER[:PERMISSIONS]], e.g. "/dev/ttyUSB0:/dev/ttyUSB0:rwm".
+// The container path defaults to the host path and the permissions default to "rwm".
+func ParseDeviceMapping(spec string) (*DeviceMapping, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) > 3 {
+		return nil, fmt.Errorf("invalid device spec %q: too many fields", spec)
+	}
+
+	mapping := &DeviceMapping{
+		HostPath:      parts[0],
+		ContainerPath: parts[0],
+		Permissions:   "rwm",
+	}
+	if len(parts) > 1 && parts[1] != "" {
+		mapping.ContainerPath = parts[1]
+	}
+	if len(parts) > 2 {
+		mapping.Permissions = parts[2]
+	}
+
+	if !filepath.IsAbs(mapping.HostPath) {
+		return nil, fmt.Errorf("invalid device spec %q: host path must be absolute", spec)
+	}
+	if !filepath.IsAbs(mapping.ContainerPath) {
+		return nil, fmt.Errorf("invalid device spec %q: container path must be absolute", spec)
+	}
+	if err := validateDevicePermissions(mapping.Permissions); err != nil {
+		return nil, fmt.Errorf("invalid device spec %q: %v", spec, err)
+	}
+
+	return mapping, nil
+}
+
+// validateDevicePermissions checks that permissions is a non-empty combination of r, w, and m without repeats.
+func validateDevicePermissions(permissions string) error {
+	if permissions == "" {
+		return fmt.Errorf("empty device permissions")
+	}
+	seen := map[rune]bool{}
+	for _, p := range permissions {
+		if !strings.ContainsRune("rwm", p) {
+			return fmt.Errorf("invalid device permission %q", p)
+		}
+		if seen[p] {
+			return fmt.Errorf("duplicate device permission %q", p)
+		}
+		seen[p] = true
+	}
+	return nil
+}
+
+// Inspect stats the host device and records its type, major/minor numbers, and mode.
+// It returns an error if the host path does not exist or is not a character or block device.
+func (d *DeviceMapping) Inspect() error {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(d.HostPath, &stat); err != nil {
+		return fmt.Errorf("failed to stat device %s: %v", d.HostPath, err)
+	}
+
+	switch stat.Mode & syscall.S_IFMT {
+	case syscall.S_IFCHR:
+		d.Type = 'c'
+	case syscall.S_IFBLK:
+		d.Type = 'b'
+	default:
+		return fmt.Errorf("%s is not a character or block device", d.HostPath)
+	}
+
+	d.Major = unix.Major(stat.Rdev)
+	d.Minor = unix.Minor(stat.Rdev)
+	d.Mode = os.FileMode(stat.Mode & 0777)
+	return nil
+}
+
+// Mknod creates a device node at path in the filesystem.
+// The mode must include the file type bits (syscall.S_IFCHR or syscall.S_IFBLK).
+func (fs *Filesystem) Mknod(path string, mode uint32, major, minor uint32) error {
+	nodePath, err := SecureJoin(fs.Root, path)
+	if err != nil {
+		return fmt.Errorf("failed to resolve device path %s: %v", path, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(nodePath), 0755); err != nil {
+		return fmt.Errorf("failed to create parent directory for device %s: %v", path, err)
+	}
+	if err := syscall.Mknod(nodePath, mode, int(unix.Mkdev(major, minor))); err != nil {
+		return fmt.Errorf("failed to create device node %s: %v", path, err)
+	}
+	return nil
+}
+
+// CreateDevice creates the device node described by the mapping inside the filesystem.
+// The mapping must have been inspected first so its type and numbers are known.
+func (fs *Filesystem) CreateDevice(d *DeviceMapping) error {
+	var fileType uint32
+	switch d.Type {
+	case 'c':
+		fileType = syscall.S_IFCHR
+	case 'b':
+		fileType = syscall.S_IFBLK
+	default:
+		return fmt.Errorf("device %s has not been inspected", d.HostPath)
+	}
+	return fs.Mknod(d.ContainerPath, fileType|uint32(d.Mode), d.Major, d.Minor)
+}
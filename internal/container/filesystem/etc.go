@@ -0,0 +1,78 @@
+package filesystem
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// These are the container paths the generated configuration files are written to by default.
+const (
+	DefaultResolvConfPath = "/etc/resolv.conf"
+	DefaultHostsPath      = "/etc/hosts"
+)
+
+// WriteFile writes data to the file at the container path, creating its parent directories as needed.
+// Symlinks along the path, including one at the file itself, are followed inside the root, so an image that
+// links /etc/resolv.conf to /run/resolv.conf gets the link's target written instead of the link replaced.
+func (fs *Filesystem) WriteFile(path string, data []byte, perm os.FileMode) error {
+	hostPath, err := SecureJoin(fs.Root, path)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %v", path, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(hostPath), 0755); err != nil {
+		return fmt.Errorf("failed to create parent directory for %s: %v", path, err)
+	}
+	if err := os.WriteFile(hostPath, data, perm); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return nil
+}
+
+// WriteResolvConf writes the container's resolv.conf with a nameserver line for each DNS server and a search
+// line for the search domains. It is written to ResolvConfPath, or DefaultResolvConfPath when that is unset.
+func (fs *Filesystem) WriteResolvConf(dns []net.IP, searchDomains []string) error {
+	var b strings.Builder
+	for _, server := range dns {
+		fmt.Fprintf(&b, "nameserver %s\n", server)
+	}
+	if len(searchDomains) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(searchDomains, " "))
+	}
+
+	path := fs.ResolvConfPath
+	if path == "" {
+		path = DefaultResolvConfPath
+	}
+	return fs.WriteFile(path, []byte(b.String()), 0644)
+}
+
+// WriteHostsFile writes the container's hosts file: the localhost entries, with hostname resolving to the loopback
+// address as well, followed by a line for each of entries, which map names to the addresses they resolve to,
+// ordered by name. It is written to HostsPath, or DefaultHostsPath when that is unset.
+func (fs *Filesystem) WriteHostsFile(hostname string, entries map[string]net.IP) error {
+	var b strings.Builder
+	b.WriteString("127.0.0.1\tlocalhost")
+	if hostname != "" && hostname != "localhost" {
+		fmt.Fprintf(&b, " %s", hostname)
+	}
+	b.WriteString("\n::1\tlocalhost ip6-localhost ip6-loopback\n")
+
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s\t%s\n", entries[name], name)
+	}
+
+	path := fs.HostsPath
+	if path == "" {
+		path = DefaultHostsPath
+	}
+	return fs.WriteFile(path, []byte(b.String()), 0644)
+}
@@ -1,6 +1,7 @@
 package filesystem
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -8,6 +9,7 @@ import (
 	"syscall"
 
 	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
 )
 
 var logger, _ = zap.NewProduction()
@@ -18,17 +20,27 @@ type Mount struct {
 	Target string
 	FSType string
 	Flags  uintptr
+	// Data holds filesystem-specific options, e.g. "size=65536" for a tmpfs.
+	Data string
+	// ReadOnly makes a bind mount read-only. The kernel ignores MS_RDONLY when binding, so it takes a remount.
+	ReadOnly bool
 }
 
 // Filesystem is an abstraction over a container's filesystem.
+// ResolvConfPath and HostsPath override where the generated resolv.conf and hosts files are written,
+// for images that keep their configuration outside /etc. UpperDir is the writable layer behind Root, if Root is
+// an overlay mount.
 type Filesystem struct {
-	Root string
+	Root           string
+	ResolvConfPath string
+	HostsPath      string
+	UpperDir       string
 }
 
 type FilesystemHandler interface {
-    Stat(name string) (os.FileInfo, error)
-    Create(name string) (*os.File, error)
-    Remove(name string) error
+	Stat(name string) (os.FileInfo, error)
+	Create(name string) (*os.File, error)
+	Remove(name string) error
 }
 
 // NewFilesystem creates a new filesystem object for the given root directory.
@@ -50,11 +62,21 @@ func NewFilesystem(root string) (*Filesystem, error) {
 }
 
 // Mount mounts the given mount into the filesystem.
+// A bind mount with ReadOnly set is remounted read-only right after it is made.
 func (fs *Filesystem) Mount(mount *Mount) error {
-	err := syscall.Mount(mount.Source, filepath.Join(fs.Root, mount.Target), mount.FSType, mount.Flags, "")
+	target := filepath.Join(fs.Root, mount.Target)
+	err := syscall.Mount(mount.Source, target, mount.FSType, mount.Flags, mount.Data)
 	if err != nil {
 		return fmt.Errorf("failed to mount %s: %v", mount.Target, err)
 	}
+	if mount.ReadOnly && mount.Flags&syscall.MS_BIND != 0 {
+		// The remount applies only to the bind's own mount; MS_REC has no meaning for it
+		flags := mount.Flags&^syscall.MS_REC | syscall.MS_REMOUNT | syscall.MS_RDONLY
+		if err := syscall.Mount("", target, "", flags, ""); err != nil {
+			_ = syscall.Unmount(target, syscall.MNT_DETACH)
+			return fmt.Errorf("failed to make %s read-only: %v", mount.Target, err)
+		}
+	}
 	return nil
 }
 
@@ -67,9 +89,295 @@ func (fs *Filesystem) Unmount(target string) error {
 	return nil
 }
 
+// MountProc mounts a fresh proc filesystem at /proc in the root.
+// It must be called from the container's process, after it has entered its own PID and mount namespaces, so the
+// mount shows the container's processes rather than the host's. The mount tree is made private first, so the
+// mount does not propagate back to the host.
+func (fs *Filesystem) MountProc() error {
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("failed to make mounts private: %v", err)
+	}
+	if err := fs.CreateDir("/proc"); err != nil {
+		return err
+	}
+	return fs.Mount(&Mount{
+		Source: "proc",
+		Target: "/proc",
+		FSType: "proc",
+		Flags:  syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC,
+	})
+}
+
+// defaultDevices are the device nodes every container's /dev gets, whatever its image provides.
+var defaultDevices = []struct {
+	path         string
+	major, minor uint32
+}{
+	{"/dev/null", 1, 3},
+	{"/dev/zero", 1, 5},
+	{"/dev/full", 1, 7},
+	{"/dev/random", 1, 8},
+	{"/dev/urandom", 1, 9},
+	{"/dev/tty", 5, 0},
+}
+
+// defaultDevLinks are the symlinks every container's /dev gets, pointing at the process's own file descriptors.
+var defaultDevLinks = map[string]string{
+	"/dev/fd":     "/proc/self/fd",
+	"/dev/stdin":  "/proc/self/fd/0",
+	"/dev/stdout": "/proc/self/fd/1",
+	"/dev/stderr": "/proc/self/fd/2",
+}
+
+// MountDefaults mounts the filesystems every container expects: a fresh proc at /proc, a read-only sysfs at /sys,
+// and a tmpfs at /dev holding the minimal device nodes. Device nodes already in the root's /dev, like the ones
+// created for the container's devices, are carried over to the tmpfs. Where device nodes cannot be created, as in
+// a user namespace, the original nodes are bind mounted instead.
+// Like MountProc, it must be called from the container's process, after it has entered its own PID and mount
+// namespaces.
+func (fs *Filesystem) MountDefaults() error {
+	if err := fs.MountProc(); err != nil {
+		return err
+	}
+
+	if err := fs.CreateDir("/sys"); err != nil {
+		return err
+	}
+	if err := fs.Mount(&Mount{
+		Source: "sysfs",
+		Target: "/sys",
+		FSType: "sysfs",
+		Flags:  syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC | syscall.MS_RDONLY,
+	}); err != nil {
+		return err
+	}
+
+	// The nodes to bind are opened before the tmpfs covers them, which for a root of "/" includes the host's
+	nodes := make([]deviceNode, 0, len(defaultDevices))
+	for _, device := range defaultDevices {
+		nodes = append(nodes, deviceNode{
+			path:   device.path,
+			mode:   syscall.S_IFCHR | 0666,
+			rdev:   unix.Mkdev(device.major, device.minor),
+			source: device.path,
+		})
+	}
+	existing, err := fs.deviceNodes("/dev")
+	if err != nil {
+		return err
+	}
+	nodes = append(nodes, existing...)
+	for i := range nodes {
+		if f, err := os.OpenFile(nodes[i].source, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0); err == nil {
+			defer f.Close()
+			nodes[i].sourceFile = f
+		}
+	}
+
+	if err := fs.CreateDir("/dev"); err != nil {
+		return err
+	}
+	if err := fs.Mount(&Mount{
+		Source: "tmpfs",
+		Target: "/dev",
+		FSType: "tmpfs",
+		Flags:  syscall.MS_NOSUID | syscall.MS_STRICTATIME,
+		Data:   "mode=755,size=65536k",
+	}); err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		if err := fs.restoreDeviceNode(node); err != nil {
+			return err
+		}
+	}
+	for link, target := range defaultDevLinks {
+		if err := os.Symlink(target, filepath.Join(fs.Root, link)); err != nil {
+			return fmt.Errorf("failed to create %s: %v", link, err)
+		}
+	}
+	return nil
+}
+
+// deviceNode is a device node found in the root, recorded so it can be recreated elsewhere.
+// source is the host path of the original node, and sourceFile an O_PATH handle to it once it has been opened.
+type deviceNode struct {
+	path       string
+	mode       uint32
+	rdev       uint64
+	uid, gid   int
+	source     string
+	sourceFile *os.File
+}
+
+// deviceNodes returns the character and block device nodes under dir in the root. A missing dir has none.
+func (fs *Filesystem) deviceNodes(dir string) ([]deviceNode, error) {
+	var nodes []deviceNode
+	err := filepath.WalkDir(filepath.Join(fs.Root, dir), func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.Type()&os.ModeDevice == 0 {
+			return nil
+		}
+		var stat syscall.Stat_t
+		if err := syscall.Lstat(path, &stat); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(fs.Root, path)
+		if err != nil {
+			return err
+		}
+		nodes = append(nodes, deviceNode{
+			path:   filepath.Join("/", rel),
+			mode:   stat.Mode,
+			rdev:   stat.Rdev,
+			uid:    int(stat.Uid),
+			gid:    int(stat.Gid),
+			source: path,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list device nodes in %s: %v", dir, err)
+	}
+	return nodes, nil
+}
+
+// restoreDeviceNode recreates node in the root with its permissions and owner, replacing any node already there.
+// If the node cannot be created and the original was opened, the original is bind mounted in its place.
+func (fs *Filesystem) restoreDeviceNode(node deviceNode) error {
+	nodePath := filepath.Join(fs.Root, node.path)
+	if err := os.Remove(nodePath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to replace device node %s: %v", node.path, err)
+	}
+	if err := fs.Mknod(node.path, node.mode&syscall.S_IFMT, unix.Major(node.rdev), unix.Minor(node.rdev)); err != nil {
+		if node.sourceFile == nil {
+			return err
+		}
+		return fs.bindDeviceNode(node)
+	}
+	// Mknod is subject to the umask, so the permissions are set explicitly
+	if err := os.Chmod(nodePath, os.FileMode(node.mode&0777)); err != nil {
+		return fmt.Errorf("failed to set permissions of %s: %v", node.path, err)
+	}
+	if err := os.Lchown(nodePath, node.uid, node.gid); err != nil {
+		return fmt.Errorf("failed to set ownership of %s: %v", node.path, err)
+	}
+	return nil
+}
+
+// bindDeviceNode bind mounts the original of node over an empty file at its path in the root. The bound node keeps
+// the original's permissions and owner, which must not be changed through it.
+func (fs *Filesystem) bindDeviceNode(node deviceNode) error {
+	nodePath := filepath.Join(fs.Root, node.path)
+	f, err := os.OpenFile(nodePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("failed to create mount point for device %s: %v", node.path, err)
+	}
+	f.Close()
+	source := fmt.Sprintf("/proc/self/fd/%d", node.sourceFile.Fd())
+	if err := syscall.Mount(source, nodePath, "", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("failed to bind device %s: %v", node.path, err)
+	}
+	return nil
+}
+
+// DefaultShmSize is the size of a container's /dev/shm when none is given.
+const DefaultShmSize = 64 << 20
+
+// MinShmSize is the smallest /dev/shm a container may be given.
+const MinShmSize = 1 << 20
+
+// ValidateShmSize checks that size is a usable size for /dev/shm.
+func ValidateShmSize(size int64) error {
+	if size < MinShmSize {
+		return fmt.Errorf("invalid shm size %d: must be at least %d bytes", size, MinShmSize)
+	}
+	return nil
+}
+
+// MountTmpfs mounts a tmpfs of at most size bytes at target in the root, creating target if needed.
+func (fs *Filesystem) MountTmpfs(target string, size int64, flags uintptr) error {
+	if err := fs.CreateDir(target); err != nil {
+		return err
+	}
+	return fs.Mount(&Mount{
+		Source: "tmpfs",
+		Target: target,
+		FSType: "tmpfs",
+		Flags:  flags,
+		Data:   fmt.Sprintf("mode=1777,size=%d", size),
+	})
+}
+
+// MountShm mounts a tmpfs of size bytes at /dev/shm in the root. Like MountProc, it must be called from the
+// container's process once it is in its own mount namespace, so the container gets its own shared memory whether
+// or not it shares an IPC namespace.
+func (fs *Filesystem) MountShm(size int64) error {
+	if err := ValidateShmSize(size); err != nil {
+		return err
+	}
+	return fs.MountTmpfs("/dev/shm", size, syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC)
+}
+
+// pivotOldDir is where the old root is put while pivoting, relative to the new root.
+const pivotOldDir = ".pivot_old"
+
+// PivotRoot makes the root the root filesystem of the calling process and detaches the old one, so nothing outside
+// the root is reachable anymore. The working directory is left at the new "/".
+// Like MountProc, it must be called from the container's process, inside its own mount namespace with private
+// mounts. The root is bind mounted onto itself first, since pivot_root(2) requires the new root to be a mount point;
+// the bind is recursive so mounts already made in the root, like /proc, are kept.
+func (fs *Filesystem) PivotRoot() error {
+	if err := syscall.Mount(fs.Root, fs.Root, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("failed to bind mount root %s onto itself: %v", fs.Root, err)
+	}
+	oldRoot := filepath.Join(fs.Root, pivotOldDir)
+	if err := os.MkdirAll(oldRoot, 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %v", oldRoot, err)
+	}
+	if err := syscall.PivotRoot(fs.Root, oldRoot); err != nil {
+		return fmt.Errorf("failed to pivot root to %s: %v", fs.Root, err)
+	}
+	if err := syscall.Chdir("/"); err != nil {
+		return fmt.Errorf("failed to change directory to new root: %v", err)
+	}
+	oldRoot = filepath.Join("/", pivotOldDir)
+	if err := syscall.Unmount(oldRoot, syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("failed to unmount old root: %v", err)
+	}
+	if err := os.Remove(oldRoot); err != nil {
+		return fmt.Errorf("failed to remove %s: %v", oldRoot, err)
+	}
+	return nil
+}
+
+// Enter pivots into the root and changes to workDir, a path inside it. A filesystem whose root is the host's "/"
+// is not pivoted, as there is nothing to hide.
+func (fs *Filesystem) Enter(workDir string) error {
+	if fs.Root != "/" {
+		if err := fs.PivotRoot(); err != nil {
+			return err
+		}
+	}
+	if err := os.Chdir(workDir); err != nil {
+		return fmt.Errorf("failed to change to working directory %s: %v", workDir, err)
+	}
+	return nil
+}
+
 // CreateDir creates a directory in the filesystem.
+// Symlinks along the path are resolved inside the root, so the directory is never created outside it.
 func (fs *Filesystem) CreateDir(path string) error {
-	err := os.MkdirAll(filepath.Join(fs.Root, path), 0755)
+	dirPath, err := SecureJoin(fs.Root, path)
+	if err != nil {
+		return fmt.Errorf("failed to resolve directory %s: %v", path, err)
+	}
+	err = os.MkdirAll(dirPath, 0755)
 	if err != nil {
 		return fmt.Errorf("failed to create directory %s: %v", path, err)
 	}
@@ -159,6 +467,103 @@ func (fs *Filesystem) CopyFile(src string, dst string) error {
 	return nil
 }
 
+// CopyDir copies the directory tree at src to dst in the filesystem, creating dst if needed.
+// Directories and regular files keep their permissions, symlinks are copied as links rather than followed, and
+// ownership is kept where the caller is allowed to set it. Other file types, like device nodes, are skipped.
+func (fs *Filesystem) CopyDir(src string, dst string) error {
+	srcRoot := filepath.Join(fs.Root, src)
+	dstRoot := filepath.Join(fs.Root, dst)
+
+	srcInfo, err := os.Stat(srcRoot)
+	if err != nil {
+		return fmt.Errorf("failed to stat source directory %s: %v", src, err)
+	}
+	if !srcInfo.IsDir() {
+		return fmt.Errorf("source is not a directory %s", src)
+	}
+
+	// Directory permissions are applied once the walk is done, so a read-only directory can still be filled
+	type dirMode struct {
+		path string
+		mode os.FileMode
+	}
+	var dirs []dirMode
+
+	err = filepath.WalkDir(srcRoot, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(srcRoot, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dstRoot, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case d.IsDir():
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return fmt.Errorf("failed to create directory %s: %v", target, err)
+			}
+			dirs = append(dirs, dirMode{target, info.Mode()})
+		case d.Type()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return fmt.Errorf("failed to read symlink %s: %v", path, err)
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return fmt.Errorf("failed to create symlink %s: %v", target, err)
+			}
+		case d.Type().IsRegular():
+			if err := fs.CopyFile(filepath.Join(src, rel), filepath.Join(dst, rel)); err != nil {
+				return err
+			}
+			// The mode is set after the owner, since chown clears setuid and setgid bits
+			if err := copyOwnership(target, info); err != nil {
+				return err
+			}
+			if err := os.Chmod(target, info.Mode()); err != nil {
+				return fmt.Errorf("failed to set permissions of %s: %v", target, err)
+			}
+			return nil
+		default:
+			return nil
+		}
+		return copyOwnership(target, info)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to copy directory from %s to %s: %v", src, dst, err)
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i].path, dirs[i].mode); err != nil {
+			return fmt.Errorf("failed to set permissions of %s: %v", dirs[i].path, err)
+		}
+	}
+	return nil
+}
+
+// copyOwnership gives path the owner and group recorded in info.
+func copyOwnership(path string, info os.FileInfo) error {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	return chownIfPermitted(path, int(stat.Uid), int(stat.Gid))
+}
+
+// chownIfPermitted sets the owner and group of path, without following a symlink. Only a privileged caller may hand
+// files to other users, so a permission error is not a failure.
+func chownIfPermitted(path string, uid, gid int) error {
+	if err := os.Lchown(path, uid, gid); err != nil && !errors.Is(err, syscall.EPERM) {
+		return fmt.Errorf("failed to set ownership of %s: %v", path, err)
+	}
+	return nil
+}
+
 // SetFileOwnership sets the ownership of a file in the filesystem.
 func (fs *Filesystem) SetFileOwnership(path string, uid int, gid int) error {
 	err := os.Chown(filepath.Join(fs.Root, path), uid, gid)
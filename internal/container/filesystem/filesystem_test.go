@@ -2,9 +2,18 @@
 package filesystem
 
 import (
+	"archive/tar"
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"syscall"
 	"testing"
@@ -107,6 +116,39 @@ func TestMountUnmount(t *testing.T) {
 	})
 }
 
+func TestMountReadOnlyBind(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to bind mount")
+	}
+
+	source := t.TempDir()
+	if err := os.WriteFile(filepath.Join(source, "file"), []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs := &Filesystem{Root: t.TempDir()}
+	if err := fs.CreateDir("/ro"); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &Mount{Source: source, Target: "/ro", Flags: syscall.MS_BIND, ReadOnly: true}
+	if err := fs.Mount(m); err != nil {
+		t.Fatalf("failed to mount read-only bind: %v", err)
+	}
+	defer fs.Unmount("/ro")
+
+	target := filepath.Join(fs.Root, "ro", "file")
+	if content, err := os.ReadFile(target); err != nil || string(content) != "original" {
+		t.Errorf("unexpected content through the bind mount: %q, %v", content, err)
+	}
+	err := os.WriteFile(target, []byte("changed"), 0644)
+	if !errors.Is(err, syscall.EROFS) {
+		t.Errorf("expected writing through the read-only bind to fail with EROFS, got %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(source, "file"), []byte("changed"), 0644); err != nil {
+		t.Errorf("the source became read-only too: %v", err)
+	}
+}
+
 // isMounted checks if the given mountpoint is currently mounted.
 func isMounted(mountpoint string) bool {
 	f, err := os.Open("/proc/mounts")
@@ -128,6 +170,103 @@ func isMounted(mountpoint string) bool {
 	return false
 }
 
+func TestPivotRoot(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to pivot root")
+	}
+
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "marker"), []byte("inside"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs := &Filesystem{Root: root}
+
+	// The pivot happens on a thread of its own, in its own mount namespace, which is never unlocked so the thread
+	// exits with the goroutine instead of going back to the runtime with the wrong root.
+	errc := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		if err := syscall.Unshare(syscall.CLONE_NEWNS | syscall.CLONE_FS); err != nil {
+			errc <- err
+			return
+		}
+		if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+			errc <- err
+			return
+		}
+		if err := fs.PivotRoot(); err != nil {
+			errc <- err
+			return
+		}
+		if content, err := os.ReadFile("/marker"); err != nil || string(content) != "inside" {
+			errc <- fmt.Errorf("marker not found at the new root: %q, %v", content, err)
+			return
+		}
+		if _, err := os.Stat(root); !os.IsNotExist(err) {
+			errc <- fmt.Errorf("host path %s is still reachable after pivoting: %v", root, err)
+			return
+		}
+		if _, err := os.Stat("/" + pivotOldDir); !os.IsNotExist(err) {
+			errc <- fmt.Errorf("%s was not removed: %v", pivotOldDir, err)
+			return
+		}
+		errc <- nil
+	}()
+	if err := <-errc; err != nil {
+		t.Fatalf("PivotRoot failed: %v", err)
+	}
+}
+
+func TestMountDefaults(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to mount filesystems")
+	}
+
+	fs := &Filesystem{Root: t.TempDir()}
+	if err := fs.Mknod("/dev/mynull", syscall.S_IFCHR|0600, 1, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	// The mounts are made on a thread of its own, in its own mount namespace, so they disappear with it.
+	errc := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		if err := syscall.Unshare(syscall.CLONE_NEWNS | syscall.CLONE_FS); err != nil {
+			errc <- err
+			return
+		}
+		if err := fs.MountDefaults(); err != nil {
+			errc <- err
+			return
+		}
+		for _, path := range []string{"proc/self", "sys/kernel"} {
+			if _, err := os.Stat(filepath.Join(fs.Root, path)); err != nil {
+				errc <- fmt.Errorf("%s is missing: %v", path, err)
+				return
+			}
+		}
+		for path, want := range map[string]os.FileMode{"dev/null": 0666, "dev/urandom": 0666, "dev/mynull": 0600} {
+			info, err := os.Stat(filepath.Join(fs.Root, path))
+			if err != nil {
+				errc <- fmt.Errorf("%s is missing: %v", path, err)
+				return
+			}
+			if info.Mode()&os.ModeCharDevice == 0 || info.Mode().Perm() != want {
+				errc <- fmt.Errorf("%s has mode %v, want a character device with permissions %v", path, info.Mode(), want)
+				return
+			}
+		}
+		if target, err := os.Readlink(filepath.Join(fs.Root, "dev/fd")); err != nil || target != "/proc/self/fd" {
+			errc <- fmt.Errorf("dev/fd links to %q: %v", target, err)
+			return
+		}
+		errc <- nil
+	}()
+	if err := <-errc; err != nil {
+		t.Fatalf("MountDefaults failed: %v", err)
+	}
+}
+
 func TestCreateRemoveDir(t *testing.T) {
 	t.Run("create and remove directory", func(t *testing.T) {
 		// Set up temporary directory for filesystem
@@ -232,6 +371,113 @@ func TestCopyFile(t *testing.T) {
 	}
 }
 
+func TestCopyFileContents(t *testing.T) {
+	root := t.TempDir()
+	fs, err := NewFilesystem(root)
+	if err != nil {
+		t.Fatalf("failed to create filesystem: %v", err)
+	}
+
+	want := "copied contents\n"
+	if err := os.WriteFile(filepath.Join(root, "src.txt"), []byte(want), 0644); err != nil {
+		t.Fatalf("failed to write source file: %v", err)
+	}
+	if err := fs.CopyFile("src.txt", "dst.txt"); err != nil {
+		t.Fatalf("failed to copy file: %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(root, "dst.txt"))
+	if err != nil {
+		t.Fatalf("failed to read destination file: %v", err)
+	}
+	if string(got) != want {
+		t.Errorf("destination file contains %q, want %q", got, want)
+	}
+
+	// Binary contents spanning several copy buffers must come through byte for byte
+	binary := make([]byte, 100000)
+	for i := range binary {
+		binary[i] = byte(i * 7)
+	}
+	if err := os.WriteFile(filepath.Join(root, "src.bin"), binary, 0644); err != nil {
+		t.Fatalf("failed to write source file: %v", err)
+	}
+	if err := fs.CopyFile("src.bin", "dst.bin"); err != nil {
+		t.Fatalf("failed to copy file: %v", err)
+	}
+	got, err = os.ReadFile(filepath.Join(root, "dst.bin"))
+	if err != nil {
+		t.Fatalf("failed to read destination file: %v", err)
+	}
+	if !bytes.Equal(got, binary) {
+		t.Errorf("destination file differs from the source: got %d bytes, want %d", len(got), len(binary))
+	}
+}
+
+func TestCopyDir(t *testing.T) {
+	root := t.TempDir()
+	fs, err := NewFilesystem(root)
+	if err != nil {
+		t.Fatalf("failed to create filesystem: %v", err)
+	}
+
+	src := filepath.Join(root, "src")
+	if err := os.MkdirAll(filepath.Join(src, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "bin", "tool"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "secret"), []byte("hidden"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "bin", "setuid"), nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(src, "bin", "setuid"), 0755|os.ModeSetuid); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("bin/tool", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(src, "locked"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "locked", "file"), []byte("inside"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(src, "locked"), 0555); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.CopyDir("src", "dst"); err != nil {
+		t.Fatalf("CopyDir returned an error: %v", err)
+	}
+
+	dst := filepath.Join(root, "dst")
+	for path, want := range map[string]string{"bin/tool": "#!/bin/sh\n", "secret": "hidden", "locked/file": "inside"} {
+		if got, err := os.ReadFile(filepath.Join(dst, path)); err != nil || string(got) != want {
+			t.Errorf("%s contains %q (%v), want %q", path, got, err, want)
+		}
+	}
+	for path, want := range map[string]os.FileMode{"bin/tool": 0755, "bin/setuid": 0755 | os.ModeSetuid, "secret": 0600, "locked": 0555 | os.ModeDir} {
+		info, err := os.Lstat(filepath.Join(dst, path))
+		if err != nil {
+			t.Fatalf("failed to stat %s: %v", path, err)
+		}
+		if info.Mode() != want {
+			t.Errorf("%s has mode %v, want %v", path, info.Mode(), want)
+		}
+	}
+	if target, err := os.Readlink(filepath.Join(dst, "link")); err != nil || target != "bin/tool" {
+		t.Errorf("link was not copied as a symlink: %q, %v", target, err)
+	}
+
+	if err := fs.CopyDir("src/secret", "other"); err == nil || !strings.Contains(err.Error(), "not a directory") {
+		t.Errorf("expected an error copying a file as a directory, got %v", err)
+	}
+}
+
 func TestSetFileOwnership(t *testing.T) {
 	// Create a temporary directory to use for the filesystem root
 	rootDir, err := os.MkdirTemp("", "fs-test")
@@ -346,3 +592,679 @@ func TestGetAbsolutePath(t *testing.T) {
 		t.Errorf("GetAbsolutePath should have returned an error for non-existent path")
 	}
 }
+
+// writeExecutable creates an executable file with the given content under root.
+func writeExecutable(t *testing.T, root, path, content string) {
+	t.Helper()
+	fullPath := filepath.Join(root, path)
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		t.Fatalf("failed to create directory for %s: %v", path, err)
+	}
+	if err := os.WriteFile(fullPath, []byte(content), 0755); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+}
+
+func TestValidateCommand(t *testing.T) {
+	root := t.TempDir()
+	writeExecutable(t, root, "bin/sh", "\x7fELF")
+	writeExecutable(t, root, "usr/bin/myapp", "\x7fELF")
+	writeExecutable(t, root, "app/run.sh", "#!/bin/sh\necho hi\n")
+	writeExecutable(t, root, "app/run.py", "#!/usr/bin/env python3\nprint('hi')\n")
+	writeExecutable(t, root, "app/broken.sh", "#!/bin/bash\necho hi\n")
+	if err := os.WriteFile(filepath.Join(root, "app/data"), []byte("data"), 0644); err != nil {
+		t.Fatalf("failed to write data file: %v", err)
+	}
+
+	fs, err := NewFilesystem(root)
+	if err != nil {
+		t.Fatalf("failed to create filesystem: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		command string
+		pathEnv string
+		want    string
+		wantErr bool
+	}{
+		{"absolute path present", "/bin/sh", "", "/bin/sh", false},
+		{"resolved through PATH", "myapp", "", "/usr/bin/myapp", false},
+		{"custom PATH", "run.sh", "/app", "/app/run.sh", false},
+		{"missing binary", "/bin/bash", "", "", true},
+		{"missing from PATH", "myapp", "/bin", "", true},
+		{"not executable", "/app/data", "", "", true},
+		{"shebang interpreter present", "/app/run.sh", "", "/app/run.sh", false},
+		{"shebang interpreter missing", "/app/broken.sh", "", "", true},
+		{"env interpreter missing", "/app/run.py", "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := fs.ValidateCommand(tt.command, tt.pathEnv)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ValidateCommand(%q) error = %v, wantErr %v", tt.command, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ValidateCommand(%q) = %q, want %q", tt.command, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSecureJoin(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "usr/bin"), 0755); err != nil {
+		t.Fatalf("failed to create usr/bin: %v", err)
+	}
+	if err := os.Symlink("/usr/bin", filepath.Join(root, "bin")); err != nil {
+		t.Fatalf("failed to create bin symlink: %v", err)
+	}
+	if err := os.Symlink("../../../../etc", filepath.Join(root, "usr/escape")); err != nil {
+		t.Fatalf("failed to create escape symlink: %v", err)
+	}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/bin/sh", filepath.Join(root, "usr/bin/sh")},
+		{"/../../etc/passwd", filepath.Join(root, "etc/passwd")},
+		{"/usr/escape/passwd", filepath.Join(root, "etc/passwd")},
+		{"usr/bin", filepath.Join(root, "usr/bin")},
+	}
+
+	for _, tt := range tests {
+		got, err := SecureJoin(root, tt.path)
+		if err != nil {
+			t.Fatalf("SecureJoin(%q) returned an error: %v", tt.path, err)
+		}
+		if got != tt.want {
+			t.Errorf("SecureJoin(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestParseDeviceMapping(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    DeviceMapping
+		wantErr bool
+	}{
+		{"/dev/ttyUSB0", DeviceMapping{HostPath: "/dev/ttyUSB0", ContainerPath: "/dev/ttyUSB0", Permissions: "rwm"}, false},
+		{"/dev/ttyUSB0:/dev/serial", DeviceMapping{HostPath: "/dev/ttyUSB0", ContainerPath: "/dev/serial", Permissions: "rwm"}, false},
+		{"/dev/ttyUSB0:/dev/ttyUSB0:rw", DeviceMapping{HostPath: "/dev/ttyUSB0", ContainerPath: "/dev/ttyUSB0", Permissions: "rw"}, false},
+		{"/dev/sda::r", DeviceMapping{HostPath: "/dev/sda", ContainerPath: "/dev/sda", Permissions: "r"}, false},
+		{"dev/ttyUSB0", DeviceMapping{}, true},
+		{"/dev/ttyUSB0:serial", DeviceMapping{}, true},
+		{"/dev/ttyUSB0:/dev/ttyUSB0:rx", DeviceMapping{}, true},
+		{"/dev/ttyUSB0:/dev/ttyUSB0:rr", DeviceMapping{}, true},
+		{"/dev/ttyUSB0:/dev/ttyUSB0:", DeviceMapping{}, true},
+		{"/a:/b:r:extra", DeviceMapping{}, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseDeviceMapping(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseDeviceMapping(%q) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if err == nil && *got != tt.want {
+			t.Errorf("ParseDeviceMapping(%q) = %+v, want %+v", tt.spec, *got, tt.want)
+		}
+	}
+}
+
+func TestInspectDeviceRejectsRegularFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "not-a-device")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	device := &DeviceMapping{HostPath: path, ContainerPath: "/dev/x", Permissions: "rwm"}
+	if err := device.Inspect(); err == nil {
+		t.Error("expected an error inspecting a regular file")
+	}
+
+	missing := &DeviceMapping{HostPath: "/dev/does-not-exist", ContainerPath: "/dev/x", Permissions: "rwm"}
+	if err := missing.Inspect(); err == nil {
+		t.Error("expected an error inspecting a missing device")
+	}
+}
+
+func TestCreateDevice(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to create device nodes")
+	}
+
+	fs, err := NewFilesystem(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create filesystem: %v", err)
+	}
+
+	device, err := ParseDeviceMapping("/dev/null:/dev/mynull:rw")
+	if err != nil {
+		t.Fatalf("failed to parse device: %v", err)
+	}
+	if err := device.Inspect(); err != nil {
+		t.Fatalf("failed to inspect device: %v", err)
+	}
+	if device.Type != 'c' || device.Major != 1 || device.Minor != 3 {
+		t.Fatalf("unexpected /dev/null device: %c %d:%d", device.Type, device.Major, device.Minor)
+	}
+
+	if err := fs.CreateDevice(device); err != nil {
+		t.Fatalf("failed to create device: %v", err)
+	}
+
+	var stat syscall.Stat_t
+	if err := syscall.Stat(filepath.Join(fs.Root, "dev/mynull"), &stat); err != nil {
+		t.Fatalf("failed to stat created device: %v", err)
+	}
+	if stat.Mode&syscall.S_IFMT != syscall.S_IFCHR {
+		t.Errorf("created node is not a character device")
+	}
+	if stat.Rdev != 0x103 {
+		t.Errorf("created node has device number %#x, want %#x", stat.Rdev, 0x103)
+	}
+}
+
+func TestLoopbackFS(t *testing.T) {
+	if _, err := CreateLoopbackFS(filepath.Join(t.TempDir(), "tiny.img"), MinLoopbackSize-1); err == nil {
+		t.Error("expected an image below the minimum size to be refused")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to attach loop devices and mount")
+	}
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 is not installed")
+	}
+	if _, err := os.Stat("/dev/loop-control"); err != nil {
+		t.Skip("loop devices are not available")
+	}
+
+	const size = 8 << 20
+	image := filepath.Join(t.TempDir(), "rw.img")
+	device, err := CreateLoopbackFS(image, size)
+	if err != nil {
+		t.Fatalf("CreateLoopbackFS returned an error: %v", err)
+	}
+	defer DetachLoopDevice(device)
+	if _, err := CreateLoopbackFS(image, size); err == nil {
+		t.Error("expected an existing image to be refused")
+	}
+
+	devices, err := ListLoopDevices()
+	if err != nil {
+		t.Fatalf("ListLoopDevices returned an error: %v", err)
+	}
+	attached := false
+	for _, d := range devices {
+		attached = attached || (d.Device == device && d.BackingFile == image)
+	}
+	if !attached {
+		t.Errorf("%s is not listed as attached to %s: %+v", device, image, devices)
+	}
+
+	mountPoint := t.TempDir()
+	if err := syscall.Mount(device, mountPoint, "ext4", 0, ""); err != nil {
+		t.Fatalf("failed to mount %s: %v", device, err)
+	}
+	if err := os.WriteFile(filepath.Join(mountPoint, "hello"), []byte("hello"), 0644); err != nil {
+		t.Errorf("failed to write to the loopback filesystem: %v", err)
+	}
+	// The filesystem is capped at the image size
+	if err := os.WriteFile(filepath.Join(mountPoint, "big"), make([]byte, size), 0644); err == nil {
+		t.Error("writing more than the image size succeeded")
+	}
+	if err := syscall.Unmount(mountPoint, 0); err != nil {
+		t.Fatalf("failed to unmount %s: %v", mountPoint, err)
+	}
+
+	if err := DetachLoopDevice(device); err != nil {
+		t.Fatalf("DetachLoopDevice returned an error: %v", err)
+	}
+	if devices, err = ListLoopDevices(); err != nil {
+		t.Fatalf("ListLoopDevices returned an error: %v", err)
+	}
+	for _, d := range devices {
+		if d.Device == device {
+			t.Errorf("%s is still attached after it was detached", device)
+		}
+	}
+	if err := DetachLoopDevice(device); err != nil {
+		t.Errorf("detaching a detached device returned an error: %v", err)
+	}
+}
+
+func TestOverlayMountData(t *testing.T) {
+	supportAll := func(string) bool { return true }
+
+	data, err := overlayMountData("/lower", "/upper", "/work", nil, supportAll)
+	if err != nil {
+		t.Fatalf("overlayMountData returned an error: %v", err)
+	}
+	if data != "lowerdir=/lower,upperdir=/upper,workdir=/work" {
+		t.Errorf("unexpected default options: %s", data)
+	}
+
+	options := &OverlayOptions{Metacopy: true, RedirectDir: true, Volatile: true}
+	data, err = overlayMountData("/lower", "/upper", "/work", options, supportAll)
+	if err != nil {
+		t.Fatalf("overlayMountData returned an error: %v", err)
+	}
+	if data != "lowerdir=/lower,upperdir=/upper,workdir=/work,redirect_dir=on,metacopy=on,volatile" {
+		t.Errorf("unexpected options: %s", data)
+	}
+
+	supportNone := func(string) bool { return false }
+	if _, err := overlayMountData("/lower", "/upper", "/work", &OverlayOptions{}, supportNone); err != nil {
+		t.Errorf("options left off should not be probed: %v", err)
+	}
+	_, err = overlayMountData("/lower", "/upper", "/work", &OverlayOptions{Metacopy: true}, supportNone)
+	if err == nil || !strings.Contains(err.Error(), "metacopy is not supported") {
+		t.Errorf("expected an unsupported metacopy error, got %v", err)
+	}
+}
+
+func TestOverlayFeatureSupported(t *testing.T) {
+	defer func(dir string) { overlayParametersDir = dir }(overlayParametersDir)
+	overlayParametersDir = t.TempDir()
+	if err := os.WriteFile(filepath.Join(overlayParametersDir, "redirect_dir"), []byte("N\n"), 0644); err != nil {
+		t.Fatalf("failed to write parameter: %v", err)
+	}
+
+	if !overlayFeatureSupported("redirect_dir") {
+		t.Error("expected redirect_dir to be supported when its parameter exists")
+	}
+	if overlayFeatureSupported("metacopy") {
+		t.Error("expected metacopy to be unsupported when its parameter is missing")
+	}
+
+	fs := &Filesystem{Root: t.TempDir()}
+	lower, upper, work, merged := overlayDirs(t)
+	err := fs.MountOverlayWithOptions(lower, upper, work, merged, &OverlayOptions{Metacopy: true})
+	if err == nil || !strings.Contains(err.Error(), "not supported") {
+		t.Errorf("expected an unsupported option error, got %v", err)
+	}
+}
+
+// overlayDirs creates the lower, upper, work, and merged directories of an overlay.
+func overlayDirs(t *testing.T) (lower, upper, work, merged string) {
+	base := t.TempDir()
+	dirs := []string{"lower", "upper", "work", "merged"}
+	for i, name := range dirs {
+		dirs[i] = filepath.Join(base, name)
+		if err := os.Mkdir(dirs[i], 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dirs[0], dirs[1], dirs[2], dirs[3]
+}
+
+func TestMountOverlay(t *testing.T) {
+	fs := &Filesystem{Root: t.TempDir()}
+
+	t.Run("missing directory", func(t *testing.T) {
+		lower, upper, work, merged := overlayDirs(t)
+		if err := os.Remove(work); err != nil {
+			t.Fatal(err)
+		}
+		err := fs.MountOverlay(lower, upper, work, merged)
+		if err == nil || !strings.Contains(err.Error(), "overlay work directory does not exist") {
+			t.Errorf("expected a missing work directory error, got %v", err)
+		}
+
+		err = fs.MountOverlay(lower+":"+filepath.Join(lower, "missing"), upper, work, merged)
+		if err == nil || !strings.Contains(err.Error(), "overlay lower directory does not exist") {
+			t.Errorf("expected a missing lower directory error, got %v", err)
+		}
+	})
+
+	t.Run("not a directory", func(t *testing.T) {
+		lower, upper, work, merged := overlayDirs(t)
+		if err := os.Remove(upper); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(upper, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		err := fs.MountOverlay(lower, upper, work, merged)
+		if err == nil || !strings.Contains(err.Error(), "overlay upper directory is not a directory") {
+			t.Errorf("expected an upper directory error, got %v", err)
+		}
+	})
+
+	t.Run("mount and unmount", func(t *testing.T) {
+		if os.Geteuid() != 0 {
+			t.Skip("requires root to mount an overlay")
+		}
+		lower, upper, work, merged := overlayDirs(t)
+		if err := os.WriteFile(filepath.Join(lower, "base"), []byte("base"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.MountOverlay(lower, upper, work, merged); err != nil {
+			t.Skipf("overlay is not available: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(merged, "base"), []byte("changed"), 0644); err != nil {
+			t.Errorf("failed to write through the overlay: %v", err)
+		}
+		if err := fs.UnmountOverlay(merged); err != nil {
+			t.Fatalf("UnmountOverlay returned an error: %v", err)
+		}
+
+		if content, err := os.ReadFile(filepath.Join(lower, "base")); err != nil || string(content) != "base" {
+			t.Errorf("lower layer was modified: %q, %v", content, err)
+		}
+		if content, err := os.ReadFile(filepath.Join(upper, "base")); err != nil || string(content) != "changed" {
+			t.Errorf("write was not copied up to the upper layer: %q, %v", content, err)
+		}
+		if isMounted(merged) {
+			t.Errorf("%s is still mounted", merged)
+		}
+	})
+}
+
+func TestWriteResolvConfFollowsSymlink(t *testing.T) {
+	fs := &Filesystem{Root: t.TempDir()}
+	if err := os.MkdirAll(filepath.Join(fs.Root, "etc"), 0755); err != nil {
+		t.Fatalf("failed to create /etc: %v", err)
+	}
+	// An absolute link target must be resolved inside the rootfs, not on the host.
+	if err := os.Symlink("/run/resolv.conf", filepath.Join(fs.Root, "etc/resolv.conf")); err != nil {
+		t.Fatalf("failed to create symlink: %v", err)
+	}
+
+	dns := []net.IP{net.ParseIP("8.8.8.8"), net.ParseIP("8.8.4.4")}
+	if err := fs.WriteResolvConf(dns, []string{"example.com"}); err != nil {
+		t.Fatalf("WriteResolvConf returned an error: %v", err)
+	}
+
+	info, err := os.Lstat(filepath.Join(fs.Root, "etc/resolv.conf"))
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("expected /etc/resolv.conf to remain a symlink, got %v (%v)", info, err)
+	}
+	content, err := os.ReadFile(filepath.Join(fs.Root, "run/resolv.conf"))
+	if err != nil {
+		t.Fatalf("expected the symlink target to be written: %v", err)
+	}
+	expected := "nameserver 8.8.8.8\nnameserver 8.8.4.4\nsearch example.com\n"
+	if string(content) != expected {
+		t.Errorf("expected resolv.conf %q, got %q", expected, content)
+	}
+}
+
+func TestWriteResolvConfOverridePath(t *testing.T) {
+	fs := &Filesystem{Root: t.TempDir(), ResolvConfPath: "/config/resolv.conf"}
+	if err := fs.WriteResolvConf([]net.IP{net.ParseIP("1.1.1.1")}, nil); err != nil {
+		t.Fatalf("WriteResolvConf returned an error: %v", err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(fs.Root, "config/resolv.conf"))
+	if err != nil {
+		t.Fatalf("expected the override path to be written: %v", err)
+	}
+	if string(content) != "nameserver 1.1.1.1\n" {
+		t.Errorf("unexpected resolv.conf %q", content)
+	}
+	if _, err := os.Stat(filepath.Join(fs.Root, "etc/resolv.conf")); !os.IsNotExist(err) {
+		t.Error("expected the default path to be left alone")
+	}
+}
+
+func TestWalk(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "usr/bin"), 0755); err != nil {
+		t.Fatalf("failed to create usr/bin: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "usr/bin/sh"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatalf("failed to create usr/bin/sh: %v", err)
+	}
+	if err := os.Symlink("/etc", filepath.Join(root, "hostetc")); err != nil {
+		t.Fatalf("failed to create hostetc symlink: %v", err)
+	}
+
+	fs := &Filesystem{Root: root}
+	var got []string
+	err := fs.Walk(func(relPath string, info os.FileInfo) error {
+		if relPath == "hostetc" && info.Mode()&os.ModeSymlink == 0 {
+			t.Errorf("hostetc reported with mode %v, want a symlink", info.Mode())
+		}
+		got = append(got, relPath)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk returned an error: %v", err)
+	}
+
+	want := []string{"hostetc", "usr", "usr/bin", "usr/bin/sh"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Walk visited %v, want %v", got, want)
+	}
+}
+
+func TestLookPathInRoot(t *testing.T) {
+	root := t.TempDir()
+	name := "spocker-lookpath-test"
+	writeExecutable(t, root, filepath.Join("usr/bin", name), "\x7fELF")
+	if err := os.Symlink("/usr/bin", filepath.Join(root, "sbin")); err != nil {
+		t.Fatalf("failed to create sbin symlink: %v", err)
+	}
+
+	got, err := LookPathInRoot(root, name, "/usr/local/bin:/usr/bin")
+	if err != nil {
+		t.Fatalf("LookPathInRoot returned an error: %v", err)
+	}
+	if got != "/usr/bin/"+name {
+		t.Errorf("LookPathInRoot() = %q, want %q", got, "/usr/bin/"+name)
+	}
+	// The symlink is resolved inside the rootfs, not against the host's /usr/bin
+	if got, err := LookPathInRoot(root, name, "/sbin"); err != nil || got != "/sbin/"+name {
+		t.Errorf("LookPathInRoot() through a symlinked PATH entry = %q, %v", got, err)
+	}
+	if _, err := exec.LookPath(name); err == nil {
+		t.Fatalf("%s unexpectedly exists on the host", name)
+	}
+
+	if _, err := LookPathInRoot(root, "sh", "/usr/bin"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("expected a not found error for a binary missing from the rootfs, got %v", err)
+	}
+	if _, err := LookPathInRoot(root, name, "/bin"); err == nil {
+		t.Error("expected an error when the binary is not on the container's PATH")
+	}
+}
+
+func TestDiskUsage(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "etc/app"), 0755); err != nil {
+		t.Fatalf("failed to create etc/app: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "etc/app/config"), make([]byte, 3000), 0644); err != nil {
+		t.Fatalf("failed to create config: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "data"), make([]byte, 5000), 0644); err != nil {
+		t.Fatalf("failed to create data: %v", err)
+	}
+	// A hard link takes no space of its own
+	if err := os.Link(filepath.Join(root, "data"), filepath.Join(root, "data.link")); err != nil {
+		t.Fatalf("failed to link data: %v", err)
+	}
+	// A sparse file only takes the blocks it has written
+	sparse, err := os.Create(filepath.Join(root, "sparse"))
+	if err != nil {
+		t.Fatalf("failed to create sparse file: %v", err)
+	}
+	if err := sparse.Truncate(1 << 30); err != nil {
+		t.Fatalf("failed to extend sparse file: %v", err)
+	}
+	sparse.Close()
+
+	upper := t.TempDir()
+	if err := os.WriteFile(filepath.Join(upper, "data"), make([]byte, 700), 0644); err != nil {
+		t.Fatalf("failed to create upper data: %v", err)
+	}
+
+	fs := &Filesystem{Root: root, UpperDir: upper}
+	usage, err := fs.DiskUsage()
+	if err != nil {
+		t.Fatalf("DiskUsage returned an error: %v", err)
+	}
+	if usage.SizeRootFs != 8000 {
+		t.Errorf("SizeRootFs = %d, want 8000", usage.SizeRootFs)
+	}
+	if usage.SizeRw != 700 {
+		t.Errorf("SizeRw = %d, want 700", usage.SizeRw)
+	}
+
+	fs.UpperDir = ""
+	usage, err = fs.DiskUsage()
+	if err != nil {
+		t.Fatalf("DiskUsage returned an error: %v", err)
+	}
+	if usage.SizeRw != usage.SizeRootFs {
+		t.Errorf("SizeRw = %d without an upper dir, want the rootfs size %d", usage.SizeRw, usage.SizeRootFs)
+	}
+
+	if os.Geteuid() == 0 {
+		return
+	}
+	// Without root, an unreadable directory is skipped and noted
+	if err := os.Chmod(filepath.Join(root, "etc/app"), 0); err != nil {
+		t.Fatalf("failed to make etc/app unreadable: %v", err)
+	}
+	defer os.Chmod(filepath.Join(root, "etc/app"), 0755)
+	usage, err = fs.DiskUsage()
+	if err != nil {
+		t.Fatalf("DiskUsage returned an error: %v", err)
+	}
+	if usage.SizeRootFs != 5000 || len(usage.Skipped) != 1 {
+		t.Errorf("got SizeRootFs %d and skipped %v, want 5000 with etc/app skipped", usage.SizeRootFs, usage.Skipped)
+	}
+}
+
+// writeTar writes an archive of entries to a file, gzip-compressed if compress is set, and returns its path.
+func writeTar(t *testing.T, compress bool, entries []*tar.Header, contents map[string]string) string {
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(&buf)
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+	for _, hdr := range entries {
+		hdr.Size = int64(len(contents[hdr.Name]))
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(contents[hdr.Name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "image.tar")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestExtractTar(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("gzip=%v", compress), func(t *testing.T) {
+			entries := []*tar.Header{
+				{Name: "./", Typeflag: tar.TypeDir, Mode: 0755},
+				{Name: "./bin/", Typeflag: tar.TypeDir, Mode: 0555},
+				{Name: "./bin/tool", Typeflag: tar.TypeReg, Mode: 0755},
+				{Name: "./bin/alias", Typeflag: tar.TypeLink, Linkname: "./bin/tool"},
+				{Name: "./etc/secret", Typeflag: tar.TypeReg, Mode: 0600},
+				{Name: "./tool", Typeflag: tar.TypeSymlink, Linkname: "/bin/tool"},
+			}
+			contents := map[string]string{"./bin/tool": "#!/bin/sh\n", "./etc/secret": "hidden"}
+			fs := &Filesystem{Root: t.TempDir()}
+			if err := fs.ExtractTar(writeTar(t, compress, entries, contents)); err != nil {
+				t.Fatalf("ExtractTar returned an error: %v", err)
+			}
+
+			for path, want := range map[string]string{"bin/tool": "#!/bin/sh\n", "bin/alias": "#!/bin/sh\n", "etc/secret": "hidden"} {
+				if got, err := os.ReadFile(filepath.Join(fs.Root, path)); err != nil || string(got) != want {
+					t.Errorf("%s contains %q (%v), want %q", path, got, err, want)
+				}
+			}
+			for path, want := range map[string]os.FileMode{"bin": 0555 | os.ModeDir, "bin/tool": 0755, "etc/secret": 0600} {
+				info, err := os.Lstat(filepath.Join(fs.Root, path))
+				if err != nil {
+					t.Fatalf("failed to stat %s: %v", path, err)
+				}
+				if info.Mode() != want {
+					t.Errorf("%s has mode %v, want %v", path, info.Mode(), want)
+				}
+			}
+			if target, err := os.Readlink(filepath.Join(fs.Root, "tool")); err != nil || target != "/bin/tool" {
+				t.Errorf("tool was not extracted as a symlink: %q, %v", target, err)
+			}
+			tool, _ := os.Stat(filepath.Join(fs.Root, "bin/tool"))
+			alias, _ := os.Stat(filepath.Join(fs.Root, "bin/alias"))
+			if !os.SameFile(tool, alias) {
+				t.Error("bin/alias is not a hardlink to bin/tool")
+			}
+		})
+	}
+
+	t.Run("path traversal", func(t *testing.T) {
+		fs := &Filesystem{Root: t.TempDir()}
+		entries := []*tar.Header{{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0644}}
+		err := fs.ExtractTar(writeTar(t, false, entries, nil))
+		if err == nil || !strings.Contains(err.Error(), "escapes the root") {
+			t.Errorf("expected a path traversal error, got %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(filepath.Dir(fs.Root), "escape")); !os.IsNotExist(err) {
+			t.Errorf("entry was written outside the root: %v", err)
+		}
+	})
+
+	t.Run("symlink escape", func(t *testing.T) {
+		outside := t.TempDir()
+		outsideDir := t.TempDir()
+		if err := os.Chmod(outsideDir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		fs := &Filesystem{Root: t.TempDir()}
+		entries := []*tar.Header{
+			{Name: "link", Typeflag: tar.TypeSymlink, Linkname: outside},
+			{Name: "link/file", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "/abs", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "dirlink", Typeflag: tar.TypeSymlink, Linkname: outsideDir},
+			{Name: "dirlink/", Typeflag: tar.TypeDir, Mode: 0777},
+		}
+		if err := fs.ExtractTar(writeTar(t, false, entries, nil)); err != nil {
+			t.Fatalf("ExtractTar returned an error: %v", err)
+		}
+		if info, err := os.Stat(outsideDir); err != nil {
+			t.Fatal(err)
+		} else if info.Mode().Perm() != 0700 {
+			t.Errorf("directory entry changed the mode of a directory outside the root to %v", info.Mode())
+		}
+		if info, err := os.Lstat(filepath.Join(fs.Root, "dirlink")); err != nil {
+			t.Errorf("directory entry was not extracted: %v", err)
+		} else if info.Mode() != os.ModeDir|0777 {
+			t.Errorf("directory entry did not replace the symlink with a directory: %v", info.Mode())
+		}
+		if _, err := os.Stat(filepath.Join(outside, "file")); !os.IsNotExist(err) {
+			t.Errorf("entry was written through a symlink outside the root: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(fs.Root, outside, "file")); err != nil {
+			t.Errorf("entry through the symlink was not kept inside the root: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(fs.Root, "abs")); err != nil {
+			t.Errorf("absolute entry was not extracted relative to the root: %v", err)
+		}
+	})
+}
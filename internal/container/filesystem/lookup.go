@@ -0,0 +1,205 @@
+package filesystem
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultPath is the PATH used to resolve commands inside the container when none is configured.
+const DefaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// maxSymlinks bounds the number of symlinks SecureJoin follows before giving up.
+const maxSymlinks = 255
+
+// maxInterpreterLine matches the kernel's limit on the length of a "#!" line.
+const maxInterpreterLine = 256
+
+// SecureJoin joins unsafePath onto root, resolving symlinks as if root were the filesystem root.
+// Absolute symlink targets and ".." components are evaluated relative to root, so the result never escapes it.
+func SecureJoin(root, unsafePath string) (string, error) {
+	current := "/"
+	links := 0
+	for unsafePath != "" {
+		var part string
+		if i := strings.IndexByte(unsafePath, '/'); i >= 0 {
+			part, unsafePath = unsafePath[:i], unsafePath[i+1:]
+		} else {
+			part, unsafePath = unsafePath, ""
+		}
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			current = filepath.Dir(current)
+			continue
+		}
+
+		next := filepath.Join(current, part)
+		info, err := os.Lstat(filepath.Join(root, next))
+		if err != nil {
+			if os.IsNotExist(err) {
+				current = next
+				continue
+			}
+			return "", fmt.Errorf("failed to stat %s: %v", next, err)
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links resolving %s", next)
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", fmt.Errorf("failed to read symlink %s: %v", next, err)
+		}
+		if filepath.IsAbs(target) {
+			current = "/"
+		}
+		unsafePath = target + "/" + unsafePath
+	}
+
+	return filepath.Join(root, current), nil
+}
+
+// LookPathInRoot searches for an executable named name in the rootfs at root, honoring the container's PATH,
+// like Filesystem.LookPath. Each PATH entry is joined onto root with SecureJoin, so symlinks in the rootfs are
+// resolved inside it rather than on the host. The returned path is relative to the container.
+func LookPathInRoot(root string, name string, pathEnv string) (string, error) {
+	return (&Filesystem{Root: root}).LookPath(name, pathEnv)
+}
+
+// LookPath searches for an executable named name inside the filesystem, honoring the container's PATH.
+// Names containing a slash are resolved directly against the root. The returned path is relative to the
+// container, e.g. "/usr/bin/sh".
+func (fs *Filesystem) LookPath(name string, pathEnv string) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("empty command name")
+	}
+
+	if strings.Contains(name, "/") {
+		containerPath := filepath.Join("/", name)
+		if err := fs.checkExecutable(containerPath); err != nil {
+			return "", fmt.Errorf("executable %s not found in container rootfs: %v", name, err)
+		}
+		return containerPath, nil
+	}
+
+	if pathEnv == "" {
+		pathEnv = DefaultPath
+	}
+	for _, dir := range filepath.SplitList(pathEnv) {
+		if dir == "" {
+			dir = "."
+		}
+		containerPath := filepath.Join("/", dir, name)
+		if err := fs.checkExecutable(containerPath); err == nil {
+			return containerPath, nil
+		}
+	}
+
+	return "", fmt.Errorf("executable %s not found in container rootfs PATH %s", name, pathEnv)
+}
+
+// ValidateCommand checks that the command can be executed inside the filesystem.
+// Besides resolving the command itself, it verifies that the interpreter named by a "#!" line exists,
+// since a missing interpreter fails with the same opaque "no such file or directory" error at exec time.
+func (fs *Filesystem) ValidateCommand(name string, pathEnv string) (string, error) {
+	containerPath, err := fs.LookPath(name, pathEnv)
+	if err != nil {
+		return "", err
+	}
+
+	interpreter, err := fs.readInterpreter(containerPath)
+	if err != nil {
+		return "", err
+	}
+	if interpreter == nil {
+		return containerPath, nil
+	}
+
+	if _, err := fs.LookPath(interpreter[0], pathEnv); err != nil {
+		return "", fmt.Errorf("interpreter %s for %s not found in container rootfs", interpreter[0], containerPath)
+	}
+	// "#!/usr/bin/env prog" defers the lookup to PATH, so the real interpreter must be on it too.
+	if filepath.Base(interpreter[0]) == "env" && len(interpreter) > 1 {
+		if _, err := fs.LookPath(interpreter[1], pathEnv); err != nil {
+			return "", fmt.Errorf("interpreter %s for %s not found in container rootfs PATH", interpreter[1], containerPath)
+		}
+	}
+
+	return containerPath, nil
+}
+
+// checkExecutable returns an error unless the container path resolves to an executable regular file.
+func (fs *Filesystem) checkExecutable(containerPath string) error {
+	hostPath, err := SecureJoin(fs.Root, containerPath)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(hostPath)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", containerPath)
+	}
+	if info.Mode().Perm()&0111 == 0 {
+		return fmt.Errorf("%s is not executable", containerPath)
+	}
+	return nil
+}
+
+// readInterpreter returns the interpreter and its argument from the file's "#!" line, or nil if it has none.
+func (fs *Filesystem) readInterpreter(containerPath string) ([]string, error) {
+	hostPath, err := SecureJoin(fs.Root, containerPath)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(hostPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", containerPath, err)
+	}
+	defer f.Close()
+
+	line, err := bufio.NewReader(io.LimitReader(f, maxInterpreterLine)).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read %s: %v", containerPath, err)
+	}
+	if !strings.HasPrefix(line, "#!") {
+		return nil, nil
+	}
+
+	fields := strings.Fields(strings.TrimPrefix(line, "#!"))
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty interpreter line in %s", containerPath)
+	}
+	return fields, nil
+}
+
+// Walk calls fn for every file under the root, in lexical order, with its path relative to the root
+// (e.g. "etc/passwd") and its Lstat info. Symlinks are reported as symlinks and never followed, so the walk
+// cannot leave the root. Returning filepath.SkipDir from fn for a directory skips its contents.
+func (fs *Filesystem) Walk(fn func(relPath string, info os.FileInfo) error) error {
+	return filepath.Walk(fs.Root, func(hostPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if hostPath == fs.Root {
+			return nil
+		}
+		relPath, err := filepath.Rel(fs.Root, hostPath)
+		if err != nil {
+			return err
+		}
+		return fn(relPath, info)
+	})
+}
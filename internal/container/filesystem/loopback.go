@@ -0,0 +1,162 @@
+package filesystem
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// MinLoopbackSize is the smallest image CreateLoopbackFS makes; mkfs.ext4 needs room for its metadata.
+const MinLoopbackSize = 4 << 20
+
+// loopAttachAttempts bounds how often AttachLoopDevice asks for another free device when the one it was given is
+// taken by someone else before it could attach to it.
+const loopAttachAttempts = 5
+
+// sysBlockDir is where the kernel lists block devices, each loop device with its backing file.
+var sysBlockDir = "/sys/block"
+
+// LoopDevice is a loop device and the file it is attached to.
+type LoopDevice struct {
+	Device      string
+	BackingFile string
+}
+
+// CreateLoopbackFS creates an ext4 image of sizeBytes at path and attaches it to a free loop device, which it
+// returns for mounting, e.g. as a container's writable layer. The file is sparse, so it only takes up the space
+// written to it, but the filesystem on it can never grow past sizeBytes. The image must not exist yet. If any step
+// fails, the image is removed again.
+func CreateLoopbackFS(path string, sizeBytes int64) (device string, err error) {
+	if sizeBytes < MinLoopbackSize {
+		return "", fmt.Errorf("invalid loopback image size %d: must be at least %d bytes", sizeBytes, MinLoopbackSize)
+	}
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		return "", fmt.Errorf("mkfs.ext4 is needed for loopback images: %v", err)
+	}
+
+	image, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", fmt.Errorf("failed to create loopback image %s: %v", path, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(path)
+		}
+	}()
+	err = image.Truncate(sizeBytes)
+	if closeErr := image.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to size loopback image %s: %v", path, err)
+	}
+
+	if out, err := exec.Command("mkfs.ext4", "-q", "-F", path).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("failed to create filesystem on %s: %v: %s", path, err, strings.TrimSpace(string(out)))
+	}
+	return AttachLoopDevice(path)
+}
+
+// AttachLoopDevice attaches the file at path to a free loop device and returns the device.
+func AttachLoopDevice(path string) (string, error) {
+	backing, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer backing.Close()
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %v", path, err)
+	}
+
+	control, err := os.OpenFile("/dev/loop-control", os.O_RDWR, 0)
+	if err != nil {
+		return "", fmt.Errorf("failed to open loop control device: %v", err)
+	}
+	defer control.Close()
+
+	for attempt := 0; attempt < loopAttachAttempts; attempt++ {
+		index, err := unix.IoctlRetInt(int(control.Fd()), unix.LOOP_CTL_GET_FREE)
+		if err != nil {
+			if errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.ENODEV) {
+				return "", fmt.Errorf("no free loop device: all are in use (%v)", err)
+			}
+			return "", fmt.Errorf("failed to find a free loop device: %v", err)
+		}
+		device := fmt.Sprintf("/dev/loop%d", index)
+		loop, err := os.OpenFile(device, os.O_RDWR, 0)
+		if err != nil {
+			return "", fmt.Errorf("failed to open %s: %v", device, err)
+		}
+
+		err = unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_SET_FD, int(backing.Fd()))
+		if errors.Is(err, syscall.EBUSY) {
+			// Someone else took the device between finding and attaching it
+			loop.Close()
+			continue
+		}
+		if err != nil {
+			loop.Close()
+			return "", fmt.Errorf("failed to attach %s to %s: %v", path, device, err)
+		}
+
+		info := &unix.LoopInfo64{}
+		copy(info.File_name[:], absPath)
+		if err := unix.IoctlLoopSetStatus64(int(loop.Fd()), info); err != nil {
+			_ = unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_CLR_FD, 0)
+			loop.Close()
+			return "", fmt.Errorf("failed to set up %s: %v", device, err)
+		}
+		loop.Close()
+		return device, nil
+	}
+	return "", fmt.Errorf("failed to attach %s: every free loop device was taken first", path)
+}
+
+// DetachLoopDevice detaches device from its backing file. A device that is not attached is left alone. A device
+// that is still mounted is detached by the kernel once it is unmounted.
+func DetachLoopDevice(device string) error {
+	loop, err := os.OpenFile(device, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", device, err)
+	}
+	defer loop.Close()
+	if err := unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_CLR_FD, 0); err != nil && !errors.Is(err, syscall.ENXIO) {
+		return fmt.Errorf("failed to detach %s: %v", device, err)
+	}
+	return nil
+}
+
+// ListLoopDevices returns the attached loop devices, or none without sysfs. A backing file that has been removed
+// since it was attached keeps its path, with the " (deleted)" suffix the kernel gives it trimmed.
+func ListLoopDevices() ([]LoopDevice, error) {
+	entries, err := os.ReadDir(sysBlockDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list block devices: %v", err)
+	}
+	var devices []LoopDevice
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), "loop") {
+			continue
+		}
+		// Only attached devices have a backing file
+		backing, err := os.ReadFile(filepath.Join(sysBlockDir, entry.Name(), "loop", "backing_file"))
+		if err != nil {
+			continue
+		}
+		devices = append(devices, LoopDevice{
+			Device:      "/dev/" + entry.Name(),
+			BackingFile: strings.TrimSuffix(strings.TrimSpace(string(backing)), " (deleted)"),
+		})
+	}
+	return devices, nil
+}
@@ -0,0 +1,136 @@
+package filesystem
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// overlayParametersDir is where the overlay module exposes its parameters, one file per optional feature.
+var overlayParametersDir = "/sys/module/overlay/parameters"
+
+// OverlayOptions enables optional overlayfs features. All of them are off by default.
+type OverlayOptions struct {
+	// Metacopy copies up only metadata on chmod/chown, deferring the data copy until the file is written.
+	Metacopy bool
+	// RedirectDir lets directories be renamed without copying up their whole contents.
+	RedirectDir bool
+	// Volatile skips all syncs to the upper layer. It is faster, but the upper layer is unusable after a crash.
+	Volatile bool
+}
+
+// MountOverlay mounts an overlay of upper on top of lower at merged, using work as the overlay work directory.
+func (fs *Filesystem) MountOverlay(lower, upper, work, merged string) error {
+	return fs.MountOverlayWithOptions(lower, upper, work, merged, nil)
+}
+
+// MountOverlayWithOptions mounts an overlay like MountOverlay, enabling the optional features set in options.
+// It returns an error if a requested feature is not supported by the running kernel.
+func (fs *Filesystem) MountOverlayWithOptions(lower, upper, work, merged string, options *OverlayOptions) error {
+	if err := checkOverlayDirs(lower, upper, work, merged); err != nil {
+		return err
+	}
+	data, err := overlayMountData(lower, upper, work, options, overlayFeatureSupported)
+	if err != nil {
+		return err
+	}
+	if err := syscall.Mount("overlay", merged, "overlay", 0, data); err != nil {
+		return fmt.Errorf("failed to mount overlay at %s: %v", merged, err)
+	}
+	return nil
+}
+
+// UnmountOverlay unmounts the overlay mounted at merged.
+func (fs *Filesystem) UnmountOverlay(merged string) error {
+	if err := syscall.Unmount(merged, 0); err != nil {
+		return fmt.Errorf("failed to unmount overlay at %s: %v", merged, err)
+	}
+	return nil
+}
+
+// checkOverlayDirs returns an error naming the first overlay directory that does not exist or is not a directory.
+// The mount itself fails with a bare ENOENT or ENOTDIR that does not say which one is wrong. lower may list several
+// layers separated by colons.
+func checkOverlayDirs(lower, upper, work, merged string) error {
+	type overlayDir struct {
+		name string
+		path string
+	}
+	var dirs []overlayDir
+	for _, layer := range strings.Split(lower, ":") {
+		dirs = append(dirs, overlayDir{"lower", layer})
+	}
+	dirs = append(dirs, overlayDir{"upper", upper}, overlayDir{"work", work}, overlayDir{"merged", merged})
+
+	for _, dir := range dirs {
+		info, err := os.Stat(dir.path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return fmt.Errorf("overlay %s directory does not exist: %s", dir.name, dir.path)
+			}
+			return fmt.Errorf("failed to stat overlay %s directory %s: %v", dir.name, dir.path, err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("overlay %s directory is not a directory: %s", dir.name, dir.path)
+		}
+	}
+	return nil
+}
+
+// overlayMountData assembles the overlay mount option string, checking each requested feature with supported.
+func overlayMountData(lower, upper, work string, options *OverlayOptions, supported func(feature string) bool) (string, error) {
+	opts := []string{
+		"lowerdir=" + lower,
+		"upperdir=" + upper,
+		"workdir=" + work,
+	}
+	if options == nil {
+		return strings.Join(opts, ","), nil
+	}
+
+	for _, feature := range []struct {
+		name    string
+		enabled bool
+		option  string
+	}{
+		{"redirect_dir", options.RedirectDir, "redirect_dir=on"},
+		{"metacopy", options.Metacopy, "metacopy=on"},
+		{"volatile", options.Volatile, "volatile"},
+	} {
+		if !feature.enabled {
+			continue
+		}
+		if !supported(feature.name) {
+			return "", fmt.Errorf("overlay option %s is not supported by this kernel", feature.name)
+		}
+		opts = append(opts, feature.option)
+	}
+	return strings.Join(opts, ","), nil
+}
+
+// overlayFeatureSupported reports whether the running kernel's overlayfs supports the named feature.
+// Features with a module parameter are probed through it; volatile has none and needs Linux 5.10 or later.
+func overlayFeatureSupported(feature string) bool {
+	if feature == "volatile" {
+		return kernelAtLeast(5, 10)
+	}
+	_, err := os.Stat(filepath.Join(overlayParametersDir, feature))
+	return err == nil
+}
+
+// kernelAtLeast reports whether the running kernel's version is at least major.minor.
+func kernelAtLeast(major, minor int) bool {
+	var uname unix.Utsname
+	if err := unix.Uname(&uname); err != nil {
+		return false
+	}
+	var gotMajor, gotMinor int
+	if _, err := fmt.Sscanf(unix.ByteSliceToString(uname.Release[:]), "%d.%d", &gotMajor, &gotMinor); err != nil {
+		return false
+	}
+	return gotMajor > major || (gotMajor == major && gotMinor >= minor)
+}
@@ -0,0 +1,101 @@
+package filesystem
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// DiskUsage is the disk space taken by a container's filesystem, in bytes.
+type DiskUsage struct {
+	// SizeRw is the space taken by the container's writable layer, and SizeRootFs by its whole rootfs.
+	SizeRw     int64
+	SizeRootFs int64
+	// Skipped lists the paths that could not be read, with the reason; they are left out of the sizes.
+	Skipped []string
+}
+
+// DiskUsage reports the disk space taken by the filesystem. The writable layer is UpperDir if the root is an
+// overlay mount; otherwise the root itself is written to, and SizeRw is the size of the whole rootfs. Only files
+// are counted, not directories. A file counts with the blocks it occupies when that is less than its size, so
+// sparse files are not overcounted, and hard links count once. Mounts below the root, such as /proc, are not
+// descended into. Files that cannot be read, e.g. for lack of permission, are skipped and noted in Skipped.
+func (fs *Filesystem) DiskUsage() (*DiskUsage, error) {
+	usage := &DiskUsage{}
+	size, err := treeSize(fs.Root, usage)
+	if err != nil {
+		return nil, err
+	}
+	usage.SizeRootFs = size
+
+	if fs.UpperDir == "" {
+		usage.SizeRw = size
+		return usage, nil
+	}
+	if usage.SizeRw, err = treeSize(fs.UpperDir, usage); err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// treeSize returns the disk space taken by the tree at root, without crossing into other filesystems. Paths that
+// cannot be read are noted in usage.Skipped.
+func treeSize(root string, usage *DiskUsage) (int64, error) {
+	rootInfo, err := os.Lstat(root)
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat %s: %v", root, err)
+	}
+	rootStat, ok := rootInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("failed to read device of %s", root)
+	}
+
+	type inode struct{ dev, ino uint64 }
+	seen := map[inode]bool{}
+	var size int64
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// A file removed while walking takes no space any more
+			if !os.IsNotExist(err) {
+				usage.Skipped = append(usage.Skipped, fmt.Sprintf("%s: %v", path, err))
+			}
+			return nil
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return nil
+		}
+		if uint64(stat.Dev) != uint64(rootStat.Dev) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if stat.Nlink > 1 {
+			key := inode{uint64(stat.Dev), uint64(stat.Ino)}
+			if seen[key] {
+				return nil
+			}
+			seen[key] = true
+		}
+		size += fileSize(info.Size(), stat.Blocks)
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to walk %s: %v", root, err)
+	}
+	return size, nil
+}
+
+// fileSize is the space a file of the given size takes in the given number of 512-byte blocks: its size, unless
+// the file is sparse and occupies less.
+func fileSize(size, blocks int64) int64 {
+	if allocated := blocks * 512; allocated < size {
+		return allocated
+	}
+	return size
+}
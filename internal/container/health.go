@@ -0,0 +1,164 @@
+package container
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"spocker/internal/container/process"
+)
+
+// These defaults apply when a HealthCheck leaves its timing unset.
+const (
+	DefaultHealthInterval = time.Second
+	DefaultHealthTimeout  = 5 * time.Second
+)
+
+// HealthChecker runs a single health probe against a container, returning nil if it is healthy.
+type HealthChecker interface {
+	Check(ctx context.Context) error
+}
+
+// HealthCheck configures how and how often a container's health is probed.
+type HealthCheck struct {
+	Command  []string
+	Interval time.Duration
+	Timeout  time.Duration
+	// Checker overrides the default probe, which runs Command inside the container as Exec does. It cannot be sent
+	// to the daemon.
+	Checker HealthChecker `json:"-"`
+}
+
+// CommandHealthChecker probes health by running a command in the running container with the given ID, as Exec
+// does: it joins the container's namespaces, so it sees the container's rootfs, processes, and network, and is
+// limited to its cgroup and capabilities.
+type CommandHealthChecker struct {
+	ID      string
+	Command []string
+}
+
+// Check runs the health command and treats a zero exit status as healthy.
+func (c *CommandHealthChecker) Check(ctx context.Context) error {
+	if len(c.Command) == 0 {
+		return fmt.Errorf("empty health check command")
+	}
+
+	var stderr bytes.Buffer
+	spec := &process.ProcessSpec{Path: c.Command[0], Args: c.Command[1:]}
+	code, err := runExec(ctx, c.ID, spec, false, nil, io.Discard, &stderr)
+	if err != nil {
+		return fmt.Errorf("health check %v failed: %v", c.Command, err)
+	}
+	if code != 0 {
+		return fmt.Errorf("health check %v failed with exit code %d: %s", c.Command, code, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// checker returns the health checker to use for the container with the given ID.
+func (hc *HealthCheck) checker(id string) HealthChecker {
+	if hc.Checker != nil {
+		return hc.Checker
+	}
+	return &CommandHealthChecker{ID: id, Command: hc.Command}
+}
+
+// awaitHealthy probes the container with the given ID until a check succeeds, the start period elapses, or ctx is
+// done.
+func awaitHealthy(ctx context.Context, hc *HealthCheck, id string, startPeriod time.Duration) error {
+	interval := hc.Interval
+	if interval <= 0 {
+		interval = DefaultHealthInterval
+	}
+	timeout := hc.Timeout
+	if timeout <= 0 {
+		timeout = DefaultHealthTimeout
+	}
+	checker := hc.checker(id)
+
+	deadline := time.NewTimer(startPeriod)
+	defer deadline.Stop()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var lastErr error
+	for {
+		checkCtx, cancel := context.WithTimeout(ctx, timeout)
+		lastErr = checker.Check(checkCtx)
+		cancel()
+		if lastErr == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("container exited before becoming healthy: %v", lastErr)
+		case <-deadline.C:
+			return fmt.Errorf("container did not become healthy within %s: %v", startPeriod, lastErr)
+		case <-ticker.C:
+		}
+	}
+}
+
+// cancelStopTimeout is how long waitContainer gives a cancelled container to exit after its stop signal before
+// killing it.
+var cancelStopTimeout = DefaultStopTimeout
+
+// waitContainer waits for the started container process to exit and returns its final state.
+// When the config asks for it, a container that does not become healthy within the start period is
+// killed and reported as a failed start. The process was not started with ctx, so it is stopped here if ctx is
+// done before it exits: it is sent its stop signal, and killed if it is still running after cancelStopTimeout.
+func waitContainer(ctx context.Context, cmd *exec.Cmd, config *Config) (*os.ProcessState, error) {
+	waitCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type waitResult struct {
+		state *os.ProcessState
+		err   error
+	}
+	waitDone := make(chan waitResult, 1)
+	go func() {
+		processState, err := cmd.Process.Wait()
+		cancel()
+		waitDone <- waitResult{processState, err}
+	}()
+
+	if config.HealthCheck != nil && config.HealthExitOnUnhealthy {
+		if err := awaitHealthy(waitCtx, config.HealthCheck, config.ID, config.StartPeriod); err != nil && ctx.Err() == nil {
+			_ = cmd.Process.Kill()
+			result := <-waitDone
+			return result.state, err
+		}
+	}
+
+	<-waitCtx.Done()
+	if ctx.Err() != nil {
+		sig := process.DefaultStopSignal
+		if config.StopSignal != "" {
+			if parsed, err := process.ParseSignal(config.StopSignal); err == nil {
+				sig = parsed
+			}
+		}
+		_ = cmd.Process.Signal(sig)
+		timer := time.NewTimer(cancelStopTimeout)
+		defer timer.Stop()
+		select {
+		case result := <-waitDone:
+			waitDone <- result
+		case <-timer.C:
+			_ = cmd.Process.Kill()
+		}
+	}
+	result := <-waitDone
+	if result.err != nil {
+		return nil, fmt.Errorf("failed to wait for command: %v", result.err)
+	}
+	if ctx.Err() != nil {
+		return result.state, fmt.Errorf("container was cancelled: %v", ctx.Err())
+	}
+	return result.state, nil
+}
@@ -0,0 +1,203 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"spocker/internal/container/cgroup"
+	"spocker/internal/container/filesystem"
+	"spocker/internal/container/network"
+	"spocker/internal/container/process"
+)
+
+// inspectWorkers bounds how many containers InspectAll gathers stats for at the same time.
+const inspectWorkers = 8
+
+// ContainerInfo is a container's state together with what is currently observed about it. Errors lists what could
+// not be read for the container; the rest of its info is still filled in as far as possible.
+type ContainerInfo struct {
+	*ContainerState
+	// Running reports whether the container's recorded process is still alive.
+	Running bool `json:"running"`
+	// MemoryUsage is the memory the container's cgroup currently uses, in bytes.
+	MemoryUsage uint64 `json:"memoryUsage,omitempty"`
+	// NetStats are the traffic counters of the container's host-side interface, if it is running with one.
+	NetStats *network.NetStats `json:"netStats,omitempty"`
+	// SizeRw and SizeRootFs are the disk space taken by the container's writable layer and its whole rootfs, in
+	// bytes. They are only gathered when asked for, since it takes walking the rootfs.
+	SizeRw     int64    `json:"sizeRw,omitempty"`
+	SizeRootFs int64    `json:"sizeRootFs,omitempty"`
+	Errors     []string `json:"errors,omitempty"`
+}
+
+// addError records that part of the container's info could not be gathered.
+func (info *ContainerInfo) addError(err error) {
+	info.Errors = append(info.Errors, err.Error())
+}
+
+// InspectAll returns the info of every container in StateDir, ordered by ID, in one pass: the state store is read
+// once, the liveness of every container's process is checked together, and cgroup and network stats are gathered
+// for several containers at a time. A container whose state or stats cannot be read is still returned, with what
+// went wrong in its Errors, so one broken container does not hide the others. With size set, the disk space of
+// every container's rootfs is gathered too.
+func InspectAll(size bool) ([]*ContainerInfo, error) {
+	entries, err := os.ReadDir(StateDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list containers: %v", err)
+	}
+
+	var infos []*ContainerInfo
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(StateDir, entry.Name(), stateFileName)); os.IsNotExist(err) {
+			continue
+		}
+		state, err := LoadState(entry.Name())
+		if err != nil {
+			info := &ContainerInfo{ContainerState: &ContainerState{ID: entry.Name()}}
+			info.addError(err)
+			infos = append(infos, info)
+			continue
+		}
+		infos = append(infos, &ContainerInfo{ContainerState: state})
+	}
+
+	live := liveProcesses()
+	for _, info := range infos {
+		if info.PID != 0 && info.Status == StatusRunning {
+			startTime, ok := live[info.PID]
+			info.Running = ok && (info.StartTime == 0 || startTime == info.StartTime)
+		}
+	}
+
+	gatherAll(infos, func(info *ContainerInfo) {
+		gatherStats(info)
+		if size {
+			gatherSize(info)
+		}
+	})
+	return infos, nil
+}
+
+// Inspect returns the info of the container with the given ID, like InspectAll does for every container.
+func Inspect(id string, size bool) (*ContainerInfo, error) {
+	state, err := LoadState(id)
+	if err != nil {
+		return nil, err
+	}
+	info := &ContainerInfo{ContainerState: state, Running: checkRunning(state) == nil}
+	gatherStats(info)
+	if size {
+		gatherSize(info)
+	}
+	return info, nil
+}
+
+// liveProcesses returns the start time of every process in /proc, keyed by PID. Processes that exit while /proc is
+// being read are left out.
+func liveProcesses() map[int]uint64 {
+	live := map[int]uint64{}
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return live
+	}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		if startTime, err := process.ProcessStartTime(pid); err == nil {
+			live[pid] = startTime
+		}
+	}
+	return live
+}
+
+// gatherAll calls gather for every container, on at most inspectWorkers containers at the same time.
+func gatherAll(infos []*ContainerInfo, gather func(info *ContainerInfo)) {
+	work := make(chan *ContainerInfo)
+	var wg sync.WaitGroup
+	for i := 0; i < inspectWorkers && i < len(infos); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for info := range work {
+				gather(info)
+			}
+		}()
+	}
+	for _, info := range infos {
+		work <- info
+	}
+	close(work)
+	wg.Wait()
+}
+
+// gatherStats fills in the container's cgroup and network stats, recording what cannot be read in its Errors.
+func gatherStats(info *ContainerInfo) {
+	if info.CgroupPath != "" {
+		usage, err := memoryUsage(info.CgroupPath)
+		if err != nil {
+			info.addError(err)
+		} else {
+			info.MemoryUsage = usage
+		}
+	}
+	if info.Running && info.Network != nil && info.Network.Interface != "" {
+		stats, err := network.InterfaceStats(info.Network.Interface)
+		if err != nil {
+			info.addError(err)
+		} else {
+			info.NetStats = stats
+		}
+	}
+}
+
+// gatherSize fills in the disk space taken by the container's rootfs, recording what cannot be read in its Errors.
+func gatherSize(info *ContainerInfo) {
+	if info.Rootfs == "" {
+		return
+	}
+	fs := &filesystem.Filesystem{Root: info.Rootfs, UpperDir: info.UpperDir}
+	usage, err := fs.DiskUsage()
+	if err != nil {
+		info.addError(err)
+		return
+	}
+	info.SizeRw = usage.SizeRw
+	info.SizeRootFs = usage.SizeRootFs
+	for _, skipped := range usage.Skipped {
+		info.Errors = append(info.Errors, "skipped "+skipped)
+	}
+}
+
+// memoryUsage reads the memory usage of the cgroup at cgroupPath, which is the cgroup's directory under its root.
+// On cgroup v1 the usage is kept by the memory controller's hierarchy, next to the cgroup's directory.
+func memoryUsage(cgroupPath string) (uint64, error) {
+	version, err := cgroup.CgroupVersion()
+	if err != nil {
+		return 0, err
+	}
+	usageFile := filepath.Join(cgroupPath, "memory.current")
+	if version == 1 {
+		usageFile = filepath.Join(filepath.Dir(cgroupPath), "memory", filepath.Base(cgroupPath), "memory.usage_in_bytes")
+	}
+	data, err := os.ReadFile(usageFile)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read memory usage: %v", err)
+	}
+	usage, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid memory usage in %s: %v", usageFile, err)
+	}
+	return usage, nil
+}
@@ -0,0 +1,465 @@
+package container
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"spocker/internal/container/filesystem"
+	"spocker/internal/container/network"
+	"spocker/internal/container/process"
+
+	"golang.org/x/sys/unix"
+)
+
+// NetworkLabel is the label whose value puts containers on a shared network: JoinLabeledNetwork attaches every
+// container with the same value for it, e.g. app=web for NetworkLabel "app", to the same bridge, and the containers
+// can reach each other by ID. Empty, the default, turns labeled networks off.
+var NetworkLabel = ""
+
+// ResolverCommand is the argument spocker re-executes itself with to run the resolver of a labeled network; the
+// main binary must call ServeLabeledNetwork when it sees it.
+const ResolverCommand = "resolve"
+
+// labeledSubnets is the range the subnets of labeled networks are taken from, a /24 for each network.
+var labeledSubnets = &net.IPNet{IP: net.IPv4(10, 88, 0, 0).To4(), Mask: net.CIDRMask(16, 32)}
+
+// labeledNetworksDir is the directory in StateDir holding a record of each labeled network.
+const labeledNetworksDir = ".networks"
+
+// labeledNetwork is the record of the network shared by the containers with one value of NetworkLabel.
+type labeledNetwork struct {
+	Bridge string `json:"bridge"`
+	// Label is the key=value pair the network is for.
+	Label  string `json:"label"`
+	Subnet string `json:"subnet"`
+	// Members maps the ID of every container on the network to its address.
+	Members map[string]string `json:"members"`
+	// ResolverPID and ResolverStartTime identify the process serving DNS for the network on its gateway address.
+	ResolverPID       int    `json:"resolverPid,omitempty"`
+	ResolverStartTime uint64 `json:"resolverStartTime,omitempty"`
+}
+
+// JoinLabeledNetwork attaches the container with the given ID to the network for its value of NetworkLabel in
+// labels, creating the network if it is the first container with that value. The container gets an interface on
+// the network's bridge, and the hosts files of all the network's containers are rewritten so each resolves the
+// others by ID. The network's resolver, which also knows the containers' aliases, is started on the gateway address
+// if it is not running, and the container's resolv.conf points at it. Nothing is done when NetworkLabel is unset or
+// labels do not have it, or when the container is on the network already. The container must have a process, i.e.
+// be created or running.
+func JoinLabeledNetwork(id string, labels map[string]string) (err error) {
+	value, ok := labels[NetworkLabel]
+	if NetworkLabel == "" || !ok {
+		return nil
+	}
+	state, err := LoadState(id)
+	if err != nil {
+		return err
+	}
+	if state.PID == 0 {
+		return fmt.Errorf("container %s has no process to attach to a network", id)
+	}
+
+	unlock, err := lockLabeledNetworks()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	networks, err := loadLabeledNetworks()
+	if err != nil {
+		return err
+	}
+
+	label := NetworkLabel + "=" + value
+	ln := networks[labeledBridgeName(label)]
+	if ln == nil {
+		subnet, err := freeLabeledSubnet(networks)
+		if err != nil {
+			return err
+		}
+		ln = &labeledNetwork{Bridge: labeledBridgeName(label), Label: label, Subnet: subnet.String(), Members: map[string]string{}}
+	}
+	if _, ok := ln.Members[id]; ok {
+		return nil
+	}
+
+	_, subnet, err := net.ParseCIDR(ln.Subnet)
+	if err != nil {
+		return fmt.Errorf("invalid subnet %q of network %s: %v", ln.Subnet, ln.Label, err)
+	}
+	gateway := hostAddress(subnet, 1)
+	allocator := ipAllocator(subnet, gateway)
+	ip, err := allocator.Allocate()
+	if err != nil {
+		return fmt.Errorf("failed to allocate an address on network %s: %v", ln.Label, err)
+	}
+	hostVeth, err := attachLabeledNetwork(ln, state.PID, id, subnet, ip)
+	if err != nil {
+		_ = allocator.Release(ip)
+		return err
+	}
+
+	// From here on a failure takes the container off the network again, so neither its address nor its veth is lost
+	ln.Members[id] = ip.String()
+	defer func() {
+		if err != nil {
+			_ = network.DeleteVeth(hostVeth)
+			_ = ln.leave(id)
+		}
+	}()
+	if err := ln.startResolver(gateway); err != nil {
+		return err
+	}
+	if err := saveLabeledNetwork(ln); err != nil {
+		return err
+	}
+	if err := ln.writeHosts(); err != nil {
+		return err
+	}
+	if state.Rootfs == "" || state.Rootfs == "/" {
+		return nil
+	}
+	fs := &filesystem.Filesystem{Root: state.Rootfs}
+	if err := fs.WriteResolvConf([]net.IP{gateway}, nil); err != nil {
+		return fmt.Errorf("failed to point container %s at the resolver of network %s: %v", id, ln.Label, err)
+	}
+	return nil
+}
+
+// attachLabeledNetwork gives the process with the given PID, of the container with the given ID, an interface with
+// address ip on the network's bridge, creating the bridge if need be. It returns the name of the host end of the
+// interface's veth pair.
+func attachLabeledNetwork(ln *labeledNetwork, pid int, id string, subnet *net.IPNet, ip net.IP) (string, error) {
+	gateway := hostAddress(subnet, 1)
+	if _, err := network.EnsureBridge(ln.Bridge, &net.IPNet{IP: gateway, Mask: subnet.Mask}); err != nil {
+		return "", fmt.Errorf("failed to create network %s: %v", ln.Label, err)
+	}
+	hostVeth, _, err := network.VethNames(id)
+	if err != nil {
+		return "", err
+	}
+	ifName, err := network.FreeInterfaceName(pid, "eth")
+	if err != nil {
+		return "", err
+	}
+	if err := network.AttachToBridgeNamespace(ln.Bridge, pid, hostVeth, ifName, &net.IPNet{IP: ip, Mask: subnet.Mask}); err != nil {
+		return "", fmt.Errorf("failed to attach container %s to network %s: %v", id, ln.Label, err)
+	}
+	return hostVeth, nil
+}
+
+// leaveLabeledNetworks takes the container with the given ID off the labeled networks it is on. The container's own
+// interface goes away with its network namespace.
+func leaveLabeledNetworks(id string) error {
+	unlock, err := lockLabeledNetworks()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	networks, err := loadLabeledNetworks()
+	if err != nil {
+		return err
+	}
+
+	for _, ln := range networks {
+		if err := ln.leave(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// leave takes the container with the given ID off the network, if it is on it, rewriting the hosts files of the
+// containers that stay, and returns its address to the IP ledger. A network without containers left is deleted along
+// with its bridge and resolver. The caller holds the lock on the network records.
+func (ln *labeledNetwork) leave(id string) error {
+	ip, ok := ln.Members[id]
+	if !ok {
+		return nil
+	}
+	delete(ln.Members, id)
+	if _, subnet, err := net.ParseCIDR(ln.Subnet); err == nil {
+		if err := ipAllocator(subnet, hostAddress(subnet, 1)).Release(net.ParseIP(ip)); err != nil {
+			return err
+		}
+	}
+
+	if len(ln.Members) == 0 {
+		ln.stopResolver()
+		if err := network.DeleteBridge(ln.Bridge); err != nil {
+			return err
+		}
+		if err := os.Remove(filepath.Join(StateDir, labeledNetworksDir, ln.Bridge+".json")); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove network %s: %v", ln.Label, err)
+		}
+		return nil
+	}
+	if err := saveLabeledNetwork(ln); err != nil {
+		return err
+	}
+	return ln.writeHosts()
+}
+
+// writeHosts rewrites the hosts file of every container on the network with an entry for each of the others.
+// Containers that share the host's root have no hosts file of their own and are left alone. Every container's file
+// is written even if another's fails; the first error is returned.
+func (ln *labeledNetwork) writeHosts() error {
+	var firstErr error
+	for id := range ln.Members {
+		state, err := LoadState(id)
+		if err != nil {
+			continue
+		}
+		if state.Rootfs == "" || state.Rootfs == "/" {
+			continue
+		}
+		entries := map[string]net.IP{}
+		for other, ip := range ln.Members {
+			if other != id {
+				entries[other] = net.ParseIP(ip)
+			}
+		}
+		fs := &filesystem.Filesystem{Root: state.Rootfs}
+		if err := fs.WriteHostsFile(state.hostname(), entries); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to update hosts file of container %s: %v", id, err)
+		}
+	}
+	return firstErr
+}
+
+// startResolver starts the network's resolver, serving DNS on port 53 of gateway, unless it is running already.
+// The socket is bound here, so a failure to bind is reported to the joining container, and handed to the resolver
+// process, which runs in a session of its own so it outlives the caller.
+func (ln *labeledNetwork) startResolver(gateway net.IP) error {
+	if ln.ResolverPID != 0 {
+		if startTime, err := process.ProcessStartTime(ln.ResolverPID); err == nil && startTime == ln.ResolverStartTime {
+			return nil
+		}
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: gateway, Port: 53})
+	if err != nil {
+		return fmt.Errorf("failed to listen for DNS queries on network %s: %v", ln.Label, err)
+	}
+	defer conn.Close()
+	socket, err := conn.File()
+	if err != nil {
+		return fmt.Errorf("failed to get DNS socket of network %s: %v", ln.Label, err)
+	}
+	defer socket.Close()
+
+	cmd := exec.Command("/proc/self/exe", ResolverCommand, StateDir, ln.Bridge)
+	cmd.ExtraFiles = []*os.File{socket}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start resolver of network %s: %v", ln.Label, err)
+	}
+	// Reap the resolver if it exits while this process is still around, e.g. in the daemon
+	go func() { _ = cmd.Wait() }()
+
+	ln.ResolverPID = cmd.Process.Pid
+	if ln.ResolverStartTime, err = process.ProcessStartTime(ln.ResolverPID); err != nil {
+		_ = cmd.Process.Kill()
+		return fmt.Errorf("failed to start resolver of network %s: %v", ln.Label, err)
+	}
+	return nil
+}
+
+// stopResolver stops the network's resolver, if it is still the process that was started.
+func (ln *labeledNetwork) stopResolver() {
+	if ln.ResolverPID == 0 {
+		return
+	}
+	if startTime, err := process.ProcessStartTime(ln.ResolverPID); err == nil && startTime == ln.ResolverStartTime {
+		_ = syscall.Kill(ln.ResolverPID, syscall.SIGTERM)
+	}
+}
+
+// lookup returns the address of the container on the network whose ID or one of whose aliases is name, compared
+// without regard to case. Should several containers share an alias, the one with the lowest ID has it.
+func (ln *labeledNetwork) lookup(name string) (net.IP, bool) {
+	ids := make([]string, 0, len(ln.Members))
+	for id := range ln.Members {
+		if strings.EqualFold(id, name) {
+			return net.ParseIP(ln.Members[id]), true
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		state, err := LoadState(id)
+		if err != nil {
+			continue
+		}
+		for _, alias := range state.Aliases {
+			if strings.EqualFold(alias, name) {
+				return net.ParseIP(ln.Members[id]), true
+			}
+		}
+	}
+	return nil, false
+}
+
+// ServeLabeledNetwork runs the resolver of the labeled network on the given bridge, with the network records in
+// stateDir, until it is stopped. It answers the IDs and aliases of the network's containers and forwards other
+// names to the host's DNS server. The socket to serve on is inherited as file descriptor 3 from JoinLabeledNetwork,
+// which starts the resolver with ResolverCommand.
+func ServeLabeledNetwork(stateDir, bridge string) error {
+	StateDir = stateDir
+	conn, err := net.FilePacketConn(os.NewFile(3, "dns"))
+	if err != nil {
+		return fmt.Errorf("failed to open DNS socket: %v", err)
+	}
+	defer conn.Close()
+
+	resolver := &network.Resolver{
+		Lookup: func(name string) (net.IP, bool) {
+			// The records are read on every query, so containers that join or leave are seen right away
+			networks, err := loadLabeledNetworks()
+			if err != nil || networks[bridge] == nil {
+				return nil, false
+			}
+			return networks[bridge].lookup(name)
+		},
+	}
+	// The resolver forwards to a single upstream, the host's first nameserver
+	if upstream, err := network.GetDefaultDNS(); err == nil && len(upstream) > 0 {
+		resolver.Upstream = &net.UDPAddr{IP: upstream[0], Port: 53}
+	}
+	return resolver.Serve(conn)
+}
+
+// ValidateNetworkAlias checks that alias is a valid DNS name: dot-separated labels of letters, digits, and hyphens,
+// none starting or ending with a hyphen.
+func ValidateNetworkAlias(alias string) error {
+	if alias == "" || len(alias) > 253 {
+		return fmt.Errorf("invalid network alias %q: must be 1 to 253 characters", alias)
+	}
+	for _, label := range strings.Split(alias, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("invalid network alias %q: labels must be 1 to 63 characters and not start or end with a hyphen", alias)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return fmt.Errorf("invalid network alias %q: only letters, digits, hyphens, and dots are allowed", alias)
+			}
+		}
+	}
+	return nil
+}
+
+// labeledBridgeName returns the name of the bridge of the network for label: "spk" followed by eight hex digits of
+// the label's SHA-256, which keeps it within the kernel's limit on interface names.
+func labeledBridgeName(label string) string {
+	sum := sha256.Sum256([]byte(label))
+	return "spk" + hex.EncodeToString(sum[:4])
+}
+
+// freeLabeledSubnet returns the first /24 of labeledSubnets that no labeled network uses.
+func freeLabeledSubnet(networks map[string]*labeledNetwork) (*net.IPNet, error) {
+	used := map[string]bool{}
+	for _, ln := range networks {
+		used[ln.Subnet] = true
+	}
+	ones, _ := labeledSubnets.Mask.Size()
+	for i := 0; i < 1<<(24-ones); i++ {
+		subnet := &net.IPNet{IP: hostAddress(labeledSubnets, i<<8), Mask: net.CIDRMask(24, 32)}
+		if !used[subnet.String()] {
+			return subnet, nil
+		}
+	}
+	return nil, fmt.Errorf("no free subnet left in %s for labeled networks", labeledSubnets)
+}
+
+// hostAddress returns the nth address of the IPv4 subnet.
+func hostAddress(subnet *net.IPNet, n int) net.IP {
+	base := subnet.IP.To4()
+	ip := make(net.IP, net.IPv4len)
+	value := uint32(base[0])<<24 | uint32(base[1])<<16 | uint32(base[2])<<8 | uint32(base[3])
+	value += uint32(n)
+	ip[0], ip[1], ip[2], ip[3] = byte(value>>24), byte(value>>16), byte(value>>8), byte(value)
+	return ip
+}
+
+// lockLabeledNetworks takes an exclusive lock on the labeled network records, so containers joining and leaving at
+// the same time, from this or other processes, do not hand out the same address. It returns the function that
+// releases the lock.
+func lockLabeledNetworks() (func(), error) {
+	dir := filepath.Join(StateDir, labeledNetworksDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create network directory %s: %v", dir, err)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, ".lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open network lock: %v", err)
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock networks: %v", err)
+	}
+	return func() {
+		_ = unix.Flock(int(f.Fd()), unix.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// loadLabeledNetworks reads the records of all labeled networks, keyed by bridge name.
+func loadLabeledNetworks() (map[string]*labeledNetwork, error) {
+	dir := filepath.Join(StateDir, labeledNetworksDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to list networks: %v", err)
+	}
+	networks := map[string]*labeledNetwork{}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read network %s: %v", entry.Name(), err)
+		}
+		ln := &labeledNetwork{}
+		if err := json.Unmarshal(data, ln); err != nil {
+			return nil, fmt.Errorf("failed to decode network %s: %v", entry.Name(), err)
+		}
+		if ln.Members == nil {
+			ln.Members = map[string]string{}
+		}
+		networks[ln.Bridge] = ln
+	}
+	return networks, nil
+}
+
+// saveLabeledNetwork writes the network's record atomically.
+func saveLabeledNetwork(ln *labeledNetwork) error {
+	data, err := json.MarshalIndent(ln, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode network %s: %v", ln.Label, err)
+	}
+	dir := filepath.Join(StateDir, labeledNetworksDir)
+	tmp, err := os.CreateTemp(dir, ln.Bridge+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary network file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write network %s: %v", ln.Label, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close network file for %s: %v", ln.Label, err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, ln.Bridge+".json")); err != nil {
+		return fmt.Errorf("failed to save network %s: %v", ln.Label, err)
+	}
+	return nil
+}
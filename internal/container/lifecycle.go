@@ -0,0 +1,264 @@
+package container
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"spocker/internal/container/cgroup"
+	"spocker/internal/container/network"
+	"spocker/internal/container/process"
+
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+// startFifoName is the name of the FIFO, inside a container's state directory, that a created container waits on.
+const startFifoName = "start.fifo"
+
+// startTimeout bounds how long starting a container waits for its process to reach the start fifo.
+const startTimeout = 10 * time.Second
+
+// DefaultStopTimeout is how long Stop waits for a container to exit after its stop signal before killing it.
+const DefaultStopTimeout = 10 * time.Second
+
+// Create sets up a container without running its command and returns its ID.
+// The cgroup, namespaces, network, and rootfs are set up and the container's process is started, but it waits
+// until Start is called before running the command, so the container can be inspected or wired up first.
+// The container outlives the call: Start runs it, and Remove tears it down whether or not it was started.
+func Create(config *Config) (string, error) {
+	logger, _ := zap.NewProduction()
+	defer func() {
+		if syncErr := logger.Sync(); syncErr != nil {
+			fmt.Printf("Error syncing logger: %v\n", syncErr)
+		}
+	}()
+
+	// The container outlives the call, so nothing it starts is tied to a context
+	c, err := create(context.Background(), config, logger)
+	if err != nil {
+		return "", err
+	}
+	// The namespace handle only lives as long as this process; the container keeps its namespaces through its own process.
+	if err := c.ns.Close(); err != nil {
+		logger.Warn("Failed to close namespace", zap.String("id", c.state.ID), zap.Error(err))
+	}
+	return c.state.ID, nil
+}
+
+// Start runs the command of a created container. It returns once the command is running; the command's exit
+// is not waited for.
+func Start(id string) error {
+	state, err := LoadState(id)
+	if err != nil {
+		return err
+	}
+	if state.Status != StatusCreated {
+		return fmt.Errorf("container %s cannot be started: it is %s", id, state.Status)
+	}
+	return startCreated(state)
+}
+
+// Stop asks the running container to exit by sending its stop signal, SIGTERM unless the container was created
+// with another, and kills it with SIGKILL if it is still running after timeout. The container is recorded as
+// stopped; its exit code is only known when the caller is the container process's parent, and is -1 otherwise.
+func Stop(id string, timeout time.Duration) error {
+	state, err := LoadState(id)
+	if err != nil {
+		return err
+	}
+	if err := checkRunning(state); err != nil {
+		return err
+	}
+	sig, err := stopSignal(state)
+	if err != nil {
+		return err
+	}
+
+	code, _, err := process.Stop(state.PID, state.StartTime, sig, timeout)
+	if err != nil {
+		return fmt.Errorf("failed to stop container %s: %v", id, err)
+	}
+	state.Status = StatusStopped
+	state.RecordExit(code, time.Now(), false)
+	if err := SaveState(state); err != nil {
+		return err
+	}
+	if state.PIDFile != "" {
+		return removePIDFile(state.PIDFile, state.PID)
+	}
+	return nil
+}
+
+// stopSignal returns the signal the container is asked to stop with.
+func stopSignal(state *ContainerState) (syscall.Signal, error) {
+	if state.StopSignal == "" {
+		return process.DefaultStopSignal, nil
+	}
+	sig, err := process.ParseSignal(state.StopSignal)
+	if err != nil {
+		return 0, fmt.Errorf("invalid stop signal of container %s: %v", state.ID, err)
+	}
+	return sig, nil
+}
+
+// Remove tears down the container and deletes its state, including its cgroup, network, published ports, overlay upper
+// directory, writable layer, loop devices, and temporary directories. A created container that was never started, or a
+// failed one that was kept, has its waiting process killed. Running containers are refused. Resources that are already gone are skipped, so
+// Remove can be retried after a partial failure.
+func Remove(id string) error {
+	state, err := LoadState(id)
+	if err != nil {
+		return err
+	}
+	if state.Status == StatusRunning && checkRunning(state) == nil {
+		return fmt.Errorf("container %s is running", id)
+	}
+
+	if state.Status == StatusCreated || state.Status == StatusFailed {
+		if err := killContainer(state); err != nil {
+			return err
+		}
+	}
+	if state.Network != nil && state.Network.Interface != "" {
+		if err := network.TeardownNetwork(state.PID, containerNetwork(state)); err != nil {
+			return fmt.Errorf("failed to delete network of container %s: %v", id, err)
+		}
+	}
+	if err := leaveLabeledNetworks(id); err != nil {
+		return fmt.Errorf("failed to leave labeled network of container %s: %v", id, err)
+	}
+	if state.CgroupPath != "" {
+		fileHandler := &cgroup.DefaultFileHandler{}
+		if err := cgroup.RemoveCgroup(fileHandler, state.CgroupPath); err != nil {
+			return fmt.Errorf("failed to remove cgroup of container %s: %v", id, err)
+		}
+	}
+	if err := unmountOverlayRootfs(state); err != nil {
+		return err
+	}
+	if err := unmountWritableLayer(id); err != nil {
+		return err
+	}
+	if state.PIDFile != "" {
+		if err := removePIDFile(state.PIDFile, state.PID); err != nil {
+			return err
+		}
+	}
+	if err := detachLoopDevices(id); err != nil {
+		return err
+	}
+	if err := removeTempDirs(id); err != nil {
+		return err
+	}
+	return RemoveState(id)
+}
+
+// containerNetwork returns the network recorded in the container's state, with its published ports and the allocator
+// its address was leased from, for TeardownNetwork.
+func containerNetwork(state *ContainerState) *network.Network {
+	n := &network.Network{
+		Name:       state.Network.Interface,
+		Gateway:    state.Network.Gateway,
+		Ports:      state.Ports,
+		Masquerade: state.Network.Masquerade,
+		Bridge:     state.Network.Bridge,
+	}
+	if subnet := state.Network.Subnet(); subnet != nil {
+		n.IPNet = &net.IPNet{IP: state.Network.IP, Mask: subnet.Mask}
+		n.Allocator = ipAllocator(subnet, state.Network.Gateway)
+	}
+	return n
+}
+
+// killContainer kills the container's process with SIGKILL and waits for it to exit. Nothing is done if the
+// process is already gone or its PID now belongs to another process.
+func killContainer(state *ContainerState) error {
+	if state.PID == 0 {
+		return nil
+	}
+	if startTime, err := process.ProcessStartTime(state.PID); err != nil || startTime != state.StartTime {
+		return nil
+	}
+	if err := syscall.Kill(state.PID, syscall.SIGKILL); err != nil && !errors.Is(err, syscall.ESRCH) {
+		return fmt.Errorf("failed to kill process %d of container %s: %v", state.PID, state.ID, err)
+	}
+	if _, err := process.WaitPID(state.PID, state.StartTime); err != nil {
+		return fmt.Errorf("failed to wait for process %d of container %s: %v", state.PID, state.ID, err)
+	}
+	return nil
+}
+
+// createStartFifo creates the start fifo in the container's state directory and returns its path.
+func createStartFifo(id string) (string, error) {
+	dir, err := stateDir(id)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create state directory %s: %v", dir, err)
+	}
+	fifo := filepath.Join(dir, startFifoName)
+	if err := unix.Mkfifo(fifo, 0600); err != nil {
+		return "", fmt.Errorf("failed to create start fifo %s: %v", fifo, err)
+	}
+	return fifo, nil
+}
+
+// startCreated releases the created container's process from the start fifo and records the container as running.
+// The process may not have reached the fifo yet, so opening it is retried until the process is waiting on it or
+// turns out to have exited. The container's pidfile is written before the process is released, so it exists
+// for as long as the command runs.
+func startCreated(state *ContainerState) (err error) {
+	dir, err := stateDir(state.ID)
+	if err != nil {
+		return err
+	}
+	fifo := filepath.Join(dir, startFifoName)
+
+	if state.PIDFile != "" {
+		if err := writePIDFile(state.PIDFile, state.PID); err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				_ = removePIDFile(state.PIDFile, state.PID)
+			}
+		}()
+	}
+
+	deadline := time.Now().Add(startTimeout)
+	for {
+		// Opening the write end without blocking fails with ENXIO until the process has opened the read end.
+		f, err := os.OpenFile(fifo, os.O_WRONLY|unix.O_NONBLOCK, 0)
+		if err == nil {
+			_, err = f.Write([]byte{0})
+			f.Close()
+			if err != nil {
+				return fmt.Errorf("failed to start container %s: %v", state.ID, err)
+			}
+			break
+		}
+		if !errors.Is(err, unix.ENXIO) {
+			return fmt.Errorf("failed to open start fifo of container %s: %v", state.ID, err)
+		}
+		if startTime, err := process.ProcessStartTime(state.PID); err != nil || startTime != state.StartTime {
+			return fmt.Errorf("container %s exited before it was started", state.ID)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for container %s to be ready to start", state.ID)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := os.Remove(fifo); err != nil {
+		return fmt.Errorf("failed to remove start fifo of container %s: %v", state.ID, err)
+	}
+
+	state.Status = StatusRunning
+	return SaveState(state)
+}
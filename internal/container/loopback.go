@@ -0,0 +1,80 @@
+package container
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"spocker/internal/container/filesystem"
+)
+
+// loopbackImageName is the name of the loopback image of a container's writable layer, in its temporary directory.
+const loopbackImageName = "rw.img"
+
+// LoopbackImagePath returns where the loopback image backing the container's writable layer is kept, as created
+// with filesystem.CreateLoopbackFS. It is in the container's temporary directory, which can live on a larger
+// filesystem than StateDir and is removed along with the container.
+func LoopbackImagePath(id string) (string, error) {
+	dir, err := containerTempDir(id)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, loopbackImageName), nil
+}
+
+// detachLoopDevices detaches the loop devices attached to files of the container with the given ID, in its state
+// or temporary directory.
+func detachLoopDevices(id string) error {
+	devices, err := filesystem.ListLoopDevices()
+	if err != nil {
+		return err
+	}
+	for _, device := range devices {
+		if owner, ok := loopDeviceOwner(device); ok && owner == id {
+			if err := filesystem.DetachLoopDevice(device.Device); err != nil {
+				return fmt.Errorf("failed to detach loop device of container %s: %v", id, err)
+			}
+		}
+	}
+	return nil
+}
+
+// GCLoopDevices detaches the loop devices left attached to files of containers that no longer exist, e.g. because
+// spocker crashed before it could remove them, and returns the devices.
+func GCLoopDevices() ([]string, error) {
+	devices, err := filesystem.ListLoopDevices()
+	if err != nil {
+		return nil, err
+	}
+	var detached []string
+	for _, device := range devices {
+		id, ok := loopDeviceOwner(device)
+		if !ok {
+			continue
+		}
+		if _, err := LoadState(id); err == nil {
+			continue
+		}
+		if err := filesystem.DetachLoopDevice(device.Device); err != nil {
+			return detached, err
+		}
+		detached = append(detached, device.Device)
+	}
+	return detached, nil
+}
+
+// loopDeviceOwner returns the ID of the container whose state or temporary directory holds the backing file of
+// device, if any.
+func loopDeviceOwner(device filesystem.LoopDevice) (string, bool) {
+	for _, base := range []string{StateDir, TempBaseDir} {
+		rel, err := filepath.Rel(base, device.BackingFile)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		id, _, ok := strings.Cut(rel, string(filepath.Separator))
+		if ok {
+			return id, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,76 @@
+package namespace
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// nsFileNames maps namespace types to their files in /proc/<pid>/ns.
+var nsFileNames = map[NamespaceType]string{
+	NamespaceTypePID:    "pid",
+	NamespaceTypeUTS:    "uts",
+	NamespaceTypeIPC:    "ipc",
+	NamespaceTypeNet:    "net",
+	NamespaceTypeUser:   "user",
+	NamespaceTypeCgroup: "cgroup",
+	NamespaceTypeMount:  "mnt",
+}
+
+// Target names the namespaces of the given types of the process with the given PID, for a caller to join.
+type Target struct {
+	PID   int
+	Types []NamespaceType
+}
+
+// Join moves the calling thread into the namespaces of the given types of the process with the given PID, e.g.
+// to run a command in a running container. Only the calling thread is moved, so the caller must have locked it
+// with runtime.LockOSThread and should not unlock it afterwards. Joining a PID namespace only affects the
+// children the thread creates afterwards, and a user namespace, which is joined first, can only be joined by a
+// single-threaded process. Joining a mount namespace unshares the thread's filesystem attributes from the rest of
+// the process first, since the kernel refuses it to a thread sharing them, and moves the thread to the root of the
+// namespace. Every namespace is opened before any is joined, so a missing one fails before the
+// thread is changed.
+func Join(pid int, types []NamespaceType) error {
+	ordered := make([]NamespaceType, 0, len(types))
+	for _, nsType := range types {
+		if nsType == NamespaceTypeUser {
+			ordered = append([]NamespaceType{nsType}, ordered...)
+		} else {
+			ordered = append(ordered, nsType)
+		}
+	}
+
+	files := make([]*os.File, 0, len(ordered))
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for _, nsType := range ordered {
+		name, ok := nsFileNames[nsType]
+		if !ok {
+			return fmt.Errorf("unknown namespace type %d", nsType)
+		}
+		file, err := os.Open(filepath.Join("/proc", strconv.Itoa(pid), "ns", name))
+		if err != nil {
+			return fmt.Errorf("failed to open %s namespace of process %d: %w", name, pid, err)
+		}
+		files = append(files, file)
+	}
+
+	for i, file := range files {
+		if ordered[i] == NamespaceTypeMount {
+			if err := unix.Unshare(unix.CLONE_FS); err != nil {
+				return fmt.Errorf("failed to unshare filesystem attributes to join mount namespace: %w", err)
+			}
+		}
+		if err := unix.Setns(int(file.Fd()), 0); err != nil {
+			return fmt.Errorf("failed to join %s namespace of process %d: %w", nsFileNames[ordered[i]], pid, err)
+		}
+	}
+	return nil
+}
@@ -2,46 +2,60 @@ package namespace
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/exec"
 	"syscall"
 
 	"spocker/internal/container/util"
 )
 
+// HolderCommand is the argument that makes the spocker binary hold the namespaces it was started in until it is
+// killed, as NewNamespace starts it.
+const HolderCommand = "child"
+
 // NewNamespace returns a new namespace object.
-func NewNamespace(spec *NamespaceSpec) (*Namespace, error) {
+// The child process holding the namespace is killed if ctx is done before the namespace is closed.
+func NewNamespace(ctx context.Context, spec *NamespaceSpec) (*Namespace, error) {
 	r, w, err := os.Pipe()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create pipe: %w", err)
 	}
 
-	ctx := context.Background()
-	cmd, err := util.CreateCommand(ctx, "/proc/self/exe", "child")
+	cmd, err := util.CreateCommand(ctx, "/proc/self/exe", HolderCommand)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create child process: %w", err)
 	}
+	// The holder always gets a mount namespace of its own so that unsharing it keeps its mounts private.
 	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Cloneflags:   syscall.CLONE_NEWUTS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNS,
+		Cloneflags:   syscall.CLONE_NEWNS,
 		Unshareflags: syscall.CLONE_NEWNS,
 	}
+	for _, nsType := range spec.types() {
+		cmd.SysProcAttr.Cloneflags |= nsType.CloneFlag()
+	}
+	if spec.Includes(NamespaceTypeUser) {
+		cmd.SysProcAttr.UidMappings, cmd.SysProcAttr.GidMappings = IDMappings(spec)
+	}
 	cmd.ExtraFiles = []*os.File{w}
 	cmd.Stderr = os.Stderr
 
 	if err := cmd.Start(); err != nil {
+		r.Close()
+		w.Close()
 		return nil, fmt.Errorf("failed to start container process: %w", err)
 	}
-
-	file := os.NewFile(uintptr(r.Fd()), "namespace")
+	// The child holds its own copy of the write end.
+	w.Close()
 
 	ns := &Namespace{
 		Name: spec.Name,
 		Type: spec.Type,
-		File: file,
+		File: r,
+		cmd:  cmd,
 	}
 
-	defer file.Close()
-
 	return ns, nil
 }
 
@@ -50,15 +64,18 @@ type Namespace struct {
 	Name string
 	Type NamespaceType
 	File *os.File
+
+	cmd    *exec.Cmd
+	closed bool
 }
 
 // Enter enters the namespace.
-func (ns *Namespace) Enter() error {
+// The shell is killed if ctx is done before it exits.
+func (ns *Namespace) Enter(ctx context.Context) error {
 	if err := syscall.Dup2(int(ns.File.Fd()), syscall.Stdin); err != nil {
 		return fmt.Errorf("failed to duplicate file descriptor to stdin: %w", err)
 	}
 
-	ctx := context.Background()
 	cmd, err := util.CreateCommand(ctx, "/bin/sh", "-i")
 	if err != nil {
 		return fmt.Errorf("failed to create command: %w", err)
@@ -72,7 +89,25 @@ func (ns *Namespace) Enter() error {
 }
 
 // Close releases the namespace's resources.
+// The child process holding the namespace is killed and reaped before its file is closed.
+// Calling Close more than once is a no-op.
 func (ns *Namespace) Close() error {
+	if ns.closed {
+		return nil
+	}
+	ns.closed = true
+
+	if ns.cmd != nil && ns.cmd.Process != nil {
+		if err := ns.cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+			return fmt.Errorf("failed to kill namespace process %d: %w", ns.cmd.Process.Pid, err)
+		}
+		// The process was just killed, so its exit status carries no information.
+		var exitErr *exec.ExitError
+		if err := ns.cmd.Wait(); err != nil && !errors.As(err, &exitErr) {
+			return fmt.Errorf("failed to reap namespace process %d: %w", ns.cmd.Process.Pid, err)
+		}
+	}
+
 	if err := ns.File.Close(); err != nil {
 		return fmt.Errorf("failed to close namespace file: %w", err)
 	}
@@ -91,23 +126,73 @@ const (
 	NamespaceTypeNet
 	NamespaceTypeUser
 	NamespaceTypeCgroup
+	NamespaceTypeMount
 )
 
+// CloneFlag returns the clone(2) flag that creates a namespace of type t, or 0 for an unknown type.
+func (t NamespaceType) CloneFlag() uintptr {
+	switch t {
+	case NamespaceTypePID:
+		return syscall.CLONE_NEWPID
+	case NamespaceTypeUTS:
+		return syscall.CLONE_NEWUTS
+	case NamespaceTypeIPC:
+		return syscall.CLONE_NEWIPC
+	case NamespaceTypeNet:
+		return syscall.CLONE_NEWNET
+	case NamespaceTypeUser:
+		return syscall.CLONE_NEWUSER
+	case NamespaceTypeCgroup:
+		return syscall.CLONE_NEWCGROUP
+	case NamespaceTypeMount:
+		return syscall.CLONE_NEWNS
+	}
+	return 0
+}
+
 // NamespaceSpec represents the specification for a Linux namespace.
+// Types requests further namespaces to be created alongside the one of type Type.
+// UIDMappings and GIDMappings map IDs inside a user namespace to IDs outside it; they are only used with
+// NamespaceTypeUser. Without any, the namespace's root is mapped to the calling user and group.
 type NamespaceSpec struct {
-	Name string
-	Type NamespaceType
+	Name        string
+	Type        NamespaceType
+	Types       []NamespaceType
+	UIDMappings []syscall.SysProcIDMap
+	GIDMappings []syscall.SysProcIDMap
 }
 
-// SetHostname sets the hostname of the current namespace and returns an error if it fails.
-func SetHostname(hostname string) error {
+// types returns the types of all namespaces requested by the spec.
+func (spec *NamespaceSpec) types() []NamespaceType {
+	return append([]NamespaceType{spec.Type}, spec.Types...)
+}
 
-	ctx := context.Background()
-	cmd, err := util.CreateCommand(ctx, "sudo", "hostnamectl", "set-hostname", hostname)
-	if err != nil {
-		return fmt.Errorf("failed to create command: %w", err)
+// Includes reports whether the spec requests a namespace of type t.
+func (spec *NamespaceSpec) Includes(t NamespaceType) bool {
+	for _, nsType := range spec.types() {
+		if nsType == t {
+			return true
+		}
 	}
-	if err := cmd.Run(); err != nil {
+	return false
+}
+
+// IDMappings returns the UID and GID mappings of a user namespace created for spec.
+func IDMappings(spec *NamespaceSpec) (uidMappings, gidMappings []syscall.SysProcIDMap) {
+	uidMappings, gidMappings = spec.UIDMappings, spec.GIDMappings
+	if len(uidMappings) == 0 {
+		uidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+	}
+	if len(gidMappings) == 0 {
+		gidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+	}
+	return uidMappings, gidMappings
+}
+
+// SetHostname sets the hostname of the current UTS namespace and returns an error if it fails.
+// Called from the host's namespace, it changes the host's hostname.
+func SetHostname(hostname string) error {
+	if err := syscall.Sethostname([]byte(hostname)); err != nil {
 		return fmt.Errorf("failed to set hostname to %s: %w", hostname, err)
 	}
 	return nil
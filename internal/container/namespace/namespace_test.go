@@ -1,11 +1,28 @@
 package namespace
 
 import (
+	"context"
 	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
 	"syscall"
 	"testing"
+	"time"
 )
 
+func TestMain(m *testing.M) {
+	// NewNamespace re-executes the binary as "child", which in tests is the test binary itself.
+	// Act as an idle namespace holder instead of running the tests again.
+	if len(os.Args) > 1 && os.Args[1] == "child" {
+		for {
+			time.Sleep(time.Hour)
+		}
+	}
+	os.Exit(m.Run())
+}
+
 func assertNoError(t *testing.T, err error) {
 	t.Helper()
 	if err != nil {
@@ -19,25 +36,177 @@ func TestNewNamespace(t *testing.T) {
 		Type: NamespaceTypePID,
 	}
 
-	ns, err := NewNamespace(spec)
+	ns, err := NewNamespace(context.Background(), spec)
 	assertNoError(t, err)
 	defer ns.Close()
 }
 
+func TestCloneFlag(t *testing.T) {
+	for nsType, want := range map[NamespaceType]uintptr{
+		NamespaceTypePID:    syscall.CLONE_NEWPID,
+		NamespaceTypeUTS:    syscall.CLONE_NEWUTS,
+		NamespaceTypeIPC:    syscall.CLONE_NEWIPC,
+		NamespaceTypeNet:    syscall.CLONE_NEWNET,
+		NamespaceTypeUser:   syscall.CLONE_NEWUSER,
+		NamespaceTypeCgroup: syscall.CLONE_NEWCGROUP,
+		NamespaceTypeMount:  syscall.CLONE_NEWNS,
+		NamespaceType(-1):   0,
+	} {
+		if got := nsType.CloneFlag(); got != want {
+			t.Errorf("NamespaceType(%d).CloneFlag() = %#x, want %#x", nsType, got, want)
+		}
+	}
+}
+
+func TestNewNamespaceMultipleTypes(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating namespaces requires root")
+	}
+
+	spec := &NamespaceSpec{Name: "test-multi", Type: NamespaceTypeNet, Types: []NamespaceType{NamespaceTypeIPC}}
+	ns, err := NewNamespace(context.Background(), spec)
+	assertNoError(t, err)
+	defer ns.Close()
+
+	for _, name := range []string{"net", "ipc", "uts"} {
+		ours, err := os.Readlink("/proc/self/ns/" + name)
+		assertNoError(t, err)
+		theirs, err := os.Readlink("/proc/" + strconv.Itoa(ns.cmd.Process.Pid) + "/ns/" + name)
+		assertNoError(t, err)
+		if requested := name != "uts"; (ours != theirs) != requested {
+			t.Errorf("%s namespace: requested %v, but holder has %q and we have %q", name, requested, theirs, ours)
+		}
+	}
+}
+
 func TestNamespaceEnterAndClose(t *testing.T) {
 	spec := &NamespaceSpec{
 		Name: "test-namespace",
 		Type: NamespaceTypePID,
 	}
 
-	ns, err := NewNamespace(spec)
+	ns, err := NewNamespace(context.Background(), spec)
 	assertNoError(t, err)
 	defer ns.Close()
 
-	err = ns.Enter()
+	err = ns.Enter(context.Background())
 	assertNoError(t, err)
 }
 
+func TestUserNamespace(t *testing.T) {
+	spec := &NamespaceSpec{Name: "test-userns", Type: NamespaceTypeUser}
+	ns, err := NewNamespace(context.Background(), spec)
+	if err != nil {
+		t.Skipf("user namespaces are not available: %v", err)
+	}
+	defer ns.Close()
+
+	readMap := func(name string) string {
+		content, err := os.ReadFile("/proc/" + strconv.Itoa(ns.cmd.Process.Pid) + "/" + name)
+		assertNoError(t, err)
+		return strings.Join(strings.Fields(string(content)), " ")
+	}
+	// Without mappings, root in the namespace is the calling user
+	if got, want := readMap("uid_map"), "0 "+strconv.Itoa(os.Getuid())+" 1"; got != want {
+		t.Errorf("uid_map = %q, want %q", got, want)
+	}
+	if got, want := readMap("gid_map"), "0 "+strconv.Itoa(os.Getgid())+" 1"; got != want {
+		t.Errorf("gid_map = %q, want %q", got, want)
+	}
+
+	uidMappings, gidMappings := IDMappings(&NamespaceSpec{
+		Type:        NamespaceTypeUser,
+		UIDMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: 100000, Size: 65536}},
+	})
+	if len(uidMappings) != 1 || uidMappings[0].HostID != 100000 || uidMappings[0].Size != 65536 {
+		t.Errorf("expected the given UID mappings to be used, got %+v", uidMappings)
+	}
+	if len(gidMappings) != 1 || gidMappings[0].HostID != os.Getgid() {
+		t.Errorf("expected the GID mappings to default to the calling group, got %+v", gidMappings)
+	}
+}
+
+func TestJoin(t *testing.T) {
+	if err := Join(os.Getpid(), []NamespaceType{NamespaceType(-1)}); err == nil {
+		t.Error("expected an unknown namespace type to be refused")
+	}
+	if err := Join(0, []NamespaceType{NamespaceTypeUTS}); err == nil {
+		t.Error("expected joining the namespaces of a missing process to fail")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("joining namespaces requires root")
+	}
+
+	ns, err := NewNamespace(context.Background(), &NamespaceSpec{Name: "test-join", Type: NamespaceTypeUTS})
+	assertNoError(t, err)
+	defer ns.Close()
+	pid := ns.cmd.Process.Pid
+	want, err := os.Readlink("/proc/" + strconv.Itoa(pid) + "/ns/uts")
+	assertNoError(t, err)
+
+	done := make(chan string, 1)
+	go func() {
+		// The thread is never unlocked, so it exits with the goroutine instead of returning to the pool
+		runtime.LockOSThread()
+		if err := Join(pid, []NamespaceType{NamespaceTypeUTS}); err != nil {
+			done <- err.Error()
+			return
+		}
+		got, err := os.Readlink("/proc/thread-self/ns/uts")
+		if err != nil {
+			done <- err.Error()
+			return
+		}
+		done <- got
+	}()
+	if got := <-done; got != want {
+		t.Errorf("thread is in UTS namespace %q after Join, want %q", got, want)
+	}
+	if ours, err := os.Readlink("/proc/thread-self/ns/uts"); err != nil || ours == want {
+		t.Errorf("Join moved a thread other than the caller's into the namespace (%v)", err)
+	}
+}
+
+func TestPersist(t *testing.T) {
+	oldPersistDir := PersistDir
+	PersistDir = t.TempDir()
+	defer func() { PersistDir = oldPersistDir }()
+	for _, path := range []string{"relative", PersistDir, PersistDir + "/../escape", "/etc/passwd"} {
+		if err := validatePersistPath(path); err == nil {
+			t.Errorf("expected path %q outside %s to be refused", path, PersistDir)
+		}
+	}
+	if err := RemovePersisted("/etc/passwd"); err == nil {
+		t.Error("expected RemovePersisted to refuse a path outside PersistDir")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("bind mounting namespaces requires root")
+	}
+
+	ns, err := NewNamespace(context.Background(), &NamespaceSpec{Name: "test-persist", Type: NamespaceTypeUTS})
+	assertNoError(t, err)
+	want, err := os.Readlink("/proc/" + strconv.Itoa(ns.cmd.Process.Pid) + "/ns/uts")
+	assertNoError(t, err)
+	path := PersistDir + "/named/uts"
+	assertNoError(t, ns.Persist(path))
+	if err := ns.Persist(path); err == nil {
+		t.Error("expected persisting onto an existing file to fail")
+	}
+	assertNoError(t, ns.Close())
+
+	// The namespace outlives its process, so its inode is still reachable through the bind mount
+	var st syscall.Stat_t
+	assertNoError(t, syscall.Stat(path, &st))
+	if got := "uts:[" + strconv.FormatUint(st.Ino, 10) + "]"; got != want {
+		t.Errorf("persisted namespace is %q, want %q", got, want)
+	}
+
+	assertNoError(t, RemovePersisted(path))
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed, got %v", path, err)
+	}
+}
+
 func TestSetHostname(t *testing.T) {
 	err := syscall.Sethostname([]byte("test-hostname"))
 	assertNoError(t, err)
@@ -52,3 +221,149 @@ func TestSetHostname(t *testing.T) {
 		t.Fatalf("expected hostname to be %q, but got %q", "test-hostname2", hostname)
 	}
 }
+
+func TestNamespaceCloseKillsChild(t *testing.T) {
+	spec := &NamespaceSpec{
+		Name: "test-namespace",
+		Type: NamespaceTypePID,
+	}
+
+	ns, err := NewNamespace(context.Background(), spec)
+	assertNoError(t, err)
+	pid := ns.cmd.Process.Pid
+	if err := syscall.Kill(pid, 0); err != nil {
+		t.Fatalf("expected the namespace process to be running: %v", err)
+	}
+
+	assertNoError(t, ns.Close())
+	if err := syscall.Kill(pid, 0); err != syscall.ESRCH {
+		t.Errorf("expected the namespace process to be gone after Close, got %v", err)
+	}
+
+	// Closing again must not fail.
+	assertNoError(t, ns.Close())
+}
+
+func TestNamespaceCancelKillsChild(t *testing.T) {
+	spec := &NamespaceSpec{
+		Name: "test-namespace",
+		Type: NamespaceTypePID,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ns, err := NewNamespace(ctx, spec)
+	assertNoError(t, err)
+	defer ns.Close()
+
+	cancel()
+	exited := make(chan error, 1)
+	go func() { exited <- ns.cmd.Wait() }()
+	select {
+	case err := <-exited:
+		if err == nil {
+			t.Error("expected the namespace process to be killed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("namespace process still running after its context was cancelled")
+	}
+}
+
+func TestParseSysctl(t *testing.T) {
+	key, value, err := ParseSysctl("net.ipv4.ip_local_port_range=32768 60999")
+	assertNoError(t, err)
+	if key != "net.ipv4.ip_local_port_range" || value != "32768 60999" {
+		t.Errorf("unexpected sysctl %q=%q", key, value)
+	}
+
+	key, value, err = ParseSysctl("kernel.shmmax=68719476736")
+	assertNoError(t, err)
+	if key != "kernel.shmmax" || value != "68719476736" {
+		t.Errorf("unexpected sysctl %q=%q", key, value)
+	}
+
+	key, value, err = ParseSysctl("kernel.domainname=example.com")
+	assertNoError(t, err)
+	if key != "kernel.domainname" || value != "example.com" {
+		t.Errorf("unexpected sysctl %q=%q", key, value)
+	}
+
+	for _, spec := range []string{"net.ipv4.ip_forward", "=1", "kernel.osrelease=x", "vm.swappiness=10", "net/../../kernel/panic=1"} {
+		if _, _, err := ParseSysctl(spec); err == nil {
+			t.Errorf("ParseSysctl(%q) should fail", spec)
+		}
+	}
+
+	if err := ValidateSysctl("kernel.panic"); err == nil || !strings.Contains(err.Error(), "not namespaced") {
+		t.Errorf("expected a host-global sysctl to be rejected, got %v", err)
+	}
+}
+
+func TestApplySysctls(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to create namespaces")
+	}
+
+	const key, path = "net.ipv4.ip_local_port_range", "/proc/sys/net/ipv4/ip_local_port_range"
+	hostValue, err := os.ReadFile(path)
+	assertNoError(t, err)
+
+	cmd := exec.Command("sleep", "30")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNET}
+	assertNoError(t, cmd.Start())
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+
+	assertNoError(t, ApplySysctls(cmd.Process.Pid, map[string]string{key: "20000 30000"}))
+
+	out, err := exec.Command("nsenter", "--target", strconv.Itoa(cmd.Process.Pid), "--net", "cat", path).Output()
+	if err != nil {
+		t.Skipf("nsenter is not available to read the sysctl back: %v", err)
+	}
+	if fields := strings.Fields(string(out)); len(fields) != 2 || fields[0] != "20000" || fields[1] != "30000" {
+		t.Errorf("expected the container's port range to be 20000 30000, got %q", out)
+	}
+
+	after, err := os.ReadFile(path)
+	assertNoError(t, err)
+	if string(after) != string(hostValue) {
+		t.Errorf("the host's port range changed from %q to %q", hostValue, after)
+	}
+
+	if err := ApplySysctls(os.Getpid(), map[string]string{key: "20000 30000"}); err == nil {
+		t.Error("expected setting a sysctl in a namespace shared with the host to fail")
+	}
+}
+
+func TestApplyUTSSysctls(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to create namespaces")
+	}
+
+	hostHostname, err := os.Hostname()
+	assertNoError(t, err)
+
+	cmd := exec.Command("sleep", "30")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWUTS}
+	assertNoError(t, cmd.Start())
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+
+	assertNoError(t, ApplySysctls(cmd.Process.Pid, map[string]string{"kernel.hostname": "sysctl-test", "kernel.domainname": "example.com"}))
+
+	out, err := exec.Command("nsenter", "--target", strconv.Itoa(cmd.Process.Pid), "--uts", "cat", "/proc/sys/kernel/hostname", "/proc/sys/kernel/domainname").Output()
+	if err != nil {
+		t.Skipf("nsenter is not available to read the sysctls back: %v", err)
+	}
+	if got := strings.Fields(string(out)); len(got) != 2 || got[0] != "sysctl-test" || got[1] != "example.com" {
+		t.Errorf("expected the container's hostname and domain name to be sysctl-test and example.com, got %q", out)
+	}
+
+	if after, err := os.Hostname(); err != nil || after != hostHostname {
+		t.Errorf("the host's hostname changed from %q to %q (%v)", hostHostname, after, err)
+	}
+}
@@ -0,0 +1,70 @@
+package namespace
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// PersistDir is the directory under which namespaces are bind mounted to outlive the processes in them.
+var PersistDir = "/var/run/spocker/ns"
+
+// Persist bind mounts the namespace onto path, which must be under PersistDir, so it is kept alive after the
+// process holding it exits and can be joined by opening path, as with ip netns add.
+// The file at path is created for the bind mount and must not exist yet.
+func (ns *Namespace) Persist(path string) error {
+	if ns.closed || ns.cmd == nil || ns.cmd.Process == nil {
+		return fmt.Errorf("namespace %s has no process to persist it from", ns.Name)
+	}
+	name, ok := nsFileNames[ns.Type]
+	if !ok {
+		return fmt.Errorf("unknown namespace type %d", ns.Type)
+	}
+	if err := validatePersistPath(path); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", path, err)
+	}
+	file, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE|os.O_EXCL, 0444)
+	if err != nil {
+		return fmt.Errorf("failed to create mount point %s: %w", path, err)
+	}
+	file.Close()
+
+	source := filepath.Join("/proc", strconv.Itoa(ns.cmd.Process.Pid), "ns", name)
+	if err := syscall.Mount(source, path, "", syscall.MS_BIND, ""); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("failed to bind mount %s onto %s: %w", source, path, err)
+	}
+	return nil
+}
+
+// RemovePersisted unmounts a namespace persisted at path by Persist and removes its mount point.
+// The namespace is destroyed once no process is left in it and nothing else holds it open.
+func RemovePersisted(path string) error {
+	if err := validatePersistPath(path); err != nil {
+		return err
+	}
+	if err := syscall.Unmount(path, syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("failed to unmount %s: %w", path, err)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", path, err)
+	}
+	return nil
+}
+
+// validatePersistPath returns an error unless path is below PersistDir, so a persisted namespace cannot be
+// mounted over, or unmounted from, an arbitrary file on the host.
+func validatePersistPath(path string) error {
+	rel, err := filepath.Rel(PersistDir, filepath.Clean(path))
+	if err != nil || !filepath.IsAbs(path) || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("invalid namespace path %q: must be under %s", path, PersistDir)
+	}
+	return nil
+}
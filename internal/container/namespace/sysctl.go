@@ -0,0 +1,118 @@
+package namespace
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// namespacedSysctls lists the sysctls that are isolated by the IPC namespace and can be set per container.
+var namespacedSysctls = map[string]bool{
+	"kernel.msgmax":          true,
+	"kernel.msgmnb":          true,
+	"kernel.msgmni":          true,
+	"kernel.sem":             true,
+	"kernel.shmall":          true,
+	"kernel.shmmax":          true,
+	"kernel.shmmni":          true,
+	"kernel.shm_rmid_forced": true,
+}
+
+// utsSysctls lists the sysctls that are isolated by the UTS namespace: the container's hostname and domain name.
+var utsSysctls = map[string]bool{
+	"kernel.hostname":   true,
+	"kernel.domainname": true,
+}
+
+// ParseSysctl parses a sysctl given as KEY=VALUE, e.g. "net.ipv4.ip_local_port_range=32768 60999".
+func ParseSysctl(spec string) (string, string, error) {
+	key, value, ok := strings.Cut(spec, "=")
+	key = strings.TrimSpace(key)
+	if !ok || key == "" {
+		return "", "", fmt.Errorf("invalid sysctl %q: expected KEY=VALUE", spec)
+	}
+	if err := ValidateSysctl(key); err != nil {
+		return "", "", err
+	}
+	return key, value, nil
+}
+
+// ValidateSysctl returns an error unless the sysctl is isolated by a namespace the container gets its own copy of.
+// Host-global sysctls are rejected, since setting them from a container would change them for the whole host.
+func ValidateSysctl(key string) error {
+	_, err := sysctlNamespace(key)
+	return err
+}
+
+// sysctlNamespace returns the type of namespace that isolates the sysctl.
+func sysctlNamespace(key string) (NamespaceType, error) {
+	if strings.Contains(key, "/") || strings.Contains(key, "..") {
+		return 0, fmt.Errorf("invalid sysctl %q", key)
+	}
+	switch {
+	case strings.HasPrefix(key, "net."):
+		return NamespaceTypeNet, nil
+	case namespacedSysctls[key], strings.HasPrefix(key, "fs.mqueue."):
+		return NamespaceTypeIPC, nil
+	case utsSysctls[key]:
+		return NamespaceTypeUTS, nil
+	}
+	return 0, fmt.Errorf("sysctl %s is not namespaced and cannot be set for a container", key)
+}
+
+// ApplySysctls sets the sysctls inside the network, IPC, and UTS namespaces of the process with the given PID.
+// It refuses to set a sysctl in a namespace the process shares with the caller, since that would change it
+// for the host as well.
+func ApplySysctls(pid int, sysctls map[string]string) error {
+	for key, value := range sysctls {
+		nsType, err := sysctlNamespace(key)
+		if err != nil {
+			return err
+		}
+		if err := writeSysctlIn(pid, nsType, key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSysctlIn writes the sysctl from a thread that has joined the process's namespace of the given type.
+// The network, IPC, and UTS namespaces can be joined by a single thread, which is thrown away afterwards so no other
+// goroutine runs in the container's namespaces.
+func writeSysctlIn(pid int, nsType NamespaceType, key, value string) error {
+	name := nsFileNames[nsType]
+	nsPath := filepath.Join("/proc", strconv.Itoa(pid), "ns", name)
+	ours, err := os.Readlink(filepath.Join("/proc/self/ns", name))
+	if err != nil {
+		return fmt.Errorf("failed to read our %s namespace: %w", name, err)
+	}
+	theirs, err := os.Readlink(nsPath)
+	if err != nil {
+		return fmt.Errorf("failed to read %s namespace of process %d: %w", name, pid, err)
+	}
+	if ours == theirs {
+		return fmt.Errorf("cannot set sysctl %s: process %d shares the host's %s namespace", key, pid, name)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		// The thread is never unlocked, so it exits with the goroutine instead of returning to the pool.
+		runtime.LockOSThread()
+
+		if err := Join(pid, []NamespaceType{nsType}); err != nil {
+			done <- err
+			return
+		}
+
+		sysctlPath := filepath.Join("/proc/sys", strings.ReplaceAll(key, ".", "/"))
+		if err := os.WriteFile(sysctlPath, []byte(value), 0644); err != nil {
+			done <- fmt.Errorf("failed to set sysctl %s: %w", key, err)
+			return
+		}
+		done <- nil
+	}()
+	return <-done
+}
@@ -0,0 +1,240 @@
+package network
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// EnsureBridge creates the bridge interface name with gateway as its address and brings it up. A bridge of that
+// name left from before is reused, and given the address if it does not have it yet. A nil gateway leaves the
+// bridge without an address.
+func EnsureBridge(name string, gateway *net.IPNet) (netlink.Link, error) {
+	bridge, err := ensureLink(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: name}})
+	if err != nil {
+		return nil, err
+	}
+	if gateway != nil {
+		if err := netlink.AddrAdd(bridge, &netlink.Addr{IPNet: gateway}); err != nil && !errors.Is(err, syscall.EEXIST) {
+			return nil, fmt.Errorf("failed to assign address %s to bridge %s: %w", gateway, name, err)
+		}
+	}
+	if err := netlink.LinkSetUp(bridge); err != nil {
+		return nil, fmt.Errorf("failed to bring up bridge %s: %w", name, err)
+	}
+	return bridge, nil
+}
+
+// BridgeName returns the name of the bridge AttachNamespace connects the containers on subnet to: "spkbr" followed
+// by eight hex digits of the SHA-256 of the subnet, which keeps it within the kernel's limit on interface names.
+func BridgeName(subnet *net.IPNet) string {
+	sum := sha256.Sum256([]byte((&net.IPNet{IP: subnet.IP.Mask(subnet.Mask), Mask: subnet.Mask}).String()))
+	return "spkbr" + hex.EncodeToString(sum[:4])
+}
+
+// CreateBridge creates the bridge interface name with ipNet as its address, which containers attached to it use
+// as their gateway, and brings it up. Unlike EnsureBridge, it fails if an interface of that name already exists.
+// If any step fails the bridge is removed again.
+func CreateBridge(name string, ipNet *net.IPNet) (netlink.Link, error) {
+	if _, err := netlink.LinkByName(name); err == nil {
+		return nil, fmt.Errorf("network already exists: %s", name)
+	}
+
+	if err := netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: name}}); err != nil {
+		return nil, fmt.Errorf("failed to create bridge %s: %w", name, err)
+	}
+	bridge, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up bridge %s: %w", name, err)
+	}
+	if err := netlink.AddrAdd(bridge, &netlink.Addr{IPNet: ipNet}); err != nil {
+		_ = netlink.LinkDel(bridge)
+		return nil, fmt.Errorf("failed to assign address %s to bridge %s: %w", ipNet, name, err)
+	}
+	if err := netlink.LinkSetUp(bridge); err != nil {
+		_ = netlink.LinkDel(bridge)
+		return nil, fmt.Errorf("failed to bring up bridge %s: %w", name, err)
+	}
+	return bridge, nil
+}
+
+// AttachToBridge makes the bridge named bridgeName the master of the host end vethHostName of a veth pair, so
+// traffic from the peer is switched onto the bridge.
+func AttachToBridge(bridgeName, vethHostName string) error {
+	bridge, err := netlink.LinkByName(bridgeName)
+	if err != nil {
+		return fmt.Errorf("failed to look up bridge %s: %w", bridgeName, err)
+	}
+	if _, ok := bridge.(*netlink.Bridge); !ok {
+		return fmt.Errorf("%s is a %s, not a bridge", bridgeName, bridge.Type())
+	}
+	veth, err := netlink.LinkByName(vethHostName)
+	if err != nil {
+		return fmt.Errorf("failed to look up veth %s: %w", vethHostName, err)
+	}
+	if err := netlink.LinkSetMaster(veth, bridge); err != nil {
+		return fmt.Errorf("failed to attach veth %s to bridge %s: %w", vethHostName, bridgeName, err)
+	}
+	return nil
+}
+
+// DeleteBridge removes the bridge interface name. A bridge that is already gone is not an error.
+func DeleteBridge(name string) error {
+	bridge, err := netlink.LinkByName(name)
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			return nil
+		}
+		return fmt.Errorf("failed to look up bridge %s: %w", name, err)
+	}
+	if err := netlink.LinkDel(bridge); err != nil && !errors.Is(err, syscall.ENODEV) {
+		return fmt.Errorf("failed to delete bridge %s: %w", name, err)
+	}
+	return nil
+}
+
+// DeleteVeth removes the veth pair whose host end is named name, wherever its peer is. A veth that is already gone
+// is not an error.
+func DeleteVeth(name string) error {
+	veth, err := netlink.LinkByName(name)
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			return nil
+		}
+		return fmt.Errorf("failed to look up veth %s: %w", name, err)
+	}
+	if err := netlink.LinkDel(veth); err != nil && !errors.Is(err, syscall.ENODEV) {
+		return fmt.Errorf("failed to delete veth %s: %w", name, err)
+	}
+	return nil
+}
+
+// AttachToBridgeNamespace connects the network namespace of the process with the given PID to the bridge named
+// bridge. A veth pair is created with hostVeth on the host, attached to the bridge, and its peer moved into the
+// namespace, where it is named ifName, given addr, and brought up. No route is added besides the one to addr's
+// subnet, so the namespace keeps its default route. If any step fails the veth pair is removed again.
+func AttachToBridgeNamespace(bridge string, pid int, hostVeth, ifName string, addr *net.IPNet) (err error) {
+	// The peer is created on the host, so it needs a name that is free there until it is moved and renamed
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return fmt.Errorf("failed to generate veth peer name: %w", err)
+	}
+	peerName := "vpeer" + hex.EncodeToString(suffix)
+	host, peer, err := CreateVethPair(hostVeth, peerName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// Deleting the host end takes the peer with it, wherever it is
+		if err == nil {
+			return
+		}
+		if link, lookupErr := netlink.LinkByName(hostVeth); lookupErr == nil {
+			_ = netlink.LinkDel(link)
+		}
+	}()
+
+	if err := AttachToBridge(bridge, hostVeth); err != nil {
+		return err
+	}
+	if err := netlink.LinkSetUp(host); err != nil {
+		return fmt.Errorf("failed to bring up veth %s: %w", hostVeth, err)
+	}
+	if err := MoveLinkToNamespace(peer, pid); err != nil {
+		return err
+	}
+
+	nsHandle, err := netns.GetFromPid(pid)
+	if err != nil {
+		return fmt.Errorf("failed to get network namespace of process %d: %w", pid, err)
+	}
+	defer nsHandle.Close()
+	handle, err := netlink.NewHandleAt(nsHandle)
+	if err != nil {
+		return fmt.Errorf("failed to open netlink handle in namespace of process %d: %w", pid, err)
+	}
+	defer handle.Delete()
+
+	peer, err = handle.LinkByName(peerName)
+	if err != nil {
+		return fmt.Errorf("failed to find veth peer in namespace of process %d: %w", pid, err)
+	}
+	if err := handle.LinkSetName(peer, ifName); err != nil {
+		return fmt.Errorf("failed to rename veth peer to %s: %w", ifName, err)
+	}
+	if err := handle.AddrAdd(peer, &netlink.Addr{IPNet: addr}); err != nil {
+		return fmt.Errorf("failed to assign address %s to %s: %w", addr, ifName, err)
+	}
+	if err := handle.LinkSetUp(peer); err != nil {
+		return fmt.Errorf("failed to bring up %s: %w", ifName, err)
+	}
+	return nil
+}
+
+// CreateVethPair creates a veth pair with the ends named hostName and peerName, both in the caller's network
+// namespace, and returns the two ends as looked up after creation, so their indexes and attributes are filled in.
+// The ends are left down.
+func CreateVethPair(hostName, peerName string) (netlink.Link, netlink.Link, error) {
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: hostName}, PeerName: peerName}
+	if err := netlink.LinkAdd(veth); err != nil {
+		return nil, nil, fmt.Errorf("failed to create veth pair %s: %w", hostName, err)
+	}
+
+	host, err := netlink.LinkByName(hostName)
+	if err != nil {
+		_ = netlink.LinkDel(veth)
+		return nil, nil, fmt.Errorf("failed to look up veth %s: %w", hostName, err)
+	}
+	peer, err := netlink.LinkByName(peerName)
+	if err != nil {
+		_ = netlink.LinkDel(host)
+		return nil, nil, fmt.Errorf("failed to look up veth peer %s: %w", peerName, err)
+	}
+	return host, peer, nil
+}
+
+// MoveLinkToNamespace moves link into the network namespace of the process with the given PID. The link keeps its
+// name, so it must not clash with an interface in that namespace, and it is brought down by the move.
+func MoveLinkToNamespace(link netlink.Link, pid int) error {
+	if err := netlink.LinkSetNsPid(link, pid); err != nil {
+		return fmt.Errorf("failed to move %s into network namespace of process %d: %w", link.Attrs().Name, pid, err)
+	}
+	return nil
+}
+
+// FreeInterfaceName returns the first of prefix0, prefix1, ... up to prefix9 that no interface in the network
+// namespace of the process with the given PID is named.
+func FreeInterfaceName(pid int, prefix string) (string, error) {
+	nsHandle, err := netns.GetFromPid(pid)
+	if err != nil {
+		return "", fmt.Errorf("failed to get network namespace of process %d: %w", pid, err)
+	}
+	defer nsHandle.Close()
+	handle, err := netlink.NewHandleAt(nsHandle)
+	if err != nil {
+		return "", fmt.Errorf("failed to open netlink handle in namespace of process %d: %w", pid, err)
+	}
+	defer handle.Delete()
+
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("%s%d", prefix, i)
+		_, err := handle.LinkByName(name)
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			return name, nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to look up interface %s in namespace of process %d: %w", name, pid, err)
+		}
+	}
+	return "", fmt.Errorf("no free %sN interface name in namespace of process %d", prefix, pid)
+}
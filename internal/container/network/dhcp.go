@@ -1,6 +1,8 @@
 package network
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -8,7 +10,7 @@ import (
 	"time"
 
 	"github.com/insomniacslk/dhcp/dhcpv6"
-	"github.com/mdlayher/arp"
+	"github.com/insomniacslk/dhcp/dhcpv6/server6"
 	"github.com/vishvananda/netlink"
 )
 
@@ -17,84 +19,83 @@ func dhcpHandler(conn net.PacketConn, peer net.Addr, m dhcpv6.DHCPv6) {
 	log.Print(m.Summary())
 }
 
-// IsIPInUse checks if the given IP address is already in use.
-func IsIPInUse(ip net.IP) bool {
-	iface, err := net.InterfaceByIndex(1) // You may need to change this to the appropriate network interface index
-	if err != nil {
-		log.Printf("Error getting network interface: %v", err)
-		return true
+// dhcpServer is a running DHCP server and the channel closed once it has stopped serving.
+type dhcpServer struct {
+	server *server6.Server
+	served chan struct{}
+}
+
+// stop closes the server's listener and waits for it to stop serving. A server that already stopped is not an error.
+func (d *dhcpServer) stop() error {
+	if err := d.server.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return fmt.Errorf("failed to stop DHCP server: %w", err)
 	}
+	<-d.served
+	return nil
+}
 
-	// Get the source IP and hardware address for the network interface
-	sourceIP, sourceHardwareAddr := getSourceIPAndHardwareAddr(iface)
+// ErrIPInUse is returned when an address about to be assigned is already claimed by another host on the segment.
+var ErrIPInUse = errors.New("IP address already in use")
 
-	// Create an ARP client
-	client, err := arp.Dial(iface)
+// ErrNoDefaultRoute is returned when the host has no IPv4 default route, and so no interface that reaches the outside
+// network.
+var ErrNoDefaultRoute = errors.New("no default route: cannot tell which interface reaches the outside network")
+
+// arpProbeTimeout bounds how long checkIPConflict waits for another host to answer for an address.
+const arpProbeTimeout = 200 * time.Millisecond
+
+// checkIPConflict returns an error wrapping ErrIPInUse if a host other than iface itself claims ip on iface's
+// segment. The kernel neighbor table is consulted first, since it already knows the hosts the link has talked
+// to; a short ARP probe then catches hosts it has not seen. Entries whose resolution failed are ignored, and so
+// is a probe that cannot be sent, e.g. because iface has no IPv4 address yet, as the address may still be free.
+func checkIPConflict(ip net.IP, iface *net.Interface, handler NetworkHandler) error {
+	neighbors, err := handler.NeighList(iface.Index, netlink.FAMILY_ALL)
 	if err != nil {
-		log.Printf("Error creating ARP client: %v", err)
-		return true
+		return fmt.Errorf("failed to list neighbors of %s: %w", iface.Name, err)
 	}
-	defer client.Close()
-
-	// Create an ARP request
-	arpRequest, err := arp.NewPacket(
-		arp.OperationRequest,
-		sourceHardwareAddr,
-		netIPToNetIPAddr(sourceIP), // Use helper function to convert net.IP to netip.Addr
-		net.HardwareAddr{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF},
-		netIPToNetIPAddr(ip), // Use helper function to convert net.IP to netip.Addr
-	)
-	if err != nil {
-		log.Printf("Error creating ARP request: %v", err)
-		return true
+	for _, neighbor := range neighbors {
+		if !neighbor.IP.Equal(ip) || neighbor.State&(netlink.NUD_INCOMPLETE|netlink.NUD_FAILED) != 0 {
+			continue
+		}
+		if claimedByOther(neighbor.HardwareAddr, iface) {
+			return fmt.Errorf("%w: %s is claimed by %s on %s", ErrIPInUse, ip, neighbor.HardwareAddr, iface.Name)
+		}
 	}
 
-	// Send the ARP request
-	err = client.WriteTo(arpRequest, net.HardwareAddr{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF})
-	if err != nil {
-		log.Printf("Error sending ARP request: %v", err)
-		return true
+	if ip.To4() == nil {
+		return nil
 	}
-
-	// Set a one-second timeout
-	timeout := time.After(time.Second)
-
-	for {
-		select {
-		case <-timeout:
-			// Timeout reached, no ARP reply received
-			return false
-		default:
-			// Read ARP replies
-			arpReply, _, err := client.Read()
-			if err != nil {
-				continue
-			}
-
-			// Check if the ARP reply is for the target IP address
-			if arpReply.Operation == arp.OperationReply && arpReply.TargetIP == (netIPToNetIPAddr(ip)) { // Use helper function to convert net.IP to netip.Addr
-				return true
-			}
-		}
+	mac, err := handler.ProbeARP(iface, ip, arpProbeTimeout)
+	if err == nil && claimedByOther(mac, iface) {
+		return fmt.Errorf("%w: %s answered ARP for %s on %s", ErrIPInUse, mac, ip, iface.Name)
 	}
+	return nil
 }
 
-func getSourceIPAndHardwareAddr(iface *net.Interface) (net.IP, net.HardwareAddr) {
-	addrs, err := iface.Addrs()
+// claimedByOther reports whether mac is a hardware address other than iface's own.
+func claimedByOther(mac net.HardwareAddr, iface *net.Interface) bool {
+	return len(mac) > 0 && !bytes.Equal(mac, iface.HardwareAddr)
+}
+
+// IsIPInUse reports whether another host claims ip on the segment of the interface of the default route, as found
+// by checkIPConflict. All lookups go through handler. Without a default route there is no segment for another host to
+// claim ip on, so it counts as free; any other address that cannot be checked counts as in use.
+func IsIPInUse(ip net.IP, handler NetworkHandler) bool {
+	iface, err := defaultRouteInterface(handler)
+	if errors.Is(err, ErrNoDefaultRoute) {
+		return false
+	}
 	if err != nil {
-		log.Printf("Error getting addresses for interface: %v", err)
-		return nil, nil
+		log.Printf("Error getting network interface: %v", err)
+		return true
 	}
-
-	for _, addr := range addrs {
-		if ipNet, ok := addr.(*net.IPNet); ok {
-			if ip4 := ipNet.IP.To4(); ip4 != nil {
-				return ip4, iface.HardwareAddr
-			}
+	if err := checkIPConflict(ip, iface, handler); err != nil {
+		if !errors.Is(err, ErrIPInUse) {
+			log.Printf("Error checking whether %s is in use: %v", ip, err)
 		}
+		return true
 	}
-
-	return nil, nil
+	return false
 }
 
 func netIPToNetIPAddr(ip net.IP) netip.Addr {
@@ -113,18 +114,37 @@ func netIPToNetIPAddr(ip net.IP) netip.Addr {
 	return netip.Addr{}
 }
 
-// GetDefaultGateway returns the default gateway IP address for the given IPNet subnet.
-func GetDefaultGateway(ipNet *net.IPNet, handler NetworkHandler) (net.IP, error) {
-	interfaces, err := net.Interfaces()
+// DefaultRouteInterface returns the interface the host's IPv4 default route goes out of. It returns
+// ErrNoDefaultRoute if the host has none.
+func DefaultRouteInterface() (*net.Interface, error) {
+	return defaultRouteInterface(DefaultNetworkHandler{})
+}
+
+// defaultRouteInterface returns the interface of the IPv4 default route, looked up through handler.
+func defaultRouteInterface(handler NetworkHandler) (*net.Interface, error) {
+	routes, err := handler.RouteList(nil, netlink.FAMILY_V4)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get interfaces: %w", err)
+		return nil, fmt.Errorf("failed to get routes: %w", err)
 	}
-
-	var defaultIface *net.Interface
-	for _, iface := range interfaces {
-		if defaultIface == nil || iface.Index < defaultIface.Index {
-			defaultIface = &iface
+	for _, route := range routes {
+		if (route.Dst != nil && !isDefaultDst(route.Dst)) || route.LinkIndex == 0 {
+			continue
+		}
+		iface, err := handler.InterfaceByIndex(route.LinkIndex)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get interface %d of the default route: %w", route.LinkIndex, err)
 		}
+		return iface, nil
+	}
+	return nil, ErrNoDefaultRoute
+}
+
+// GetDefaultGateway returns the default gateway IP address for the given IPNet subnet, as routed on the interface of
+// the host's default route. It returns nil if that interface is not on the subnet.
+func GetDefaultGateway(ipNet *net.IPNet, handler NetworkHandler) (net.IP, error) {
+	defaultIface, err := defaultRouteInterface(handler)
+	if err != nil {
+		return nil, err
 	}
 
 	addrs, err := handler.Addrs(defaultIface)
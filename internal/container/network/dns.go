@@ -10,13 +10,16 @@ import (
 	"net"
 	"os"
 	"strings"
-	"time"
 )
 
-// GetDefaultDNS returns the default DNS IP address.
-func GetDefaultDNS() (net.IP, error) {
+// HostResolvConfPath is the host's resolv.conf, which GetDefaultDNS reads the nameservers from.
+var HostResolvConfPath = "/etc/resolv.conf"
+
+// GetDefaultDNS returns the host's DNS servers, from every nameserver line of HostResolvConfPath in order.
+// Lines whose address does not parse are skipped.
+func GetDefaultDNS() ([]net.IP, error) {
 	// Open the resolv.conf file
-	file, err := os.Open("/etc/resolv.conf")
+	file, err := os.Open(HostResolvConfPath)
 	if err != nil {
 		log.Printf("Error opening resolv.conf: %v", err)
 		return nil, err
@@ -24,6 +27,7 @@ func GetDefaultDNS() (net.IP, error) {
 	defer file.Close()
 
 	// Read the file line by line
+	var servers []net.IP
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -31,9 +35,8 @@ func GetDefaultDNS() (net.IP, error) {
 
 		// Look for the nameserver directive
 		if len(fields) >= 2 && fields[0] == "nameserver" {
-			ip := net.ParseIP(fields[1])
-			if ip != nil {
-				return ip, nil
+			if ip := net.ParseIP(fields[1]); ip != nil {
+				servers = append(servers, ip)
 			}
 		}
 	}
@@ -43,57 +46,7 @@ func GetDefaultDNS() (net.IP, error) {
 		return nil, err
 	}
 
-	return nil, nil
-}
-
-func configureDNS(containerID, dns string) error {
-	udpAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", dns, 53))
-	if err != nil {
-		return fmt.Errorf("failed to resolve DNS address: %w", err)
-	}
-
-	udpConn, err := net.DialUDP("udp", nil, udpAddr)
-	if err != nil {
-		return fmt.Errorf("failed to create UDP connection to DNS server: %w", err)
-	}
-	defer udpConn.Close()
-
-	// For example, querying "example.com" with a type A (IPv4) record
-	query, err := createDNSQuery("example.com", 1)
-	if err != nil {
-		return fmt.Errorf("failed to create DNS query: %w", err)
-	}
-	if _, err := udpConn.Write(query); err != nil {
-		return fmt.Errorf("failed to send DNS query: %w", err)
-	}
-
-	// Set a read timeout for the response
-	err = udpConn.SetReadDeadline(time.Now().Add(5 * time.Second))
-	if err != nil {
-		return fmt.Errorf("failed to set a read timeout for the response: %w", err)
-	}
-
-	// Read the DNS response
-	response := make([]byte, 512)
-	n, _, err := udpConn.ReadFrom(response)
-	if err != nil {
-		return fmt.Errorf("failed to read DNS response: %w", err)
-	}
-
-	// Parse the DNS response
-	answers, err := parseDNSResponse(response[:n])
-	if err != nil {
-		return fmt.Errorf("failed to parse DNS response: %w", err)
-	}
-
-	// Process the DNS response
-	for _, answer := range answers {
-		if answer.Type == 1 {
-			fmt.Printf("IPv4 address for %s: %s\n", answer.Name, answer.Data)
-		}
-	}
-
-	return nil
+	return servers, nil
 }
 
 func parseDNSResponse(response []byte) ([]Answer, error) {
@@ -146,8 +99,8 @@ func readDomainName(data []byte, offset int) (string, int, error) {
 				return "", offset, err
 			}
 			name = append(name, compressedName)
-			offset += 2
-			break
+			// A pointer ends the name, and takes up two bytes without a terminating zero
+			return strings.Join(name, "."), offset + 2, nil
 		}
 
 		offset++
@@ -185,6 +138,7 @@ func readAnswer(data []byte, offset int) (Answer, int, error) {
 	}, end + 10 + int(rdlength), nil
 }
 
+// createDNSQuery returns a recursive query for records of type qtype of domain in class IN, with a random ID.
 func createDNSQuery(domain string, qtype uint16) ([]byte, error) {
 	var idBytes [2]byte
 	if _, err := rand.Read(idBytes[:]); err != nil {
@@ -199,17 +153,20 @@ func createDNSQuery(domain string, qtype uint16) ([]byte, error) {
 	header[2] = header[2] | recursionDesiredFlag
 	binary.BigEndian.PutUint16(header[4:], 1) // One question
 
-	question := make([]byte, 0, 32)
-	labels := strings.Split(domain, ".")
-	for _, label := range labels {
-		question = append(question, byte(len(label)))
-		question = append(question, []byte(label)...)
+	question := make([]byte, 0, len(domain)+6)
+	if domain = strings.TrimSuffix(domain, "."); domain != "" {
+		for _, label := range strings.Split(domain, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, fmt.Errorf("invalid domain name %q", domain)
+			}
+			question = append(question, byte(len(label)))
+			question = append(question, label...)
+		}
 	}
 	question = append(question, 0) // Zero-length label (root)
 
-	binary.BigEndian.PutUint16(question, uint16(len(question)-2))
-	binary.BigEndian.PutUint16(question, qtype)
-	binary.BigEndian.PutUint16(question, 1) // Class IN
+	question = binary.BigEndian.AppendUint16(question, qtype)
+	question = binary.BigEndian.AppendUint16(question, 1) // Class IN
 
 	return append(header, question...), nil
 }
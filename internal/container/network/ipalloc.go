@@ -0,0 +1,202 @@
+package network
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// IPAllocator hands out the host addresses of a subnet. Probing the network for a free address leaves a gap until
+// the address is live in which another connection could find it free as well, so every address handed out is leased
+// until it is released, and never handed out twice. Networks of containers sharing a subnet share its allocator.
+// An allocator made with NewFileIPAllocator keeps its leases in a ledger file instead of in memory, so allocators in
+// other processes using the same ledger never hand out an address it leased either.
+type IPAllocator struct {
+	mu      sync.Mutex
+	subnet  *net.IPNet
+	gateway net.IP
+	leased  map[string]bool
+	// ledger is the file the leases are kept in, empty to keep them in memory.
+	ledger string
+}
+
+// NewIPAllocator returns an allocator for the host addresses of subnet with none leased but the gateway, if any.
+func NewIPAllocator(subnet *net.IPNet, gateway net.IP) *IPAllocator {
+	return &IPAllocator{subnet: subnet, gateway: gateway, leased: map[string]bool{}}
+}
+
+// NewFileIPAllocator returns an allocator like NewIPAllocator whose leases are kept in the ledger file at path,
+// which holds the leases of every subnet allocated from with it. Every allocation and release holds an exclusive lock
+// on the ledger, so concurrent callers in any process are serialized. The ledger is created on first use.
+func NewFileIPAllocator(path string, subnet *net.IPNet, gateway net.IP) *IPAllocator {
+	a := NewIPAllocator(subnet, gateway)
+	a.ledger = path
+	return a
+}
+
+// Allocate leases the first host address of the subnet that is not leased yet.
+func (a *IPAllocator) Allocate() (net.IP, error) {
+	return a.AllocateFree(0, nil)
+}
+
+// AllocateFree leases a host address of the subnet that is neither leased yet nor reported as in use by inUse, such
+// as an address another host on the network answers for. Subnets too large to scan are probed at up to maxAttempts
+// random addresses, as in CreateNetwork. A nil inUse only skips leased addresses.
+func (a *IPAllocator) AllocateFree(maxAttempts int, inUse func(net.IP) bool) (net.IP, error) {
+	var ip net.IP
+	err := a.update(func() error {
+		var err error
+		ip, err = findAvailableIP(a.subnet, maxAttempts, func(ip net.IP) bool {
+			return a.taken(ip) || (inUse != nil && inUse(ip))
+		})
+		if err != nil {
+			return err
+		}
+		a.leased[ip.String()] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ip, nil
+}
+
+// Reserve leases a specific address, failing if it is outside the subnet or leased already.
+func (a *IPAllocator) Reserve(ip net.IP) error {
+	return a.update(func() error {
+		if !a.subnet.Contains(ip) {
+			return fmt.Errorf("IP address %s is outside subnet %s", ip, a.subnet)
+		}
+		if a.taken(ip) {
+			return fmt.Errorf("%w: %s", ErrIPInUse, ip)
+		}
+		a.leased[ip.String()] = true
+		return nil
+	})
+}
+
+// Release returns an address to the allocator. Releasing an address that is not leased is not an error.
+func (a *IPAllocator) Release(ip net.IP) error {
+	return a.update(func() error {
+		delete(a.leased, ip.String())
+		return nil
+	})
+}
+
+// Leased returns the addresses of the subnet that are leased, in order.
+func (a *IPAllocator) Leased() ([]net.IP, error) {
+	var ips []net.IP
+	err := a.update(func() error {
+		for ip := range a.leased {
+			ips = append(ips, net.ParseIP(ip))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(ips, func(i, j int) bool { return bytes.Compare(ips[i].To16(), ips[j].To16()) < 0 })
+	return ips, nil
+}
+
+// taken reports whether ip is leased or is the gateway.
+func (a *IPAllocator) taken(ip net.IP) bool {
+	return a.leased[ip.String()] || (a.gateway != nil && a.gateway.Equal(ip))
+}
+
+// update runs fn with the allocator's leases up to date, and saves them if fn succeeds. With a ledger, the leases are
+// read from it and written back while it is locked, so no other allocator changes them in between.
+func (a *IPAllocator) update(fn func() error) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.ledger == "" {
+		return fn()
+	}
+
+	unlock, err := lockLedger(a.ledger)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	leases, err := readLedger(a.ledger)
+	if err != nil {
+		return err
+	}
+	subnet := (&net.IPNet{IP: a.subnet.IP.Mask(a.subnet.Mask), Mask: a.subnet.Mask}).String()
+	a.leased = map[string]bool{}
+	for _, ip := range leases[subnet] {
+		a.leased[ip] = true
+	}
+
+	if err := fn(); err != nil {
+		return err
+	}
+	leases[subnet] = leases[subnet][:0]
+	for ip := range a.leased {
+		leases[subnet] = append(leases[subnet], ip)
+	}
+	sort.Strings(leases[subnet])
+	if len(leases[subnet]) == 0 {
+		delete(leases, subnet)
+	}
+	return writeLedger(a.ledger, leases)
+}
+
+// lockLedger takes an exclusive lock on the ledger at path, through a lock file next to it since the ledger itself is
+// replaced on every write. It returns the function that releases the lock.
+func lockLedger(path string) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create IP ledger directory: %w", err)
+	}
+	f, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open IP ledger lock: %w", err)
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock IP ledger %s: %w", path, err)
+	}
+	return func() {
+		_ = unix.Flock(int(f.Fd()), unix.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// readLedger reads the leased addresses of every subnet in the ledger at path. A missing ledger has no leases.
+func readLedger(path string) (map[string][]string, error) {
+	leases := map[string][]string{}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return leases, nil
+		}
+		return nil, fmt.Errorf("failed to read IP ledger %s: %w", path, err)
+	}
+	if err := json.Unmarshal(data, &leases); err != nil {
+		return nil, fmt.Errorf("failed to decode IP ledger %s: %w", path, err)
+	}
+	return leases, nil
+}
+
+// writeLedger replaces the ledger at path atomically, so readers never see a partially written one.
+func writeLedger(path string, leases map[string][]string) error {
+	data, err := json.MarshalIndent(leases, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode IP ledger: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write IP ledger %s: %w", path, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write IP ledger %s: %w", path, err)
+	}
+	return nil
+}
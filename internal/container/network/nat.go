@@ -0,0 +1,97 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// masqueradeRule returns the rule in the nat table's POSTROUTING chain that masquerades traffic from subnet leaving
+// through outboundIface. Traffic between containers on the subnet is left alone, so they see each other's addresses.
+func masqueradeRule(subnet *net.IPNet, outboundIface string) []string {
+	return []string{"-s", subnet.String(), "!", "-d", subnet.String(), "-o", outboundIface, "-j", "MASQUERADE"}
+}
+
+// EnableMasquerade adds a MASQUERADE rule to the nat table's POSTROUTING chain, so containers on subnet reach
+// external hosts with the address of outboundIface. Adding the rule again is a no-op, so it does not stack up when
+// the network is set up more than once.
+func EnableMasquerade(subnet *net.IPNet, outboundIface string) error {
+	ipt, err := iptables.New()
+	if err != nil {
+		return fmt.Errorf("failed to initialize iptables: %w", err)
+	}
+	if err := ipt.AppendUnique("nat", "POSTROUTING", masqueradeRule(subnet, outboundIface)...); err != nil {
+		return fmt.Errorf("failed to masquerade %s through %s: %w", subnet, outboundIface, err)
+	}
+	return nil
+}
+
+// DisableMasquerade removes the rule added by EnableMasquerade. A rule that is already gone is not an error.
+func DisableMasquerade(subnet *net.IPNet, outboundIface string) error {
+	ipt, err := iptables.New()
+	if err != nil {
+		return fmt.Errorf("failed to initialize iptables: %w", err)
+	}
+	if err := ipt.DeleteIfExists("nat", "POSTROUTING", masqueradeRule(subnet, outboundIface)...); err != nil {
+		return fmt.Errorf("failed to stop masquerading %s through %s: %w", subnet, outboundIface, err)
+	}
+	return nil
+}
+
+// dnatRule returns the rule in the nat table's PREROUTING chain that forwards the host port of m to containerIP.
+func dnatRule(containerIP net.IP, m PortMapping) []string {
+	rule := []string{"-p", m.Protocol}
+	if m.HostIP != nil {
+		rule = append(rule, "-d", m.HostIP.String())
+	}
+	destination := net.JoinHostPort(containerIP.String(), strconv.Itoa(m.ContainerPort))
+	return append(rule, "--dport", strconv.Itoa(m.HostPort), "-j", "DNAT", "--to-destination", destination)
+}
+
+// validatePublish returns an error unless m can be turned into a DNAT rule to containerIP.
+func validatePublish(containerIP net.IP, m PortMapping) error {
+	if containerIP == nil {
+		return fmt.Errorf("cannot publish port %s: container has no IP address", m)
+	}
+	if m.Protocol != "tcp" && m.Protocol != "udp" {
+		return fmt.Errorf("cannot publish port %s: protocol must be tcp or udp", m)
+	}
+	if m.HostPort <= 0 || m.HostPort > 65535 || m.ContainerPort <= 0 || m.ContainerPort > 65535 {
+		return fmt.Errorf("cannot publish port %s: host and container ports must be from 1 to 65535", m)
+	}
+	return nil
+}
+
+// PublishPort adds a DNAT rule to the nat table's PREROUTING chain that forwards traffic arriving for the host port
+// of m to the container port at containerIP. The host port must have been assigned already. Publishing the same
+// mapping again is a no-op.
+func PublishPort(containerIP net.IP, m PortMapping) error {
+	if err := validatePublish(containerIP, m); err != nil {
+		return err
+	}
+	ipt, err := iptables.New()
+	if err != nil {
+		return fmt.Errorf("failed to initialize iptables: %w", err)
+	}
+	if err := ipt.AppendUnique("nat", "PREROUTING", dnatRule(containerIP, m)...); err != nil {
+		return fmt.Errorf("failed to publish port %s: %w", m, err)
+	}
+	return nil
+}
+
+// UnpublishPort removes the rule added by PublishPort. A rule that is already gone is not an error.
+func UnpublishPort(containerIP net.IP, m PortMapping) error {
+	if err := validatePublish(containerIP, m); err != nil {
+		return err
+	}
+	ipt, err := iptables.New()
+	if err != nil {
+		return fmt.Errorf("failed to initialize iptables: %w", err)
+	}
+	if err := ipt.DeleteIfExists("nat", "PREROUTING", dnatRule(containerIP, m)...); err != nil {
+		return fmt.Errorf("failed to unpublish port %s: %w", m, err)
+	}
+	return nil
+}
@@ -2,21 +2,40 @@ package network
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"math/big"
 	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
+	"spocker/internal/container/filesystem"
+
 	"github.com/insomniacslk/dhcp/dhcpv6"
 	"github.com/insomniacslk/dhcp/dhcpv6/server6"
+	"github.com/mdlayher/arp"
 	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
 )
 
 func (dnh DefaultNetworkHandler) InterfaceByName(name string) (*net.Interface, error) {
 	return net.InterfaceByName(name)
 }
 
+func (dnh DefaultNetworkHandler) InterfaceByIndex(index int) (*net.Interface, error) {
+	return net.InterfaceByIndex(index)
+}
+
 func (dnh DefaultNetworkHandler) RouteList(link netlink.Link, family int) ([]netlink.Route, error) {
 	return netlink.RouteList(link, family)
 }
@@ -33,6 +52,109 @@ func (dnh DefaultNetworkHandler) Addrs(iface *net.Interface) ([]net.Addr, error)
 	return iface.Addrs()
 }
 
+func (dnh DefaultNetworkHandler) NeighList(linkIndex, family int) ([]netlink.Neigh, error) {
+	return netlink.NeighList(linkIndex, family)
+}
+
+func (dnh DefaultNetworkHandler) ProbeARP(iface *net.Interface, ip net.IP, timeout time.Duration) (net.HardwareAddr, error) {
+	client, err := arp.Dial(iface)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	if err := client.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	return client.Resolve(netIPToNetIPAddr(ip))
+}
+
+func (nh NamespaceHandler) InterfaceByName(name string) (iface *net.Interface, err error) {
+	err = nh.do(func() error {
+		iface, err = net.InterfaceByName(name)
+		return err
+	})
+	return iface, err
+}
+
+func (nh NamespaceHandler) InterfaceByIndex(index int) (iface *net.Interface, err error) {
+	err = nh.do(func() error {
+		iface, err = net.InterfaceByIndex(index)
+		return err
+	})
+	return iface, err
+}
+
+func (nh NamespaceHandler) RouteList(link netlink.Link, family int) (routes []netlink.Route, err error) {
+	err = nh.do(func() error {
+		routes, err = netlink.RouteList(link, family)
+		return err
+	})
+	return routes, err
+}
+
+func (nh NamespaceHandler) DialTimeout(network, address string, timeout time.Duration) (conn net.Conn, err error) {
+	err = nh.do(func() error {
+		conn, err = net.DialTimeout(network, address, timeout)
+		return err
+	})
+	return conn, err
+}
+
+func (nh NamespaceHandler) ResolveUDPAddr(network, address string) (addr *net.UDPAddr, err error) {
+	err = nh.do(func() error {
+		addr, err = net.ResolveUDPAddr(network, address)
+		return err
+	})
+	return addr, err
+}
+
+func (nh NamespaceHandler) Addrs(iface *net.Interface) (addrs []net.Addr, err error) {
+	err = nh.do(func() error {
+		addrs, err = iface.Addrs()
+		return err
+	})
+	return addrs, err
+}
+
+func (nh NamespaceHandler) NeighList(linkIndex, family int) (neighs []netlink.Neigh, err error) {
+	err = nh.do(func() error {
+		neighs, err = netlink.NeighList(linkIndex, family)
+		return err
+	})
+	return neighs, err
+}
+
+func (nh NamespaceHandler) ProbeARP(iface *net.Interface, ip net.IP, timeout time.Duration) (hw net.HardwareAddr, err error) {
+	err = nh.do(func() error {
+		hw, err = DefaultNetworkHandler{}.ProbeARP(iface, ip, timeout)
+		return err
+	})
+	return hw, err
+}
+
+// do runs fn on a thread of its own that has entered the handler's network namespace, so the sockets fn opens are
+// in that namespace.
+func (nh NamespaceHandler) do(fn func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		// The thread is never unlocked, so it exits with the goroutine instead of returning to the pool.
+		runtime.LockOSThread()
+
+		nsHandle, err := netns.GetFromPid(nh.PID)
+		if err != nil {
+			done <- fmt.Errorf("failed to get network namespace of process %d: %w", nh.PID, err)
+			return
+		}
+		defer nsHandle.Close()
+		if err := netns.Set(nsHandle); err != nil {
+			done <- fmt.Errorf("failed to enter network namespace of process %d: %w", nh.PID, err)
+			return
+		}
+		done <- fn()
+	}()
+	return <-done
+}
+
 // CreateNetwork creates a new container network.
 func CreateNetwork(config *Config, handler NetworkHandler) (*Network, error) {
 	if config == nil || config.IPNet == nil {
@@ -43,6 +165,13 @@ func CreateNetwork(config *Config, handler NetworkHandler) (*Network, error) {
 		return nil, fmt.Errorf("network already exists: %w", err)
 	}
 
+	// Work on a copy so the caller's config is not mutated with the allocated address
+	ipNet := &net.IPNet{IP: config.IPNet.IP, Mask: config.IPNet.Mask}
+	gateway, err := config.gateway(handler)
+	if err != nil {
+		return nil, err
+	}
+	var dhcp *dhcpServer
 	if config.DHCP {
 		laddr := &net.UDPAddr{
 			IP:   net.ParseIP("::1"),
@@ -53,24 +182,26 @@ func CreateNetwork(config *Config, handler NetworkHandler) (*Network, error) {
 			return nil, fmt.Errorf("failed to create DHCP server: %w", err)
 		}
 
-		if err := server.Serve(); err != nil {
-			return nil, fmt.Errorf("failed to start DHCP server: %w", err)
-		}
+		// The server runs until the network is torn down, or it fails
+		dhcp = &dhcpServer{server: server, served: make(chan struct{})}
+		go func() {
+			defer close(dhcp.served)
+			if err := server.Serve(); err != nil && !errors.Is(err, net.ErrClosed) {
+				log.Printf("DHCP server for network %s stopped: %v", config.Name, err)
+			}
+		}()
 	} else {
-		ip, err := GetAvailableIP(config.IPNet, handler)
-		if err != nil {
-			return nil, fmt.Errorf("failed to assign IP address to container: %w", err)
+		inUse := config.unavailable(gateway, handler)
+		var ip net.IP
+		if config.Allocator != nil {
+			ip, err = config.Allocator.AllocateFree(config.MaxIPAttempts, inUse)
+		} else {
+			ip, err = findAvailableIP(config.IPNet, config.MaxIPAttempts, inUse)
 		}
-		config.IPNet.IP = ip
-	}
-
-	gateway := config.Gateway
-	if gateway == nil {
-		defaultGateway, err := GetDefaultGateway(config.IPNet, handler)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get default gateway: %w", err)
+			return nil, fmt.Errorf("failed to assign IP address to container: %w", err)
 		}
-		gateway = defaultGateway
+		ipNet = &net.IPNet{IP: ip, Mask: config.IPNet.Mask}
 	}
 
 	dns := config.DNS
@@ -79,44 +210,203 @@ func CreateNetwork(config *Config, handler NetworkHandler) (*Network, error) {
 		if err != nil {
 			return nil, fmt.Errorf("failed to get default DNS: %w", err)
 		}
-		dns = []net.IP{defaultDNS}
+		dns = defaultDNS
 	}
 
 	network := &Network{
-		Name:    config.Name,
-		IPNet:   config.IPNet,
-		Gateway: gateway,
-		DNS:     dns,
-		DHCP:    config.DHCP,
+		Name:      config.Name,
+		IPNet:     ipNet,
+		Gateway:   gateway,
+		DNS:       dns,
+		DHCP:      config.DHCP,
+		Allocator: config.Allocator,
+		dhcp:      dhcp,
 	}
 
 	return network, nil
 }
 
-// GetAvailableIP finds and returns an available IP address in the given IPNet subnet range.
-func GetAvailableIP(ipNet *net.IPNet, handler NetworkHandler) (net.IP, error) {
-	ipRange := ipNet.IP.Mask(ipNet.Mask)
+// Result reports the addressing the container ended up with on the network. handler looks into the container's
+// network namespace, as a NamespaceHandler does: once AttachNamespace has plumbed the container's interface,
+// ContainerInterfaceName, its MAC address and its address on the network's subnet are reported. Until then, or if
+// the interface cannot be read, the address assigned in IPNet is reported without a MAC address. Interface is the
+// host end of the network, which traffic counters are read from.
+func (n *Network) Result(handler NetworkHandler) *NetworkResult {
+	result := &NetworkResult{
+		Gateway:    n.Gateway,
+		Interface:  n.Name,
+		Masquerade: n.Masquerade,
+		Bridge:     n.Bridge,
+	}
+	if n.IPNet != nil {
+		result.IP = n.IPNet.IP
+		result.PrefixLen, _ = n.IPNet.Mask.Size()
+	}
+
+	iface, err := handler.InterfaceByName(ContainerInterfaceName)
+	if err != nil {
+		return result
+	}
+	result.MAC = iface.HardwareAddr.String()
+	addrs, err := handler.Addrs(iface)
+	if err != nil {
+		return result
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || !ipNet.IP.IsGlobalUnicast() || (n.IPNet != nil && !n.IPNet.Contains(ipNet.IP)) {
+			continue
+		}
+		result.IP = ipNet.IP
+		result.PrefixLen, _ = ipNet.Mask.Size()
+		break
+	}
+	return result
+}
+
+// Subnet returns the subnet the container's address is on, or nil if the result has no address.
+func (r *NetworkResult) Subnet() *net.IPNet {
+	if r == nil || r.IP == nil || r.PrefixLen == 0 {
+		return nil
+	}
+	bits := 8 * net.IPv6len
+	if r.IP.To4() != nil {
+		bits = 8 * net.IPv4len
+	}
+	mask := net.CIDRMask(r.PrefixLen, bits)
+	return &net.IPNet{IP: r.IP.Mask(mask), Mask: mask}
+}
+
+// DefaultMaxIPAttempts is the number of random addresses probed in subnets too large to scan exhaustively.
+const DefaultMaxIPAttempts = 100
+
+// exhaustiveScanLimit is the largest number of host addresses a subnet can have and still be scanned exhaustively.
+const exhaustiveScanLimit = 1024
+
+// GetAvailableIP returns a host address of the config's subnet that CreateNetwork could assign: one that IsIPInUse
+// reports as free and that is neither excluded by the config nor its gateway. The network and broadcast addresses
+// are never returned. Addresses are looked for as CreateNetwork does: in order on small subnets, and at up to the
+// config's MaxIPAttempts random addresses on large ones.
+func GetAvailableIP(config *Config, handler NetworkHandler) (net.IP, error) {
+	if config == nil || config.IPNet == nil {
+		return nil, fmt.Errorf("invalid network configuration")
+	}
+	gateway, err := config.gateway(handler)
+	if err != nil {
+		return nil, err
+	}
+	return findAvailableIP(config.IPNet, config.MaxIPAttempts, config.unavailable(gateway, handler))
+}
+
+// gateway returns the config's gateway, or the default gateway of its subnet if it has none. Without a default
+// route there is no default gateway, and so none is returned.
+func (c *Config) gateway(handler NetworkHandler) (net.IP, error) {
+	if c.Gateway != nil {
+		return c.Gateway, nil
+	}
+	gateway, err := GetDefaultGateway(c.IPNet, handler)
+	if err != nil && !errors.Is(err, ErrNoDefaultRoute) {
+		return nil, fmt.Errorf("failed to get default gateway: %w", err)
+	}
+	return gateway, nil
+}
+
+// unavailable returns the predicate both GetAvailableIP and CreateNetwork allocate with: an address is unavailable if
+// the config excludes it, it is gateway, or IsIPInUse reports it as in use.
+func (c *Config) unavailable(gateway net.IP, handler NetworkHandler) func(net.IP) bool {
+	return func(ip net.IP) bool {
+		return c.excludes(ip) || (gateway != nil && gateway.Equal(ip)) || IsIPInUse(ip, handler)
+	}
+}
 
+// hostRange returns the network address of ipNet and the offsets from it of its first and last host addresses.
+// The network and broadcast addresses are not usable when the subnet is large enough to have them.
+func hostRange(ipNet *net.IPNet) (*big.Int, *big.Int, *big.Int, int, error) {
+	base := ipNet.IP.Mask(ipNet.Mask)
+	if base == nil {
+		return nil, nil, nil, 0, fmt.Errorf("invalid subnet: %v", ipNet)
+	}
 	ones, bits := ipNet.Mask.Size()
-	ipSpace := big.NewInt(1 << uint(bits-ones))
+	hostBits := uint(bits - ones)
+	size := new(big.Int).Lsh(big.NewInt(1), hostBits)
+
+	first, last := big.NewInt(0), new(big.Int).Sub(size, big.NewInt(1))
+	if hostBits >= 2 {
+		first.Add(first, big.NewInt(1))
+		last.Sub(last, big.NewInt(1))
+	}
+	return new(big.Int).SetBytes(base), first, last, len(base), nil
+}
 
-	// Try up to 10 random addresses
-	for i := 0; i < 10; i++ {
-		// Generate a random IP address within the subnet range
-		randInt, err := rand.Int(rand.Reader, ipSpace)
+// scanAvailableIP returns the first host address of ipNet, in order, for which inUse reports false.
+func scanAvailableIP(ipNet *net.IPNet, inUse func(net.IP) bool) (net.IP, error) {
+	baseInt, first, last, length, err := hostRange(ipNet)
+	if err != nil {
+		return nil, err
+	}
+	for offset := new(big.Int).Set(first); offset.Cmp(last) <= 0; offset.Add(offset, big.NewInt(1)) {
+		ip := intToIP(new(big.Int).Add(baseInt, offset), length)
+		if !inUse(ip) {
+			return ip, nil
+		}
+	}
+	return nil, fmt.Errorf("no available IP address in subnet %v", ipNet)
+}
+
+// findAvailableIP returns a host address in ipNet for which inUse reports false.
+// Subnets with at most exhaustiveScanLimit hosts are scanned in order, so a free address is always found if one
+// exists. Larger subnets are probed at up to maxAttempts random addresses.
+func findAvailableIP(ipNet *net.IPNet, maxAttempts int, inUse func(net.IP) bool) (net.IP, error) {
+	baseInt, first, last, length, err := hostRange(ipNet)
+	if err != nil {
+		return nil, err
+	}
+	hosts := new(big.Int).Add(new(big.Int).Sub(last, first), big.NewInt(1))
+	if hosts.Cmp(big.NewInt(exhaustiveScanLimit)) <= 0 {
+		return scanAvailableIP(ipNet, inUse)
+	}
+
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultMaxIPAttempts
+	}
+	for i := 0; i < maxAttempts; i++ {
+		randInt, err := rand.Int(rand.Reader, hosts)
 		if err != nil {
 			return nil, fmt.Errorf("failed to generate random IP address: %w", err)
 		}
-		ipInt := big.NewInt(0).Add(randInt, big.NewInt(0).SetBytes(ipRange.To16()))
-		ip := net.IP(ipInt.Bytes())
-
-		// Check if the IP address is available
-		if !IsIPInUse(ip) {
+		offset := randInt.Add(randInt, first)
+		ip := intToIP(offset.Add(offset, baseInt), length)
+		if !inUse(ip) {
 			return ip, nil
 		}
 	}
 
-	return nil, fmt.Errorf("no available IP address in subnet range")
+	return nil, fmt.Errorf("no available IP address found in subnet %v after %d attempts", ipNet, maxAttempts)
+}
+
+// excludes reports whether ip must not be allocated to a container: it is the gateway, one of the reserved
+// addresses, or inside one of the excluded ranges.
+func (c *Config) excludes(ip net.IP) bool {
+	if c.Gateway != nil && c.Gateway.Equal(ip) {
+		return true
+	}
+	for _, reserved := range c.ReservedIPs {
+		if reserved.Equal(ip) {
+			return true
+		}
+	}
+	for _, excluded := range c.ExcludeRanges {
+		if excluded.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// intToIP converts n into an IP address of the given byte length.
+func intToIP(n *big.Int, length int) net.IP {
+	ip := make(net.IP, length)
+	return n.FillBytes(ip)
 }
 
 // DeleteNetwork deletes an existing container network.
@@ -141,12 +431,145 @@ func DeleteNetwork(networkName string) error {
 	return nil
 }
 
+// NetnsDir is where named network namespaces are bind mounted, as by ip netns add.
+var NetnsDir = "/var/run/netns"
+
+// TeardownNetwork removes everything set up for a container's network in one go: the DNAT rules of its published
+// Ports, its host veth, which takes the peer inside the container with it, and any bind mount in NetnsDir that keeps
+// the container's network namespace alive, whether it is named after the network or is a bind of the namespace of the
+// process with the given PID. The container's address is released to the network's Allocator, and the masquerade
+// rule and the Bridge of its subnet are removed once no other address of the subnet is leased from it. The DHCP
+// server CreateNetwork started for a DHCP network is stopped.
+// Whatever is already gone is skipped, so it can be called again after a partial failure. A step that fails does not
+// stop the others; the first error is returned.
+func TeardownNetwork(containerPID int, network *Network) error {
+	if network == nil || network.Name == "" {
+		return fmt.Errorf("invalid network configuration")
+	}
+
+	var firstErr error
+	record := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if network.dhcp != nil {
+		record(network.dhcp.stop())
+		network.dhcp = nil
+	}
+
+	var containerIP net.IP
+	if network.IPNet != nil {
+		containerIP = network.IPNet.IP
+	}
+	for _, mapping := range network.Ports {
+		record(UnpublishPort(containerIP, mapping))
+	}
+
+	if link, err := netlink.LinkByName(network.Name); err == nil {
+		if err := netlink.LinkDel(link); err != nil && !errors.Is(err, syscall.ENODEV) {
+			record(fmt.Errorf("failed to delete interface %s: %w", network.Name, err))
+		}
+	} else {
+		var notFound netlink.LinkNotFoundError
+		if !errors.As(err, &notFound) {
+			record(fmt.Errorf("failed to look up interface %s: %w", network.Name, err))
+		}
+	}
+
+	binds, err := netnsBinds(containerPID, network.Name)
+	record(err)
+	for _, bind := range binds {
+		record(removeNetnsBind(bind))
+	}
+
+	if network.Allocator != nil && containerIP != nil {
+		record(network.Allocator.Release(containerIP))
+	}
+	if (network.Masquerade != "" || network.Bridge != "") && network.IPNet != nil {
+		// The rule and the bridge serve the whole subnet, so they stay for as long as another container holds an
+		// address on it
+		shared := false
+		if network.Allocator != nil {
+			leased, err := network.Allocator.Leased()
+			record(err)
+			shared = err != nil || len(leased) > 0
+		}
+		if !shared && network.Masquerade != "" {
+			subnet := &net.IPNet{IP: network.IPNet.IP.Mask(network.IPNet.Mask), Mask: network.IPNet.Mask}
+			record(DisableMasquerade(subnet, network.Masquerade))
+		}
+		if !shared && network.Bridge != "" {
+			record(DeleteBridge(network.Bridge))
+		}
+	}
+	return firstErr
+}
+
+// netnsBinds returns the bind mounts in NetnsDir that belong to the container: the one named name, and those of
+// the network namespace of the process with the given PID while it is still running.
+func netnsBinds(pid int, name string) ([]string, error) {
+	binds := map[string]bool{}
+	if _, err := os.Lstat(filepath.Join(NetnsDir, name)); err == nil {
+		binds[filepath.Join(NetnsDir, name)] = true
+	}
+
+	var nsStat unix.Stat_t
+	if pid > 0 && unix.Stat(filepath.Join("/proc", strconv.Itoa(pid), "ns", "net"), &nsStat) == nil {
+		entries, err := os.ReadDir(NetnsDir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to list %s: %w", NetnsDir, err)
+		}
+		for _, entry := range entries {
+			path := filepath.Join(NetnsDir, entry.Name())
+			var bindStat unix.Stat_t
+			if unix.Stat(path, &bindStat) == nil && bindStat.Dev == nsStat.Dev && bindStat.Ino == nsStat.Ino {
+				binds[path] = true
+			}
+		}
+	}
+
+	paths := make([]string, 0, len(binds))
+	for path := range binds {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// removeNetnsBind unmounts a network namespace bind mount and removes its mountpoint.
+func removeNetnsBind(path string) error {
+	if err := unix.Unmount(path, unix.MNT_DETACH); err != nil && !errors.Is(err, unix.EINVAL) && !errors.Is(err, unix.ENOENT) {
+		return fmt.Errorf("failed to unmount network namespace %s: %w", path, err)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove network namespace %s: %w", path, err)
+	}
+	return nil
+}
+
 // ConnectToNetwork connects the container to an existing network.
-func ConnectToNetwork(containerID string, network *Network) error {
+// The container's resolv.conf in Rootfs is written with the network's DNS servers and search domains.
+// With an Allocator, the container's address is leased from it, so concurrent connections cannot be given the
+// same one: an IPNet without a host address is given the first free one, and a given address must not be leased
+// already. The lease is released again if the connection fails.
+func ConnectToNetwork(containerID string, network *Network) (err error) {
 	if network == nil {
 		return fmt.Errorf("invalid network configuration")
 	}
 
+	if network.Allocator != nil {
+		if err := leaseAddress(network); err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				_ = network.Allocator.Release(network.IPNet.IP)
+			}
+		}()
+	}
+
 	iface, err := net.InterfaceByName(network.Name)
 	if err != nil {
 		return fmt.Errorf("network not found: %w", err)
@@ -157,6 +580,10 @@ func ConnectToNetwork(containerID string, network *Network) error {
 		return fmt.Errorf("failed to get network link: %w", err)
 	}
 
+	if err := checkIPConflict(network.IPNet.IP, iface, DefaultNetworkHandler{}); err != nil {
+		return err
+	}
+
 	ipAddr := &netlink.Addr{
 		IPNet: network.IPNet,
 	}
@@ -174,9 +601,9 @@ func ConnectToNetwork(containerID string, network *Network) error {
 		}
 	}
 
-	if network.DNS != nil && len(network.DNS) > 0 {
-		dns := network.DNS[0].String()
-		if err := configureDNS(containerID, dns); err != nil {
+	if network.Rootfs != "" {
+		fs := &filesystem.Filesystem{Root: network.Rootfs}
+		if err := fs.WriteResolvConf(network.DNS, network.SearchDomains); err != nil {
 			return fmt.Errorf("failed to configure DNS: %w", err)
 		}
 	}
@@ -186,11 +613,171 @@ func ConnectToNetwork(containerID string, network *Network) error {
 	return nil
 }
 
-// DisconnectFromNetwork disconnects a container from a network.
-func DisconnectFromNetwork(containerID, networkName string) error {
-	if networkName == "" {
+// leaseAddress leases the address of the network's IPNet from its Allocator, allocating one if the IPNet holds only
+// the subnet.
+func leaseAddress(network *Network) error {
+	if network.IPNet == nil {
+		return fmt.Errorf("invalid network configuration")
+	}
+	if network.IPNet.IP != nil && !network.IPNet.IP.Equal(network.IPNet.IP.Mask(network.IPNet.Mask)) {
+		return network.Allocator.Reserve(network.IPNet.IP)
+	}
+	ip, err := network.Allocator.Allocate()
+	if err != nil {
+		return fmt.Errorf("failed to assign IP address to container: %w", err)
+	}
+	network.IPNet = &net.IPNet{IP: ip, Mask: network.IPNet.Mask}
+	return nil
+}
+
+// AttachNamespace plumbs the network into the network namespace of the process with the given PID. The bridge of
+// the network's subnet, named by BridgeName, is created with the gateway as its address unless it exists already,
+// and a veth pair is attached to it: the host end is named after the network, and the other end is moved into the
+// namespace as ContainerInterfaceName, given the network's address, and used for a default route through the
+// gateway. Without a gateway the bridge has no address and no default route is added. The bridge is recorded in
+// the network's Bridge for TeardownNetwork. If any step fails the veth pair is removed again.
+func (n *Network) AttachNamespace(pid int) (err error) {
+	if n.Name == "" || n.IPNet == nil {
+		return fmt.Errorf("invalid network configuration")
+	}
+	subnet := &net.IPNet{IP: n.IPNet.IP.Mask(n.IPNet.Mask), Mask: n.IPNet.Mask}
+	var gateway *net.IPNet
+	if n.Gateway != nil {
+		gateway = &net.IPNet{IP: n.Gateway, Mask: n.IPNet.Mask}
+	}
+	bridge := BridgeName(subnet)
+	if _, err := EnsureBridge(bridge, gateway); err != nil {
+		return err
+	}
+	n.Bridge = bridge
+
+	if err := AttachToBridgeNamespace(bridge, pid, n.Name, ContainerInterfaceName, n.IPNet); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = DeleteVeth(n.Name)
+		}
+	}()
+	if n.Gateway == nil {
+		return nil
+	}
+
+	nsHandle, err := netns.GetFromPid(pid)
+	if err != nil {
+		return fmt.Errorf("failed to get network namespace of process %d: %w", pid, err)
+	}
+	defer nsHandle.Close()
+	handle, err := netlink.NewHandleAt(nsHandle)
+	if err != nil {
+		return fmt.Errorf("failed to open netlink handle in namespace of process %d: %w", pid, err)
+	}
+	defer handle.Delete()
+	link, err := handle.LinkByName(ContainerInterfaceName)
+	if err != nil {
+		return fmt.Errorf("failed to find %s in namespace of process %d: %w", ContainerInterfaceName, pid, err)
+	}
+	if err := handle.RouteAdd(&netlink.Route{LinkIndex: link.Attrs().Index, Gw: n.Gateway}); err != nil {
+		return fmt.Errorf("failed to add default route via %s: %w", n.Gateway, err)
+	}
+	return nil
+}
+
+// VerifyConnected reads back the configuration of the container's interface, ContainerInterfaceName, through
+// handler, which must look into the container's network namespace as a NamespaceHandler does, and checks that it is
+// what AttachNamespace applies: the interface has the network's address, and, when the network has a gateway, a
+// default route goes through it. This catches a connection that silently failed part way. Every discrepancy is
+// described in the returned error, with what was wanted against what was found.
+func VerifyConnected(network *Network, handler NetworkHandler) error {
+	if network == nil || network.Name == "" || network.IPNet == nil {
+		return fmt.Errorf("invalid network configuration")
+	}
+
+	iface, err := handler.InterfaceByName(ContainerInterfaceName)
+	if err != nil {
+		return fmt.Errorf("network %s: interface %s not found: %w", network.Name, ContainerInterfaceName, err)
+	}
+
+	var problems []string
+	addrs, err := handler.Addrs(iface)
+	if err != nil {
+		return fmt.Errorf("network %s: failed to read addresses: %w", network.Name, err)
+	}
+	var haveAddrs []string
+	assigned := false
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		haveAddrs = append(haveAddrs, ipNet.String())
+		if ipNet.IP.Equal(network.IPNet.IP) && ipNet.Mask.String() == network.IPNet.Mask.String() {
+			assigned = true
+		}
+	}
+	if !assigned {
+		problems = append(problems, fmt.Sprintf("address: want %s, have %s", network.IPNet, listOrNone(haveAddrs)))
+	}
+
+	if network.Gateway != nil {
+		link := &netlink.Device{LinkAttrs: netlink.LinkAttrs{Index: iface.Index, Name: iface.Name}}
+		routes, err := handler.RouteList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return fmt.Errorf("network %s: failed to read routes: %w", network.Name, err)
+		}
+		var haveGateways []string
+		routed := false
+		for _, route := range routes {
+			if route.Dst != nil && !isDefaultDst(route.Dst) {
+				continue
+			}
+			haveGateways = append(haveGateways, route.Gw.String())
+			if route.Gw.Equal(network.Gateway) {
+				routed = true
+			}
+		}
+		if !routed {
+			problems = append(problems, fmt.Sprintf("default route: want via %s, have %s", network.Gateway, listOrNone(haveGateways)))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("network %s is not configured as intended: %s", network.Name, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// isDefaultDst reports whether dst is a default route destination, 0.0.0.0/0 or ::/0.
+func isDefaultDst(dst *net.IPNet) bool {
+	ones, _ := dst.Mask.Size()
+	return ones == 0 && dst.IP.IsUnspecified()
+}
+
+// listOrNone joins items for an error message, or returns "none" if there are none.
+func listOrNone(items []string) string {
+	if len(items) == 0 {
+		return "none"
+	}
+	return strings.Join(items, ", ")
+}
+
+// DisconnectFromNetwork disconnects a container from a network, unpublishing the network's ports first. The
+// container's address is released to the network's Allocator, if it has one.
+func DisconnectFromNetwork(containerID string, network *Network) error {
+	if network == nil || network.Name == "" {
 		return fmt.Errorf("invalid network name")
 	}
+	networkName := network.Name
+
+	var containerIP net.IP
+	if network.IPNet != nil {
+		containerIP = network.IPNet.IP
+	}
+	for _, mapping := range network.Ports {
+		if err := UnpublishPort(containerIP, mapping); err != nil {
+			return err
+		}
+	}
 
 	iface, err := net.InterfaceByName(networkName)
 	if err != nil {
@@ -205,8 +792,158 @@ func DisconnectFromNetwork(containerID, networkName string) error {
 	if err := netlink.LinkSetDown(link); err != nil {
 		return fmt.Errorf("failed to bring down network link: %w", err)
 	}
+	if network.Allocator != nil && containerIP != nil {
+		if err := network.Allocator.Release(containerIP); err != nil {
+			return err
+		}
+	}
 
 	log.Printf("Container %s disconnected from network %s", containerID, networkName)
 
 	return nil
 }
+
+// ParseMode converts a networking mode name into a Mode, defaulting to ModeBridge for an empty name.
+func ParseMode(name string) (Mode, error) {
+	switch Mode(name) {
+	case "", ModeBridge:
+		return ModeBridge, nil
+	case ModeHost:
+		return ModeHost, nil
+	case ModeNone:
+		return ModeNone, nil
+	case ModeContainer:
+		return ModeContainer, nil
+	default:
+		return "", fmt.Errorf("unknown network mode: %s", name)
+	}
+}
+
+// SetupLoopbackOnly brings up the loopback interface inside the network namespace of the process with the given PID.
+// No other interfaces are created, so the namespace stays isolated from every external network.
+func SetupLoopbackOnly(netnsPID int) error {
+	nsHandle, err := netns.GetFromPid(netnsPID)
+	if err != nil {
+		return fmt.Errorf("failed to get network namespace of process %d: %w", netnsPID, err)
+	}
+	defer nsHandle.Close()
+
+	handle, err := netlink.NewHandleAt(nsHandle)
+	if err != nil {
+		return fmt.Errorf("failed to open netlink handle in namespace of process %d: %w", netnsPID, err)
+	}
+	defer handle.Delete()
+
+	lo, err := handle.LinkByName("lo")
+	if err != nil {
+		return fmt.Errorf("failed to find loopback interface: %w", err)
+	}
+
+	if err := handle.LinkSetUp(lo); err != nil {
+		return fmt.Errorf("failed to bring up loopback interface: %w", err)
+	}
+
+	return nil
+}
+
+// InterfaceStats returns the traffic counters of the named interface, such as a container's host-side veth.
+func InterfaceStats(name string) (*NetStats, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			return nil, fmt.Errorf("network interface %s not found", name)
+		}
+		return nil, fmt.Errorf("failed to look up network interface %s: %w", name, err)
+	}
+
+	stats := link.Attrs().Statistics
+	if stats == nil {
+		return nil, fmt.Errorf("no statistics reported for network interface %s", name)
+	}
+	return &NetStats{
+		RxBytes:   stats.RxBytes,
+		RxPackets: stats.RxPackets,
+		RxErrors:  stats.RxErrors,
+		RxDropped: stats.RxDropped,
+		TxBytes:   stats.TxBytes,
+		TxPackets: stats.TxPackets,
+		TxErrors:  stats.TxErrors,
+		TxDropped: stats.TxDropped,
+	}, nil
+}
+
+// ensureLink creates link, tolerating an interface of the same name left over from an earlier run.
+// An existing interface of the same kind is reused; one of a different kind is an error.
+// The returned link is looked up after creation so its index and other kernel-assigned attributes are filled in.
+func ensureLink(link netlink.Link) (netlink.Link, error) {
+	name := link.Attrs().Name
+	err := netlink.LinkAdd(link)
+	if err == nil {
+		return netlink.LinkByName(name)
+	}
+	if !errors.Is(err, syscall.EEXIST) {
+		return nil, fmt.Errorf("failed to create %s interface %s: %w", link.Type(), name, err)
+	}
+
+	existing, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up existing interface %s: %w", name, err)
+	}
+	if existing.Type() != link.Type() {
+		return nil, fmt.Errorf("interface %s already exists as a %s, not a %s", name, existing.Type(), link.Type())
+	}
+	return existing, nil
+}
+
+// maxInterfaceNameLen is the longest interface name the kernel accepts (IFNAMSIZ less the terminating NUL).
+const maxInterfaceNameLen = 15
+
+// maxVethSuffix bounds the suffix VethNames appends to a host veth name that is already taken.
+const maxVethSuffix = 999
+
+// ContainerInterfaceName is the name of the container's end of its veth pair, inside its network namespace.
+const ContainerInterfaceName = "eth0"
+
+// VethNames returns the names of the two ends of a container's veth pair: "veth" followed by eight hex digits
+// derived from the container ID for the host end, and ContainerInterfaceName for the end inside the container.
+// Container IDs are far longer than the kernel allows interface names to be, so the host name is a short prefix;
+// if an interface by that name already exists on the host, a numeric suffix is added until the name is free.
+// It returns an error if every suffix is taken.
+func VethNames(containerID string) (host, peer string, err error) {
+	host, err = vethNames(containerID, func(name string) bool {
+		_, err := net.InterfaceByName(name)
+		return err == nil
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return host, ContainerInterfaceName, nil
+}
+
+// vethNames returns the host veth name for the container, using exists to tell which names are taken.
+func vethNames(containerID string, exists func(name string) bool) (string, error) {
+	base := "veth" + vethID(containerID)
+	if !exists(base) {
+		return base, nil
+	}
+	for n := 1; n <= maxVethSuffix; n++ {
+		name := base + strconv.Itoa(n)
+		if !exists(name) {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("no free veth name for container %s: %s through %s%d are taken", containerID, base, base, maxVethSuffix)
+}
+
+// vethID returns the eight hex digits that identify the container in its veth name: the start of the ID when it
+// is hex, as generated container IDs are, or of the ID's SHA-256 otherwise.
+func vethID(containerID string) string {
+	if len(containerID) >= 8 {
+		if _, err := hex.DecodeString(containerID[:8]); err == nil {
+			return strings.ToLower(containerID[:8])
+		}
+	}
+	sum := sha256.Sum256([]byte(containerID))
+	return hex.EncodeToString(sum[:4])
+}
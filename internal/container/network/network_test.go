@@ -1,12 +1,24 @@
 package network
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/insomniacslk/dhcp/dhcpv6"
 	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
 )
 
 func TestCreateNetwork(t *testing.T) {
@@ -23,7 +35,7 @@ func TestCreateNetwork(t *testing.T) {
 	if err1 != nil {
 		t.Errorf("Test case 1 failed: %v", err1)
 	}
-	if net1.Name != "testnet1" || net1.IPNet.String() != "192.168.0.0/24" || net1.Gateway.String() != "192.168.0.1" || len(net1.DNS) != 1 || net1.DNS[0].String() != "8.8.8.8" || net1.DHCP {
+	if net1.Name != "testnet1" || net1.IPNet.String() != "192.168.0.2/24" || net1.Gateway.String() != "192.168.0.1" || len(net1.DNS) != 1 || net1.DNS[0].String() != "8.8.8.8" || net1.DHCP {
 		t.Errorf("Test case 1 failed: incorrect network configuration")
 	}
 
@@ -40,6 +52,8 @@ func TestCreateNetwork(t *testing.T) {
 	net2, err2 := CreateNetwork(config2, handler2)
 	if err2 != nil {
 		t.Errorf("Test case 2 failed: %v", err2)
+	} else {
+		defer TeardownNetwork(0, net2)
 	}
 	if net2.Name != "testnet2" || net2.IPNet.String() != "192.168.1.0/24" || net2.Gateway.String() != "192.168.1.1" || len(net2.DNS) != 1 || net2.DNS[0].String() != "8.8.8.8" || !net2.DHCP {
 		t.Errorf("Test case 2 failed: incorrect network configuration")
@@ -61,54 +75,128 @@ func TestCreateNetwork(t *testing.T) {
 }
 
 func TestGetAvailableIP(t *testing.T) {
-	// Create a new IPNet with the 192.168.1.0/24 subnet range
 	_, ipNet, _ := net.ParseCIDR("192.168.1.0/24")
 
-	// Set up some IP addresses that are already in use
-	inUseIPs := []string{"192.168.1.1", "192.168.1.100", "192.168.1.200"}
-	for _, ip := range inUseIPs {
-		if err := os.Setenv(fmt.Sprintf("IP_IN_USE_%s", ip), "1"); err != nil {
-			t.Fatalf("failed to set environment variable: %v", err)
-		}
-		defer os.Unsetenv(fmt.Sprintf("IP_IN_USE_%s", ip))
+	// Hosts answer ARP for the first two addresses, so the scan moves past them
+	own, _ := net.ParseMAC("02:00:00:00:00:01")
+	foreign, _ := net.ParseMAC("02:00:00:00:00:99")
+	handler := &fakeNeighborHandler{
+		iface: &net.Interface{Index: 1, Name: "eth-test", HardwareAddr: own},
+		arp:   map[string]net.HardwareAddr{"192.168.1.1": foreign, "192.168.1.2": foreign},
+	}
+	ip, err := GetAvailableIP(&Config{IPNet: ipNet}, handler)
+	if err != nil {
+		t.Fatalf("GetAvailableIP returned an error: %v", err)
+	}
+	if !ip.Equal(net.ParseIP("192.168.1.3")) {
+		t.Fatalf("GetAvailableIP returned %v, want 192.168.1.3", ip)
+	}
+	if IsIPInUse(ip, handler) {
+		t.Fatalf("GetAvailableIP returned an IP that is already in use: %v", ip)
+	}
+}
+
+func TestAvailableIPExclusions(t *testing.T) {
+	// The host's default route is on the subnet, through the gateway .1, and no other host answers for any address
+	_, subnet, _ := net.ParseCIDR("10.9.0.0/24")
+	handler := &fakeFreeHandler{fakeInterfaceHandler{
+		iface: &net.Interface{Index: 2, Name: "eth-test"},
+		addrs: []net.Addr{&net.IPNet{IP: net.ParseIP("10.9.0.50"), Mask: subnet.Mask}},
+		routes: []netlink.Route{
+			{LinkIndex: 2, Gw: net.ParseIP("10.9.0.1")},
+			{LinkIndex: 2, Dst: subnet, Gw: net.ParseIP("10.9.0.1")},
+		},
+	}}
+	_, excluded, _ := net.ParseCIDR("10.9.0.2/31")
+	config := &Config{
+		Name:          "testexcl0",
+		IPNet:         subnet,
+		DNS:           []net.IP{net.ParseIP("8.8.8.8")},
+		ExcludeRanges: []*net.IPNet{excluded},
+		ReservedIPs:   []net.IP{net.ParseIP("10.9.0.4")},
 	}
 
-	// Call GetAvailableIP and make sure it returns a valid IP address
-	handler := DefaultNetworkHandler{}
-	ip, err := GetAvailableIP(ipNet, handler)
+	// .1 is the default gateway, .2-.3 are excluded and .4 reserved, so both paths start at .5
+	ip, err := GetAvailableIP(config, handler)
 	if err != nil {
 		t.Fatalf("GetAvailableIP returned an error: %v", err)
 	}
-	if ip == nil {
-		t.Fatal("GetAvailableIP returned nil")
+	if !ip.Equal(net.ParseIP("10.9.0.5")) {
+		t.Errorf("GetAvailableIP returned %v, want 10.9.0.5", ip)
 	}
-	if !ipNet.Contains(ip) {
-		t.Fatalf("GetAvailableIP returned an IP outside of the subnet range: %v", ip)
+	n, err := CreateNetwork(config, handler)
+	if err != nil {
+		t.Fatalf("CreateNetwork returned an error: %v", err)
 	}
-	if IsIPInUse(ip) {
-		t.Fatalf("GetAvailableIP returned an IP that is already in use: %v", ip)
+	if !n.IPNet.IP.Equal(net.ParseIP("10.9.0.5")) || !n.Gateway.Equal(net.ParseIP("10.9.0.1")) {
+		t.Errorf("CreateNetwork assigned %v with gateway %v, want 10.9.0.5 with gateway 10.9.0.1", n.IPNet.IP, n.Gateway)
+	}
+
+	// Without any exclusions the default gateway is still skipped
+	n, err = CreateNetwork(&Config{Name: "testexcl0", IPNet: subnet, DNS: config.DNS}, handler)
+	if err != nil {
+		t.Fatalf("CreateNetwork returned an error: %v", err)
+	}
+	if !n.IPNet.IP.Equal(net.ParseIP("10.9.0.2")) {
+		t.Errorf("CreateNetwork assigned %v, want 10.9.0.2 past the default gateway", n.IPNet.IP)
 	}
 }
 
 func TestIsIPInUse(t *testing.T) {
-	// Set up an IP address that is in use
-	inUseIP := "192.168.1.1"
-	inUseAddr := net.ParseIP(inUseIP)
-	if err := os.Setenv(fmt.Sprintf("IP_IN_USE_%s", inUseIP), "1"); err != nil {
-		t.Fatalf("failed to set environment variable: %v", err)
+	own, _ := net.ParseMAC("02:00:00:00:00:01")
+	foreign, _ := net.ParseMAC("02:00:00:00:00:99")
+	handler := &fakeNeighborHandler{
+		iface: &net.Interface{Index: 1, Name: "eth-test", HardwareAddr: own},
+		neighbors: []netlink.Neigh{
+			{LinkIndex: 1, IP: net.ParseIP("192.168.1.1"), HardwareAddr: foreign, State: netlink.NUD_REACHABLE},
+		},
+		arp: map[string]net.HardwareAddr{"192.168.1.3": foreign},
+	}
+
+	for ip, want := range map[string]bool{"192.168.1.1": true, "192.168.1.2": false, "192.168.1.3": true} {
+		if got := IsIPInUse(net.ParseIP(ip), handler); got != want {
+			t.Errorf("IsIPInUse(%s) = %v, want %v", ip, got, want)
+		}
 	}
-	defer os.Unsetenv(fmt.Sprintf("IP_IN_USE_%s", inUseIP))
 
-	// Test that the in-use IP address is detected as being in use
-	if !IsIPInUse(inUseAddr) {
-		t.Fatalf("IsIPInUse failed to detect an in-use IP address: %v", inUseAddr)
+	// Without a default route there is no segment another host could claim the address on
+	if IsIPInUse(net.ParseIP("192.168.1.2"), &fakeNeighborHandler{}) {
+		t.Error("expected an address to count as free when the host has no default route")
 	}
 
-	// Test that a different IP address is detected as not being in use
-	unusedIP := "192.168.1.2"
-	unusedAddr := net.ParseIP(unusedIP)
-	if IsIPInUse(unusedAddr) {
-		t.Fatalf("IsIPInUse incorrectly detected an unused IP address as being in use: %v", unusedAddr)
+	// An interface that cannot be looked up cannot be probed, so the address cannot be known to be free
+	broken := &fakeInterfaceHandler{
+		iface:  &net.Interface{Index: 1, Name: "eth-test"},
+		routes: []netlink.Route{{LinkIndex: 2, Gw: net.ParseIP("192.168.1.1")}},
+	}
+	if !IsIPInUse(net.ParseIP("192.168.1.2"), broken) {
+		t.Error("expected an address to count as in use when the default route's interface cannot be found")
+	}
+}
+
+func TestGetAvailableIPWithoutDefaultRoute(t *testing.T) {
+	_, ipNet, _ := net.ParseCIDR("192.168.1.0/24")
+	ip, err := GetAvailableIP(&Config{IPNet: ipNet}, &fakeNeighborHandler{})
+	if err != nil {
+		t.Fatalf("GetAvailableIP returned an error: %v", err)
+	}
+	if !ip.Equal(net.ParseIP("192.168.1.1")) {
+		t.Errorf("GetAvailableIP returned %v, want 192.168.1.1", ip)
+	}
+}
+
+func TestGetAvailableIPLargeSubnet(t *testing.T) {
+	// With every address of a /8 taken, only MaxIPAttempts of them are probed rather than all 16 million
+	_, ipNet, _ := net.ParseCIDR("10.0.0.0/8")
+	config := &Config{IPNet: ipNet, ExcludeRanges: []*net.IPNet{ipNet}, MaxIPAttempts: 5}
+	if _, err := GetAvailableIP(config, &fakeNeighborHandler{}); err == nil || !strings.Contains(err.Error(), "after 5 attempts") {
+		t.Errorf("expected GetAvailableIP to give up after 5 attempts, got %v", err)
+	}
+
+	config.ExcludeRanges = nil
+	ip, err := GetAvailableIP(config, &fakeNeighborHandler{})
+	if err != nil || !ipNet.Contains(ip) {
+		t.Errorf("expected a free address in %s, got %v (%v)", ipNet, ip, err)
 	}
 }
 
@@ -119,18 +207,47 @@ func TestGetDefaultGateway(t *testing.T) {
 		Mask: net.IPv4Mask(255, 255, 255, 0),
 	}
 
-	handler := DefaultNetworkHandler{}
+	_, subnet, _ := net.ParseCIDR("192.168.1.0/24")
+	handler := &fakeInterfaceHandler{
+		iface: &net.Interface{Index: 2, Name: "eth0"},
+		addrs: []net.Addr{&net.IPNet{IP: net.ParseIP("192.168.1.10"), Mask: subnet.Mask}},
+		routes: []netlink.Route{
+			{LinkIndex: 2, Gw: expectedGateway},
+			{LinkIndex: 2, Dst: subnet, Gw: expectedGateway},
+		},
+	}
 	gateway, err := GetDefaultGateway(ipNet, handler)
 	if err != nil {
-		t.Errorf("GetDefaultGateway returned %v, expected nil", expectedGateway)
+		t.Fatalf("GetDefaultGateway returned an error: %v", err)
+	}
+	if !gateway.Equal(expectedGateway) {
+		t.Errorf("GetDefaultGateway returned %v, expected %v", gateway, expectedGateway)
 	}
 
-	if gateway == nil {
-		t.Errorf("GetDefaultGateway returned nil, expected %v", expectedGateway)
+	handler.routes = handler.routes[1:]
+	if _, err := GetDefaultGateway(ipNet, handler); err == nil || !strings.Contains(err.Error(), "no default route") {
+		t.Errorf("expected a no default route error, got %v", err)
 	}
+}
 
-	if !gateway.Equal(expectedGateway) {
-		t.Errorf("GetDefaultGateway returned %v, expected %v", gateway, expectedGateway)
+func TestDefaultRouteInterface(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.0.0.0/24")
+	_, everything, _ := net.ParseCIDR("0.0.0.0/0")
+	handler := &fakeInterfaceHandler{
+		iface: &net.Interface{Index: 7, Name: "eth7"},
+		routes: []netlink.Route{
+			{LinkIndex: 1, Dst: subnet},
+			{LinkIndex: 7, Dst: everything, Gw: net.ParseIP("10.0.0.1")},
+		},
+	}
+	iface, err := defaultRouteInterface(handler)
+	if err != nil || iface.Name != "eth7" {
+		t.Errorf("defaultRouteInterface = %v, %v, want eth7", iface, err)
+	}
+
+	handler.routes = handler.routes[:1]
+	if _, err := defaultRouteInterface(handler); err == nil || !strings.Contains(err.Error(), "no default route") {
+		t.Errorf("expected a no default route error, got %v", err)
 	}
 }
 
@@ -150,15 +267,21 @@ func TestGetDefaultDNS(t *testing.T) {
 	}
 
 	// Test the GetDefaultDNS function with the temporary file
-	expected := net.ParseIP("8.8.8.8")
+	oldPath := HostResolvConfPath
+	HostResolvConfPath = tmpfile.Name()
+	defer func() { HostResolvConfPath = oldPath }()
 	actual, err := GetDefaultDNS()
 	if err != nil {
-		t.Fatalf("Failed to get default DNA: %v", err)
+		t.Fatalf("Failed to get default DNS: %v", err)
+	}
+	expected := []net.IP{net.ParseIP("8.8.8.8"), net.ParseIP("8.8.4.4")}
+	if len(actual) != len(expected) {
+		t.Fatalf("GetDefaultDNS returned %v, expected %v", actual, expected)
 	}
-	if actual == nil {
-		t.Errorf("GetDefaultDNS returned nil")
-	} else if !actual.Equal(expected) {
-		t.Errorf("GetDefaultDNS returned %v, expected %v", actual, expected)
+	for i := range expected {
+		if !actual[i].Equal(expected[i]) {
+			t.Errorf("GetDefaultDNS returned %v, expected %v", actual, expected)
+		}
 	}
 }
 
@@ -206,6 +329,17 @@ func createTestNetwork(ifName string) error {
 	return nil
 }
 
+// Helper function to create a veth pair for tests that need a real link on kernels without the dummy driver
+func createTestVeth(ifName, peerName string) error {
+	link := &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{
+			Name: ifName,
+		},
+		PeerName: peerName,
+	}
+	return netlink.LinkAdd(link)
+}
+
 func TestConnectToNetwork(t *testing.T) {
 	networkName := "test_network"
 	err := createTestNetwork(networkName)
@@ -222,7 +356,8 @@ func TestConnectToNetwork(t *testing.T) {
 		Name:    networkName,
 		IPNet:   ipNet,
 		Gateway: net.ParseIP("192.168.0.1"),
-		DNS:     []net.IP{net.ParseIP("8.8.8.8")},
+		DNS:     []net.IP{net.ParseIP("8.8.8.8"), net.ParseIP("8.8.4.4")},
+		Rootfs:  t.TempDir(),
 	}
 
 	err = ConnectToNetwork(containerID, network)
@@ -230,6 +365,12 @@ func TestConnectToNetwork(t *testing.T) {
 		t.Fatalf("Failed to connect container %s to network %s: %v", containerID, networkName, err)
 	}
 
+	// Check that the container's resolv.conf points at all of the network's DNS servers
+	resolvConf, err := os.ReadFile(filepath.Join(network.Rootfs, "etc", "resolv.conf"))
+	if err != nil || string(resolvConf) != "nameserver 8.8.8.8\nnameserver 8.8.4.4\n" {
+		t.Fatalf("expected resolv.conf to name 8.8.8.8 and 8.8.4.4, got %q (%v)", resolvConf, err)
+	}
+
 	// Check that the container is assigned the correct IP address
 	addrs, err := netlink.AddrList(nil, netlink.FAMILY_ALL)
 	if err != nil {
@@ -269,7 +410,7 @@ func TestConnectToNetwork(t *testing.T) {
 	}
 	conn.Close()
 
-	err = DisconnectFromNetwork(containerID, network.Name)
+	err = DisconnectFromNetwork(containerID, network)
 	if err != nil {
 		t.Fatalf("Failed to disconnect container %s from network %s: %v", containerID, networkName, err)
 	}
@@ -304,7 +445,7 @@ func TestDisconnectFromNetwork(t *testing.T) {
 		t.Fatalf("Failed to connect container %s to network %s: %v", containerID, networkName, err)
 	}
 
-	err = DisconnectFromNetwork(containerID, network.Name)
+	err = DisconnectFromNetwork(containerID, network)
 	if err != nil {
 		t.Fatalf("Failed to disconnect container %s from network %s: %v", containerID, networkName, err)
 	}
@@ -409,6 +550,8 @@ func TestConnectToNetwork_DuplicateIPAddress(t *testing.T) {
 		IPNet:   ipNet,
 		Gateway: net.ParseIP("192.168.0.1"),
 		DNS:     []net.IP{net.ParseIP("8.8.8.8")},
+		// The second connection is refused by the allocator before it gets to probe the address
+		Allocator: NewIPAllocator(&net.IPNet{IP: net.IPv4(192, 168, 0, 0), Mask: net.CIDRMask(24, 32)}, net.ParseIP("192.168.0.1")),
 	}
 
 	// First connection attempt
@@ -424,8 +567,1219 @@ func TestConnectToNetwork_DuplicateIPAddress(t *testing.T) {
 		t.Fatalf("Expected error when connecting two containers with the same IP address, but got no error")
 	}
 
-	err = DisconnectFromNetwork(containerID, network.Name)
+	err = DisconnectFromNetwork(containerID, network)
 	if err != nil {
 		t.Fatalf("Failed to disconnect container %s from network %s: %v", containerID, networkName, err)
 	}
 }
+
+func TestParseMode(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    Mode
+		wantErr bool
+	}{
+		{"", ModeBridge, false},
+		{"bridge", ModeBridge, false},
+		{"host", ModeHost, false},
+		{"none", ModeNone, false},
+		{"overlay", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseMode(tt.name)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseMode(%q) error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("ParseMode(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSetupLoopbackOnly(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to create network namespaces")
+	}
+
+	cmd := exec.Command("sleep", "10")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNET}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start child: %v", err)
+	}
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+
+	if err := SetupLoopbackOnly(cmd.Process.Pid); err != nil {
+		t.Fatalf("SetupLoopbackOnly returned an error: %v", err)
+	}
+
+	nsHandle, err := netns.GetFromPid(cmd.Process.Pid)
+	if err != nil {
+		t.Fatalf("failed to get child network namespace: %v", err)
+	}
+	defer nsHandle.Close()
+
+	handle, err := netlink.NewHandleAt(nsHandle)
+	if err != nil {
+		t.Fatalf("failed to open netlink handle: %v", err)
+	}
+	defer handle.Delete()
+
+	links, err := handle.LinkList()
+	if err != nil {
+		t.Fatalf("failed to list links: %v", err)
+	}
+	if len(links) != 1 || links[0].Attrs().Name != "lo" {
+		t.Fatalf("expected only the lo interface, got %d links", len(links))
+	}
+	if links[0].Attrs().Flags&net.FlagUp == 0 {
+		t.Errorf("loopback interface is not up")
+	}
+
+	// Dial from inside the namespace; without any routes it must fail.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		t.Fatalf("failed to get current network namespace: %v", err)
+	}
+	defer origin.Close()
+	if err := netns.Set(nsHandle); err != nil {
+		t.Fatalf("failed to enter child network namespace: %v", err)
+	}
+	conn, dialErr := net.DialTimeout("tcp", "8.8.8.8:53", time.Second)
+	if err := netns.Set(origin); err != nil {
+		t.Fatalf("failed to restore network namespace: %v", err)
+	}
+	if dialErr == nil {
+		conn.Close()
+		t.Errorf("outbound dial succeeded from a loopback-only namespace")
+	}
+}
+
+func TestAttachNamespace(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to create network namespaces")
+	}
+
+	cmd := exec.Command("sleep", "10")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNET}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start child: %v", err)
+	}
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+
+	network := &Network{
+		Name:    "testattach0",
+		IPNet:   &net.IPNet{IP: net.IPv4(10, 201, 0, 2).To4(), Mask: net.CIDRMask(24, 32)},
+		Gateway: net.IPv4(10, 201, 0, 1).To4(),
+	}
+	if err := network.AttachNamespace(cmd.Process.Pid); err != nil {
+		t.Fatalf("AttachNamespace returned an error: %v", err)
+	}
+	defer TeardownNetwork(cmd.Process.Pid, network)
+	if network.Bridge != BridgeName(network.IPNet) {
+		t.Errorf("expected bridge %s to be recorded, got %q", BridgeName(network.IPNet), network.Bridge)
+	}
+
+	handler := NamespaceHandler{PID: cmd.Process.Pid}
+	if err := VerifyConnected(network, handler); err != nil {
+		t.Errorf("VerifyConnected returned an error for the attached namespace: %v", err)
+	}
+	// The host's view has no such interface, so the check must be made inside the namespace
+	if err := VerifyConnected(network, DefaultNetworkHandler{}); err == nil {
+		t.Error("expected VerifyConnected to fail when looking at the host's namespace")
+	}
+
+	// The gateway on the bridge answers from inside the namespace
+	listener, err := net.Listen("tcp", net.JoinHostPort(network.Gateway.String(), "0"))
+	if err != nil {
+		t.Fatalf("failed to listen on the gateway address: %v", err)
+	}
+	defer listener.Close()
+	conn, err := handler.DialTimeout("tcp", listener.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("failed to reach the gateway from the namespace: %v", err)
+	}
+	conn.Close()
+
+	if err := TeardownNetwork(cmd.Process.Pid, network); err != nil {
+		t.Fatalf("TeardownNetwork returned an error: %v", err)
+	}
+	for _, name := range []string{network.Name, network.Bridge} {
+		if _, err := net.InterfaceByName(name); err == nil {
+			t.Errorf("expected interface %s to be removed", name)
+		}
+	}
+}
+
+func TestNetworkResult(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.200.0.0/24")
+	network := &Network{
+		Name:    "veth-result",
+		IPNet:   &net.IPNet{IP: net.ParseIP("10.200.0.2").To4(), Mask: subnet.Mask},
+		Gateway: net.ParseIP("10.200.0.1"),
+		Bridge:  BridgeName(subnet),
+	}
+
+	// Before the container's interface is plumbed, the assigned address is reported without a MAC
+	result := network.Result(&fakeInterfaceHandler{iface: &net.Interface{Name: "eth1"}})
+	if !result.IP.Equal(network.IPNet.IP) || result.PrefixLen != 24 || result.MAC != "" {
+		t.Errorf("expected the assigned address without a MAC, got %+v", result)
+	}
+
+	// Once it is, what the interface has is reported
+	mac, _ := net.ParseMAC("02:42:0a:c8:00:05")
+	handler := &fakeInterfaceHandler{
+		iface: &net.Interface{Index: 2, Name: ContainerInterfaceName, HardwareAddr: mac},
+		addrs: []net.Addr{
+			&net.IPNet{IP: net.ParseIP("fe80::42:aff:fec8:5"), Mask: net.CIDRMask(64, 128)},
+			&net.IPNet{IP: net.ParseIP("10.200.0.5").To4(), Mask: net.CIDRMask(25, 32)},
+		},
+	}
+	result = network.Result(handler)
+	if !result.IP.Equal(net.ParseIP("10.200.0.5")) || result.PrefixLen != 25 {
+		t.Errorf("expected the interface's address 10.200.0.5/25, got %s/%d", result.IP, result.PrefixLen)
+	}
+	if result.MAC != mac.String() {
+		t.Errorf("expected the interface's MAC %s, got %s", mac, result.MAC)
+	}
+	if result.Interface != network.Name || result.Bridge != network.Bridge || !result.Gateway.Equal(network.Gateway) {
+		t.Errorf("unexpected result %+v", result)
+	}
+}
+
+func TestFindAvailableIPNearlyFullSubnet(t *testing.T) {
+	_, ipNet, _ := net.ParseCIDR("10.1.2.0/28")
+	free := net.ParseIP("10.1.2.9")
+
+	// Every host address except one is taken; random probing would often miss the free one.
+	inUse := func(ip net.IP) bool { return !ip.Equal(free) }
+
+	ip, err := findAvailableIP(ipNet, 1, inUse)
+	if err != nil {
+		t.Fatalf("findAvailableIP returned an error: %v", err)
+	}
+	if !ip.Equal(free) {
+		t.Errorf("findAvailableIP returned %v, want %v", ip, free)
+	}
+}
+
+func TestFindAvailableIPExhaustedSubnet(t *testing.T) {
+	_, ipNet, _ := net.ParseCIDR("10.1.2.0/28")
+	var probed []string
+	inUse := func(ip net.IP) bool {
+		probed = append(probed, ip.String())
+		return true
+	}
+
+	if _, err := findAvailableIP(ipNet, 1, inUse); err == nil {
+		t.Fatal("expected an error for an exhausted subnet")
+	}
+	// A /28 has 14 usable hosts; the network and broadcast addresses must never be probed.
+	if len(probed) != 14 {
+		t.Errorf("expected 14 probes, got %d", len(probed))
+	}
+	for _, ip := range probed {
+		if ip == "10.1.2.0" || ip == "10.1.2.15" {
+			t.Errorf("probed reserved address %s", ip)
+		}
+	}
+}
+
+func TestScanAvailableIP(t *testing.T) {
+	tests := []struct {
+		cidr   string
+		taken  []string
+		want   string
+		probes []string
+	}{
+		// A /30 has two hosts between its network and broadcast addresses
+		{cidr: "10.1.3.0/30", taken: []string{"10.1.3.1"}, want: "10.1.3.2", probes: []string{"10.1.3.1", "10.1.3.2"}},
+		{cidr: "10.1.4.0/24", taken: []string{"10.1.4.1", "10.1.4.2"}, want: "10.1.4.3", probes: []string{"10.1.4.1", "10.1.4.2", "10.1.4.3"}},
+		{cidr: "10.1.5.0/30", taken: []string{"10.1.5.1", "10.1.5.2"}, probes: []string{"10.1.5.1", "10.1.5.2"}},
+	}
+	for _, tt := range tests {
+		_, ipNet, _ := net.ParseCIDR(tt.cidr)
+		var probes []string
+		inUse := func(ip net.IP) bool {
+			probes = append(probes, ip.String())
+			for _, taken := range tt.taken {
+				if ip.Equal(net.ParseIP(taken)) {
+					return true
+				}
+			}
+			return false
+		}
+
+		ip, err := scanAvailableIP(ipNet, inUse)
+		if tt.want == "" {
+			if err == nil || !strings.Contains(err.Error(), "no available IP") {
+				t.Errorf("%s: expected a no available IP error, got %v, %v", tt.cidr, ip, err)
+			}
+		} else if err != nil || ip.String() != tt.want {
+			t.Errorf("%s: scanAvailableIP = %v, %v, want %s", tt.cidr, ip, err, tt.want)
+		}
+		if strings.Join(probes, " ") != strings.Join(tt.probes, " ") {
+			t.Errorf("%s: probed %v, want %v", tt.cidr, probes, tt.probes)
+		}
+	}
+}
+
+func TestFindAvailableIPLargeSubnetAttempts(t *testing.T) {
+	_, ipNet, _ := net.ParseCIDR("10.0.0.0/8")
+	probes := 0
+	inUse := func(ip net.IP) bool {
+		probes++
+		if !ipNet.Contains(ip) {
+			t.Errorf("probed address %v outside %v", ip, ipNet)
+		}
+		return true
+	}
+
+	if _, err := findAvailableIP(ipNet, 25, inUse); err == nil {
+		t.Fatal("expected an error when every probed address is in use")
+	}
+	if probes != 25 {
+		t.Errorf("expected 25 probes, got %d", probes)
+	}
+}
+
+func TestInterfaceStats(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to create interfaces")
+	}
+
+	ifName := "teststats0"
+	if err := createTestVeth(ifName, "teststats1"); err != nil {
+		t.Fatalf("Failed to create test network: %v", err)
+	}
+	defer DeleteNetwork(ifName)
+
+	stats, err := InterfaceStats(ifName)
+	if err != nil {
+		t.Fatalf("InterfaceStats returned an error: %v", err)
+	}
+	if stats == nil {
+		t.Fatal("InterfaceStats returned nil stats")
+	}
+	// A fresh interface that is down has carried no traffic.
+	if stats.RxBytes != 0 || stats.TxBytes != 0 || stats.RxPackets != 0 || stats.TxPackets != 0 {
+		t.Errorf("expected zero counters for an unused interface, got %+v", stats)
+	}
+
+	_, err = InterfaceStats("nosuchiface0")
+	if err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("expected a not found error for a missing interface, got %v", err)
+	}
+}
+
+func TestEnsureLink(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to create interfaces")
+	}
+
+	ifName := "testensure0"
+	veth := func() netlink.Link {
+		return &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: ifName}, PeerName: "testensure1"}
+	}
+	created, err := ensureLink(veth())
+	if err != nil {
+		t.Fatalf("ensureLink returned an error: %v", err)
+	}
+	defer DeleteNetwork(ifName)
+
+	reused, err := ensureLink(veth())
+	if err != nil {
+		t.Fatalf("ensureLink returned an error for an existing link: %v", err)
+	}
+	if reused.Attrs().Index != created.Attrs().Index {
+		t.Errorf("expected the existing link %d to be reused, got %d", created.Attrs().Index, reused.Attrs().Index)
+	}
+
+	bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: ifName}}
+	_, err = ensureLink(bridge)
+	if err == nil || !strings.Contains(err.Error(), "already exists as a veth") {
+		t.Errorf("expected an incompatible link error, got %v", err)
+	}
+}
+
+func TestVethNames(t *testing.T) {
+	id := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	none := func(string) bool { return false }
+
+	host, err := vethNames(id, none)
+	if err != nil {
+		t.Fatalf("vethNames returned an error: %v", err)
+	}
+	if host != "veth01234567" {
+		t.Errorf("vethNames(%q) = %q, want %q", id, host, "veth01234567")
+	}
+	if again, _ := vethNames(id, none); again != host {
+		t.Errorf("vethNames is not deterministic: got %q then %q", host, again)
+	}
+	if _, peer, err := VethNames(id); err != nil || peer != "eth0" {
+		t.Errorf("expected the container end to be named eth0, got %q (%v)", peer, err)
+	}
+
+	// IDs that are not hex, or too short to take a prefix of, are hashed into a valid name.
+	for _, other := range []string{"my-container", "abc", strings.Repeat("z", 100)} {
+		name, _ := vethNames(other, none)
+		if len(name) > maxInterfaceNameLen || !strings.HasPrefix(name, "veth") {
+			t.Errorf("vethNames(%q) = %q, want a veth name of at most %d characters", other, name, maxInterfaceNameLen)
+		}
+	}
+
+	taken := map[string]bool{"veth01234567": true, "veth012345671": true}
+	name, err := vethNames(id, func(name string) bool { return taken[name] })
+	if err != nil || name != "veth012345672" {
+		t.Errorf("expected the first free suffix, got %q (%v)", name, err)
+	}
+
+	largest := "veth01234567" + strconv.Itoa(maxVethSuffix)
+	name, err = vethNames(id, func(name string) bool { return name != largest })
+	if err != nil || name != largest {
+		t.Errorf("expected the largest suffix, got %q (%v)", name, err)
+	}
+	if len(name) > maxInterfaceNameLen {
+		t.Errorf("name %q with the largest suffix is longer than %d characters", name, maxInterfaceNameLen)
+	}
+
+	all := func(string) bool { return true }
+	if name, err := vethNames(id, all); err == nil {
+		t.Errorf("expected an error when every name is taken, got %q", name)
+	}
+}
+
+func TestFindAvailableIPSkipsExcluded(t *testing.T) {
+	_, ipNet, _ := net.ParseCIDR("10.1.2.0/28")
+	_, infra, _ := net.ParseCIDR("10.1.2.0/29")
+	config := &Config{
+		IPNet:         ipNet,
+		Gateway:       net.ParseIP("10.1.2.8"),
+		ExcludeRanges: []*net.IPNet{infra},
+		ReservedIPs:   []net.IP{net.ParseIP("10.1.2.9"), net.ParseIP("10.1.2.10")},
+	}
+
+	for _, excluded := range []string{"10.1.2.1", "10.1.2.7", "10.1.2.8", "10.1.2.9", "10.1.2.10"} {
+		if !config.excludes(net.ParseIP(excluded)) {
+			t.Errorf("expected %s to be excluded", excluded)
+		}
+	}
+	if config.excludes(net.ParseIP("10.1.2.11")) {
+		t.Error("expected 10.1.2.11 not to be excluded")
+	}
+
+	// .1-.10 are excluded, so the first free address is .11.
+	ip, err := findAvailableIP(ipNet, 1, config.excludes)
+	if err != nil {
+		t.Fatalf("findAvailableIP returned an error: %v", err)
+	}
+	if !ip.Equal(net.ParseIP("10.1.2.11")) {
+		t.Errorf("findAvailableIP returned %v, want 10.1.2.11", ip)
+	}
+
+	// With every remaining address taken, allocation fails instead of handing out an excluded one.
+	inUse := func(ip net.IP) bool { return config.excludes(ip) || ip[len(ip)-1] > 10 }
+	if ip, err := findAvailableIP(ipNet, 1, inUse); err == nil {
+		t.Errorf("expected an error when only excluded addresses are free, got %v", ip)
+	}
+}
+
+// fakeFreeHandler is a fakeInterfaceHandler on whose segment no other host claims any address.
+type fakeFreeHandler struct {
+	fakeInterfaceHandler
+}
+
+func (f *fakeFreeHandler) NeighList(linkIndex, family int) ([]netlink.Neigh, error) {
+	return nil, nil
+}
+
+func (f *fakeFreeHandler) ProbeARP(iface *net.Interface, ip net.IP, timeout time.Duration) (net.HardwareAddr, error) {
+	return nil, fmt.Errorf("no answer for %s", ip)
+}
+
+// fakeNeighborHandler serves a fixed neighbor table and ARP answers, keyed by IP.
+type fakeNeighborHandler struct {
+	DefaultNetworkHandler
+	iface     *net.Interface
+	neighbors []netlink.Neigh
+	arp       map[string]net.HardwareAddr
+	probed    []string
+}
+
+func (f *fakeNeighborHandler) InterfaceByIndex(index int) (*net.Interface, error) {
+	if f.iface == nil || f.iface.Index != index {
+		return nil, fmt.Errorf("no interface with index %d", index)
+	}
+	return f.iface, nil
+}
+
+func (f *fakeNeighborHandler) RouteList(link netlink.Link, family int) ([]netlink.Route, error) {
+	if f.iface == nil {
+		return nil, nil
+	}
+	return []netlink.Route{{LinkIndex: f.iface.Index, Gw: net.ParseIP("192.168.1.1")}}, nil
+}
+
+func (f *fakeNeighborHandler) NeighList(linkIndex, family int) ([]netlink.Neigh, error) {
+	return f.neighbors, nil
+}
+
+func (f *fakeNeighborHandler) ProbeARP(iface *net.Interface, ip net.IP, timeout time.Duration) (net.HardwareAddr, error) {
+	f.probed = append(f.probed, ip.String())
+	if mac, ok := f.arp[ip.String()]; ok {
+		return mac, nil
+	}
+	return nil, fmt.Errorf("no answer for %s", ip)
+}
+
+func TestCheckIPConflict(t *testing.T) {
+	own, _ := net.ParseMAC("02:00:00:00:00:01")
+	foreign, _ := net.ParseMAC("02:00:00:00:00:99")
+	iface := &net.Interface{Index: 7, Name: "veth-test", HardwareAddr: own}
+	handler := &fakeNeighborHandler{
+		neighbors: []netlink.Neigh{
+			{LinkIndex: 7, IP: net.ParseIP("10.0.0.5"), HardwareAddr: foreign, State: netlink.NUD_REACHABLE},
+			{LinkIndex: 7, IP: net.ParseIP("10.0.0.6"), HardwareAddr: own, State: netlink.NUD_STALE},
+			{LinkIndex: 7, IP: net.ParseIP("10.0.0.7"), HardwareAddr: foreign, State: netlink.NUD_FAILED},
+		},
+		arp: map[string]net.HardwareAddr{"10.0.0.8": foreign},
+	}
+
+	tests := []struct {
+		ip       string
+		conflict bool
+	}{
+		{"10.0.0.5", true},  // in the neighbor table with a foreign MAC
+		{"10.0.0.6", false}, // our own address
+		{"10.0.0.7", false}, // resolution failed, so nothing claims it
+		{"10.0.0.8", true},  // unknown to the kernel, but answers ARP
+		{"10.0.0.9", false}, // nobody claims it
+	}
+	for _, tt := range tests {
+		err := checkIPConflict(net.ParseIP(tt.ip), iface, handler)
+		if got := errors.Is(err, ErrIPInUse); got != tt.conflict {
+			t.Errorf("checkIPConflict(%s): got error %v, want conflict %v", tt.ip, err, tt.conflict)
+		}
+	}
+	for _, probed := range handler.probed {
+		if probed == "10.0.0.5" {
+			t.Error("an address already known to conflict should not be probed")
+		}
+	}
+}
+
+func TestTeardownNetworkStopsDHCP(t *testing.T) {
+	config := &Config{
+		Name:    "testdhcp0",
+		IPNet:   &net.IPNet{IP: net.ParseIP("192.168.7.0"), Mask: net.CIDRMask(24, 32)},
+		Gateway: net.ParseIP("192.168.7.1"),
+		DNS:     []net.IP{net.ParseIP("8.8.8.8")},
+		DHCP:    true,
+	}
+	n, err := CreateNetwork(config, DefaultNetworkHandler{})
+	if err != nil {
+		t.Skipf("cannot start a DHCP server here: %v", err)
+	}
+	addr := &net.UDPAddr{IP: net.ParseIP("::1"), Port: dhcpv6.DefaultServerPort}
+	if conn, err := net.ListenUDP("udp6", addr); err == nil {
+		conn.Close()
+		t.Fatal("expected the DHCP server to hold its port while the network exists")
+	}
+
+	if err := TeardownNetwork(0, n); err != nil {
+		t.Fatalf("TeardownNetwork returned an error: %v", err)
+	}
+	conn, err := net.ListenUDP("udp6", addr)
+	if err != nil {
+		t.Fatalf("expected TeardownNetwork to stop the DHCP server and free its port: %v", err)
+	}
+	conn.Close()
+	if err := TeardownNetwork(0, n); err != nil {
+		t.Errorf("TeardownNetwork returned an error the second time: %v", err)
+	}
+}
+
+func TestTeardownNetwork(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to create interfaces and network namespaces")
+	}
+	oldNetnsDir := NetnsDir
+	NetnsDir = t.TempDir()
+	defer func() { NetnsDir = oldNetnsDir }()
+
+	// A process in its own network namespace stands in for the container
+	cmd := exec.Command("sleep", "30")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNET}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start process in a new network namespace: %v", err)
+	}
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+	pid := cmd.Process.Pid
+
+	hostVeth := "vethteardown"
+	if err := createTestVeth(hostVeth, "vethteardownp"); err != nil {
+		t.Fatalf("failed to create veth pair: %v", err)
+	}
+	peer, err := netlink.LinkByName("vethteardownp")
+	if err != nil {
+		t.Fatalf("failed to find veth peer: %v", err)
+	}
+	if err := netlink.LinkSetNsPid(peer, pid); err != nil {
+		t.Fatalf("failed to move veth peer into the namespace: %v", err)
+	}
+
+	// Keep the namespace alive by a bind under a name other than the network's, as ip netns would
+	bind := filepath.Join(NetnsDir, "keep")
+	if err := os.WriteFile(bind, nil, 0444); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mount(fmt.Sprintf("/proc/%d/ns/net", pid), bind, "", syscall.MS_BIND, ""); err != nil {
+		t.Fatalf("failed to bind mount the network namespace: %v", err)
+	}
+
+	_, subnet, _ := net.ParseCIDR("10.234.0.0/24")
+	containerIP := net.ParseIP("10.234.0.2")
+	allocator := NewIPAllocator(subnet, net.ParseIP("10.234.0.1"))
+	if err := allocator.Reserve(containerIP); err != nil {
+		t.Fatal(err)
+	}
+	network := &Network{Name: hostVeth, IPNet: &net.IPNet{IP: containerIP, Mask: subnet.Mask}, Allocator: allocator}
+
+	// The NAT rules are only set up where iptables can be used; the rest of the teardown is checked regardless
+	mapping := PortMapping{HostPort: 18084, ContainerPort: 80, Protocol: "tcp"}
+	ipt, err := iptables.New()
+	natRules := err == nil
+	if natRules {
+		if err := PublishPort(containerIP, mapping); err != nil {
+			t.Fatalf("PublishPort returned an error: %v", err)
+		}
+		defer UnpublishPort(containerIP, mapping)
+		if err := EnableMasquerade(subnet, "lo"); err != nil {
+			t.Fatalf("EnableMasquerade returned an error: %v", err)
+		}
+		defer DisableMasquerade(subnet, "lo")
+		network.Ports = []PortMapping{mapping}
+		network.Masquerade = "lo"
+	}
+
+	if err := TeardownNetwork(pid, network); err != nil {
+		t.Fatalf("TeardownNetwork returned an error: %v", err)
+	}
+	if leased, err := allocator.Leased(); err != nil || len(leased) != 0 {
+		t.Errorf("expected the container's address to be released, still leased: %v (%v)", leased, err)
+	}
+	if natRules {
+		if exists, err := ipt.Exists("nat", "PREROUTING", dnatRule(containerIP, mapping)...); err != nil || exists {
+			t.Errorf("DNAT rule still exists after teardown (%v)", err)
+		}
+		if exists, err := ipt.Exists("nat", "POSTROUTING", masqueradeRule(subnet, "lo")...); err != nil || exists {
+			t.Errorf("masquerade rule still exists after teardown of the last container on the subnet (%v)", err)
+		}
+	}
+	if _, err := netlink.LinkByName(hostVeth); err == nil {
+		t.Errorf("host veth %s still exists after teardown", hostVeth)
+	}
+	if links, err := interfacesOf(pid); err != nil || strings.Contains(links, "vethteardownp") {
+		t.Errorf("veth peer still exists in the container's namespace after teardown: %q (%v)", links, err)
+	}
+	if _, err := os.Lstat(bind); !os.IsNotExist(err) {
+		t.Errorf("network namespace bind %s still exists after teardown: %v", bind, err)
+	}
+
+	// Tearing down again finds nothing left to remove
+	if err := TeardownNetwork(pid, network); err != nil {
+		t.Errorf("a second TeardownNetwork returned an error: %v", err)
+	}
+}
+
+func TestTeardownNetworkKeepsSharedMasquerade(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to change iptables rules")
+	}
+	ipt, err := iptables.New()
+	if err != nil {
+		t.Skipf("iptables is not available: %v", err)
+	}
+
+	_, subnet, _ := net.ParseCIDR("10.235.0.0/24")
+	allocator := NewIPAllocator(subnet, net.ParseIP("10.235.0.1"))
+	for _, ip := range []string{"10.235.0.2", "10.235.0.3"} {
+		if err := allocator.Reserve(net.ParseIP(ip)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := EnableMasquerade(subnet, "lo"); err != nil {
+		t.Fatalf("EnableMasquerade returned an error: %v", err)
+	}
+	defer DisableMasquerade(subnet, "lo")
+
+	first := &Network{Name: "vethshared0", IPNet: &net.IPNet{IP: net.ParseIP("10.235.0.2"), Mask: subnet.Mask}, Allocator: allocator, Masquerade: "lo"}
+	if err := TeardownNetwork(0, first); err != nil {
+		t.Fatalf("TeardownNetwork returned an error: %v", err)
+	}
+	if exists, err := ipt.Exists("nat", "POSTROUTING", masqueradeRule(subnet, "lo")...); err != nil || !exists {
+		t.Errorf("masquerade rule was removed while another container is still on the subnet (%v)", err)
+	}
+
+	second := &Network{Name: "vethshared1", IPNet: &net.IPNet{IP: net.ParseIP("10.235.0.3"), Mask: subnet.Mask}, Allocator: allocator, Masquerade: "lo"}
+	if err := TeardownNetwork(0, second); err != nil {
+		t.Fatalf("TeardownNetwork returned an error: %v", err)
+	}
+	if exists, err := ipt.Exists("nat", "POSTROUTING", masqueradeRule(subnet, "lo")...); err != nil || exists {
+		t.Errorf("masquerade rule still exists after the last container left the subnet (%v)", err)
+	}
+}
+
+func TestCreateVethPair(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to create interfaces and network namespaces")
+	}
+
+	cmd := exec.Command("sleep", "30")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNET}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start process in a new network namespace: %v", err)
+	}
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+
+	host, peer, err := CreateVethPair("vethpairh", "vethpairp")
+	if err != nil {
+		t.Fatalf("CreateVethPair returned an error: %v", err)
+	}
+	defer DeleteNetwork("vethpairh")
+	if host.Attrs().Index == 0 || peer.Attrs().Index == 0 {
+		t.Errorf("expected both ends to be looked up, got indexes %d and %d", host.Attrs().Index, peer.Attrs().Index)
+	}
+	if _, _, err := CreateVethPair("vethpairh", "vethpairq"); err == nil {
+		t.Error("expected creating a veth pair with a taken name to fail")
+	}
+
+	if err := MoveLinkToNamespace(peer, cmd.Process.Pid); err != nil {
+		t.Fatalf("MoveLinkToNamespace returned an error: %v", err)
+	}
+	if _, err := netlink.LinkByName("vethpairp"); err == nil {
+		t.Error("veth peer is still in the host's namespace after the move")
+	}
+	if links, err := interfacesOf(cmd.Process.Pid); err != nil || !strings.Contains(links, "vethpairp") {
+		t.Errorf("veth peer is missing from the process's namespace: %q (%v)", links, err)
+	}
+}
+
+func TestCreateBridge(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to create interfaces")
+	}
+
+	ip, ipNet, _ := net.ParseCIDR("10.231.0.1/24")
+	ipNet.IP = ip
+	bridge, err := CreateBridge("testbr0", ipNet)
+	if err != nil {
+		t.Fatalf("CreateBridge returned an error: %v", err)
+	}
+	defer DeleteBridge("testbr0")
+	addrs, err := netlink.AddrList(bridge, netlink.FAMILY_V4)
+	if err != nil || len(addrs) != 1 || !addrs[0].IP.Equal(ipNet.IP) {
+		t.Errorf("expected the bridge to have address %s, got %v (%v)", ipNet, addrs, err)
+	}
+	if _, err := CreateBridge("testbr0", ipNet); err == nil || !strings.Contains(err.Error(), "network already exists") {
+		t.Errorf("expected a network already exists error, got %v", err)
+	}
+
+	host, _, err := CreateVethPair("vethbrh", "vethbrp")
+	if err != nil {
+		t.Fatalf("CreateVethPair returned an error: %v", err)
+	}
+	defer DeleteNetwork("vethbrh")
+	if err := AttachToBridge("vethbrp", "vethbrh"); err == nil {
+		t.Error("expected attaching to an interface that is not a bridge to fail")
+	}
+	if err := AttachToBridge("testbr0", "vethbrh"); err != nil {
+		t.Fatalf("AttachToBridge returned an error: %v", err)
+	}
+	host, err = netlink.LinkByName(host.Attrs().Name)
+	if err != nil || host.Attrs().MasterIndex != bridge.Attrs().Index {
+		t.Errorf("expected veth to have bridge %d as master, got %+v (%v)", bridge.Attrs().Index, host, err)
+	}
+}
+
+func TestMasquerade(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.232.0.0/24")
+	rule := strings.Join(masqueradeRule(subnet, "eth0"), " ")
+	if want := "-s 10.232.0.0/24 ! -d 10.232.0.0/24 -o eth0 -j MASQUERADE"; rule != want {
+		t.Errorf("masqueradeRule = %q, want %q", rule, want)
+	}
+
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to change iptables rules")
+	}
+	ipt, err := iptables.New()
+	if err != nil {
+		t.Skipf("iptables is not available: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := EnableMasquerade(subnet, "eth0"); err != nil {
+			t.Fatalf("EnableMasquerade returned an error: %v", err)
+		}
+	}
+	defer DisableMasquerade(subnet, "eth0")
+	rules, err := ipt.List("nat", "POSTROUTING")
+	if err != nil {
+		t.Fatalf("failed to list rules: %v", err)
+	}
+	count := 0
+	for _, r := range rules {
+		if strings.Contains(r, subnet.String()) && strings.Contains(r, "MASQUERADE") {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Errorf("expected enabling masquerading twice to add one rule, found %d", count)
+	}
+
+	if err := DisableMasquerade(subnet, "eth0"); err != nil {
+		t.Fatalf("DisableMasquerade returned an error: %v", err)
+	}
+	if exists, err := ipt.Exists("nat", "POSTROUTING", masqueradeRule(subnet, "eth0")...); err != nil || exists {
+		t.Errorf("masquerade rule still exists after DisableMasquerade (%v)", err)
+	}
+	if err := DisableMasquerade(subnet, "eth0"); err != nil {
+		t.Errorf("DisableMasquerade of a removed rule returned an error: %v", err)
+	}
+}
+
+func TestPublishPort(t *testing.T) {
+	containerIP := net.ParseIP("10.232.0.2")
+	mapping := PortMapping{HostIP: net.ParseIP("127.0.0.1"), HostPort: 8080, ContainerPort: 80, Protocol: "tcp"}
+	rule := strings.Join(dnatRule(containerIP, mapping), " ")
+	if want := "-p tcp -d 127.0.0.1 --dport 8080 -j DNAT --to-destination 10.232.0.2:80"; rule != want {
+		t.Errorf("dnatRule = %q, want %q", rule, want)
+	}
+
+	for _, invalid := range []PortMapping{
+		{ContainerPort: 80, Protocol: "tcp"},
+		{HostPort: 8080, ContainerPort: 80, Protocol: "sctp"},
+		{HostPort: 8080, Protocol: "udp"},
+	} {
+		if err := PublishPort(containerIP, invalid); err == nil {
+			t.Errorf("expected publishing %+v to fail", invalid)
+		}
+	}
+	if err := PublishPort(nil, mapping); err == nil {
+		t.Error("expected publishing to a container without an address to fail")
+	}
+
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to change iptables rules")
+	}
+	ipt, err := iptables.New()
+	if err != nil {
+		t.Skipf("iptables is not available: %v", err)
+	}
+	if err := PublishPort(containerIP, mapping); err != nil {
+		t.Fatalf("PublishPort returned an error: %v", err)
+	}
+	defer UnpublishPort(containerIP, mapping)
+	if exists, err := ipt.Exists("nat", "PREROUTING", dnatRule(containerIP, mapping)...); err != nil || !exists {
+		t.Errorf("DNAT rule is missing after PublishPort (%v)", err)
+	}
+	if err := UnpublishPort(containerIP, mapping); err != nil {
+		t.Fatalf("UnpublishPort returned an error: %v", err)
+	}
+	if exists, err := ipt.Exists("nat", "PREROUTING", dnatRule(containerIP, mapping)...); err != nil || exists {
+		t.Errorf("DNAT rule still exists after UnpublishPort (%v)", err)
+	}
+}
+
+// interfacesOf returns the interface table of the network namespace of the process with the given PID.
+func interfacesOf(pid int) (string, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/net/dev", pid))
+	return string(data), err
+}
+
+func TestParsePortMapping(t *testing.T) {
+	tests := []struct {
+		spec string
+		want string
+	}{
+		{"8080:80", "0.0.0.0:8080->80/tcp"},
+		{":80", "0.0.0.0:0->80/tcp"},
+		{"80", "0.0.0.0:0->80/tcp"},
+		{"127.0.0.1:5353:53/udp", "127.0.0.1:5353->53/udp"},
+		{"127.0.0.1::53/UDP", "127.0.0.1:0->53/udp"},
+	}
+	for _, tt := range tests {
+		mapping, err := ParsePortMapping(tt.spec)
+		if err != nil {
+			t.Errorf("ParsePortMapping(%q) returned an error: %v", tt.spec, err)
+			continue
+		}
+		if got := mapping.String(); got != tt.want {
+			t.Errorf("ParsePortMapping(%q) = %s, want %s", tt.spec, got, tt.want)
+		}
+	}
+
+	for _, spec := range []string{"", "8080:", "0", "70000:80", "8080:80/sctp", "nope:8080:80", "1:2:3:4"} {
+		if _, err := ParsePortMapping(spec); err == nil {
+			t.Errorf("ParsePortMapping(%q) should fail", spec)
+		}
+	}
+}
+
+func TestPortAllocator(t *testing.T) {
+	allocator := NewPortAllocator()
+
+	first, err := allocator.Allocate("tcp", nil)
+	if err != nil {
+		t.Fatalf("Allocate returned an error: %v", err)
+	}
+	second, err := allocator.Allocate("tcp", func(port int) bool { return port == first })
+	if err != nil {
+		t.Fatalf("Allocate returned an error: %v", err)
+	}
+	if first == 0 || second == 0 || first == second {
+		t.Fatalf("expected two different concrete ports, got %d and %d", first, second)
+	}
+	for _, port := range []int{first, second} {
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			t.Errorf("allocated port %d is not free: %v", port, err)
+			continue
+		}
+		listener.Close()
+	}
+
+	if err := allocator.Reserve("tcp", first); err == nil {
+		t.Errorf("reserving the allocated port %d again succeeded", first)
+	}
+	if err := allocator.Reserve("udp", first); err != nil {
+		t.Errorf("the same port number should be free for another protocol: %v", err)
+	}
+	allocator.Release("tcp", first)
+	if err := allocator.Reserve("tcp", first); err != nil {
+		t.Errorf("a released port should be free again: %v", err)
+	}
+
+	// Ports reported as taken are never handed out
+	if _, err := allocator.Allocate("tcp", func(int) bool { return true }); err == nil {
+		t.Error("expected Allocate to fail when every port is taken")
+	}
+}
+
+func TestIPAllocator(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.1.6.0/28")
+	allocator := NewIPAllocator(subnet, net.ParseIP("10.1.6.1"))
+
+	// A /28 has 14 hosts, one of them the gateway; concurrent allocations must never share an address
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	leased := map[string]int{}
+	failures := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ip, err := allocator.Allocate()
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failures++
+				return
+			}
+			leased[ip.String()]++
+		}()
+	}
+	wg.Wait()
+	if len(leased) != 13 || failures != 7 {
+		t.Errorf("expected 13 distinct leases and 7 failures, got %d and %d", len(leased), failures)
+	}
+	for ip, n := range leased {
+		if n != 1 || ip == "10.1.6.1" {
+			t.Errorf("address %s leased %d times", ip, n)
+		}
+	}
+
+	if err := allocator.Reserve(net.ParseIP("10.1.6.5")); !errors.Is(err, ErrIPInUse) {
+		t.Errorf("expected reserving a leased address to fail with ErrIPInUse, got %v", err)
+	}
+	if err := allocator.Reserve(net.ParseIP("10.1.7.5")); err == nil {
+		t.Error("expected reserving an address outside the subnet to fail")
+	}
+	allocator.Release(net.ParseIP("10.1.6.5"))
+	if ip, err := allocator.Allocate(); err != nil || !ip.Equal(net.ParseIP("10.1.6.5")) {
+		t.Errorf("expected the released address to be allocated again, got %v, %v", ip, err)
+	}
+}
+
+func TestFileIPAllocator(t *testing.T) {
+	ledger := filepath.Join(t.TempDir(), "leases.json")
+	_, subnet, _ := net.ParseCIDR("10.1.7.0/28")
+	gateway := net.ParseIP("10.1.7.1")
+
+	// Allocators sharing a ledger stand in for separate processes: none may hand out an address another leased
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	leased := map[string]int{}
+	failures := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ip, err := NewFileIPAllocator(ledger, subnet, gateway).Allocate()
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failures++
+				return
+			}
+			leased[ip.String()]++
+		}()
+	}
+	wg.Wait()
+	if len(leased) != 13 || failures != 7 {
+		t.Errorf("expected 13 distinct leases and 7 failures, got %d and %d", len(leased), failures)
+	}
+	for ip, n := range leased {
+		if n != 1 || ip == gateway.String() {
+			t.Errorf("address %s leased %d times", ip, n)
+		}
+	}
+
+	allocator := NewFileIPAllocator(ledger, subnet, gateway)
+	if err := allocator.Reserve(net.ParseIP("10.1.7.5")); !errors.Is(err, ErrIPInUse) {
+		t.Errorf("expected reserving an address leased through the ledger to fail with ErrIPInUse, got %v", err)
+	}
+	if err := NewFileIPAllocator(ledger, subnet, gateway).Release(net.ParseIP("10.1.7.5")); err != nil {
+		t.Fatalf("Release returned an error: %v", err)
+	}
+	if ip, err := allocator.AllocateFree(0, func(ip net.IP) bool { return false }); err != nil || !ip.Equal(net.ParseIP("10.1.7.5")) {
+		t.Errorf("expected the address released through another allocator to be allocated again, got %v, %v", ip, err)
+	}
+
+	// Other subnets in the same ledger are leased independently
+	_, other, _ := net.ParseCIDR("10.1.8.0/28")
+	if ip, err := NewFileIPAllocator(ledger, other, nil).Allocate(); err != nil || !ip.Equal(net.ParseIP("10.1.8.1")) {
+		t.Errorf("expected the first address of another subnet, got %v, %v", ip, err)
+	}
+}
+
+func TestNetworkResultSubnet(t *testing.T) {
+	result := &NetworkResult{IP: net.ParseIP("10.1.9.7"), PrefixLen: 24}
+	if subnet := result.Subnet(); subnet == nil || subnet.String() != "10.1.9.0/24" {
+		t.Errorf("expected subnet 10.1.9.0/24, got %v", subnet)
+	}
+	if subnet := (&NetworkResult{Interface: "eth0"}).Subnet(); subnet != nil {
+		t.Errorf("expected no subnet for a result without an address, got %v", subnet)
+	}
+}
+
+// fakeInterfaceHandler serves a single interface with fixed addresses and routes.
+type fakeInterfaceHandler struct {
+	DefaultNetworkHandler
+	iface  *net.Interface
+	addrs  []net.Addr
+	routes []netlink.Route
+}
+
+func (f *fakeInterfaceHandler) InterfaceByName(name string) (*net.Interface, error) {
+	if name != f.iface.Name {
+		return nil, fmt.Errorf("no such interface: %s", name)
+	}
+	return f.iface, nil
+}
+
+func (f *fakeInterfaceHandler) InterfaceByIndex(index int) (*net.Interface, error) {
+	if index != f.iface.Index {
+		return nil, fmt.Errorf("no interface with index %d", index)
+	}
+	return f.iface, nil
+}
+
+func (f *fakeInterfaceHandler) Addrs(iface *net.Interface) ([]net.Addr, error) {
+	return f.addrs, nil
+}
+
+func (f *fakeInterfaceHandler) RouteList(link netlink.Link, family int) ([]netlink.Route, error) {
+	return f.routes, nil
+}
+
+func TestVerifyConnected(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.0.0.0/24")
+	network := &Network{
+		Name:    "veth-test",
+		IPNet:   &net.IPNet{IP: net.ParseIP("10.0.0.5").To4(), Mask: subnet.Mask},
+		Gateway: net.ParseIP("10.0.0.1"),
+	}
+	handler := &fakeInterfaceHandler{
+		iface: &net.Interface{Index: 7, Name: ContainerInterfaceName},
+		addrs: []net.Addr{&net.IPNet{IP: net.ParseIP("10.0.0.5").To4(), Mask: subnet.Mask}},
+		routes: []netlink.Route{
+			{LinkIndex: 7, Dst: subnet},
+			{LinkIndex: 7, Gw: net.ParseIP("10.0.0.1")},
+		},
+	}
+	if err := VerifyConnected(network, handler); err != nil {
+		t.Fatalf("VerifyConnected returned an error for a matching configuration: %v", err)
+	}
+
+	// An address that was not assigned and a missing default route are both reported
+	handler.addrs = []net.Addr{&net.IPNet{IP: net.ParseIP("10.0.0.9").To4(), Mask: subnet.Mask}}
+	handler.routes = handler.routes[:1]
+	err := VerifyConnected(network, handler)
+	if err == nil {
+		t.Fatal("expected an error for a mismatched configuration")
+	}
+	for _, want := range []string{"address: want 10.0.0.5/24, have 10.0.0.9/24", "default route: want via 10.0.0.1, have none"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected the error to contain %q, got %v", want, err)
+		}
+	}
+
+	handler.iface = &net.Interface{Index: 7, Name: "eth1"}
+	if err := VerifyConnected(network, handler); err == nil {
+		t.Error("expected an error for a missing interface")
+	}
+}
+
+// dnsQuery returns a query for the records of type qtype for name.
+func dnsQuery(id uint16, name string, qtype uint16) []byte {
+	query := []byte{byte(id >> 8), byte(id), 0x01, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range strings.Split(name, ".") {
+		query = append(query, byte(len(label)))
+		query = append(query, label...)
+	}
+	return append(query, 0, byte(qtype>>8), byte(qtype), 0, 1)
+}
+
+// exchangeDNS sends query to the server at addr and returns the response.
+func exchangeDNS(t *testing.T, addr net.Addr, query []byte) []byte {
+	t.Helper()
+	conn, err := net.Dial("udp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(query); err != nil {
+		t.Fatal(err)
+	}
+	response := make([]byte, 512)
+	n, err := conn.Read(response)
+	if err != nil {
+		t.Fatalf("no response to DNS query: %v", err)
+	}
+	return response[:n]
+}
+
+func TestCreateDNSQuery(t *testing.T) {
+	for _, domain := range []string{"example.com", "www.example.com.", "localhost"} {
+		query, err := createDNSQuery(domain, 28)
+		if err != nil {
+			t.Fatalf("createDNSQuery(%q) returned an error: %v", domain, err)
+		}
+		header, err := parseHeader(query)
+		if err != nil || header.qdcount != 1 || header.rd != 1 {
+			t.Errorf("createDNSQuery(%q) has header %+v (%v), want one question with recursion desired", domain, header, err)
+		}
+		name, qtype, qclass, end, err := parseQuestion(query)
+		if err != nil {
+			t.Fatalf("failed to parse the question of the query for %q: %v", domain, err)
+		}
+		if want := strings.TrimSuffix(domain, "."); name != want || qtype != 28 || qclass != 1 {
+			t.Errorf("question is %q type %d class %d, want %q type 28 class 1", name, qtype, qclass, want)
+		}
+		if end != len(query) {
+			t.Errorf("query for %q has %d bytes after the question", domain, len(query)-end)
+		}
+	}
+
+	for _, domain := range []string{"example..com", strings.Repeat("a", 64) + ".com"} {
+		if _, err := createDNSQuery(domain, 1); err == nil {
+			t.Errorf("expected createDNSQuery(%q) to fail", domain)
+		}
+	}
+}
+
+func TestResolver(t *testing.T) {
+	// The upstream server answers every query with 192.0.2.1
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := upstream.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _, _, end, err := parseQuestion(buf[:n])
+			if err != nil {
+				continue
+			}
+			_, _ = upstream.WriteTo(buildResponse(buf[:end], dnsRcodeOK, []net.IP{net.ParseIP("192.0.2.1")}), addr)
+		}
+	}()
+
+	resolver := &Resolver{
+		Lookup: func(name string) (net.IP, bool) {
+			if name == "web" {
+				return net.ParseIP("10.88.0.2"), true
+			}
+			return nil, false
+		},
+		Upstream: upstream.LocalAddr().(*net.UDPAddr),
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- resolver.Serve(conn) }()
+
+	answers, err := parseDNSResponse(exchangeDNS(t, conn.LocalAddr(), dnsQuery(1, "WEB", dnsTypeA)))
+	if err != nil || len(answers) != 1 || answers[0].Data != "10.88.0.2" || answers[0].Name != "WEB" {
+		t.Errorf("expected the alias to resolve to 10.88.0.2, got %+v (%v)", answers, err)
+	}
+	// A known name has no AAAA record, and is not forwarded for one
+	answers, err = parseDNSResponse(exchangeDNS(t, conn.LocalAddr(), dnsQuery(2, "web", 28)))
+	if err != nil || len(answers) != 0 {
+		t.Errorf("expected an empty answer to an AAAA query for the alias, got %+v (%v)", answers, err)
+	}
+	response := exchangeDNS(t, conn.LocalAddr(), dnsQuery(3, "example.com", dnsTypeA))
+	answers, err = parseDNSResponse(response)
+	if err != nil || len(answers) != 1 || answers[0].Data != "192.0.2.1" {
+		t.Errorf("expected an unknown name to be forwarded upstream, got %+v (%v)", answers, err)
+	}
+	if header, _ := parseHeader(response); header.id != 3 {
+		t.Errorf("expected the forwarded response to keep the query's ID, got %d", header.id)
+	}
+
+	// Without an upstream server, unknown names fail
+	resolver.Upstream = nil
+	header, err := parseHeader(exchangeDNS(t, conn.LocalAddr(), dnsQuery(4, "example.com", dnsTypeA)))
+	if err != nil || header.rcode != dnsRcodeFail {
+		t.Errorf("expected a server failure without an upstream server, got rcode %d (%v)", header.rcode, err)
+	}
+
+	conn.Close()
+	if err := <-served; err != nil {
+		t.Errorf("Serve returned an error after the connection was closed: %v", err)
+	}
+}
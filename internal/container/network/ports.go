@@ -0,0 +1,161 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxPortAttempts bounds how many ephemeral ports Allocate tries before giving up.
+const maxPortAttempts = 64
+
+// PortMapping publishes ContainerPort of a container on HostPort of the host, for the given protocol, "tcp" or
+// "udp". A HostPort of 0 asks for a free host port to be allocated. A nil HostIP means every host address.
+type PortMapping struct {
+	HostIP        net.IP `json:"hostIP,omitempty"`
+	HostPort      int    `json:"hostPort"`
+	ContainerPort int    `json:"containerPort"`
+	Protocol      string `json:"protocol"`
+}
+
+// String formats the mapping the way it is shown to users, e.g. "0.0.0.0:49153->8080/tcp".
+func (m PortMapping) String() string {
+	hostIP := "0.0.0.0"
+	if m.HostIP != nil {
+		hostIP = m.HostIP.String()
+	}
+	return fmt.Sprintf("%s->%d/%s", net.JoinHostPort(hostIP, strconv.Itoa(m.HostPort)), m.ContainerPort, m.Protocol)
+}
+
+// ParsePortMapping parses a mapping given as [[HOST_IP:]HOST_PORT:]CONTAINER_PORT[/PROTOCOL], e.g. "8080:80",
+// "127.0.0.1:8080:80/udp", or ":80". An empty or missing host port leaves HostPort 0, to be allocated. The protocol
+// defaults to tcp.
+func ParsePortMapping(spec string) (PortMapping, error) {
+	mapping := PortMapping{Protocol: "tcp"}
+	ports := spec
+	if i := strings.LastIndexByte(spec, '/'); i >= 0 {
+		ports, mapping.Protocol = spec[:i], strings.ToLower(spec[i+1:])
+	}
+	if mapping.Protocol != "tcp" && mapping.Protocol != "udp" {
+		return PortMapping{}, fmt.Errorf("invalid port mapping %q: protocol must be tcp or udp", spec)
+	}
+
+	var hostIP, hostPort, containerPort string
+	parts := strings.Split(ports, ":")
+	switch len(parts) {
+	case 1:
+		containerPort = parts[0]
+	case 2:
+		hostPort, containerPort = parts[0], parts[1]
+	case 3:
+		hostIP, hostPort, containerPort = parts[0], parts[1], parts[2]
+	default:
+		return PortMapping{}, fmt.Errorf("invalid port mapping %q: expected [[HOST_IP:]HOST_PORT:]CONTAINER_PORT[/PROTOCOL]", spec)
+	}
+
+	var err error
+	if mapping.ContainerPort, err = parsePort(containerPort); err != nil || mapping.ContainerPort == 0 {
+		return PortMapping{}, fmt.Errorf("invalid container port in port mapping %q", spec)
+	}
+	if hostPort != "" {
+		if mapping.HostPort, err = parsePort(hostPort); err != nil || mapping.HostPort == 0 {
+			return PortMapping{}, fmt.Errorf("invalid host port in port mapping %q", spec)
+		}
+	}
+	if hostIP != "" {
+		if mapping.HostIP = net.ParseIP(hostIP); mapping.HostIP == nil {
+			return PortMapping{}, fmt.Errorf("invalid host IP in port mapping %q", spec)
+		}
+	}
+	return mapping, nil
+}
+
+// parsePort parses a port number from 0 to 65535.
+func parsePort(port string) (int, error) {
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 0 || n > 65535 {
+		return 0, fmt.Errorf("invalid port: %s", port)
+	}
+	return n, nil
+}
+
+// PortAllocator hands out host ports. Finding a free port by binding it and closing the socket again leaves a gap
+// in which another allocation could find the same port, so every port handed out is reserved until it is released,
+// and never handed out twice.
+type PortAllocator struct {
+	mu       sync.Mutex
+	reserved map[string]bool
+}
+
+// NewPortAllocator returns an allocator with no ports reserved.
+func NewPortAllocator() *PortAllocator {
+	return &PortAllocator{reserved: map[string]bool{}}
+}
+
+// portKey identifies a reserved port.
+func portKey(protocol string, port int) string {
+	return protocol + "/" + strconv.Itoa(port)
+}
+
+// Allocate finds a free host port for protocol, by binding an ephemeral port and closing it again, and reserves it.
+// Ports that are reserved already or that taken reports as in use, e.g. because another container publishes them,
+// are skipped. A nil taken skips none.
+func (a *PortAllocator) Allocate(protocol string, taken func(port int) bool) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for attempt := 0; attempt < maxPortAttempts; attempt++ {
+		port, err := ephemeralPort(protocol)
+		if err != nil {
+			return 0, err
+		}
+		if a.reserved[portKey(protocol, port)] || (taken != nil && taken(port)) {
+			continue
+		}
+		a.reserved[portKey(protocol, port)] = true
+		return port, nil
+	}
+	return 0, fmt.Errorf("failed to find a free %s port after %d attempts", protocol, maxPortAttempts)
+}
+
+// Reserve reserves a specific host port for protocol, failing if it is reserved already.
+func (a *PortAllocator) Reserve(protocol string, port int) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.reserved[portKey(protocol, port)] {
+		return fmt.Errorf("host port %d/%s is already allocated", port, protocol)
+	}
+	a.reserved[portKey(protocol, port)] = true
+	return nil
+}
+
+// Release returns a port to the allocator.
+func (a *PortAllocator) Release(protocol string, port int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.reserved, portKey(protocol, port))
+}
+
+// ephemeralPort asks the kernel for a free port by binding port 0, and closes the socket again.
+func ephemeralPort(protocol string) (int, error) {
+	switch protocol {
+	case "tcp":
+		listener, err := net.Listen("tcp", ":0")
+		if err != nil {
+			return 0, fmt.Errorf("failed to find a free tcp port: %w", err)
+		}
+		defer listener.Close()
+		return listener.Addr().(*net.TCPAddr).Port, nil
+	case "udp":
+		conn, err := net.ListenPacket("udp", ":0")
+		if err != nil {
+			return 0, fmt.Errorf("failed to find a free udp port: %w", err)
+		}
+		defer conn.Close()
+		return conn.LocalAddr().(*net.UDPAddr).Port, nil
+	default:
+		return 0, fmt.Errorf("unsupported protocol: %s", protocol)
+	}
+}
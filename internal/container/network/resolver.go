@@ -0,0 +1,170 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// DNS record types, classes, and response codes the resolver deals with.
+const (
+	dnsTypeA     = 1
+	dnsTypeANY   = 255
+	dnsClassIN   = 1
+	dnsRcodeOK   = 0
+	dnsRcodeFail = 2
+)
+
+// ResolverTTL is the time to live, in seconds, of the answers the resolver gives for containers. It is short,
+// since containers come and go.
+const ResolverTTL = 10
+
+// DefaultResolverTimeout bounds how long the resolver waits for the upstream server to answer a forwarded query.
+const DefaultResolverTimeout = 2 * time.Second
+
+// Resolver is a small DNS server for the containers on a network: it answers A queries for the names Lookup knows,
+// such as container hostnames and aliases, and forwards every other query to Upstream.
+type Resolver struct {
+	// Lookup returns the address of name, which is lower case and has no trailing dot, and whether it is known.
+	Lookup func(name string) (net.IP, bool)
+	// Upstream is the server unknown names are forwarded to, usually on port 53. Without one they are answered with
+	// a server failure.
+	Upstream *net.UDPAddr
+	// Timeout bounds how long a forwarded query waits for its answer; zero means DefaultResolverTimeout.
+	Timeout time.Duration
+}
+
+// Serve answers the queries that arrive on conn until conn is closed. Each query is answered on its own goroutine,
+// so a slow upstream server does not hold up the names the resolver knows.
+func (r *Resolver) Serve(conn net.PacketConn) error {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("failed to read DNS query: %w", err)
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			if response := r.respond(query); response != nil {
+				_, _ = conn.WriteTo(response, addr)
+			}
+		}()
+	}
+}
+
+// respond returns the response to query, or nil if query is not a DNS query worth answering.
+func (r *Resolver) respond(query []byte) []byte {
+	header, err := parseHeader(query)
+	if err != nil || header.qr != 0 || header.qdcount != 1 {
+		return nil
+	}
+	name, qtype, qclass, end, err := parseQuestion(query)
+	if err != nil {
+		return nil
+	}
+
+	if ip, ok := r.Lookup(strings.ToLower(strings.TrimSuffix(name, "."))); ok && qclass == dnsClassIN {
+		// A known name has no records of other types, which is answered rather than forwarded
+		var answers []net.IP
+		if ip4 := ip.To4(); ip4 != nil && (qtype == dnsTypeA || qtype == dnsTypeANY) {
+			answers = append(answers, ip4)
+		}
+		return buildResponse(query[:end], dnsRcodeOK, answers)
+	}
+
+	response, err := r.forward(query)
+	if err != nil {
+		return buildResponse(query[:end], dnsRcodeFail, nil)
+	}
+	return response
+}
+
+// forward sends query to the upstream server and returns its response.
+func (r *Resolver) forward(query []byte) ([]byte, error) {
+	if r.Upstream == nil {
+		return nil, errors.New("no upstream DNS server")
+	}
+	conn, err := net.DialUDP("udp", nil, r.Upstream)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to upstream DNS server: %w", err)
+	}
+	defer conn.Close()
+
+	timeout := r.Timeout
+	if timeout == 0 {
+		timeout = DefaultResolverTimeout
+	}
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, fmt.Errorf("failed to set a deadline for the upstream DNS server: %w", err)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, fmt.Errorf("failed to forward DNS query: %w", err)
+	}
+	response := make([]byte, 65535)
+	n, err := conn.Read(response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upstream DNS response: %w", err)
+	}
+	return response[:n], nil
+}
+
+// parseQuestion reads the question of a query with a single question: the name asked for, its type and class,
+// and the offset the question ends at. Unlike readDomainName it checks every length against the message, since
+// queries come from anyone who can reach the resolver.
+func parseQuestion(query []byte) (string, uint16, uint16, int, error) {
+	var labels []string
+	offset := 12
+	for {
+		if offset >= len(query) {
+			return "", 0, 0, 0, errors.New("question name runs past the end of the query")
+		}
+		length := int(query[offset])
+		offset++
+		if length == 0 {
+			break
+		}
+		// Queries name the question first thing, so there is nothing earlier to point to
+		if length&0xC0 != 0 || offset+length > len(query) {
+			return "", 0, 0, 0, errors.New("invalid question name")
+		}
+		labels = append(labels, string(query[offset:offset+length]))
+		offset += length
+	}
+	if offset+4 > len(query) {
+		return "", 0, 0, 0, errors.New("question type and class run past the end of the query")
+	}
+	qtype := binary.BigEndian.Uint16(query[offset:])
+	qclass := binary.BigEndian.Uint16(query[offset+2:])
+	return strings.Join(labels, "."), qtype, qclass, offset + 4, nil
+}
+
+// buildResponse returns the response to the query whose header and question are in question, with rcode and an
+// A record for each of answers.
+func buildResponse(question []byte, rcode byte, answers []net.IP) []byte {
+	response := append([]byte(nil), question...)
+	// QR and AA are set, the query's opcode and RD are kept, and RA is set
+	response[2] = 0x80 | question[2]&0x79 | 0x04
+	response[3] = 0x80 | rcode
+	binary.BigEndian.PutUint16(response[6:], uint16(len(answers)))
+	binary.BigEndian.PutUint16(response[8:], 0)
+	binary.BigEndian.PutUint16(response[10:], 0)
+
+	for _, ip := range answers {
+		record := make([]byte, 16)
+		// The name is a pointer to the question's, which starts right after the header
+		binary.BigEndian.PutUint16(record[0:], 0xC000|12)
+		binary.BigEndian.PutUint16(record[2:], dnsTypeA)
+		binary.BigEndian.PutUint16(record[4:], dnsClassIN)
+		binary.BigEndian.PutUint32(record[6:], ResolverTTL)
+		binary.BigEndian.PutUint16(record[10:], net.IPv4len)
+		copy(record[12:], ip.To4())
+		response = append(response, record...)
+	}
+	return response
+}
@@ -7,14 +7,44 @@ import (
 	"github.com/vishvananda/netlink"
 )
 
+// Mode selects how a container's network stack is provided.
+type Mode string
+
+// These constants define the supported networking modes.
+const (
+	// ModeBridge gives the container its own network namespace configured by CreateNetwork. It is the default.
+	ModeBridge Mode = "bridge"
+	// ModeHost shares the host's network namespace with the container. No veth, IP, or route setup is done,
+	// which avoids the overhead of a separate stack but removes all network isolation: the container can bind
+	// any host port and reach every interface the host can.
+	ModeHost Mode = "host"
+	// ModeNone gives the container its own network namespace with only the loopback interface up,
+	// leaving it without any external connectivity.
+	ModeNone Mode = "none"
+	// ModeContainer joins the network namespace of another, running container, so both share its interfaces,
+	// addresses, and ports. No network setup is done for the joining container.
+	ModeContainer Mode = "container"
+)
+
 // Config represents the configuration for a container network, including properties like its name, IP network, gateway, DNS, and DHCP-related details.
 type Config struct {
+	Mode     Mode
 	Name     string
 	IPNet    *net.IPNet
 	Gateway  net.IP
 	DNS      []net.IP
 	DHCP     bool
 	DHCPArgs []string
+	// MaxIPAttempts bounds how many random addresses are probed in subnets too large to scan exhaustively.
+	// Zero means DefaultMaxIPAttempts.
+	MaxIPAttempts int
+	// ExcludeRanges and ReservedIPs are never allocated to a container, e.g. to keep addresses free for
+	// infrastructure, a DHCP range, or static assignments. The gateway is always excluded as well.
+	ExcludeRanges []*net.IPNet
+	ReservedIPs   []net.IP
+	// Allocator, if set, leases the container's address, so containers created at the same time, by this or another
+	// process sharing the allocator's ledger, are never given the same one. It is handed on to the created Network.
+	Allocator *IPAllocator
 }
 
 // Network is an abstraction over a container network, containing properties such as its name, IP network, gateway, DNS, and whether it uses DHCP.
@@ -24,20 +54,72 @@ type Network struct {
 	Gateway net.IP
 	DNS     []net.IP
 	DHCP    bool
+	// Ports are the mappings published to the container's address in IPNet, unpublished by DisconnectFromNetwork.
+	Ports []PortMapping
+	// Allocator, if set, leases the container's address in IPNet, see ConnectToNetwork.
+	Allocator *IPAllocator
+	// Masquerade is the host interface that traffic from IPNet's subnet is masqueraded through, as by
+	// EnableMasquerade, or empty if it is not masqueraded.
+	Masquerade string
+	// Bridge is the bridge AttachNamespace connected the container to, or empty if it is not connected to one.
+	Bridge string
+	// Rootfs is the container's root filesystem, whose /etc/resolv.conf ConnectToNetwork writes with DNS and
+	// SearchDomains. Empty leaves resolv.conf alone.
+	Rootfs        string
+	SearchDomains []string
+
+	// dhcp is the DHCP server CreateNetwork started for the network, stopped by TeardownNetwork.
+	dhcp *dhcpServer
+}
+
+// NetworkResult describes the addressing a container ended up with after its network was set up.
+type NetworkResult struct {
+	IP        net.IP `json:"ip,omitempty"`
+	PrefixLen int    `json:"prefixLen,omitempty"`
+	Gateway   net.IP `json:"gateway,omitempty"`
+	Interface string `json:"interface"`
+	MAC       string `json:"mac,omitempty"`
+	// Masquerade is the host interface the container's subnet is masqueraded through, if any.
+	Masquerade string `json:"masquerade,omitempty"`
+	// Bridge is the host bridge the container's interface is attached to, if any.
+	Bridge string `json:"bridge,omitempty"`
+}
+
+// NetStats holds the traffic counters of a network interface.
+type NetStats struct {
+	RxBytes   uint64 `json:"rxBytes"`
+	RxPackets uint64 `json:"rxPackets"`
+	RxErrors  uint64 `json:"rxErrors"`
+	RxDropped uint64 `json:"rxDropped"`
+	TxBytes   uint64 `json:"txBytes"`
+	TxPackets uint64 `json:"txPackets"`
+	TxErrors  uint64 `json:"txErrors"`
+	TxDropped uint64 `json:"txDropped"`
 }
 
 // NetworkHandler defines the methods required for a network handler to interact with and manage container networks.
 type NetworkHandler interface {
 	InterfaceByName(name string) (*net.Interface, error)
+	InterfaceByIndex(index int) (*net.Interface, error)
 	RouteList(link netlink.Link, family int) ([]netlink.Route, error)
 	DialTimeout(network, address string, timeout time.Duration) (net.Conn, error)
 	ResolveUDPAddr(network, address string) (*net.UDPAddr, error)
 	Addrs(*net.Interface) ([]net.Addr, error)
+	NeighList(linkIndex, family int) ([]netlink.Neigh, error)
+	// ProbeARP asks who has ip on the interface and returns the hardware address of the first host to answer
+	// within timeout.
+	ProbeARP(iface *net.Interface, ip net.IP, timeout time.Duration) (net.HardwareAddr, error)
 }
 
 // DefaultNetworkHandler is an empty placeholder for the default implementation of the NetworkHandler interface
 type DefaultNetworkHandler struct{}
 
+// NamespaceHandler implements the NetworkHandler interface like DefaultNetworkHandler, but in the network namespace
+// of the process with the given PID instead of the caller's, e.g. to read back a container's own interface.
+type NamespaceHandler struct {
+	PID int
+}
+
 // Answer represents a DNS answer, containing the name, type, time-to-live (TTL), and data of the DNS response.
 type Answer struct {
 	Name string
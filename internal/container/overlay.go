@@ -0,0 +1,135 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"spocker/internal/container/filesystem"
+
+	"golang.org/x/sys/unix"
+)
+
+// overlayDirName is the directory, in a container's state directory, that holds the layers of its overlay rootfs.
+const overlayDirName = "overlay"
+
+// writableLayerDirName is the directory, in the overlay directory, that a loopback writable layer is mounted on.
+const writableLayerDirName = "rw"
+
+// mountOverlayRootfs mounts an overlay with the rootfs of fs as its read-only lower layer and an upper layer of the
+// container's own, and moves fs to the merged directory, so everything the container writes lands in the upper layer.
+// The upper and work directories are made in layers, or in the overlay directory if layers is empty. It returns the
+// upper directory.
+func mountOverlayRootfs(fs *filesystem.Filesystem, id string, layers string) (string, error) {
+	dir, err := stateDir(id)
+	if err != nil {
+		return "", err
+	}
+	base := filepath.Join(dir, overlayDirName)
+	if layers == "" {
+		layers = base
+	}
+	upper, work, merged := filepath.Join(layers, "upper"), filepath.Join(layers, "work"), filepath.Join(base, "merged")
+	for _, layer := range []string{upper, work, merged} {
+		if err := os.MkdirAll(layer, 0755); err != nil {
+			return "", fmt.Errorf("failed to create overlay directory %s: %v", layer, err)
+		}
+	}
+	if err := fs.MountOverlay(fs.Root, upper, work, merged); err != nil {
+		_ = os.RemoveAll(base)
+		return "", err
+	}
+	fs.Root = merged
+	fs.UpperDir = upper
+	return upper, nil
+}
+
+// unmountOverlayRootfs unmounts the overlay rootfs of the container and removes its upper and work layers. A rootfs
+// that is no longer mounted is not an error. The merged directory is only removed once it is empty, so nothing in
+// the lower layer is ever removed through it. Layers on a loopback writable layer are left to unmountWritableLayer,
+// along with the overlay directory holding it.
+func unmountOverlayRootfs(state *ContainerState) error {
+	if state.UpperDir == "" {
+		return nil
+	}
+	if err := unix.Unmount(state.Rootfs, unix.MNT_DETACH); err != nil && !errors.Is(err, unix.EINVAL) && !errors.Is(err, unix.ENOENT) {
+		return fmt.Errorf("failed to unmount overlay rootfs of container %s: %v", state.ID, err)
+	}
+	layers, base := filepath.Dir(state.UpperDir), filepath.Dir(state.Rootfs)
+	for _, layer := range []string{state.UpperDir, filepath.Join(layers, "work")} {
+		if err := os.RemoveAll(layer); err != nil {
+			return fmt.Errorf("failed to remove overlay directory %s of container %s: %v", layer, state.ID, err)
+		}
+	}
+	dirs := []string{state.Rootfs}
+	if layers == base {
+		dirs = append(dirs, base)
+	}
+	for _, dir := range dirs {
+		if err := os.Remove(dir); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove overlay directory %s of container %s: %v", dir, state.ID, err)
+		}
+	}
+	return nil
+}
+
+// mountWritableLayer creates a loopback image of size bytes for the container's writable layer and mounts it in the
+// overlay directory, where mountOverlayRootfs can be given it for the upper and work directories. It returns the
+// mount point. If mounting fails, the image is detached and removed again.
+func mountWritableLayer(id string, size int64) (string, error) {
+	dir, err := stateDir(id)
+	if err != nil {
+		return "", err
+	}
+	image, err := LoopbackImagePath(id)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(image), 0700); err != nil {
+		return "", fmt.Errorf("failed to create directory for loopback image %s: %v", image, err)
+	}
+	device, err := filesystem.CreateLoopbackFS(image, size)
+	if err != nil {
+		return "", err
+	}
+	mountPoint := filepath.Join(dir, overlayDirName, writableLayerDirName)
+	if err := os.MkdirAll(mountPoint, 0755); err == nil {
+		err = unix.Mount(device, mountPoint, "ext4", 0, "")
+	}
+	if err != nil {
+		_ = filesystem.DetachLoopDevice(device)
+		_ = os.Remove(image)
+		return "", fmt.Errorf("failed to mount writable layer of container %s: %v", id, err)
+	}
+	return mountPoint, nil
+}
+
+// unmountWritableLayer unmounts the loopback writable layer of the container, detaches its loop device, and removes
+// its image and the overlay directory it was mounted in. A container without one is left alone, so it can run after
+// unmountOverlayRootfs for any container.
+func unmountWritableLayer(id string) error {
+	dir, err := stateDir(id)
+	if err != nil {
+		return err
+	}
+	base := filepath.Join(dir, overlayDirName)
+	mountPoint := filepath.Join(base, writableLayerDirName)
+	if err := unix.Unmount(mountPoint, unix.MNT_DETACH); err != nil && !errors.Is(err, unix.EINVAL) && !errors.Is(err, unix.ENOENT) {
+		return fmt.Errorf("failed to unmount writable layer of container %s: %v", id, err)
+	}
+	if err := detachLoopDevices(id); err != nil {
+		return err
+	}
+	image, err := LoopbackImagePath(id)
+	if err != nil {
+		return err
+	}
+	// The mount point is only removed once empty, so a layer that failed to unmount is never removed through it.
+	for _, path := range []string{image, mountPoint, base} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove writable layer %s of container %s: %v", path, id, err)
+		}
+	}
+	return nil
+}
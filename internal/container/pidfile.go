@@ -0,0 +1,96 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// checkPIDFile refuses a pidfile that already holds the PID of a live process, which is most likely another
+// instance that is still running. A pidfile left behind by a process that is gone is overwritten later.
+func checkPIDFile(path string) error {
+	pid, err := readPIDFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if pid > 0 && processAlive(pid) {
+		return fmt.Errorf("pidfile %s belongs to process %d, which is still running", path, pid)
+	}
+	return nil
+}
+
+// writePIDFile writes pid to the pidfile at path. The PID is written to a temporary file next to it that is then
+// renamed over it, so a reader never sees a partly written file.
+func writePIDFile(path string, pid int) error {
+	if err := checkPIDFile(path); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return fmt.Errorf("failed to write pidfile %s: %v", path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.WriteString(strconv.Itoa(pid) + "\n")
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write pidfile %s: %v", path, err)
+	}
+	return nil
+}
+
+// removePIDFile removes the pidfile at path if it still holds pid, so a pidfile that another instance has since
+// taken over is left alone.
+func removePIDFile(path string, pid int) error {
+	current, err := readPIDFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if current != pid {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove pidfile %s: %v", path, err)
+	}
+	return nil
+}
+
+// readPIDFile returns the PID in the pidfile at path. A file that does not hold a PID reads as 0.
+func readPIDFile(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, err
+		}
+		return 0, fmt.Errorf("failed to read pidfile %s: %v", path, err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, nil
+	}
+	return pid, nil
+}
+
+// processAlive reports whether a process with the given PID exists.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
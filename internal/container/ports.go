@@ -0,0 +1,101 @@
+package container
+
+import (
+	"fmt"
+	"net"
+
+	"spocker/internal/container/network"
+)
+
+// hostPorts keeps the host ports handed out to containers by this process from being handed out twice.
+var hostPorts = network.NewPortAllocator()
+
+// assignHostPorts returns the mappings with a host port for each, allocating a free one where none was given.
+// Host ports published by other containers that are still alive count as taken. Every host port returned is
+// reserved until releaseHostPorts is called with the result.
+func assignHostPorts(mappings []network.PortMapping) ([]network.PortMapping, error) {
+	published, err := publishedPorts()
+	if err != nil {
+		return nil, err
+	}
+
+	var assigned []network.PortMapping
+	for _, mapping := range mappings {
+		taken := func(port int) bool {
+			return published[hostPortKey(mapping.Protocol, port)]
+		}
+		if mapping.HostPort == 0 {
+			port, err := hostPorts.Allocate(mapping.Protocol, taken)
+			if err != nil {
+				releaseHostPorts(assigned)
+				return nil, err
+			}
+			mapping.HostPort = port
+		} else {
+			if taken(mapping.HostPort) {
+				releaseHostPorts(assigned)
+				return nil, fmt.Errorf("host port %d/%s is already published by another container", mapping.HostPort, mapping.Protocol)
+			}
+			if err := hostPorts.Reserve(mapping.Protocol, mapping.HostPort); err != nil {
+				releaseHostPorts(assigned)
+				return nil, err
+			}
+		}
+		assigned = append(assigned, mapping)
+	}
+	return assigned, nil
+}
+
+// releaseHostPorts gives the host ports of the mappings back to the allocator.
+func releaseHostPorts(mappings []network.PortMapping) {
+	for _, mapping := range mappings {
+		hostPorts.Release(mapping.Protocol, mapping.HostPort)
+	}
+}
+
+// publishHostPorts installs the DNAT rule of each mapping, forwarding its host port to the container port at
+// containerIP. If one cannot be installed, those installed before it are removed again.
+func publishHostPorts(containerIP net.IP, mappings []network.PortMapping) error {
+	for i, mapping := range mappings {
+		if err := network.PublishPort(containerIP, mapping); err != nil {
+			_ = unpublishHostPorts(containerIP, mappings[:i])
+			return err
+		}
+	}
+	return nil
+}
+
+// unpublishHostPorts removes the DNAT rules installed by publishHostPorts. Every rule is removed even if another
+// fails; the first error is returned.
+func unpublishHostPorts(containerIP net.IP, mappings []network.PortMapping) error {
+	var firstErr error
+	for _, mapping := range mappings {
+		if err := network.UnpublishPort(containerIP, mapping); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// publishedPorts returns the host ports published by containers that are created or running.
+func publishedPorts() (map[string]bool, error) {
+	states, err := ListStates()
+	if err != nil {
+		return nil, err
+	}
+	published := map[string]bool{}
+	for _, state := range states {
+		if state.Status != StatusCreated && checkRunning(state) != nil {
+			continue
+		}
+		for _, mapping := range state.Ports {
+			published[hostPortKey(mapping.Protocol, mapping.HostPort)] = true
+		}
+	}
+	return published, nil
+}
+
+// hostPortKey identifies a published host port.
+func hostPortKey(protocol string, port int) string {
+	return fmt.Sprintf("%d/%s", port, protocol)
+}
@@ -0,0 +1,65 @@
+package container
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// namespaceFlags names the namespaces behind each clone flag, in the order they are listed in errors.
+var namespaceFlags = []struct {
+	flag uintptr
+	name string
+}{
+	{syscall.CLONE_NEWNS, "mount"},
+	{syscall.CLONE_NEWUTS, "uts"},
+	{syscall.CLONE_NEWIPC, "ipc"},
+	{syscall.CLONE_NEWPID, "pid"},
+	{syscall.CLONE_NEWNET, "net"},
+	{syscall.CLONE_NEWCGROUP, "cgroup"},
+}
+
+// PreflightCheck reports problems that would make setting up the container fail partway through, such as
+// missing privileges, before anything is set up.
+func PreflightCheck(config *Config) error {
+	return checkNamespacePrivileges(cloneFlags(config))
+}
+
+// checkNamespacePrivileges returns an error if creating the namespaces in flags needs CAP_SYS_ADMIN and the
+// process does not have it. Without the check, the clone fails with a bare "operation not permitted".
+// A new user namespace grants the capability inside it, so no check is needed when one is requested.
+func checkNamespacePrivileges(flags uintptr) error {
+	if flags&syscall.CLONE_NEWUSER != 0 {
+		return nil
+	}
+	var names []string
+	for _, ns := range namespaceFlags {
+		if flags&ns.flag != 0 {
+			names = append(names, ns.name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	privileged, err := hasCapability(unix.CAP_SYS_ADMIN)
+	if err != nil {
+		return err
+	}
+	if !privileged {
+		return fmt.Errorf("creating the container's %s namespaces requires CAP_SYS_ADMIN, which spocker does not have: run it as root, or with -userns to create them in a user namespace", strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// hasCapability reports whether the capability is in the calling thread's effective set.
+func hasCapability(capability int) (bool, error) {
+	header := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&header, &data[0]); err != nil {
+		return false, fmt.Errorf("failed to read capabilities: %v", err)
+	}
+	return data[capability/32].Effective&(1<<(capability%32)) != 0, nil
+}
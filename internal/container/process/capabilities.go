@@ -0,0 +1,171 @@
+package process
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// capabilities maps the name of each Linux capability to its number.
+var capabilities = map[string]int{
+	"CAP_CHOWN":              unix.CAP_CHOWN,
+	"CAP_DAC_OVERRIDE":       unix.CAP_DAC_OVERRIDE,
+	"CAP_DAC_READ_SEARCH":    unix.CAP_DAC_READ_SEARCH,
+	"CAP_FOWNER":             unix.CAP_FOWNER,
+	"CAP_FSETID":             unix.CAP_FSETID,
+	"CAP_KILL":               unix.CAP_KILL,
+	"CAP_SETGID":             unix.CAP_SETGID,
+	"CAP_SETUID":             unix.CAP_SETUID,
+	"CAP_SETPCAP":            unix.CAP_SETPCAP,
+	"CAP_LINUX_IMMUTABLE":    unix.CAP_LINUX_IMMUTABLE,
+	"CAP_NET_BIND_SERVICE":   unix.CAP_NET_BIND_SERVICE,
+	"CAP_NET_BROADCAST":      unix.CAP_NET_BROADCAST,
+	"CAP_NET_ADMIN":          unix.CAP_NET_ADMIN,
+	"CAP_NET_RAW":            unix.CAP_NET_RAW,
+	"CAP_IPC_LOCK":           unix.CAP_IPC_LOCK,
+	"CAP_IPC_OWNER":          unix.CAP_IPC_OWNER,
+	"CAP_SYS_MODULE":         unix.CAP_SYS_MODULE,
+	"CAP_SYS_RAWIO":          unix.CAP_SYS_RAWIO,
+	"CAP_SYS_CHROOT":         unix.CAP_SYS_CHROOT,
+	"CAP_SYS_PTRACE":         unix.CAP_SYS_PTRACE,
+	"CAP_SYS_PACCT":          unix.CAP_SYS_PACCT,
+	"CAP_SYS_ADMIN":          unix.CAP_SYS_ADMIN,
+	"CAP_SYS_BOOT":           unix.CAP_SYS_BOOT,
+	"CAP_SYS_NICE":           unix.CAP_SYS_NICE,
+	"CAP_SYS_RESOURCE":       unix.CAP_SYS_RESOURCE,
+	"CAP_SYS_TIME":           unix.CAP_SYS_TIME,
+	"CAP_SYS_TTY_CONFIG":     unix.CAP_SYS_TTY_CONFIG,
+	"CAP_MKNOD":              unix.CAP_MKNOD,
+	"CAP_LEASE":              unix.CAP_LEASE,
+	"CAP_AUDIT_WRITE":        unix.CAP_AUDIT_WRITE,
+	"CAP_AUDIT_CONTROL":      unix.CAP_AUDIT_CONTROL,
+	"CAP_SETFCAP":            unix.CAP_SETFCAP,
+	"CAP_MAC_OVERRIDE":       unix.CAP_MAC_OVERRIDE,
+	"CAP_MAC_ADMIN":          unix.CAP_MAC_ADMIN,
+	"CAP_SYSLOG":             unix.CAP_SYSLOG,
+	"CAP_WAKE_ALARM":         unix.CAP_WAKE_ALARM,
+	"CAP_BLOCK_SUSPEND":      unix.CAP_BLOCK_SUSPEND,
+	"CAP_AUDIT_READ":         unix.CAP_AUDIT_READ,
+	"CAP_PERFMON":            unix.CAP_PERFMON,
+	"CAP_BPF":                unix.CAP_BPF,
+	"CAP_CHECKPOINT_RESTORE": unix.CAP_CHECKPOINT_RESTORE,
+}
+
+// DefaultCapabilities is the capability set a container gets unless it adds or drops some, the same as Docker's.
+var DefaultCapabilities = []string{
+	"CAP_AUDIT_WRITE",
+	"CAP_CHOWN",
+	"CAP_DAC_OVERRIDE",
+	"CAP_FOWNER",
+	"CAP_FSETID",
+	"CAP_KILL",
+	"CAP_MKNOD",
+	"CAP_NET_BIND_SERVICE",
+	"CAP_NET_RAW",
+	"CAP_SETFCAP",
+	"CAP_SETGID",
+	"CAP_SETPCAP",
+	"CAP_SETUID",
+	"CAP_SYS_CHROOT",
+}
+
+// allCapabilities is the name that stands for every capability in an add or drop list.
+const allCapabilities = "ALL"
+
+// ParseCapability normalizes a capability name, accepting it in any case and with or without the CAP_ prefix,
+// e.g. "net_admin" becomes "CAP_NET_ADMIN". "ALL" is accepted as is. Unknown capabilities are an error.
+func ParseCapability(name string) (string, error) {
+	upper := strings.ToUpper(strings.TrimSpace(name))
+	if upper == allCapabilities {
+		return allCapabilities, nil
+	}
+	if !strings.HasPrefix(upper, "CAP_") {
+		upper = "CAP_" + upper
+	}
+	if _, ok := capabilities[upper]; !ok {
+		return "", fmt.Errorf("unknown capability: %s", name)
+	}
+	return upper, nil
+}
+
+// Capabilities returns the sorted capability set that results from removing drop from DefaultCapabilities and then
+// adding add. Drops are applied first, as Docker does, so a capability that is both dropped and added is kept, and
+// dropping ALL followed by adds leaves exactly the added capabilities.
+func Capabilities(add, drop []string) ([]string, error) {
+	set := map[string]bool{}
+	for _, name := range DefaultCapabilities {
+		set[name] = true
+	}
+
+	for _, name := range drop {
+		parsed, err := ParseCapability(name)
+		if err != nil {
+			return nil, err
+		}
+		if parsed == allCapabilities {
+			set = map[string]bool{}
+			continue
+		}
+		delete(set, parsed)
+	}
+	for _, name := range add {
+		parsed, err := ParseCapability(name)
+		if err != nil {
+			return nil, err
+		}
+		if parsed == allCapabilities {
+			for known := range capabilities {
+				set[known] = true
+			}
+			continue
+		}
+		set[parsed] = true
+	}
+
+	result := make([]string, 0, len(set))
+	for name := range set {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// applyCapabilities limits the calling thread to caps: every other capability is dropped from the bounding set,
+// and the effective, permitted, and inheritable sets are set to caps. A root process exec'd from the thread
+// afterwards gets exactly caps as its permitted and effective sets.
+// The changes only apply to the calling thread, so it must stay locked to the goroutine until it execs.
+func applyCapabilities(caps []string) error {
+	keep := map[int]bool{}
+	var data [2]unix.CapUserData
+	for _, name := range caps {
+		capability, ok := capabilities[name]
+		if !ok {
+			return fmt.Errorf("unknown capability: %s", name)
+		}
+		keep[capability] = true
+		data[capability/32].Effective |= 1 << (capability % 32)
+	}
+	for i := range data {
+		data[i].Permitted = data[i].Effective
+		data[i].Inheritable = data[i].Effective
+	}
+
+	for capability := 0; capability <= unix.CAP_LAST_CAP; capability++ {
+		if keep[capability] {
+			continue
+		}
+		// The kernel may predate some capabilities, which then do not need dropping.
+		if err := unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(capability), 0, 0, 0); err != nil && !errors.Is(err, unix.EINVAL) {
+			return fmt.Errorf("failed to drop capability %d from the bounding set: %w", capability, err)
+		}
+	}
+
+	header := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	if err := unix.Capset(&header, &data[0]); err != nil {
+		return fmt.Errorf("failed to set capabilities: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package process
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Environ returns the environment the process was started with, as KEY=VALUE strings, from /proc/<pid>/environ.
+// Changes the process made to its environment after it started are not reflected. Reading the environment of a
+// process owned by another user needs root or CAP_SYS_PTRACE; without it the error wraps os.ErrPermission.
+func Environ(pid int) ([]string, error) {
+	environPath := filepath.Join("/proc", strconv.Itoa(pid), "environ")
+	data, err := os.ReadFile(environPath)
+	if err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			return nil, fmt.Errorf("not permitted to read the environment of process %d, which belongs to another user: %w", pid, err)
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("process %d does not exist", pid)
+		}
+		return nil, fmt.Errorf("failed to read %s: %w", environPath, err)
+	}
+	return parseEnviron(data), nil
+}
+
+// parseEnviron splits the NUL-separated contents of an environ file into its variables.
+func parseEnviron(data []byte) []string {
+	env := []string{}
+	for _, entry := range bytes.Split(data, []byte{0}) {
+		if len(entry) > 0 {
+			env = append(env, string(entry))
+		}
+	}
+	return env
+}
@@ -0,0 +1,145 @@
+package process
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"spocker/internal/container/namespace"
+
+	"golang.org/x/sys/unix"
+)
+
+// ExecCommand is the argument that makes the spocker binary run a command inside a running container.
+const ExecCommand = "exec-in"
+
+// ExecTarget is the running container a command is exec'd into: the namespaces of the given types of the process
+// with the given PID, the cgroup at CgroupPath, and the capabilities in Caps. An empty CgroupPath leaves the cgroup
+// alone, and a nil Caps the capabilities.
+type ExecTarget struct {
+	PID        int
+	Types      []namespace.NamespaceType
+	CgroupPath string
+	Caps       []string
+}
+
+// Args returns the arguments, after ExecCommand, that make the spocker binary run path with argv in the target.
+func (t ExecTarget) Args(path string, argv []string) []string {
+	types := make([]string, len(t.Types))
+	for i, nsType := range t.Types {
+		types[i] = strconv.Itoa(int(nsType))
+	}
+	caps := "-"
+	if t.Caps != nil {
+		caps = strings.Join(t.Caps, ",")
+	}
+	return append([]string{strconv.Itoa(t.PID), strings.Join(types, ","), t.CgroupPath, caps, path, "--"}, argv...)
+}
+
+// ParseExecArgs parses the arguments made by ExecTarget.Args into the target, path, and argv.
+func ParseExecArgs(args []string) (ExecTarget, string, []string, error) {
+	var target ExecTarget
+	if len(args) < 7 || args[5] != "--" {
+		return target, "", nil, fmt.Errorf("invalid %s arguments: %q", ExecCommand, args)
+	}
+	pid, err := strconv.Atoi(args[0])
+	if err != nil {
+		return target, "", nil, fmt.Errorf("invalid PID %q: %w", args[0], err)
+	}
+	target.PID = pid
+	if args[1] != "" {
+		for _, name := range strings.Split(args[1], ",") {
+			nsType, err := strconv.Atoi(name)
+			if err != nil {
+				return target, "", nil, fmt.Errorf("invalid namespace type %q: %w", name, err)
+			}
+			target.Types = append(target.Types, namespace.NamespaceType(nsType))
+		}
+	}
+	target.CgroupPath = args[2]
+	switch args[3] {
+	case "-":
+	case "":
+		target.Caps = []string{}
+	default:
+		target.Caps = strings.Split(args[3], ",")
+	}
+	return target, args[4], args[6:], nil
+}
+
+// ExecIn runs path, with argv as its arguments, in the namespaces of target's process and returns its exit code.
+// The command starts in the working directory of that process and is limited to target's capabilities. It is a
+// child of the caller, since a joined PID namespace only applies to children, so moving the caller into target's
+// cgroup, which is left to the caller, moves the command there from the start.
+// SIGTERM and SIGHUP are forwarded to the command; SIGINT and SIGQUIT are not, since a terminal sends them to the
+// command's process group, which it shares with the caller. A command killed by signal N yields 128+N.
+func ExecIn(target ExecTarget, path string, argv []string) (int, error) {
+	pid := target.PID
+	// Namespaces and capabilities are per thread, so the command is forked from the thread they are set on. The
+	// thread is never unlocked, as it could not be returned to the pool in the container's namespaces.
+	runtime.LockOSThread()
+
+	// Joining a mount namespace moves the thread to its root, so the working directory is opened beforehand.
+	wd, err := os.Open(fmt.Sprintf("/proc/%d/cwd", pid))
+	if err != nil {
+		return 127, fmt.Errorf("failed to open working directory of process %d: %w", pid, err)
+	}
+	defer wd.Close()
+
+	if err := namespace.Join(pid, target.Types); err != nil {
+		return 127, err
+	}
+	if err := unix.Fchdir(int(wd.Fd())); err != nil {
+		return 127, fmt.Errorf("failed to change to working directory of process %d: %w", pid, err)
+	}
+	if !strings.Contains(path, "/") {
+		if path, err = exec.LookPath(path); err != nil {
+			return 127, err
+		}
+	}
+	if target.Caps != nil {
+		if err := applyCapabilities(target.Caps); err != nil {
+			return 127, err
+		}
+	}
+
+	signals := make(chan os.Signal, 8)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGINT, syscall.SIGQUIT)
+	defer signal.Stop(signals)
+
+	cmd := exec.Command(path)
+	cmd.Args = argv
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return 127, fmt.Errorf("failed to start %s: %w", path, err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				if sig == syscall.SIGTERM || sig == syscall.SIGHUP {
+					_ = cmd.Process.Signal(sig)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	err = cmd.Wait()
+	close(done)
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			return 1, fmt.Errorf("failed to wait for %s: %w", path, err)
+		}
+	}
+	return exitCode(cmd.ProcessState.Sys().(syscall.WaitStatus)), nil
+}
@@ -0,0 +1,87 @@
+package process
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// InitCommand is the argument that makes the spocker binary act as a container init process.
+const InitCommand = "init"
+
+// RunInit runs command as the child of a minimal init process and returns the code init should exit with.
+// Every signal init receives is forwarded to the child, and all descendants re-parented to init are reaped so
+// they never linger as zombies. Init returns once the child exits; a child killed by signal N yields 128+N.
+func RunInit(command []string) (int, error) {
+	if len(command) == 0 {
+		return 1, fmt.Errorf("no command given to init")
+	}
+
+	// Become a subreaper so orphans are re-parented to init even when it is not PID 1.
+	if err := unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 1, 0, 0, 0); err != nil {
+		return 1, fmt.Errorf("failed to become child subreaper: %w", err)
+	}
+
+	signals := make(chan os.Signal, 32)
+	signal.Notify(signals)
+	defer signal.Stop(signals)
+
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return 127, fmt.Errorf("failed to start %s: %w", command[0], err)
+	}
+	child := cmd.Process.Pid
+
+	for sig := range signals {
+		sysSig, ok := sig.(syscall.Signal)
+		if !ok {
+			continue
+		}
+		switch sysSig {
+		case syscall.SIGCHLD:
+			if code, exited := reapChildren(child); exited {
+				return code, nil
+			}
+		case syscall.SIGURG:
+			// Used internally by the Go runtime for goroutine preemption, not meant for the child.
+		default:
+			_ = syscall.Kill(child, sysSig)
+		}
+	}
+
+	return 1, fmt.Errorf("signal channel closed unexpectedly")
+}
+
+// reapChildren waits for every exited descendant without blocking.
+// It reports the exit code of child and whether child was among the reaped processes.
+func reapChildren(child int) (int, bool) {
+	code, exited := 0, false
+	for {
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || pid <= 0 {
+			return code, exited
+		}
+		if pid == child {
+			code, exited = exitCode(status), true
+		}
+	}
+}
+
+// exitCode converts a wait status into a shell-style exit code.
+func exitCode(status syscall.WaitStatus) int {
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return status.ExitStatus()
+}
@@ -1,14 +1,10 @@
 package process
 
 import (
-	"bufio"
 	"context"
 	"fmt"
 	"os"
 	"os/exec"
-	"path/filepath"
-	"strconv"
-	"strings"
 	"syscall"
 
 	"spocker/internal/container/util"
@@ -16,7 +12,8 @@ import (
 
 // Process is a struct representing a container process.// Process represents a container process.
 type Process struct {
-	cmd *exec.Cmd
+	cmd  *exec.Cmd
+	spec *ProcessSpec
 }
 
 type ProcessHandler interface {
@@ -40,8 +37,11 @@ func (dph DefaultProcessHandler) Getppid() int {
 }
 
 // NewProcess creates a new container process based on the given ProcessSpec.
-func NewProcess(spec *ProcessSpec) (*Process, error) {
-	ctx := context.Background()
+// The process is killed if ctx is done before it exits.
+func NewProcess(ctx context.Context, spec *ProcessSpec) (*Process, error) {
+	if err := ValidateScheduler(spec.SchedPolicy, spec.SchedPriority); err != nil {
+		return nil, err
+	}
 	cmd, err := util.CreateCommand(ctx, spec.Path, spec.Args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create command: %w", err)
@@ -51,12 +51,12 @@ func NewProcess(spec *ProcessSpec) (*Process, error) {
 		Unshareflags: syscall.CLONE_NEWNS,
 	}
 
-	return &Process{cmd: cmd}, nil
+	return &Process{cmd: cmd, spec: spec}, nil
 }
 
 // Start begins the execution of the container process.
 func (p *Process) Start() error {
-	return p.cmd.Start()
+	return StartWithScheduler(p.cmd, p.spec.SchedPolicy, p.spec.SchedPriority)
 }
 
 // Wait waits for the container process to exit and returns its exit code.
@@ -85,51 +85,40 @@ func (p *Process) Kill(sig os.Signal) error {
 type ProcessSpec struct {
 	Path string
 	Args []string
+	// SchedPolicy is the scheduling policy to run the process with, e.g. SCHED_BATCH or SCHED_FIFO, and
+	// SchedPriority its priority, which only the real-time policies take. An empty policy inherits the caller's.
+	SchedPolicy   string
+	SchedPriority int
 }
 
-// GetInitProcess returns the init process for the current system.
+// GetInitProcess returns the init process for the current system, found by following the parent PIDs of the
+// current process up to PID 1.
 func GetInitProcess() (*os.Process, error) {
-	pid := syscall.Getpid()
-	for {
-		statPath := filepath.Join("/proc", strconv.Itoa(pid), "stat")
-		_, err := strconv.Atoi(strconv.Itoa(pid))
-		if err != nil {
-			return nil, fmt.Errorf("invalid PID: %v", pid)
-		}
-		statFile, err := os.Open(statPath)
-		if err != nil {
-			return nil, fmt.Errorf("failed to open %s: %v", statPath, err)
-		}
-		defer statFile.Close()
-
-		scanner := bufio.NewScanner(statFile)
-		scanner.Scan()
-		statLine := scanner.Text()
-		statFields := strings.Fields(statLine)
-		if len(statFields) < 4 {
-			return nil, fmt.Errorf("invalid stat file format: %s", statLine)
-		}
+	pid, err := findInitPID(syscall.Getpid(), ReadProcStat)
+	if err != nil {
+		return nil, err
+	}
+	return os.FindProcess(pid)
+}
 
-		// The process with PID 1 is always the init process.
-		if statFields[0] == "1" {
-			initPid, err := strconv.Atoi(statFields[0])
-			if err != nil {
-				return nil, fmt.Errorf("failed to parse init PID: %v", err)
-			}
-			return os.FindProcess(initPid)
+// findInitPID follows the parent PIDs of the process with the given PID, read with readStat, up to PID 1 and
+// returns it. A chain that ends elsewhere, at a parent PID of 0, or that loops is an error.
+func findInitPID(pid int, readStat func(pid int) (*ProcStat, error)) (int, error) {
+	seen := map[int]bool{}
+	for pid != 1 {
+		if seen[pid] {
+			return 0, fmt.Errorf("failed to find init process: the parent of process %d loops back to it", pid)
 		}
+		seen[pid] = true
 
-		// The parent PID is the fourth field in the stat file.
-		ppid, err := strconv.Atoi(statFields[3])
+		stat, err := readStat(pid)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse parent PID: %v", err)
+			return 0, fmt.Errorf("failed to find init process: %w", err)
 		}
-
-		// If the parent PID is 0, then we've reached the root process.
-		if ppid == 0 {
-			return nil, fmt.Errorf("failed to find init process")
+		if stat.PPID == 0 {
+			return 0, fmt.Errorf("failed to find init process: process %d has no parent", pid)
 		}
-
-		pid = ppid
+		pid = stat.PPID
 	}
+	return pid, nil
 }
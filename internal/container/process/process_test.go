@@ -1,8 +1,21 @@
 package process
 
 import (
+	"context"
+	"errors"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
+
+	"spocker/internal/container/namespace"
+
+	"golang.org/x/sys/unix"
 )
 
 func TestNewProcess(t *testing.T) {
@@ -10,7 +23,7 @@ func TestNewProcess(t *testing.T) {
 		Path: "/bin/bash",
 		Args: []string{"-c", "echo hello"},
 	}
-	proc, err := NewProcess(spec)
+	proc, err := NewProcess(context.Background(), spec)
 	if err != nil {
 		t.Fatalf("NewProcess returned an error: %v", err)
 	}
@@ -24,7 +37,7 @@ func TestStartWait(t *testing.T) {
 		Path: "/bin/bash",
 		Args: []string{"-c", "echo hello"},
 	}
-	proc, err := NewProcess(spec)
+	proc, err := NewProcess(context.Background(), spec)
 	if err != nil {
 		t.Fatalf("NewProcess returned an error: %v", err)
 	}
@@ -45,7 +58,7 @@ func TestKill(t *testing.T) {
 		Path: "/bin/sleep",
 		Args: []string{"5"},
 	}
-	proc, err := NewProcess(spec)
+	proc, err := NewProcess(context.Background(), spec)
 	if err != nil {
 		t.Fatalf("NewProcess returned an error: %v", err)
 	}
@@ -63,3 +76,433 @@ func TestKill(t *testing.T) {
 		t.Errorf("Process exited with status %d", exitCode)
 	}
 }
+
+// startInitHelper starts the test binary as an init process running command.
+func startInitHelper(t *testing.T, command ...string) *exec.Cmd {
+	t.Helper()
+	args := append([]string{"-test.run=TestInitHelperProcess", "--"}, command...)
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "SPOCKER_INIT_HELPER=1")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start init helper: %v", err)
+	}
+	return cmd
+}
+
+// TestInitHelperProcess is not a real test; it runs RunInit when the test binary is re-executed by the init tests.
+func TestInitHelperProcess(t *testing.T) {
+	if os.Getenv("SPOCKER_INIT_HELPER") != "1" {
+		return
+	}
+	args := os.Args
+	for i, arg := range args {
+		if arg == "--" {
+			args = args[i+1:]
+			break
+		}
+	}
+	code, err := RunInit(args)
+	if err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+	}
+	os.Exit(code)
+}
+
+func TestInitForwardsSignals(t *testing.T) {
+	cmd := startInitHelper(t, "sh", "-c", "trap 'exit 42' TERM; while :; do sleep 0.05; done")
+
+	// Give the shell time to install its trap before signalling init.
+	time.Sleep(300 * time.Millisecond)
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatalf("failed to signal init: %v", err)
+	}
+
+	err := cmd.Wait()
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		t.Fatalf("expected init to exit with the child's code, got %v", err)
+	}
+	if exitErr.ExitCode() != 42 {
+		t.Errorf("init exited with %d, want 42 from the trapped SIGTERM", exitErr.ExitCode())
+	}
+}
+
+func TestInitReapsOrphans(t *testing.T) {
+	// The subshell exits immediately, orphaning its background sleep, which is re-parented to init.
+	cmd := startInitHelper(t, "sh", "-c", "(sleep 0.1 &); sleep 1")
+	defer cmd.Wait()
+
+	time.Sleep(600 * time.Millisecond)
+	if zombies := zombieChildren(t, cmd.Process.Pid); len(zombies) > 0 {
+		t.Errorf("init left zombie children: %v", zombies)
+	}
+
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("init exited with an error: %v", err)
+	}
+}
+
+// zombieChildren returns the PIDs of zombie processes whose parent is ppid.
+func zombieChildren(t *testing.T, ppid int) []int {
+	t.Helper()
+	statFiles, err := filepath.Glob("/proc/[0-9]*/stat")
+	if err != nil {
+		t.Fatalf("failed to list processes: %v", err)
+	}
+
+	var zombies []int
+	for _, statFile := range statFiles {
+		data, err := os.ReadFile(statFile)
+		if err != nil {
+			continue
+		}
+		// Fields after the parenthesised command name start with the state and the parent PID.
+		stat := string(data)
+		fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+		if len(fields) < 2 || fields[0] != "Z" {
+			continue
+		}
+		if parent, _ := strconv.Atoi(fields[1]); parent == ppid {
+			pid, _ := strconv.Atoi(filepath.Base(filepath.Dir(statFile)))
+			zombies = append(zombies, pid)
+		}
+	}
+	return zombies
+}
+
+func TestWaitPID(t *testing.T) {
+	for name, wait := range map[string]func(int, uint64) (int, error){
+		"pidfd":   WaitPID,
+		"polling": waitPIDPolling,
+	} {
+		t.Run(name, func(t *testing.T) {
+			cmd := exec.Command("sh", "-c", "sleep 0.2; exit 3")
+			if err := cmd.Start(); err != nil {
+				t.Fatalf("failed to start process: %v", err)
+			}
+			pid := cmd.Process.Pid
+			startTime, err := ProcessStartTime(pid)
+			if err != nil {
+				t.Fatalf("ProcessStartTime returned an error: %v", err)
+			}
+
+			if _, err := wait(pid, startTime+1); err == nil {
+				t.Error("expected a start time mismatch to be detected")
+			}
+
+			code, err := wait(pid, startTime)
+			if err != nil {
+				t.Fatalf("wait returned an error: %v", err)
+			}
+			if code != 3 {
+				t.Errorf("expected exit code 3, got %d", code)
+			}
+			if err := syscall.Kill(pid, 0); err == nil {
+				t.Error("expected the process to be reaped")
+			}
+		})
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	tests := []struct {
+		name string
+		add  []string
+		drop []string
+		want []string
+	}{
+		{"default", nil, nil, DefaultCapabilities},
+		{
+			"drop and add",
+			[]string{"CAP_NET_ADMIN"},
+			[]string{"CAP_CHOWN"},
+			[]string{"CAP_AUDIT_WRITE", "CAP_DAC_OVERRIDE", "CAP_FOWNER", "CAP_FSETID", "CAP_KILL", "CAP_MKNOD", "CAP_NET_ADMIN", "CAP_NET_BIND_SERVICE", "CAP_NET_RAW", "CAP_SETFCAP", "CAP_SETGID", "CAP_SETPCAP", "CAP_SETUID", "CAP_SYS_CHROOT"},
+		},
+		{"add re-grants a drop", []string{"chown"}, []string{"CAP_CHOWN"}, DefaultCapabilities},
+		{"drop all then add", []string{"net_bind_service", "CAP_KILL"}, []string{"ALL"}, []string{"CAP_KILL", "CAP_NET_BIND_SERVICE"}},
+	}
+
+	for _, tt := range tests {
+		got, err := Capabilities(tt.add, tt.drop)
+		if err != nil {
+			t.Fatalf("%s: Capabilities returned an error: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Capabilities(%v, %v) = %v, want %v", tt.name, tt.add, tt.drop, got, tt.want)
+		}
+	}
+
+	all, err := Capabilities([]string{"ALL"}, nil)
+	if err != nil || len(all) != len(capabilities) {
+		t.Errorf("adding ALL should yield all %d capabilities, got %d (%v)", len(capabilities), len(all), err)
+	}
+	if _, err := Capabilities([]string{"CAP_FLY"}, nil); err == nil {
+		t.Error("expected an error for an unknown capability")
+	}
+}
+
+func TestSchedulerPolicy(t *testing.T) {
+	cmd := exec.Command("sleep", "10")
+	if err := StartWithScheduler(cmd, "SCHED_BATCH", 0); err != nil {
+		t.Fatalf("StartWithScheduler returned an error: %v", err)
+	}
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+
+	attr, err := unix.SchedGetAttr(cmd.Process.Pid, 0)
+	if err != nil {
+		t.Fatalf("failed to read the scheduling policy: %v", err)
+	}
+	if attr.Policy != unix.SCHED_BATCH {
+		t.Errorf("expected policy SCHED_BATCH (%d), got %d", unix.SCHED_BATCH, attr.Policy)
+	}
+
+	self, err := unix.SchedGetAttr(0, 0)
+	if err != nil {
+		t.Fatalf("failed to read the test's scheduling policy: %v", err)
+	}
+	if self.Policy == unix.SCHED_BATCH {
+		t.Error("the policy leaked into the caller")
+	}
+
+	tests := []struct {
+		policy   string
+		priority int
+		valid    bool
+	}{
+		{"", 0, true},
+		{"", 5, false},
+		{"batch", 0, true},
+		{"SCHED_BATCH", 1, false},
+		{"SCHED_FIFO", 0, false},
+		{"SCHED_FIFO", 1, true},
+		{"SCHED_RR", 99, true},
+		{"SCHED_RR", 100, false},
+		{"SCHED_DEADLINE", 0, false},
+	}
+	for _, tt := range tests {
+		if err := ValidateScheduler(tt.policy, tt.priority); (err == nil) != tt.valid {
+			t.Errorf("ValidateScheduler(%q, %d): got error %v, want valid %v", tt.policy, tt.priority, err, tt.valid)
+		}
+	}
+}
+
+func TestEnviron(t *testing.T) {
+	cmd := exec.Command("sleep", "10")
+	cmd.Env = []string{"SPOCKER_TEST=hello world", "EMPTY="}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start sleep: %v", err)
+	}
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+
+	env, err := Environ(cmd.Process.Pid)
+	if err != nil {
+		t.Fatalf("Environ returned an error: %v", err)
+	}
+	if !reflect.DeepEqual(env, cmd.Env) {
+		t.Errorf("expected environment %q, got %q", cmd.Env, env)
+	}
+
+	if _, err := Environ(-1); err == nil {
+		t.Error("expected an error for a process that does not exist")
+	}
+	// Another user's process needs privilege to read, so the error must say so instead of failing obscurely
+	if os.Geteuid() != 0 {
+		if _, err := Environ(1); err == nil || !errors.Is(err, os.ErrPermission) {
+			t.Errorf("expected a permission error reading init's environment, got %v", err)
+		}
+	}
+}
+
+func TestParseSignal(t *testing.T) {
+	tests := []struct {
+		name string
+		want syscall.Signal
+	}{
+		{"SIGQUIT", syscall.SIGQUIT},
+		{"int", syscall.SIGINT},
+		{"Term", syscall.SIGTERM},
+		{"9", syscall.SIGKILL},
+	}
+	for _, tt := range tests {
+		got, err := ParseSignal(tt.name)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseSignal(%q) = %v, %v, want %v", tt.name, got, err, tt.want)
+		}
+	}
+	for _, name := range []string{"SIGFOO", "0", "-1", "1000", ""} {
+		if _, err := ParseSignal(name); err == nil {
+			t.Errorf("expected an error for signal %q", name)
+		}
+	}
+}
+
+func TestStop(t *testing.T) {
+	dir := t.TempDir()
+	start := func(script string) (*exec.Cmd, uint64) {
+		t.Helper()
+		cmd := exec.Command("sh", "-c", script)
+		cmd.Dir = dir
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("failed to start sh: %v", err)
+		}
+		// Give the shell time to install its traps before it is signalled
+		time.Sleep(200 * time.Millisecond)
+		startTime, err := ProcessStartTime(cmd.Process.Pid)
+		if err != nil {
+			t.Fatalf("ProcessStartTime returned an error: %v", err)
+		}
+		return cmd, startTime
+	}
+
+	// The configured signal is sent first, and a process that exits on it is not killed
+	cmd, startTime := start(`trap 'echo QUIT > received; exit 3' QUIT; trap 'echo TERM > received; exit 4' TERM; while :; do sleep 0.05; done`)
+	code, killed, err := Stop(cmd.Process.Pid, startTime, syscall.SIGQUIT, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Stop returned an error: %v", err)
+	}
+	if killed || code != 3 {
+		t.Errorf("expected the process to exit with 3 on SIGQUIT, got code %d, killed %v", code, killed)
+	}
+	if received, err := os.ReadFile(filepath.Join(dir, "received")); err != nil || strings.TrimSpace(string(received)) != "QUIT" {
+		t.Errorf("expected the process to receive SIGQUIT first, got %q (%v)", received, err)
+	}
+
+	// A process that ignores the signal is killed once the timeout passes
+	cmd, startTime = start(`trap '' QUIT; while :; do sleep 0.05; done`)
+	began := time.Now()
+	code, killed, err = Stop(cmd.Process.Pid, startTime, syscall.SIGQUIT, 300*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Stop returned an error: %v", err)
+	}
+	if !killed || code != 128+int(syscall.SIGKILL) {
+		t.Errorf("expected the process to be killed with SIGKILL, got code %d, killed %v", code, killed)
+	}
+	if elapsed := time.Since(began); elapsed < 300*time.Millisecond {
+		t.Errorf("expected SIGKILL to wait for the timeout, but the process was stopped after %s", elapsed)
+	}
+
+	// A process that is already gone needs no stopping
+	if _, killed, err := Stop(cmd.Process.Pid, startTime, syscall.SIGTERM, time.Second); err != nil || killed {
+		t.Errorf("expected stopping an exited process to be a no-op, got killed %v, error %v", killed, err)
+	}
+}
+
+func TestParseProcStat(t *testing.T) {
+	const rest = " S 1 42 42 0 -1 4194560 100 0 0 0 7 3 0 0 20 0 2 0 123456 8192000 512 18446744073709551615"
+	for _, comm := range []string{"sleep", "my proc", "a) (b", ") (", ""} {
+		stat, err := parseProcStat([]byte("4321 (" + comm + ")" + rest + "\n"))
+		if err != nil {
+			t.Fatalf("failed to parse stat with comm %q: %v", comm, err)
+		}
+		want := ProcStat{PID: 4321, Comm: comm, State: 'S', PPID: 1, PGRP: 42, Session: 42, UTime: 7, STime: 3, NumThreads: 2, StartTime: 123456, VSize: 8192000, RSS: 512}
+		if *stat != want {
+			t.Errorf("parsing stat with comm %q gave %+v, want %+v", comm, *stat, want)
+		}
+	}
+
+	for _, data := range []string{"", "4321 sleep S 1", "4321 (sleep) S 1 42", "x (sleep)" + rest} {
+		if _, err := parseProcStat([]byte(data)); err == nil {
+			t.Errorf("parseProcStat(%q) should fail", data)
+		}
+	}
+
+	stat, err := ReadProcStat(os.Getpid())
+	if err != nil {
+		t.Fatalf("ReadProcStat returned an error: %v", err)
+	}
+	if stat.PID != os.Getpid() || stat.PPID != os.Getppid() || stat.StartTime == 0 {
+		t.Errorf("unexpected stat of the current process: %+v", stat)
+	}
+	if _, err := ReadProcStat(1 << 30); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected a missing process to be reported as not existing, got %v", err)
+	}
+}
+
+func TestParseProcStatus(t *testing.T) {
+	data := "Name:\tmy proc\nState:\tS (sleeping)\nTgid:\t4321\nPid:\t4322\nPPid:\t1\n" +
+		"Uid:\t1000\t1000\t1000\t1000\nGid:\t100\t100\t100\t100\nNSpid:\t4322\t7\nVmRSS:\t    2048 kB\n"
+	status, err := parseProcStatus([]byte(data))
+	if err != nil {
+		t.Fatalf("parseProcStatus returned an error: %v", err)
+	}
+	if status.Name != "my proc" || status.Tgid != 4321 || status.PID != 4322 || status.PPID != 1 || status.VmRSS != 2048*1024 {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if !reflect.DeepEqual(status.UIDs, []int{1000, 1000, 1000, 1000}) || !reflect.DeepEqual(status.NSpid, []int{4322, 7}) {
+		t.Errorf("unexpected IDs in status %+v", status)
+	}
+	if status.Fields["State"] != "S (sleeping)" {
+		t.Errorf("unexpected State field %q", status.Fields["State"])
+	}
+
+	if _, err := parseProcStatus([]byte("Name:\tx\nTgid:\tx\nPid:\t1\nPPid:\t0\n")); err == nil {
+		t.Error("expected an invalid Tgid to fail")
+	}
+}
+
+func TestFindInitPID(t *testing.T) {
+	// A simulated /proc tree: a process whose name has spaces and parentheses, under a shell, under init
+	const rest = " 42 42 0 -1 4194560 100 0 0 0 7 3 0 0 20 0 1 0 123456 8192000 512"
+	tree := map[int]string{
+		1:    "1 (systemd) S 0" + rest,
+		200:  "200 (bash) S 1" + rest,
+		4321: "4321 (my (odd) proc 7) R 200" + rest,
+		500:  "500 (orphan) S 0" + rest,
+		600:  "600 (a) S 601" + rest,
+		601:  "601 (b) S 600" + rest,
+	}
+	readStat := func(pid int) (*ProcStat, error) {
+		data, ok := tree[pid]
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+		return parseProcStat([]byte(data))
+	}
+
+	for _, pid := range []int{4321, 200, 1} {
+		init, err := findInitPID(pid, readStat)
+		if err != nil || init != 1 {
+			t.Errorf("findInitPID(%d) = %d, %v, want 1", pid, init, err)
+		}
+	}
+	for _, pid := range []int{500, 600, 999} {
+		if _, err := findInitPID(pid, readStat); err == nil {
+			t.Errorf("findInitPID(%d) should fail", pid)
+		}
+	}
+
+	init, err := GetInitProcess()
+	if err != nil {
+		t.Fatalf("GetInitProcess returned an error: %v", err)
+	}
+	if init.Pid != 1 {
+		t.Errorf("expected the init process to be PID 1, got %d", init.Pid)
+	}
+}
+
+func TestExecArgs(t *testing.T) {
+	for _, target := range []ExecTarget{
+		{PID: 42, Types: []namespace.NamespaceType{namespace.NamespaceTypeMount, namespace.NamespaceTypePID}, CgroupPath: "/sys/fs/cgroup/c1", Caps: []string{"CAP_CHOWN", "CAP_KILL"}},
+		{PID: 7, Caps: []string{}},
+		{PID: 7},
+	} {
+		args := target.Args("sh", []string{"sh", "-c", "--"})
+		got, path, argv, err := ParseExecArgs(args)
+		if err != nil {
+			t.Fatalf("ParseExecArgs(%q) returned an error: %v", args, err)
+		}
+		if !reflect.DeepEqual(got, target) || path != "sh" || !reflect.DeepEqual(argv, []string{"sh", "-c", "--"}) {
+			t.Errorf("ParseExecArgs(%q) = %+v, %q, %q, want %+v, %q, %q", args, got, path, argv, target, "sh", []string{"sh", "-c", "--"})
+		}
+	}
+
+	if _, _, _, err := ParseExecArgs([]string{"42", "", "", "-", "sh"}); err == nil {
+		t.Error("expected an error for arguments without a command")
+	}
+}
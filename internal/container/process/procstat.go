@@ -0,0 +1,144 @@
+package process
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ProcStat holds the fields of /proc/<pid>/stat that are used here. Times are in clock ticks: UTime and STime
+// are the CPU time spent in user and kernel mode, and StartTime is when the process started, counted from boot.
+type ProcStat struct {
+	PID        int
+	Comm       string
+	State      byte
+	PPID       int
+	PGRP       int
+	Session    int
+	UTime      uint64
+	STime      uint64
+	NumThreads int
+	StartTime  uint64
+	// VSize is the virtual memory size in bytes, and RSS the resident set size in pages.
+	VSize uint64
+	RSS   int64
+}
+
+// ReadProcStat reads and parses /proc/<pid>/stat. If the process does not exist the error wraps os.ErrNotExist.
+func ReadProcStat(pid int) (*ProcStat, error) {
+	statPath := filepath.Join("/proc", strconv.Itoa(pid), "stat")
+	data, err := os.ReadFile(statPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", statPath, err)
+	}
+	return parseProcStat(data)
+}
+
+// parseProcStat parses the contents of a /proc/<pid>/stat file.
+func parseProcStat(data []byte) (*ProcStat, error) {
+	// The command name is in parentheses and may itself contain spaces or parentheses, so it runs from the first
+	// opening to the last closing parenthesis, and the remaining fields are counted from there. They start at
+	// field 3 (state); starttime is field 22 and rss field 24.
+	start, end := bytes.IndexByte(data, '('), bytes.LastIndexByte(data, ')')
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("invalid stat file format: %s", data)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data[:start])))
+	if err != nil {
+		return nil, fmt.Errorf("invalid PID in stat file: %w", err)
+	}
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 22 || len(fields[0]) != 1 {
+		return nil, fmt.Errorf("invalid stat file format: %s", data)
+	}
+
+	stat := &ProcStat{PID: pid, Comm: string(data[start+1 : end]), State: fields[0][0]}
+	ints := []struct {
+		index int
+		value *int
+	}{{1, &stat.PPID}, {2, &stat.PGRP}, {3, &stat.Session}, {17, &stat.NumThreads}}
+	for _, field := range ints {
+		if *field.value, err = strconv.Atoi(fields[field.index]); err != nil {
+			return nil, fmt.Errorf("invalid field %d of stat file of process %d: %w", field.index+3, pid, err)
+		}
+	}
+	uints := []struct {
+		index int
+		value *uint64
+	}{{11, &stat.UTime}, {12, &stat.STime}, {19, &stat.StartTime}, {20, &stat.VSize}}
+	for _, field := range uints {
+		if *field.value, err = strconv.ParseUint(fields[field.index], 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid field %d of stat file of process %d: %w", field.index+3, pid, err)
+		}
+	}
+	if stat.RSS, err = strconv.ParseInt(fields[21], 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid field 24 of stat file of process %d: %w", pid, err)
+	}
+	return stat, nil
+}
+
+// ProcStatus holds the fields of /proc/<pid>/status that are used here. UIDs and GIDs are the real, effective,
+// saved, and filesystem IDs, in that order. NSpid is the process's ID in each PID namespace it is in, the outermost
+// first. VmRSS is the resident memory in bytes; it is 0 for kernel threads and zombies. Fields has every field by
+// name, e.g. "Cpus_allowed_list", trimmed of the surrounding whitespace.
+type ProcStatus struct {
+	Name   string
+	Tgid   int
+	PID    int
+	PPID   int
+	UIDs   []int
+	GIDs   []int
+	NSpid  []int
+	VmRSS  uint64
+	Fields map[string]string
+}
+
+// ReadProcStatus reads and parses /proc/<pid>/status. If the process does not exist the error wraps
+// os.ErrNotExist.
+func ReadProcStatus(pid int) (*ProcStatus, error) {
+	statusPath := filepath.Join("/proc", strconv.Itoa(pid), "status")
+	data, err := os.ReadFile(statusPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", statusPath, err)
+	}
+	return parseProcStatus(data)
+}
+
+// parseProcStatus parses the contents of a /proc/<pid>/status file.
+func parseProcStatus(data []byte) (*ProcStatus, error) {
+	status := &ProcStatus{Fields: map[string]string{}}
+	for _, line := range strings.Split(string(data), "\n") {
+		if name, value, ok := strings.Cut(line, ":"); ok {
+			status.Fields[name] = strings.TrimSpace(value)
+		}
+	}
+
+	var err error
+	status.Name = status.Fields["Name"]
+	for name, value := range map[string]*int{"Tgid": &status.Tgid, "Pid": &status.PID, "PPid": &status.PPID} {
+		if *value, err = strconv.Atoi(status.Fields[name]); err != nil {
+			return nil, fmt.Errorf("invalid %s in status file: %w", name, err)
+		}
+	}
+	for name, value := range map[string]*[]int{"Uid": &status.UIDs, "Gid": &status.GIDs, "NSpid": &status.NSpid} {
+		// NSpid is missing on kernels older than 4.1
+		for _, field := range strings.Fields(status.Fields[name]) {
+			id, err := strconv.Atoi(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s in status file: %w", name, err)
+			}
+			*value = append(*value, id)
+		}
+	}
+	if rss := strings.Fields(status.Fields["VmRSS"]); len(rss) > 0 {
+		kb, err := strconv.ParseUint(rss[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid VmRSS in status file: %w", err)
+		}
+		status.VmRSS = kb * 1024
+	}
+	return status, nil
+}
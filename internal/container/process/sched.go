@@ -0,0 +1,125 @@
+package process
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+	"unsafe"
+
+	"spocker/internal/container/namespace"
+
+	"golang.org/x/sys/unix"
+)
+
+// schedPolicies maps scheduling policy names to their kernel values.
+var schedPolicies = map[string]uint32{
+	"SCHED_OTHER": unix.SCHED_NORMAL,
+	"SCHED_BATCH": unix.SCHED_BATCH,
+	"SCHED_IDLE":  unix.SCHED_IDLE,
+	"SCHED_FIFO":  unix.SCHED_FIFO,
+	"SCHED_RR":    unix.SCHED_RR,
+}
+
+// These constants bound the priority of the real-time policies, SCHED_FIFO and SCHED_RR.
+const (
+	minRTPriority = 1
+	maxRTPriority = 99
+)
+
+// parseSchedPolicy returns the kernel value of the named policy, given in any case with or without the SCHED_ prefix.
+func parseSchedPolicy(name string) (uint32, error) {
+	upper := strings.ToUpper(name)
+	if !strings.HasPrefix(upper, "SCHED_") {
+		upper = "SCHED_" + upper
+	}
+	policy, ok := schedPolicies[upper]
+	if !ok {
+		return 0, fmt.Errorf("unknown scheduling policy: %s", name)
+	}
+	return policy, nil
+}
+
+// isRealTime reports whether the policy is one of the real-time policies.
+func isRealTime(policy uint32) bool {
+	return policy == unix.SCHED_FIFO || policy == unix.SCHED_RR
+}
+
+// ValidateScheduler checks a scheduling policy and priority. The real-time policies take a priority from 1 to 99;
+// the others take none, so their priority must be 0. An empty policy leaves the policy inherited and takes no priority.
+func ValidateScheduler(policyName string, priority int) error {
+	if policyName == "" {
+		if priority != 0 {
+			return fmt.Errorf("a scheduling priority needs a scheduling policy")
+		}
+		return nil
+	}
+	policy, err := parseSchedPolicy(policyName)
+	if err != nil {
+		return err
+	}
+	if isRealTime(policy) {
+		if priority < minRTPriority || priority > maxRTPriority {
+			return fmt.Errorf("invalid priority %d for %s: must be from %d to %d", priority, policyName, minRTPriority, maxRTPriority)
+		}
+		return nil
+	}
+	if priority != 0 {
+		return fmt.Errorf("invalid priority %d for %s: only real-time policies take a priority", priority, policyName)
+	}
+	return nil
+}
+
+// StartWithScheduler starts cmd with the given scheduling policy and priority, which it keeps across exec.
+// The policy is set on a dedicated thread that then forks the command, so the command inherits it from the start
+// without the caller's own threads being affected. An empty policy starts cmd normally.
+// The real-time policies need CAP_SYS_NICE and, with cgroup v1 RT group scheduling, a cgroup with
+// cpu.rt_runtime_us set for the process to be moved into.
+func StartWithScheduler(cmd *exec.Cmd, policyName string, priority int) error {
+	return StartInNamespaces(cmd, nil, policyName, priority)
+}
+
+// StartInNamespaces starts cmd like StartWithScheduler, in the existing namespaces of other processes instead of
+// the caller's. Namespaces cmd is cloned into are created inside the joined ones. Only namespaces that a
+// multithreaded process may join can be given; joining a user namespace fails.
+func StartInNamespaces(cmd *exec.Cmd, namespaces []namespace.Target, policyName string, priority int) error {
+	if policyName == "" && len(namespaces) == 0 {
+		return cmd.Start()
+	}
+	var policy uint32
+	if policyName != "" {
+		if err := ValidateScheduler(policyName, priority); err != nil {
+			return err
+		}
+		policy, _ = parseSchedPolicy(policyName)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		// The thread is never unlocked, so it exits with the goroutine instead of returning to the pool
+		// with the namespaces or policy still set.
+		runtime.LockOSThread()
+
+		for _, target := range namespaces {
+			if err := namespace.Join(target.PID, target.Types); err != nil {
+				done <- err
+				return
+			}
+		}
+		if policyName != "" {
+			attr := &unix.SchedAttr{Policy: policy, Priority: uint32(priority)}
+			attr.Size = uint32(unsafe.Sizeof(*attr))
+			if err := unix.SchedSetAttr(0, attr, 0); err != nil {
+				if errors.Is(err, unix.EPERM) && isRealTime(policy) {
+					done <- fmt.Errorf("scheduling policy %s requires CAP_SYS_NICE: %w", policyName, err)
+					return
+				}
+				done <- fmt.Errorf("failed to set scheduling policy %s: %w", policyName, err)
+				return
+			}
+		}
+		done <- cmd.Start()
+	}()
+	return <-done
+}
@@ -0,0 +1,61 @@
+package process
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+// WaitStartCommand is the argument that makes the spocker binary hold a created container until it is started.
+const WaitStartCommand = "wait-start"
+
+// WaitStart blocks until the container is started through the FIFO at fifo, then replaces the current process
+// with path, run with argv as its arguments and limited to the capabilities in caps. A nil caps leaves the
+// capabilities alone. The process keeps its PID, namespaces, and cgroup, so everything set up for the container
+// while it waited applies to the command. It only returns if the wait or exec fails.
+// If enter is not nil, it is called once the container is started and before path is looked up, to move the
+// process into the container's root; the FIFO lives outside it, so this cannot happen any earlier.
+func WaitStart(fifo string, enter func() error, caps []string, path string, argv []string) error {
+	// Capabilities are per thread, so they are set on the thread that goes on to exec.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	// Opening the read end blocks until the starter opens the write end.
+	f, err := os.OpenFile(fifo, os.O_RDONLY, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open start fifo %s: %w", fifo, err)
+	}
+	buf := make([]byte, 1)
+	n, err := f.Read(buf)
+	f.Close()
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("failed to read start fifo %s: %w", fifo, err)
+	}
+	if n == 0 {
+		return fmt.Errorf("start fifo %s was closed before the container was started", fifo)
+	}
+	if enter != nil {
+		if err := enter(); err != nil {
+			return err
+		}
+	}
+
+	if !strings.Contains(path, "/") {
+		if path, err = exec.LookPath(path); err != nil {
+			return err
+		}
+	}
+	if caps != nil {
+		if err := applyCapabilities(caps); err != nil {
+			return err
+		}
+	}
+	if err := syscall.Exec(path, argv, os.Environ()); err != nil {
+		return fmt.Errorf("failed to exec %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package process
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// DefaultStopSignal is the signal a process is asked to stop with when no other is configured.
+const DefaultStopSignal = syscall.SIGTERM
+
+// ParseSignal returns the signal with the given name, e.g. "SIGQUIT", given in any case with or without the SIG
+// prefix, or number, e.g. "3".
+func ParseSignal(name string) (syscall.Signal, error) {
+	if number, err := strconv.Atoi(name); err == nil {
+		if number <= 0 || unix.SignalName(syscall.Signal(number)) == "" {
+			return 0, fmt.Errorf("unknown signal: %s", name)
+		}
+		return syscall.Signal(number), nil
+	}
+
+	upper := strings.ToUpper(name)
+	if !strings.HasPrefix(upper, "SIG") {
+		upper = "SIG" + upper
+	}
+	sig := unix.SignalNum(upper)
+	if sig == 0 {
+		return 0, fmt.Errorf("unknown signal: %s", name)
+	}
+	return sig, nil
+}
+
+// Stop asks the process with the given PID and start time to exit by sending it sig, and kills it with SIGKILL
+// if it is still running after timeout. It returns once the process has exited, with its exit code if it is a
+// child of the caller and -1 otherwise, and whether it had to be killed. A process that is already gone is not
+// an error.
+func Stop(pid int, startTime uint64, sig syscall.Signal, timeout time.Duration) (int, bool, error) {
+	if current, err := ProcessStartTime(pid); err != nil || current != startTime {
+		return -1, false, nil
+	}
+
+	type waitResult struct {
+		code int
+		err  error
+	}
+	done := make(chan waitResult, 1)
+	go func() {
+		code, err := WaitPID(pid, startTime)
+		// The signal may end the process before the wait begins, which only means there is nothing left to wait for
+		if err != nil {
+			if current, statErr := ProcessStartTime(pid); statErr != nil || current != startTime {
+				code, err = -1, nil
+			}
+		}
+		done <- waitResult{code, err}
+	}()
+
+	if err := syscall.Kill(pid, sig); err != nil && !errors.Is(err, syscall.ESRCH) {
+		return -1, false, fmt.Errorf("failed to send %s to process %d: %w", unix.SignalName(sig), pid, err)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case result := <-done:
+		return result.code, false, result.err
+	case <-timer.C:
+	}
+
+	if err := syscall.Kill(pid, syscall.SIGKILL); err != nil && !errors.Is(err, syscall.ESRCH) {
+		return -1, true, fmt.Errorf("failed to kill process %d: %w", pid, err)
+	}
+	result := <-done
+	return result.code, true, result.err
+}
@@ -0,0 +1,108 @@
+package process
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// pollInterval is how often WaitPID checks /proc on kernels without pidfd support.
+const pollInterval = 100 * time.Millisecond
+
+// ProcessStartTime returns the start time of the process, in clock ticks since boot, from /proc/<pid>/stat.
+// Together with the PID it identifies a process uniquely, since a reused PID belongs to a later process.
+func ProcessStartTime(pid int) (uint64, error) {
+	startTime, _, err := readStartTime(pid)
+	return startTime, err
+}
+
+// WaitPID waits for the process with the given PID and start time to exit.
+// The process does not need to be a child of the caller. A pidfd is used where the kernel supports it, so the
+// wait cannot be confused by the PID being reused; older kernels fall back to polling /proc, checking the start
+// time on every poll. If the process is a child of the caller it is reaped and its exit code returned,
+// otherwise the exit code is not available and -1 is returned.
+func WaitPID(pid int, startTime uint64) (int, error) {
+	fd, err := unix.PidfdOpen(pid, 0)
+	if err != nil {
+		if errors.Is(err, unix.ENOSYS) {
+			return waitPIDPolling(pid, startTime)
+		}
+		if errors.Is(err, unix.ESRCH) {
+			return -1, fmt.Errorf("process %d does not exist", pid)
+		}
+		return -1, fmt.Errorf("failed to open pidfd for process %d: %w", pid, err)
+	}
+	defer unix.Close(fd)
+
+	// The pidfd pins the process it was opened for, so checking the start time now proves it is the right one.
+	if err := checkStartTime(pid, startTime); err != nil {
+		return -1, err
+	}
+
+	fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+	for {
+		if _, err := unix.Poll(fds, -1); err != nil {
+			if errors.Is(err, unix.EINTR) {
+				continue
+			}
+			return -1, fmt.Errorf("failed to wait for process %d: %w", pid, err)
+		}
+		if fds[0].Revents&unix.POLLIN != 0 {
+			return reapIfChild(pid), nil
+		}
+	}
+}
+
+// waitPIDPolling waits for the process by polling /proc until it is gone, a zombie, or replaced.
+func waitPIDPolling(pid int, startTime uint64) (int, error) {
+	if err := checkStartTime(pid, startTime); err != nil {
+		return -1, err
+	}
+
+	for {
+		current, state, err := readStartTime(pid)
+		if err != nil || current != startTime || state == 'Z' {
+			return reapIfChild(pid), nil
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// checkStartTime returns an error unless the process with the given PID has the expected start time.
+func checkStartTime(pid int, startTime uint64) error {
+	actual, _, err := readStartTime(pid)
+	if err != nil {
+		return err
+	}
+	if actual != startTime {
+		return fmt.Errorf("process %d has start time %d, expected %d: the PID was reused", pid, actual, startTime)
+	}
+	return nil
+}
+
+// reapIfChild reaps the exited process and returns its exit code, or -1 if it is not a child of the caller.
+func reapIfChild(pid int) int {
+	for {
+		var status syscall.WaitStatus
+		wpid, err := syscall.Wait4(pid, &status, syscall.WNOHANG, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || wpid != pid {
+			return -1
+		}
+		return exitCode(status)
+	}
+}
+
+// readStartTime returns the start time and state of the process from /proc/<pid>/stat.
+func readStartTime(pid int) (uint64, byte, error) {
+	stat, err := ReadProcStat(pid)
+	if err != nil {
+		return 0, 0, err
+	}
+	return stat.StartTime, stat.State, nil
+}
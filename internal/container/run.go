@@ -1,14 +1,23 @@
 package container
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"spocker/internal/container/cgroup"
 	"spocker/internal/container/filesystem"
 	"spocker/internal/container/namespace"
 	"spocker/internal/container/network"
+	"spocker/internal/container/process"
 
 	"go.uber.org/zap"
 )
@@ -19,70 +28,725 @@ type ContainerRunner interface {
 }
 
 // Run sets up the container environment and runs the specified command.
-func Run(cmd *exec.Cmd, cgroupSpec *cgroup.Spec, namespaceSpec *namespace.NamespaceSpec, fsRoot string, networkConfig *network.Config) error {
+func Run(config *Config) error {
+	return RunContext(context.Background(), config)
+}
+
+// RunContext runs the container like Run. If ctx is done before the command exits, the container's process is
+// killed, and a setup still in progress, or still waiting for a start slot, is abandoned.
+func RunContext(ctx context.Context, config *Config) error {
 	logger, _ := zap.NewProduction()
 	defer func() {
 		if syncErr := logger.Sync(); syncErr != nil {
 			fmt.Printf("Error syncing logger: %v\n", syncErr)
 		}
 	}()
-	// Set up cgroups, namespaces, or any other container settings here
-	subsystems := []cgroup.Subsystem{&cgroup.CPUSubsystem{}, &cgroup.MemorySubsystem{}, &cgroup.BlkIOSubsystem{}}
-	fileHandler := &cgroup.DefaultFileHandler{}
-	factory := cgroup.NewDefaultFactory(subsystems, fileHandler)
-	cgroup, err := factory.CreateCgroup(cgroupSpec)
+
+	c, err := create(ctx, config, logger)
 	if err != nil {
-		return fmt.Errorf("failed to create cgroup: %v", err)
+		return err
+	}
+	// Everything create set up is undone by a single ordered cleanup when Run returns
+	defer c.td.cleanup()
+	state := c.state
+	if config.Remove {
+		// Removal runs last, once the process has been reaped and everything else torn down.
+		c.td.add(stageState, "remove container", func() error {
+			return Remove(state.ID)
+		})
 	}
-	defer cgroup.Close()
 
-	container_namespace, err := namespace.NewNamespace(namespaceSpec)
-	if err != nil {
-		return fmt.Errorf("failed to create namespace: %v", err)
+	if err := startCreated(state); err != nil {
+		if config.KeepOnFailure {
+			if keepErr := c.keepFailed(err); keepErr != nil {
+				logger.Error("Failed to keep failed container", zap.String("id", state.ID), zap.Error(keepErr))
+			}
+		}
+		return err
+	}
+	if state.PIDFile != "" {
+		c.td.add(stageState, "remove pidfile", func() error {
+			return removePIDFile(state.PIDFile, state.PID)
+		})
+	}
+	// A container that ran keeps its cgroup and rootfs for inspection until it is removed, unless it is removed on exit.
+	c.keepCgroup = !config.Remove
+	c.keepRootfs = !config.Remove
+
+	processState, waitErr := waitContainer(ctx, c.cmd, config)
+	c.exited = true
+
+	state.Status = StatusStopped
+	if processState != nil {
+		state.RecordExit(exitStatus(processState), time.Now(), false)
 	}
-	defer container_namespace.Close()
+	if err := SaveState(state); err != nil {
+		logger.Error("Failed to save container state", zap.String("id", state.ID), zap.Error(err))
+	}
+
+	return waitErr
+}
 
-	// Set up the container's filesystem
-	fs, err := filesystem.NewFilesystem(fsRoot)
+// createdContainer is a container whose process has been started and is held back until the container is started.
+type createdContainer struct {
+	state  *ContainerState
+	cmd    *exec.Cmd
+	ns     *namespace.Namespace
+	td     *teardown
+	exited bool
+	// keepCgroup leaves the cgroup in place when the teardown runs, for Remove to delete later.
+	keepCgroup bool
+	// keepRootfs leaves an overlay rootfs and its upper layer in place when the teardown runs, for Diff to report
+	// on and Remove to delete later.
+	keepRootfs bool
+}
+
+// create sets up the container's cgroup, namespaces, network, and rootfs, and starts its process held at the
+// start fifo. The container's state is saved as created. If create fails, everything it set up is torn down;
+// otherwise tearing the container down is left to the returned teardown. With config.KeepOnFailure set, a failed
+// container is kept for debugging instead, as a container whose state records the failure.
+func create(ctx context.Context, config *Config, logger *zap.Logger) (_ *createdContainer, err error) {
+	cmd := config.Cmd
+	networkConfig := config.Network
+	// Set up the container's filesystem and make sure the command exists in it before any expensive setup
+	fs, err := filesystem.NewFilesystem(config.FSRoot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create filesystem: %v", err)
+	}
+	// exec.Command resolved a bare command name against the host's PATH; what runs is the rootfs's executable
+	commandPath, err := fs.ValidateCommand(cmd.Args[0], commandPathEnv(cmd))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := prepareWorkDir(fs, config); err != nil {
+		return nil, err
+	}
+	for key := range config.Sysctls {
+		if err := namespace.ValidateSysctl(key); err != nil {
+			return nil, err
+		}
+	}
+	caps, err := process.Capabilities(config.CapAdd, config.CapDrop)
+	if err != nil {
+		return nil, err
+	}
+	if err := process.ValidateScheduler(config.SchedPolicy, config.SchedPriority); err != nil {
+		return nil, err
+	}
+	if config.StopSignal != "" {
+		if _, err := process.ParseSignal(config.StopSignal); err != nil {
+			return nil, err
+		}
+	}
+	if config.PIDFile != "" {
+		if config.PIDFile, err = filepath.Abs(config.PIDFile); err != nil {
+			return nil, fmt.Errorf("invalid pidfile: %v", err)
+		}
+		if err := checkPIDFile(config.PIDFile); err != nil {
+			return nil, err
+		}
+	}
+	for _, alias := range config.NetworkAliases {
+		if err := ValidateNetworkAlias(alias); err != nil {
+			return nil, err
+		}
+	}
+	shmSize := config.ShmSize
+	if shmSize == 0 {
+		shmSize = filesystem.DefaultShmSize
+	}
+	if err := filesystem.ValidateShmSize(shmSize); err != nil {
+		return nil, err
+	}
+	if len(config.Ports) > 0 && networkMode(networkConfig) != network.ModeBridge {
+		return nil, fmt.Errorf("ports can only be published from a container with a bridge network")
+	}
+	joined, err := joinedNamespaces(config)
 	if err != nil {
-		return fmt.Errorf("failed to create filesystem: %v", err)
+		return nil, err
+	}
+	if err := PreflightCheck(config); err != nil {
+		return nil, err
 	}
 
-	// Set up the container's network
-	networkHandler := network.DefaultNetworkHandler{}
-	container_network, err := network.CreateNetwork(networkConfig, networkHandler)
+	if config.ID == "" {
+		id, err := NewID()
+		if err != nil {
+			return nil, err
+		}
+		config.ID = id
+	}
+	if _, err := LoadState(config.ID); err == nil {
+		return nil, fmt.Errorf("container %s already exists", config.ID)
+	}
+	// Configs built outside the CLI, like the daemon's, may leave the cgroup out; it is named like the CLI names it
+	if config.Cgroup == nil {
+		config.Cgroup = &cgroup.Spec{}
+	}
+	if config.Cgroup.Name == "" {
+		config.Cgroup.Name = "spocker-" + containerHostname(config.ID)
+	}
+
+	// Only the setup below contends for netlink and mounts, so only it counts against the start limit
+	release, err := acquireStartSlot(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to create network: %v", err)
+		return nil, err
 	}
+	defer release()
 
+	td := newTeardown(logger)
+	var c *createdContainer
 	defer func() {
-		err := network.DeleteNetwork(container_network.Name)
 		if err != nil {
-			logger.Error("Failed to delete network", zap.Error(err))
+			if config.KeepOnFailure && c != nil {
+				keepErr := c.keepFailed(err)
+				if keepErr == nil {
+					return
+				}
+				logger.Error("Failed to keep failed container", zap.String("id", config.ID), zap.Error(keepErr))
+			}
+			td.cleanup()
+			if removeErr := RemoveState(config.ID); removeErr != nil {
+				logger.Error("Failed to remove container state", zap.String("id", config.ID), zap.Error(removeErr))
+			}
 		}
 	}()
 
-	// Configure the container's hostname
-	if err := namespace.SetHostname("your-container-hostname"); err != nil {
-		return fmt.Errorf("failed to set hostname: %v", err)
+	state := &ContainerState{
+		ID:         config.ID,
+		Status:     StatusCreated,
+		Rootfs:     fs.Root,
+		CreatedAt:  time.Now(),
+		Labels:     config.Labels,
+		Aliases:    config.NetworkAliases,
+		StopSignal: config.StopSignal,
+		PIDFile:    config.PIDFile,
+		Hostname:   containerHostname(config.ID),
+		Caps:       caps,
+	}
+	// A kernel.hostname sysctl names the container, so the hostname set at start and in the hosts file agree with it
+	if hostname, ok := config.Sysctls["kernel.hostname"]; ok {
+		state.Hostname = strings.TrimSpace(hostname)
+	}
+	c = &createdContainer{state: state, cmd: cmd, td: td}
+
+	// With an overlay rootfs the image stays untouched: the container's writes land in an upper layer of its own
+	// A loopback writable layer caps what the container can write at the size of its image
+	var layers string
+	if config.WritableLayerSize > 0 {
+		if layers, err = mountWritableLayer(state.ID, config.WritableLayerSize); err != nil {
+			return nil, err
+		}
+		td.add(stageFilesystem, "detach writable layer", func() error {
+			if c.keepRootfs {
+				return nil
+			}
+			return unmountWritableLayer(state.ID)
+		})
+	}
+	if config.Overlay || config.WritableLayerSize > 0 {
+		lower := fs.Root
+		upper, err := mountOverlayRootfs(fs, state.ID, layers)
+		if err != nil {
+			return nil, fmt.Errorf("failed to mount overlay rootfs: %v", err)
+		}
+		state.Rootfs, state.LowerDir, state.UpperDir = fs.Root, lower, upper
+		td.add(stageFilesystem, "unmount overlay rootfs", func() error {
+			if c.keepRootfs {
+				return nil
+			}
+			return unmountOverlayRootfs(state)
+		})
+	}
+
+	// Look up the host devices before creating anything so a bad device fails fast
+	for _, device := range config.Devices {
+		if err := device.Inspect(); err != nil {
+			return nil, fmt.Errorf("invalid device: %v", err)
+		}
+		if config.Cgroup.Resources == nil {
+			config.Cgroup.Resources = &cgroup.Resources{}
+		}
+		config.Cgroup.Resources.Devices = append(config.Cgroup.Resources.Devices, deviceRule(device))
+	}
+
+	// Set up cgroups, namespaces, or any other container settings here
+	fileHandler := &cgroup.DefaultFileHandler{}
+	subsystems := []cgroup.Subsystem{
+		cgroup.NewCPUSubsystem(fileHandler),
+		cgroup.NewMemorySubsystem(fileHandler),
+		cgroup.NewBlkIOSubsystem(fileHandler),
+		cgroup.NewDevicesSubsystem(fileHandler),
+	}
+	if config.Cgroup.Resources != nil && config.Cgroup.Resources.Cpuset != nil {
+		subsystems = append(subsystems, cgroup.NewCpusetSubsystem(fileHandler))
+	}
+	factory := cgroup.NewDefaultFactory(subsystems, fileHandler)
+	cgroup, err := factory.CreateCgroup(config.Cgroup)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cgroup: %v", err)
+	}
+	state.CgroupPath = filepath.Join(cgroup.CgroupRoot, cgroup.Name)
+	td.add(stageCgroup, "remove cgroup", func() error {
+		if err := cgroup.Close(); err != nil {
+			return err
+		}
+		if c.keepCgroup {
+			return nil
+		}
+		return cgroup.Remove()
+	})
+	// Registered after its removal so it runs first: a cgroup that still has processes cannot be removed
+	td.add(stageCgroup, "freeze and empty cgroup", func() error {
+		if c.keepCgroup {
+			return nil
+		}
+		return drainCgroup(cgroup)
+	})
+
+	container_namespace, err := namespace.NewNamespace(ctx, config.Namespace)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create namespace: %v", err)
 	}
+	c.ns = container_namespace
+	td.add(stageProcess, "close namespace", container_namespace.Close)
 
-	// Set up the container's root directory (chroot)
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Cloneflags: syscall.CLONE_NEWUTS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNS | syscall.CLONE_NEWNET,
+	// Set up the container's network, unless it shares the host's stack or is isolated to loopback
+	// Its address is taken now; the interface is plumbed into the container's namespace once the process exists
+	var container_network *network.Network
+	if networkMode(networkConfig) == network.ModeBridge {
+		networkHandler := network.DefaultNetworkHandler{}
+		if networkConfig.Allocator == nil && networkConfig.IPNet != nil && !networkConfig.DHCP {
+			networkConfig.Allocator = ipAllocator(networkConfig.IPNet, networkConfig.Gateway)
+		}
+		if networkConfig.Name == "" {
+			hostVeth, _, err := network.VethNames(config.ID)
+			if err != nil {
+				return nil, err
+			}
+			networkConfig.Name = hostVeth
+		}
+		container_network, err = network.CreateNetwork(networkConfig, networkHandler)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create network: %v", err)
+		}
+		td.add(stageNetwork, "delete network", func() error {
+			return network.TeardownNetwork(state.PID, container_network)
+		})
+		if err := masqueradeNetwork(container_network); err != nil {
+			return nil, fmt.Errorf("failed to set up network: %v", err)
+		}
+
+		ports, err := assignHostPorts(config.Ports)
+		if err != nil {
+			return nil, fmt.Errorf("failed to publish ports: %v", err)
+		}
+		state.Ports = ports
+		td.add(stageNetwork, "release host ports", func() error {
+			releaseHostPorts(ports)
+			return nil
+		})
+		// The container's address is known once the network is created, so its ports can be forwarded to it
+		if err := publishHostPorts(container_network.IPNet.IP, ports); err != nil {
+			return nil, fmt.Errorf("failed to publish ports: %v", err)
+		}
+		container_network.Ports = ports
 	}
 
+	cmd.SysProcAttr = containerSysProcAttr(config)
+
 	// Set up the container's filesystem before running the command
-	cmd.Dir = fs.Root
+	for _, device := range config.Devices {
+		if err := fs.CreateDevice(device); err != nil {
+			return nil, fmt.Errorf("failed to create device: %v", err)
+		}
+	}
+	if err := writeHostsFile(fs, state.Hostname); err != nil {
+		return nil, err
+	}
+	cmd.Path = commandPath
+
+	if config.Init {
+		wrapWithInit(cmd)
+	}
+	fifo, err := createStartFifo(state.ID)
+	if err != nil {
+		return nil, err
+	}
+	wrapWithStartWait(cmd, fifo, fs.Root, containerWorkDir(config), caps, shmSize, state.Hostname)
+
+	// Start the container process; it waits at the start fifo until the container is started
+	if err := process.StartInNamespaces(cmd, joined, config.SchedPolicy, config.SchedPriority); err != nil {
+		return nil, fmt.Errorf("failed to start command: %v", err)
+	}
+	td.add(stageProcess, "stop container process", func() error {
+		if c.exited {
+			return nil
+		}
+		return stopProcess(cmd.Process)
+	})
+	// Make sure the limits actually apply to the container before letting it run unchecked
+	if err := cgroup.AddProcess(cmd.Process.Pid, fileHandler); err != nil {
+		return nil, fmt.Errorf("failed to add container process to cgroup: %v", err)
+	}
+	if member, err := cgroup.Contains(cmd.Process.Pid); err != nil {
+		return nil, fmt.Errorf("failed to verify cgroup membership: %v", err)
+	} else if !member {
+		return nil, fmt.Errorf("container process %d is not in cgroup %q, resource limits would not apply", cmd.Process.Pid, cgroup.Name)
+	}
 
-	// Run the command inside the container
-	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("failed to start command: %v", err)
+	if networkMode(networkConfig) == network.ModeNone {
+		if err := network.SetupLoopbackOnly(cmd.Process.Pid); err != nil {
+			return nil, fmt.Errorf("failed to set up loopback network: %v", err)
+		}
+	}
+	if container_network != nil {
+		// A DHCP network's address is not known here, so it is left to the container to configure
+		if !container_network.DHCP {
+			if err := container_network.AttachNamespace(cmd.Process.Pid); err != nil {
+				return nil, fmt.Errorf("failed to set up network: %v", err)
+			}
+		}
+		// The container's interface is read back in its own namespace, so the state records what it actually got
+		containerHandler := network.NamespaceHandler{PID: cmd.Process.Pid}
+		state.Network = container_network.Result(containerHandler)
+		if config.VerifyNetwork {
+			if err := network.VerifyConnected(container_network, containerHandler); err != nil {
+				return nil, fmt.Errorf("failed to verify network: %v", err)
+			}
+		}
+	}
+	if err := namespace.ApplySysctls(cmd.Process.Pid, config.Sysctls); err != nil {
+		return nil, fmt.Errorf("failed to apply sysctls: %v", err)
 	}
 
-	if _, err := cmd.Process.Wait(); err != nil {
-		return fmt.Errorf("failed to wait for command: %v", err)
+	state.PID = cmd.Process.Pid
+	if startTime, err := process.ProcessStartTime(state.PID); err == nil {
+		state.StartTime = startTime
 	}
+	if err := SaveState(state); err != nil {
+		return nil, err
+	}
+
+	td.add(stageNetwork, "leave labeled network", func() error {
+		return leaveLabeledNetworks(state.ID)
+	})
+	if err := JoinLabeledNetwork(state.ID, config.Labels); err != nil {
+		return nil, fmt.Errorf("failed to join labeled network: %v", err)
+	}
+	return c, nil
+}
 
+// keepFailed leaves everything set up for the container in place and records it as failed with reason, so the
+// container can be investigated and later removed with Remove. A started container process keeps waiting at the
+// start fifo, which keeps the container's namespaces and mounts alive.
+func (c *createdContainer) keepFailed(reason error) error {
+	if c.ns != nil {
+		if err := c.ns.Close(); err != nil {
+			return err
+		}
+	}
+
+	c.state.Status = StatusFailed
+	c.state.Error = reason.Error()
+	if c.state.PID == 0 && c.cmd.Process != nil && !c.exited {
+		c.state.PID = c.cmd.Process.Pid
+		if startTime, err := process.ProcessStartTime(c.state.PID); err == nil {
+			c.state.StartTime = startTime
+		}
+	}
+	if err := SaveState(c.state); err != nil {
+		return err
+	}
+	c.td.discard()
+	return nil
+}
+
+// stopProcess kills the process and reaps it.
+func stopProcess(p *os.Process) error {
+	if err := p.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return fmt.Errorf("failed to kill process %d: %v", p.Pid, err)
+	}
+	if _, err := p.Wait(); err != nil {
+		return fmt.Errorf("failed to reap process %d: %v", p.Pid, err)
+	}
+	return nil
+}
+
+// drainTimeout bounds how long drainCgroup waits for the processes it killed to leave the cgroup.
+const drainTimeout = 2 * time.Second
+
+// freezableCgroup is the part of a cgroup drainCgroup uses.
+type freezableCgroup interface {
+	Freeze() error
+	Thaw() error
+	ListProcesses() ([]int, error)
+}
+
+// drainCgroup kills every process left in the cgroup, e.g. ones the container's process forked into the background,
+// and waits for the cgroup to be empty. The cgroup is frozen while its processes are listed and killed, so none can
+// fork a new one in between, and thawed again for the kills to take effect. Without a freezer controller the
+// processes are killed without freezing them first. Spocker itself, which joins the cgroup when creating it, is left
+// alone, as are listed processes that no longer exist.
+func drainCgroup(cg freezableCgroup) error {
+	frozen := cg.Freeze() == nil
+	pids, err := cgroupMembers(cg)
+	for _, pid := range pids {
+		_ = syscall.Kill(pid, syscall.SIGKILL)
+	}
+	if frozen {
+		if thawErr := cg.Thaw(); thawErr != nil && err == nil {
+			err = thawErr
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to empty cgroup: %v", err)
+	}
+
+	deadline := time.Now().Add(drainTimeout)
+	for len(pids) > 0 {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("cgroup still has processes %v after %s", pids, drainTimeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+		if pids, err = cgroupMembers(cg); err != nil {
+			return fmt.Errorf("failed to empty cgroup: %v", err)
+		}
+	}
 	return nil
 }
+
+// cgroupMembers returns the processes in the cgroup that drainCgroup kills: those that exist, other than spocker.
+func cgroupMembers(cg freezableCgroup) ([]int, error) {
+	pids, err := cg.ListProcesses()
+	if err != nil {
+		return nil, err
+	}
+	var members []int
+	for _, pid := range pids {
+		if pid != os.Getpid() && syscall.Kill(pid, 0) == nil {
+			members = append(members, pid)
+		}
+	}
+	return members, nil
+}
+
+// prepareWorkDir returns the host path of the container's working directory, creating it if the config asks for it.
+func prepareWorkDir(fs *filesystem.Filesystem, config *Config) (string, error) {
+	if config.WorkDir == "" {
+		return fs.Root, nil
+	}
+
+	hostPath, err := filesystem.SecureJoin(fs.Root, config.WorkDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve working directory %s: %v", config.WorkDir, err)
+	}
+	info, err := os.Stat(hostPath)
+	if err == nil {
+		if !info.IsDir() {
+			return "", fmt.Errorf("working directory %s is not a directory in rootfs %s", config.WorkDir, fs.Root)
+		}
+		return hostPath, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to stat working directory %s: %v", config.WorkDir, err)
+	}
+	if !config.WorkDirCreate {
+		return "", fmt.Errorf("working directory %s does not exist in rootfs %s", config.WorkDir, fs.Root)
+	}
+
+	if err := fs.CreateDir(config.WorkDir); err != nil {
+		return "", err
+	}
+	mode := config.WorkDirMode
+	if mode == 0 {
+		mode = 0755
+	}
+	if err := os.Chmod(hostPath, mode); err != nil {
+		return "", fmt.Errorf("failed to set permissions of working directory %s: %v", config.WorkDir, err)
+	}
+	if err := os.Chown(hostPath, config.WorkDirUID, config.WorkDirGID); err != nil {
+		return "", fmt.Errorf("failed to set ownership of working directory %s: %v", config.WorkDir, err)
+	}
+	return hostPath, nil
+}
+
+// containerWorkDir returns the container's working directory as a path inside its root.
+func containerWorkDir(config *Config) string {
+	return filepath.Join("/", config.WorkDir)
+}
+
+// exitStatus converts a process's final state into a shell-style exit code, 128+N for a process killed by signal N.
+func exitStatus(processState *os.ProcessState) int {
+	if status, ok := processState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return processState.ExitCode()
+}
+
+// networkMode returns the networking mode requested by the config, defaulting to bridge mode.
+func networkMode(networkConfig *network.Config) network.Mode {
+	if networkConfig == nil || networkConfig.Mode == "" {
+		return network.ModeBridge
+	}
+	return networkConfig.Mode
+}
+
+// cloneFlags returns the namespaces the container process is cloned into.
+// The container always gets its own IPC namespace, so IPC sysctls can be set without touching the host's.
+// New PID and network namespaces are only requested when the container does not share the host's network or
+// join another container's namespaces, and a cgroup namespace is added on request so the container sees its
+// own cgroup as the root of the hierarchy. A user namespace is also added on request; it lets an unprivileged
+// user create the others.
+func cloneFlags(config *Config) uintptr {
+	flags := uintptr(syscall.CLONE_NEWUTS | syscall.CLONE_NEWNS | syscall.CLONE_NEWIPC)
+	if config.PIDNamespaceOf == "" {
+		flags |= syscall.CLONE_NEWPID
+	}
+	if mode := networkMode(config.Network); mode != network.ModeHost && mode != network.ModeContainer {
+		flags |= syscall.CLONE_NEWNET
+	}
+	if config.Namespace != nil && config.Namespace.Includes(namespace.NamespaceTypeCgroup) {
+		flags |= syscall.CLONE_NEWCGROUP
+	}
+	if config.Namespace != nil && config.Namespace.Includes(namespace.NamespaceTypeUser) {
+		flags |= syscall.CLONE_NEWUSER
+	}
+	return flags
+}
+
+// containerSysProcAttr returns the attributes the container process is started with: the namespaces it gets and,
+// with a user namespace, the mapping of the container's users and groups to the host's.
+func containerSysProcAttr(config *Config) *syscall.SysProcAttr {
+	attr := &syscall.SysProcAttr{Cloneflags: cloneFlags(config)}
+	if attr.Cloneflags&syscall.CLONE_NEWUSER != 0 {
+		attr.UidMappings, attr.GidMappings = namespace.IDMappings(config.Namespace)
+	}
+	return attr
+}
+
+// joinedNamespaces returns the /proc paths of the namespaces of other containers that the container joins.
+// The containers must be running, and a joined network namespace must not be changed by the container's sysctls.
+func joinedNamespaces(config *Config) ([]namespace.Target, error) {
+	if (networkMode(config.Network) == network.ModeContainer) != (config.NetNamespaceOf != "") {
+		return nil, fmt.Errorf("network mode container needs the container whose network namespace to join, and only that mode can join one")
+	}
+
+	var targets []namespace.Target
+	for _, join := range []struct {
+		id, name string
+		nsType   namespace.NamespaceType
+	}{
+		{config.PIDNamespaceOf, "pid", namespace.NamespaceTypePID},
+		{config.NetNamespaceOf, "net", namespace.NamespaceTypeNet},
+	} {
+		if join.id == "" {
+			continue
+		}
+		state, err := LoadState(join.id)
+		if err != nil {
+			return nil, fmt.Errorf("cannot join the %s namespace of container %s: %v", join.name, join.id, err)
+		}
+		if err := checkRunning(state); err != nil {
+			return nil, fmt.Errorf("cannot join the %s namespace of container %s: %v", join.name, join.id, err)
+		}
+		targets = append(targets, namespace.Target{PID: state.PID, Types: []namespace.NamespaceType{join.nsType}})
+	}
+
+	if config.NetNamespaceOf != "" {
+		for key := range config.Sysctls {
+			if strings.HasPrefix(key, "net.") {
+				return nil, fmt.Errorf("sysctl %s would change the network namespace of container %s", key, config.NetNamespaceOf)
+			}
+		}
+	}
+	return targets, nil
+}
+
+// commandPathEnv returns the PATH from the command's environment, or an empty string if it has none.
+func commandPathEnv(cmd *exec.Cmd) string {
+	for _, env := range cmd.Env {
+		if strings.HasPrefix(env, "PATH=") {
+			return strings.TrimPrefix(env, "PATH=")
+		}
+	}
+	return ""
+}
+
+// deviceRule converts a device mapping into the devices cgroup rule that allows access to it.
+func deviceRule(device *filesystem.DeviceMapping) cgroup.DeviceRule {
+	return cgroup.DeviceRule{
+		Type:   device.Type,
+		Major:  device.Major,
+		Minor:  device.Minor,
+		Access: device.Permissions,
+	}
+}
+
+// wrapWithInit rewrites cmd to re-exec spocker as the container's init, which runs the original command as its child.
+func wrapWithInit(cmd *exec.Cmd) {
+	args := append([]string{"/proc/self/exe", process.InitCommand, "--"}, cmd.Args...)
+	cmd.Path = "/proc/self/exe"
+	cmd.Args = args
+	cmd.Err = nil
+}
+
+// wrapWithStartWait rewrites cmd to re-exec spocker, which mounts /proc, /sys, /dev, and a /dev/shm of shmSize bytes
+// in root, sets the hostname, waits at the start fifo, pivots into root and changes to workDir, and then execs the original
+// command with the capabilities in caps. The mounts, the hostname, and the pivot are done by the re-executed
+// process because only it runs inside the new PID, mount, and UTS namespaces.
+func wrapWithStartWait(cmd *exec.Cmd, fifo, root, workDir string, caps []string, shmSize int64, hostname string) {
+	args := append([]string{"/proc/self/exe", process.WaitStartCommand, fifo, root, strings.Join(caps, ","), strconv.FormatInt(shmSize, 10), hostname, workDir, cmd.Path, "--"}, cmd.Args...)
+	cmd.Path = "/proc/self/exe"
+	cmd.Args = args
+	cmd.Err = nil
+}
+
+// writeHostsFile writes the hosts file of a container, so the hostname it is given resolves inside it. A container
+// sharing the host's root has no hosts file of its own and is left alone.
+func writeHostsFile(fs *filesystem.Filesystem, hostname string) error {
+	if fs.Root == "" || fs.Root == "/" {
+		return nil
+	}
+	if err := fs.WriteHostsFile(hostname, nil); err != nil {
+		return fmt.Errorf("failed to write hosts file: %v", err)
+	}
+	return nil
+}
+
+// ipLedgerName is the ledger, in StateDir, of the addresses leased to containers on bridge networks.
+const ipLedgerName = ".ip-leases.json"
+
+// ipAllocator returns the allocator that leases the addresses of subnet to containers from the ledger in StateDir,
+// so containers created at the same time by different spocker processes are never given the same address.
+func ipAllocator(subnet *net.IPNet, gateway net.IP) *network.IPAllocator {
+	return network.NewFileIPAllocator(filepath.Join(StateDir, ipLedgerName), subnet, gateway)
+}
+
+// masqueradeNetwork masquerades the subnet of the container's network through the interface of the host's default
+// route, so the container can reach external hosts, and records the interface on n for TeardownNetwork to undo it.
+// A host without a default route has no outside network to reach, so nothing is done.
+func masqueradeNetwork(n *network.Network) error {
+	outbound, err := network.DefaultRouteInterface()
+	if errors.Is(err, network.ErrNoDefaultRoute) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	subnet := &net.IPNet{IP: n.IPNet.IP.Mask(n.IPNet.Mask), Mask: n.IPNet.Mask}
+	if err := network.EnableMasquerade(subnet, outbound.Name); err != nil {
+		return err
+	}
+	n.Masquerade = outbound.Name
+	return nil
+}
+
+// containerHostname returns the hostname of the container with the given ID: the start of the ID, which keeps it
+// well within the 64 bytes a hostname may have.
+func containerHostname(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
@@ -0,0 +1,2142 @@
+package container
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"spocker/internal/container/cgroup"
+	"spocker/internal/container/containertest"
+	"spocker/internal/container/filesystem"
+	"spocker/internal/container/namespace"
+	"spocker/internal/container/network"
+	"spocker/internal/container/process"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"go.uber.org/zap"
+)
+
+// TestMain lets the test binary stand in for spocker when container setup re-executes it.
+func TestMain(m *testing.M) {
+	if os.Getenv("SPOCKER_TEST_PREFLIGHT") == "1" {
+		// Run without privileges by TestPreflightWithoutPrivileges; it checks what is printed.
+		fmt.Println(PreflightCheck(&Config{Network: &network.Config{Mode: network.ModeNone}}))
+		os.Exit(0)
+	}
+	if os.Getenv("SPOCKER_TEST_USERNS") == "1" {
+		// Run without privileges by TestUserNamespaceWithoutPrivileges; it checks what is printed.
+		config := &Config{
+			Network:   &network.Config{Mode: network.ModeNone},
+			Namespace: &namespace.NamespaceSpec{Types: []namespace.NamespaceType{namespace.NamespaceTypeUser}},
+		}
+		fmt.Printf("preflight: %v\n", PreflightCheck(config))
+		cmd := exec.Command("id", "-u")
+		cmd.SysProcAttr = containerSysProcAttr(config)
+		out, err := cmd.Output()
+		if err != nil {
+			fmt.Printf("unsupported: %v\n", err)
+			os.Exit(0)
+		}
+		fmt.Printf("uid: %s", out)
+		os.Exit(0)
+	}
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "child":
+			// The namespace holder only needs to stay alive until it is closed.
+			select {}
+		case process.WaitStartCommand:
+			if len(os.Args) < 11 {
+				os.Exit(127)
+			}
+			fs := &filesystem.Filesystem{Root: os.Args[3]}
+			if err := fs.MountDefaults(); err != nil {
+				os.Exit(1)
+			}
+			shmSize, err := strconv.ParseInt(os.Args[5], 10, 64)
+			if err != nil {
+				os.Exit(1)
+			}
+			if err := fs.MountShm(shmSize); err != nil {
+				os.Exit(1)
+			}
+			if err := namespace.SetHostname(os.Args[6]); err != nil {
+				os.Exit(1)
+			}
+			enter := func() error { return fs.Enter(os.Args[7]) }
+			_ = process.WaitStart(os.Args[2], enter, strings.Split(os.Args[4], ","), os.Args[8], os.Args[10:])
+			os.Exit(127)
+		case process.ExecCommand:
+			code, err := RunExecHelper(os.Args[2:])
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			os.Exit(code)
+		case "listen":
+			// A stack service that accepts connections on the given address until it is stopped.
+			listener, err := net.Listen("tcp", os.Args[2])
+			if err != nil {
+				os.Exit(1)
+			}
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					os.Exit(1)
+				}
+				conn.Close()
+			}
+		case "dial":
+			// Succeeds once the given address accepts a connection, giving a service a few seconds to listen.
+			for i := 0; i < 50; i++ {
+				if conn, err := net.DialTimeout("tcp", os.Args[2], time.Second); err == nil {
+					conn.Close()
+					os.Exit(0)
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+			os.Exit(1)
+		case ResolverCommand:
+			if err := ServeLabeledNetwork(os.Args[2], os.Args[3]); err != nil {
+				os.Exit(1)
+			}
+			os.Exit(0)
+		}
+	}
+	os.Exit(m.Run())
+}
+
+func TestCloneFlags(t *testing.T) {
+	bridge := cloneFlags(&Config{Network: &network.Config{Mode: network.ModeBridge}})
+	if bridge&syscall.CLONE_NEWNET == 0 {
+		t.Errorf("bridge mode should request a new network namespace")
+	}
+
+	none := cloneFlags(&Config{Network: &network.Config{Mode: network.ModeNone}})
+	if none&syscall.CLONE_NEWNET == 0 {
+		t.Errorf("none mode should request a new network namespace")
+	}
+
+	host := cloneFlags(&Config{Network: &network.Config{Mode: network.ModeHost}})
+	if host&syscall.CLONE_NEWNET != 0 {
+		t.Errorf("host mode should not request a new network namespace")
+	}
+	if host&syscall.CLONE_NEWPID == 0 || host&syscall.CLONE_NEWNS == 0 || host&syscall.CLONE_NEWUTS == 0 {
+		t.Errorf("host mode should keep the other namespaces, got %#x", host)
+	}
+	if host&syscall.CLONE_NEWCGROUP != 0 {
+		t.Errorf("a cgroup namespace should only be created on request")
+	}
+
+	cgroupns := cloneFlags(&Config{Namespace: &namespace.NamespaceSpec{Type: namespace.NamespaceTypeCgroup}})
+	if cgroupns&syscall.CLONE_NEWCGROUP == 0 {
+		t.Errorf("requesting a cgroup namespace should add CLONE_NEWCGROUP")
+	}
+	extra := cloneFlags(&Config{Namespace: &namespace.NamespaceSpec{Types: []namespace.NamespaceType{namespace.NamespaceTypeCgroup}}})
+	if extra&syscall.CLONE_NEWCGROUP == 0 {
+		t.Errorf("requesting a cgroup namespace among several should add CLONE_NEWCGROUP")
+	}
+	if host&syscall.CLONE_NEWUSER != 0 {
+		t.Errorf("a user namespace should only be created on request")
+	}
+	userns := &Config{Namespace: &namespace.NamespaceSpec{Types: []namespace.NamespaceType{namespace.NamespaceTypeUser}}}
+	attr := containerSysProcAttr(userns)
+	if attr.Cloneflags&syscall.CLONE_NEWUSER == 0 {
+		t.Errorf("requesting a user namespace should add CLONE_NEWUSER")
+	}
+	if len(attr.UidMappings) != 1 || attr.UidMappings[0].ContainerID != 0 || attr.UidMappings[0].HostID != os.Getuid() {
+		t.Errorf("expected the container's root to be mapped to the calling user, got %+v", attr.UidMappings)
+	}
+
+	joined := cloneFlags(&Config{Network: &network.Config{Mode: network.ModeContainer}, NetNamespaceOf: "a", PIDNamespaceOf: "a"})
+	if joined&(syscall.CLONE_NEWNET|syscall.CLONE_NEWPID) != 0 {
+		t.Errorf("joining another container's namespaces should not request new ones, got %#x", joined)
+	}
+	if joined&syscall.CLONE_NEWNS == 0 || joined&syscall.CLONE_NEWUTS == 0 {
+		t.Errorf("joining another container's namespaces should keep the other namespaces, got %#x", joined)
+	}
+}
+
+func TestCgroupNamespaceHidesHostPath(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to create namespaces")
+	}
+
+	cmd := exec.Command("cat", "/proc/self/cgroup")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: cloneFlags(&Config{Namespace: &namespace.NamespaceSpec{Type: namespace.NamespaceTypeCgroup}}),
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("failed to run child: %v", err)
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if !strings.HasSuffix(line, ":/") {
+			t.Errorf("expected the container to see its cgroup as the root, got %q", line)
+		}
+	}
+}
+
+func TestHostNetworkSharesNetns(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to create namespaces")
+	}
+
+	hostNetns, err := os.Readlink("/proc/self/ns/net")
+	if err != nil {
+		t.Fatalf("failed to read host network namespace: %v", err)
+	}
+	ifacesBefore, err := net.Interfaces()
+	if err != nil {
+		t.Fatalf("failed to list interfaces: %v", err)
+	}
+
+	cmd := exec.Command("readlink", "/proc/self/ns/net")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: cloneFlags(&Config{Network: &network.Config{Mode: network.ModeHost}}),
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("failed to run child: %v", err)
+	}
+
+	if got := strings.TrimSpace(string(out)); got != hostNetns {
+		t.Errorf("child network namespace = %s, want host namespace %s", got, hostNetns)
+	}
+
+	ifacesAfter, err := net.Interfaces()
+	if err != nil {
+		t.Fatalf("failed to list interfaces: %v", err)
+	}
+	if len(ifacesAfter) != len(ifacesBefore) {
+		t.Errorf("host mode changed the number of interfaces from %d to %d", len(ifacesBefore), len(ifacesAfter))
+	}
+}
+
+func TestRunMissingCommand(t *testing.T) {
+	root := t.TempDir()
+	cmd := exec.Command("/bin/does-not-exist")
+
+	err := Run(&Config{
+		Cmd:     cmd,
+		FSRoot:  root,
+		Network: &network.Config{Mode: network.ModeNone},
+	})
+	if err == nil {
+		t.Fatal("Run succeeded with a command missing from the rootfs")
+	}
+	if !strings.Contains(err.Error(), "not found in container rootfs") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// fakeHealthChecker reports healthy once it has been checked healthyAfter times, or never if healthyAfter is negative.
+type fakeHealthChecker struct {
+	healthyAfter int
+	checks       int
+}
+
+func (f *fakeHealthChecker) Check(ctx context.Context) error {
+	f.checks++
+	if f.healthyAfter >= 0 && f.checks > f.healthyAfter {
+		return nil
+	}
+	return errors.New("not healthy yet")
+}
+
+func TestWaitContainerUnhealthy(t *testing.T) {
+	cmd := exec.Command("sleep", "10")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start command: %v", err)
+	}
+
+	config := &Config{
+		HealthCheck:           &HealthCheck{Interval: 10 * time.Millisecond, Checker: &fakeHealthChecker{healthyAfter: -1}},
+		StartPeriod:           100 * time.Millisecond,
+		HealthExitOnUnhealthy: true,
+	}
+
+	start := time.Now()
+	_, err := waitContainer(context.Background(), cmd, config)
+	if err == nil {
+		t.Fatal("expected an error for a container that never becomes healthy")
+	}
+	if !strings.Contains(err.Error(), "did not become healthy") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("waitContainer took %s, the container was not stopped after the start period", elapsed)
+	}
+	if err := syscall.Kill(cmd.Process.Pid, 0); err == nil {
+		t.Errorf("expected the unhealthy container process %d to be killed and reaped", cmd.Process.Pid)
+	}
+}
+
+func TestWaitContainerHealthy(t *testing.T) {
+	cmd := exec.Command("sleep", "0.2")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start command: %v", err)
+	}
+
+	checker := &fakeHealthChecker{healthyAfter: 2}
+	config := &Config{
+		HealthCheck:           &HealthCheck{Interval: 10 * time.Millisecond, Checker: checker},
+		StartPeriod:           time.Second,
+		HealthExitOnUnhealthy: true,
+	}
+
+	processState, err := waitContainer(context.Background(), cmd, config)
+	if err != nil {
+		t.Fatalf("waitContainer returned an error for a healthy container: %v", err)
+	}
+	if processState == nil || exitStatus(processState) != 0 {
+		t.Errorf("expected a clean exit, got %v", processState)
+	}
+	if checker.checks != 3 {
+		t.Errorf("expected 3 health checks, got %d", checker.checks)
+	}
+}
+
+func TestRunHealthCheckInContainer(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to create cgroups and namespaces")
+	}
+
+	config := createTestConfig(t, filepath.Join(t.TempDir(), "unused"))
+	config.ID = "0123456789abcdef"
+	config.Cmd = exec.Command("sleep", "2")
+	// The container has a hostname of its own, so the check only passes if it runs in the container's namespaces
+	check := fmt.Sprintf(`test "$(cat /proc/sys/kernel/hostname)" = %s`, containerHostname(config.ID))
+	if err := exec.Command("sh", "-c", check).Run(); err == nil {
+		t.Skip("the host's hostname is the container's")
+	}
+	config.HealthCheck = &HealthCheck{Command: []string{"sh", "-c", check}, Interval: 50 * time.Millisecond}
+	config.StartPeriod = time.Second
+	config.HealthExitOnUnhealthy = true
+	config.Remove = true
+
+	if err := Run(config); err != nil {
+		t.Fatalf("Run returned an error for a container that is healthy inside: %v", err)
+	}
+	assertClean(t, config.ID, config)
+}
+
+func TestWaitContainerCancelled(t *testing.T) {
+	defer func(timeout time.Duration) { cancelStopTimeout = timeout }(cancelStopTimeout)
+	cancelStopTimeout = 300 * time.Millisecond
+
+	for _, tt := range []struct {
+		name       string
+		command    []string
+		stopSignal string
+		want       syscall.Signal
+	}{
+		// A container that exits on its stop signal is never killed
+		{"stop signal", []string{"sleep", "10"}, "SIGINT", syscall.SIGINT},
+		// One that ignores it is killed once the timeout is up
+		{"escalated", []string{"sh", "-c", "trap '' TERM; sleep 10"}, "", syscall.SIGKILL},
+	} {
+		cmd := exec.Command(tt.command[0], tt.command[1:]...)
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("%s: failed to start command: %v", tt.name, err)
+		}
+		// Give the shell time to set up its trap
+		time.Sleep(100 * time.Millisecond)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		processState, err := waitContainer(ctx, cmd, &Config{StopSignal: tt.stopSignal})
+		if err == nil || !strings.Contains(err.Error(), "cancelled") {
+			t.Errorf("%s: expected a cancellation error, got %v", tt.name, err)
+		}
+		status, ok := processState.Sys().(syscall.WaitStatus)
+		if !ok || !status.Signaled() || status.Signal() != tt.want {
+			t.Errorf("%s: expected the container to end with %v, got %v", tt.name, tt.want, processState)
+		}
+	}
+}
+
+func TestWrapWithInit(t *testing.T) {
+	cmd := exec.Command("sh", "-c", "echo hi")
+	wrapWithInit(cmd)
+
+	if cmd.Path != "/proc/self/exe" {
+		t.Errorf("unexpected init path %s", cmd.Path)
+	}
+	want := []string{"/proc/self/exe", "init", "--", "sh", "-c", "echo hi"}
+	if strings.Join(cmd.Args, " ") != strings.Join(want, " ") {
+		t.Errorf("init args = %q, want %q", cmd.Args, want)
+	}
+}
+
+func TestTeardownOrder(t *testing.T) {
+	var calls []string
+	record := func(name string, err error) func() error {
+		return func() error {
+			calls = append(calls, name)
+			return err
+		}
+	}
+
+	// Register steps in the order Run sets things up, which is not the order they must be undone in.
+	td := newTeardown(zap.NewNop())
+	td.add(stageState, "remove state", record("state", nil))
+	td.add(stageCgroup, "remove cgroup", record("cgroup", errors.New("device or resource busy")))
+	td.add(stageProcess, "close namespace", record("namespace", nil))
+	td.add(stageNetwork, "delete network", record("network", nil))
+	td.add(stageFilesystem, "unmount rootfs", record("filesystem", nil))
+	td.add(stageProcess, "stop container process", record("process", nil))
+
+	td.cleanup()
+
+	expected := []string{"process", "namespace", "cgroup", "network", "filesystem", "state"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("expected teardown order %v, got %v", expected, calls)
+	}
+
+	calls = nil
+	td.cleanup()
+	if len(calls) != 0 {
+		t.Errorf("expected a second cleanup to do nothing, got %v", calls)
+	}
+}
+
+// fakeFreezer is a cgroup whose processes are the given live processes and the extra PIDs, recording the freezer
+// calls made on it.
+type fakeFreezer struct {
+	procs     []*exec.Cmd
+	extra     []int
+	calls     []string
+	freezeErr error
+}
+
+func (f *fakeFreezer) Freeze() error {
+	f.calls = append(f.calls, "freeze")
+	return f.freezeErr
+}
+
+func (f *fakeFreezer) Thaw() error {
+	f.calls = append(f.calls, "thaw")
+	return nil
+}
+
+func (f *fakeFreezer) ListProcesses() ([]int, error) {
+	f.calls = append(f.calls, "list")
+	pids := append([]int{}, f.extra...)
+	for _, cmd := range f.procs {
+		if syscall.Kill(cmd.Process.Pid, 0) == nil {
+			pids = append(pids, cmd.Process.Pid)
+		}
+	}
+	return pids, nil
+}
+
+func TestDrainCgroup(t *testing.T) {
+	// This process, which joins the cgroups it creates, and one that is gone are listed but must be left alone
+	exited := exec.Command("true")
+	if err := exited.Run(); err != nil {
+		t.Fatal(err)
+	}
+	for _, freezeErr := range []error{nil, errors.New("no freezer controller")} {
+		cg := &fakeFreezer{freezeErr: freezeErr, extra: []int{os.Getpid(), exited.Process.Pid}}
+		for i := 0; i < 2; i++ {
+			cmd := exec.Command("sleep", "60")
+			if err := cmd.Start(); err != nil {
+				t.Fatalf("failed to start process: %v", err)
+			}
+			cg.procs = append(cg.procs, cmd)
+		}
+		// Reap the processes as they die, as the kernel would drop them from the cgroup
+		var wg sync.WaitGroup
+		for _, cmd := range cg.procs {
+			wg.Add(1)
+			go func(cmd *exec.Cmd) {
+				defer wg.Done()
+				_ = cmd.Wait()
+			}(cmd)
+		}
+
+		if err := drainCgroup(cg); err != nil {
+			t.Fatalf("drainCgroup returned an error: %v", err)
+		}
+		wg.Wait()
+		for _, cmd := range cg.procs {
+			if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); !ok || status.Signal() != syscall.SIGKILL {
+				t.Errorf("expected process %d to be killed, got %v", cmd.Process.Pid, cmd.ProcessState)
+			}
+		}
+
+		// The processes are listed and killed while the cgroup is frozen, if it can be
+		want := []string{"freeze", "list", "thaw"}
+		if freezeErr != nil {
+			want = []string{"freeze", "list"}
+		}
+		if len(cg.calls) < len(want) || !reflect.DeepEqual(cg.calls[:len(want)], want) {
+			t.Errorf("expected the calls to start with %v, got %v", want, cg.calls)
+		}
+	}
+}
+
+func TestStopProcess(t *testing.T) {
+	cmd := exec.Command("sleep", "60")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start process: %v", err)
+	}
+	if err := stopProcess(cmd.Process); err != nil {
+		t.Fatalf("stopProcess returned an error: %v", err)
+	}
+	if err := syscall.Kill(cmd.Process.Pid, 0); err == nil {
+		t.Error("expected the process to be gone after stopProcess")
+	}
+}
+
+func TestPrepareWorkDir(t *testing.T) {
+	fs, err := filesystem.NewFilesystem(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFilesystem returned an error: %v", err)
+	}
+
+	t.Run("default", func(t *testing.T) {
+		dir, err := prepareWorkDir(fs, &Config{})
+		if err != nil {
+			t.Fatalf("prepareWorkDir returned an error: %v", err)
+		}
+		if dir != fs.Root {
+			t.Errorf("expected the rootfs root %s, got %s", fs.Root, dir)
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		_, err := prepareWorkDir(fs, &Config{WorkDir: "/app"})
+		if err == nil || !strings.Contains(err.Error(), "does not exist in rootfs") {
+			t.Errorf("expected a missing working directory error, got %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(fs.Root, "app")); !os.IsNotExist(err) {
+			t.Error("working directory should not be created without WorkDirCreate")
+		}
+	})
+
+	t.Run("create", func(t *testing.T) {
+		config := &Config{WorkDir: "/srv/app", WorkDirCreate: true, WorkDirMode: 0700, WorkDirUID: os.Getuid(), WorkDirGID: os.Getgid()}
+		dir, err := prepareWorkDir(fs, config)
+		if err != nil {
+			t.Fatalf("prepareWorkDir returned an error: %v", err)
+		}
+		if dir != filepath.Join(fs.Root, "srv/app") {
+			t.Errorf("unexpected working directory %s", dir)
+		}
+		info, err := os.Stat(dir)
+		if err != nil {
+			t.Fatalf("working directory was not created: %v", err)
+		}
+		if !info.IsDir() || info.Mode().Perm() != 0700 {
+			t.Errorf("expected a directory with mode 0700, got %v", info.Mode())
+		}
+	})
+
+	t.Run("symlink escape", func(t *testing.T) {
+		outside := t.TempDir()
+		if err := os.Symlink(outside, filepath.Join(fs.Root, "escape")); err != nil {
+			t.Fatalf("failed to create symlink: %v", err)
+		}
+		dir, err := prepareWorkDir(fs, &Config{WorkDir: "/escape/app", WorkDirCreate: true})
+		if err != nil {
+			t.Fatalf("prepareWorkDir returned an error: %v", err)
+		}
+		if !strings.HasPrefix(dir, fs.Root) {
+			t.Errorf("working directory %s escaped the rootfs", dir)
+		}
+		if _, err := os.Stat(filepath.Join(outside, "app")); !os.IsNotExist(err) {
+			t.Error("working directory was created outside the rootfs")
+		}
+	})
+}
+
+func TestExec(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to create namespaces")
+	}
+	StateDir = t.TempDir()
+
+	// A sleeping process in its own namespaces stands in for a running container.
+	cmd := exec.Command("sleep", "30")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: cloneFlags(&Config{Network: &network.Config{Mode: network.ModeNone}}),
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start container process: %v", err)
+	}
+	defer stopProcess(cmd.Process)
+
+	startTime, err := process.ProcessStartTime(cmd.Process.Pid)
+	if err != nil {
+		t.Fatalf("ProcessStartTime returned an error: %v", err)
+	}
+	state := &ContainerState{ID: "exec-test", PID: cmd.Process.Pid, StartTime: startTime, Status: StatusRunning, Rootfs: "/", Caps: []string{"CAP_CHOWN"}}
+	if err := SaveState(state); err != nil {
+		t.Fatalf("SaveState returned an error: %v", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	code, err := runExec(context.Background(), state.ID, &process.ProcessSpec{Path: "echo", Args: []string{"hi"}}, false, nil, &stdout, &stderr)
+	if err != nil {
+		t.Fatalf("runExec returned an error: %v (stderr: %s)", err, stderr.String())
+	}
+	if code != 0 || stdout.String() != "hi\n" {
+		t.Errorf("expected exit code 0 and output %q, got %d and %q", "hi\n", code, stdout.String())
+	}
+
+	// The command must run in the container's PID namespace, where the container process is PID 1.
+	stdout.Reset()
+	if _, err := runExec(context.Background(), state.ID, &process.ProcessSpec{Path: "sh", Args: []string{"-c", "echo $$"}}, false, nil, &stdout, &stderr); err != nil {
+		t.Fatalf("runExec returned an error: %v", err)
+	}
+	if pid := strings.TrimSpace(stdout.String()); pid == "" || pid == strconv.Itoa(cmd.Process.Pid) || len(pid) > 3 {
+		t.Errorf("expected a small PID inside the container's PID namespace, got %q", pid)
+	}
+
+	// The command only gets the container's capabilities, CAP_CHOWN being capability 0.
+	stdout.Reset()
+	if _, err := runExec(context.Background(), state.ID, &process.ProcessSpec{Path: "grep", Args: []string{"^CapEff:", "/proc/self/status"}}, false, nil, &stdout, &stderr); err != nil {
+		t.Fatalf("runExec returned an error: %v", err)
+	}
+	if fields := strings.Fields(stdout.String()); len(fields) != 2 || fields[1] != "0000000000000001" {
+		t.Errorf("expected only CAP_CHOWN to be effective, got %q", stdout.String())
+	}
+
+	code, err = runExec(context.Background(), state.ID, &process.ProcessSpec{Path: "sh", Args: []string{"-c", "exit 3"}}, false, nil, &stdout, &stderr)
+	if err != nil || code != 3 {
+		t.Errorf("expected exit code 3, got %d (%v)", code, err)
+	}
+
+	state.Status = StatusStopped
+	if err := SaveState(state); err != nil {
+		t.Fatalf("SaveState returned an error: %v", err)
+	}
+	if _, err := runExec(context.Background(), state.ID, &process.ProcessSpec{Path: "echo"}, false, nil, &stdout, &stderr); err == nil || !strings.Contains(err.Error(), "not running") {
+		t.Errorf("expected a not running error, got %v", err)
+	}
+}
+
+// setupTestContainers prepares for creating real containers in a test: it skips the test where container setup
+// cannot work, keeps state and temporary directories in temporary directories, and removes the named cgroups'
+// directories afterwards.
+func setupTestContainers(t *testing.T, cgroupNames ...string) {
+	t.Helper()
+	if _, err := os.Stat("/sys/fs/cgroup/blkio/blkio.weight"); err != nil {
+		t.Skip("the blkio cgroup controller does not support weights")
+	}
+	StateDir = t.TempDir()
+	TempBaseDir = t.TempDir()
+	removeTestCgroups(t, cgroupNames...)
+}
+
+// removeTestCgroups removes the directories of the named cgroups when the test finishes.
+func removeTestCgroups(t *testing.T, cgroupNames ...string) {
+	t.Cleanup(func() {
+		for _, name := range cgroupNames {
+			_ = os.RemoveAll(filepath.Join("/sys/fs/cgroup", name))
+			for _, subsystem := range []string{"cpu", "memory", "blkio", "devices"} {
+				_ = os.Remove(filepath.Join("/sys/fs/cgroup", subsystem, name))
+			}
+		}
+	})
+}
+
+// assertClean fails the test if the container with the given ID, configured by config, left anything behind.
+func assertClean(t *testing.T, id string, config *Config) {
+	t.Helper()
+	containertest.StateDir, containertest.TempBaseDir, containertest.NetnsDir = StateDir, TempBaseDir, network.NetnsDir
+	resources := containertest.Resources{Rootfs: config.FSRoot}
+	if config.Cgroup != nil {
+		resources.Cgroup = config.Cgroup.Name
+	}
+	if networkMode(config.Network) == network.ModeBridge {
+		resources.Network = config.Network.Name
+		resources.Subnet = config.Network.IPNet
+		resources.Bridge = network.BridgeName(config.Network.IPNet)
+	}
+	containertest.Track(id, resources)
+	if err := containertest.AssertClean(id); err != nil {
+		t.Error(err)
+	}
+}
+
+// createTestConfig returns a config for a container that shares the host's rootfs and touches marker when it runs.
+func createTestConfig(t *testing.T, marker string) *Config {
+	t.Helper()
+	cgroupName := "spocker-test-" + strconv.Itoa(os.Getpid())
+	setupTestContainers(t, cgroupName)
+
+	return &Config{
+		Cmd:    exec.Command("touch", marker),
+		FSRoot: "/",
+		Cgroup: &cgroup.Spec{
+			Name: cgroupName,
+			Resources: &cgroup.Resources{
+				CPU:    &cgroup.CPU{Shares: 1024},
+				Memory: &cgroup.Memory{Limit: 1 << 30},
+				BlkIO:  &cgroup.BlkIO{Weight: 500},
+			},
+		},
+		Namespace: &namespace.NamespaceSpec{Name: "test"},
+		Network:   &network.Config{Mode: network.ModeNone},
+	}
+}
+
+func TestCreateStart(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to create cgroups and namespaces")
+	}
+	marker := filepath.Join(t.TempDir(), "started")
+	config := createTestConfig(t, marker)
+
+	id, err := Create(config)
+	if err != nil {
+		t.Fatalf("Create returned an error: %v", err)
+	}
+	state, err := LoadState(id)
+	if err != nil {
+		t.Fatalf("LoadState returned an error: %v", err)
+	}
+	if state.Status != StatusCreated || state.PID == 0 {
+		t.Fatalf("expected a created container with a PID, got status %s and PID %d", state.Status, state.PID)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := os.Stat(marker); err == nil {
+		t.Fatal("the command ran before the container was started")
+	}
+
+	if err := Start(id); err != nil {
+		t.Fatalf("Start returned an error: %v", err)
+	}
+	if _, err := process.WaitPID(state.PID, state.StartTime); err != nil {
+		t.Fatalf("WaitPID returned an error: %v", err)
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("the command did not run after the container was started: %v", err)
+	}
+	if state, err = LoadState(id); err != nil || state.Status != StatusRunning {
+		t.Errorf("expected the container to be recorded as running, got %+v (%v)", state, err)
+	}
+	if err := Start(id); err == nil {
+		t.Error("starting a container twice succeeded")
+	}
+
+	if err := Remove(id); err != nil {
+		t.Fatalf("Remove returned an error: %v", err)
+	}
+	assertClean(t, id, config)
+}
+
+func TestCreateNetworkResult(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to create cgroups, namespaces, and bridges")
+	}
+	if _, err := iptables.New(); err != nil {
+		t.Skipf("iptables is not available to masquerade the network: %v", err)
+	}
+
+	config := createTestConfig(t, filepath.Join(t.TempDir(), "started"))
+	config.Network = &network.Config{
+		Mode:    network.ModeBridge,
+		IPNet:   &net.IPNet{IP: net.IPv4(10, 203, 0, 0).To4(), Mask: net.CIDRMask(24, 32)},
+		Gateway: net.IPv4(10, 203, 0, 1).To4(),
+	}
+	id, err := Create(config)
+	if err != nil {
+		t.Fatalf("Create returned an error: %v", err)
+	}
+	defer Remove(id)
+	state, err := LoadState(id)
+	if err != nil {
+		t.Fatalf("LoadState returned an error: %v", err)
+	}
+	if state.Network == nil {
+		t.Fatal("expected the container's network to be recorded")
+	}
+
+	// What is recorded must be what the container's own interface has
+	nsHandle, err := netns.GetFromPid(state.PID)
+	if err != nil {
+		t.Fatalf("failed to get the container's network namespace: %v", err)
+	}
+	defer nsHandle.Close()
+	handle, err := netlink.NewHandleAt(nsHandle)
+	if err != nil {
+		t.Fatalf("failed to open a netlink handle in the container's namespace: %v", err)
+	}
+	defer handle.Delete()
+	link, err := handle.LinkByName(network.ContainerInterfaceName)
+	if err != nil {
+		t.Fatalf("the container has no %s: %v", network.ContainerInterfaceName, err)
+	}
+	addrs, err := handle.AddrList(link, netlink.FAMILY_V4)
+	if err != nil || len(addrs) != 1 {
+		t.Fatalf("expected one address on the container's interface, got %v (%v)", addrs, err)
+	}
+	if !state.Network.IP.Equal(addrs[0].IP) || !config.Network.IPNet.Contains(state.Network.IP) {
+		t.Errorf("recorded IP %s does not match the container's address %s", state.Network.IP, addrs[0].IP)
+	}
+	if ones, _ := addrs[0].Mask.Size(); state.Network.PrefixLen != ones {
+		t.Errorf("recorded prefix length %d does not match the container's /%d", state.Network.PrefixLen, ones)
+	}
+	if mac := link.Attrs().HardwareAddr.String(); mac == "" || state.Network.MAC != mac {
+		t.Errorf("recorded MAC %q does not match the container's MAC %q", state.Network.MAC, mac)
+	}
+	if state.Network.Interface != config.Network.Name {
+		t.Errorf("expected the host veth %s to be recorded, got %s", config.Network.Name, state.Network.Interface)
+	}
+
+	if err := Remove(id); err != nil {
+		t.Fatalf("Remove returned an error: %v", err)
+	}
+	assertClean(t, id, config)
+}
+
+func TestCreateWithoutCgroup(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to create cgroups and namespaces")
+	}
+	config := createTestConfig(t, filepath.Join(t.TempDir(), "started"))
+	config.ID = "0123456789abcdef"
+	config.Cgroup = nil
+	removeTestCgroups(t, "spocker-0123456789ab")
+
+	id, err := Create(config)
+	if err != nil {
+		t.Fatalf("Create returned an error: %v", err)
+	}
+	if config.Cgroup == nil || config.Cgroup.Name != "spocker-0123456789ab" {
+		t.Errorf("expected the cgroup to default to spocker- and the start of the ID, got %+v", config.Cgroup)
+	}
+	if err := Remove(id); err != nil {
+		t.Fatalf("Remove returned an error: %v", err)
+	}
+	assertClean(t, id, config)
+}
+
+func TestDiffCreatedOverlay(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to create cgroups, namespaces, and overlay mounts")
+	}
+	config := createTestConfig(t, filepath.Join(t.TempDir(), "started"))
+	lower := t.TempDir()
+	for _, dir := range []string{"bin", "etc"} {
+		if err := os.MkdirAll(filepath.Join(lower, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, mode := range map[string]os.FileMode{"bin/true": 0755, "etc/keep": 0644, "etc/gone": 0644} {
+		if err := os.WriteFile(filepath.Join(lower, name), []byte("original\n"), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config.Cmd = exec.Command("/bin/true")
+	config.FSRoot = lower
+	config.Overlay = true
+
+	id, err := Create(config)
+	if err != nil {
+		if strings.Contains(err.Error(), "failed to mount overlay") {
+			t.Skipf("overlay filesystem not available: %v", err)
+		}
+		t.Fatalf("Create returned an error: %v", err)
+	}
+	state, err := LoadState(id)
+	if err != nil {
+		t.Fatalf("LoadState returned an error: %v", err)
+	}
+	if state.LowerDir != lower || state.UpperDir == "" || state.Rootfs == lower {
+		t.Fatalf("expected the state to record the overlay layers over %s, got rootfs %q, lower %q, upper %q", lower, state.Rootfs, state.LowerDir, state.UpperDir)
+	}
+
+	if err := os.WriteFile(filepath.Join(state.Rootfs, "etc/keep"), []byte("changed\n"), 0644); err != nil {
+		t.Fatalf("failed to modify file: %v", err)
+	}
+	if err := os.Remove(filepath.Join(state.Rootfs, "etc/gone")); err != nil {
+		t.Fatalf("failed to delete file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(state.Rootfs, "new.txt"), []byte("new\n"), 0644); err != nil {
+		t.Fatalf("failed to add file: %v", err)
+	}
+
+	changes, err := Diff(id)
+	if err != nil {
+		t.Fatalf("Diff returned an error: %v", err)
+	}
+	kinds := map[string]ChangeKind{}
+	for _, change := range changes {
+		kinds[change.Path] = change.Kind
+	}
+	for path, want := range map[string]ChangeKind{"/etc/keep": ChangeModified, "/etc/gone": ChangeDeleted, "/new.txt": ChangeAdded, "/etc/hosts": ChangeAdded} {
+		if got, ok := kinds[path]; !ok || got != want {
+			t.Errorf("expected %s %s in the diff, got %v", want, path, changes)
+		}
+	}
+	if _, ok := kinds["/bin/true"]; ok {
+		t.Errorf("expected the untouched /bin/true to be left out of the diff, got %v", changes)
+	}
+	if data, err := os.ReadFile(filepath.Join(lower, "etc/keep")); err != nil || string(data) != "original\n" {
+		t.Errorf("expected the lower layer to be untouched, got %q (%v)", data, err)
+	}
+
+	if err := Remove(id); err != nil {
+		t.Fatalf("Remove returned an error: %v", err)
+	}
+	if _, err := os.Stat(state.UpperDir); !os.IsNotExist(err) {
+		t.Errorf("expected the upper layer %s to be removed, got %v", state.UpperDir, err)
+	}
+	if _, err := os.Stat(filepath.Join(lower, "etc/gone")); err != nil {
+		t.Errorf("expected the lower layer to keep the file the container deleted: %v", err)
+	}
+	assertClean(t, id, config)
+}
+
+func TestRemoveCreated(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to create cgroups and namespaces")
+	}
+	marker := filepath.Join(t.TempDir(), "started")
+	config := createTestConfig(t, marker)
+
+	id, err := Create(config)
+	if err != nil {
+		t.Fatalf("Create returned an error: %v", err)
+	}
+	state, err := LoadState(id)
+	if err != nil {
+		t.Fatalf("LoadState returned an error: %v", err)
+	}
+
+	if err := Remove(id); err != nil {
+		t.Fatalf("Remove returned an error: %v", err)
+	}
+	if startTime, err := process.ProcessStartTime(state.PID); err == nil && startTime == state.StartTime {
+		t.Errorf("the waiting process %d is still alive", state.PID)
+	}
+	if _, err := os.Stat(state.CgroupPath); !os.IsNotExist(err) {
+		t.Errorf("expected cgroup %s to be removed, got %v", state.CgroupPath, err)
+	}
+	if _, err := LoadState(id); err == nil {
+		t.Error("the container's state was not removed")
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Error("the command of a container that was never started ran")
+	}
+	if err := Start(id); err == nil {
+		t.Error("starting a removed container succeeded")
+	}
+	assertClean(t, id, config)
+}
+
+func TestStartedProcessSeesOwnProc(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to create namespaces")
+	}
+	StateDir = t.TempDir()
+	hostInit, err := os.ReadFile("/proc/1/comm")
+	if err != nil {
+		t.Fatalf("failed to read host init: %v", err)
+	}
+
+	state := &ContainerState{ID: "proc-test", Status: StatusCreated, Rootfs: "/"}
+	fifo, err := createStartFifo(state.ID)
+	if err != nil {
+		t.Fatalf("createStartFifo returned an error: %v", err)
+	}
+	var out bytes.Buffer
+	cmd := exec.Command("cat", "/proc/1/comm")
+	cmd.Stdout = &out
+	wrapWithStartWait(cmd, fifo, "/", "/", process.DefaultCapabilities, filesystem.DefaultShmSize, containerHostname(state.ID))
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: cloneFlags(&Config{Network: &network.Config{Mode: network.ModeNone}}),
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start container process: %v", err)
+	}
+	defer stopProcess(cmd.Process)
+
+	state.PID = cmd.Process.Pid
+	if state.StartTime, err = process.ProcessStartTime(state.PID); err != nil {
+		t.Fatalf("ProcessStartTime returned an error: %v", err)
+	}
+	if err := startCreated(state); err != nil {
+		t.Fatalf("startCreated returned an error: %v", err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("container process failed: %v", err)
+	}
+
+	// The command runs as PID 1 of its own PID namespace, so a /proc mounted there names it as init.
+	if got := strings.TrimSpace(out.String()); got != "cat" {
+		t.Errorf("container sees %q as PID 1, want %q (host init is %q)", got, "cat", strings.TrimSpace(string(hostInit)))
+	}
+	if after, err := os.ReadFile("/proc/1/comm"); err != nil || string(after) != string(hostInit) {
+		t.Errorf("the container's /proc mount leaked to the host: /proc/1/comm is %q (%v)", after, err)
+	}
+}
+
+func TestContainerHostname(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to create namespaces")
+	}
+	StateDir = t.TempDir()
+	hostHostname, err := os.Hostname()
+	if err != nil {
+		t.Fatalf("failed to read hostname: %v", err)
+	}
+
+	state := &ContainerState{ID: "hostname-test-0123456789", Status: StatusCreated, Rootfs: "/"}
+	fifo, err := createStartFifo(state.ID)
+	if err != nil {
+		t.Fatalf("createStartFifo returned an error: %v", err)
+	}
+	var out bytes.Buffer
+	cmd := exec.Command("cat", "/proc/sys/kernel/hostname")
+	cmd.Stdout = &out
+	wrapWithStartWait(cmd, fifo, "/", "/", process.DefaultCapabilities, filesystem.DefaultShmSize, containerHostname(state.ID))
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: cloneFlags(&Config{Network: &network.Config{Mode: network.ModeNone}}),
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start container process: %v", err)
+	}
+	defer stopProcess(cmd.Process)
+
+	state.PID = cmd.Process.Pid
+	if state.StartTime, err = process.ProcessStartTime(state.PID); err != nil {
+		t.Fatalf("ProcessStartTime returned an error: %v", err)
+	}
+	if err := startCreated(state); err != nil {
+		t.Fatalf("startCreated returned an error: %v", err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("container process failed: %v", err)
+	}
+
+	if got := strings.TrimSpace(out.String()); got != "hostname-tes" {
+		t.Errorf("container hostname is %q, want %q", got, "hostname-tes")
+	}
+	if after, err := os.Hostname(); err != nil || after != hostHostname {
+		t.Errorf("setting the container's hostname changed the host's from %q to %q (%v)", hostHostname, after, err)
+	}
+}
+
+func TestWriteHostsFile(t *testing.T) {
+	fs := &filesystem.Filesystem{Root: t.TempDir()}
+	if err := writeHostsFile(fs, "hosts-test-0"); err != nil {
+		t.Fatalf("writeHostsFile returned an error: %v", err)
+	}
+	hosts, err := os.ReadFile(filepath.Join(fs.Root, "etc/hosts"))
+	if err != nil {
+		t.Fatalf("failed to read hosts file: %v", err)
+	}
+	if !strings.Contains(string(hosts), "127.0.0.1\tlocalhost hosts-test-0\n") {
+		t.Errorf("expected the container's hostname to resolve to the loopback address, got:\n%s", hosts)
+	}
+
+	// The host's own hosts file is never touched
+	if err := writeHostsFile(&filesystem.Filesystem{Root: "/"}, "hosts-test-0"); err != nil {
+		t.Errorf("writeHostsFile returned an error for a container sharing the host's root: %v", err)
+	}
+}
+
+func TestShmMount(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to create namespaces")
+	}
+	StateDir = t.TempDir()
+	hostShm, err := os.ReadDir("/dev/shm")
+	if err != nil {
+		t.Fatalf("failed to read host /dev/shm: %v", err)
+	}
+
+	const shmSize = 2 << 20
+	state := &ContainerState{ID: "shm-test", Status: StatusCreated, Rootfs: "/"}
+	fifo, err := createStartFifo(state.ID)
+	if err != nil {
+		t.Fatalf("createStartFifo returned an error: %v", err)
+	}
+	// The container fills /dev/shm past its size; dd must fail with the tmpfs full
+	var out bytes.Buffer
+	cmd := exec.Command("sh", "-c", `stat -f -c "%T %b %S" /dev/shm; dd if=/dev/zero of=/dev/shm/fill bs=1M count=3 2>/dev/null; echo $?`)
+	cmd.Stdout = &out
+	wrapWithStartWait(cmd, fifo, "/", "/", process.DefaultCapabilities, shmSize, containerHostname(state.ID))
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: cloneFlags(&Config{Network: &network.Config{Mode: network.ModeNone}}),
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start container process: %v", err)
+	}
+	defer stopProcess(cmd.Process)
+
+	state.PID = cmd.Process.Pid
+	if state.StartTime, err = process.ProcessStartTime(state.PID); err != nil {
+		t.Fatalf("ProcessStartTime returned an error: %v", err)
+	}
+	if err := startCreated(state); err != nil {
+		t.Fatalf("startCreated returned an error: %v", err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("container process failed: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("unexpected output %q", out.String())
+	}
+	var fsType string
+	var blocks, blockSize int64
+	if _, err := fmt.Sscanf(lines[0], "%s %d %d", &fsType, &blocks, &blockSize); err != nil {
+		t.Fatalf("failed to parse statfs output %q: %v", lines[0], err)
+	}
+	if fsType != "tmpfs" || blocks*blockSize != shmSize {
+		t.Errorf("/dev/shm is a %s of %d bytes, want a tmpfs of %d bytes", fsType, blocks*blockSize, shmSize)
+	}
+	if lines[1] == "0" {
+		t.Error("writing past the size of /dev/shm succeeded")
+	}
+	if after, err := os.ReadDir("/dev/shm"); err != nil || len(after) != len(hostShm) {
+		t.Errorf("the container's /dev/shm mount leaked to the host: %d entries, had %d (%v)", len(after), len(hostShm), err)
+	}
+
+	for _, size := range []int64{-1, filesystem.MinShmSize - 1} {
+		if err := filesystem.ValidateShmSize(size); err == nil {
+			t.Errorf("ValidateShmSize(%d) should fail", size)
+		}
+	}
+}
+
+// unprivilegedTestCommand returns a command that runs a copy of the test binary as nobody, with env added to its
+// environment so TestMain knows what to do.
+func unprivilegedTestCommand(t *testing.T, env string) *exec.Cmd {
+	t.Helper()
+	// Copy the test binary somewhere an unprivileged user can execute it.
+	dir, err := os.MkdirTemp("", "spocker-unprivileged")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatalf("failed to make %s accessible: %v", dir, err)
+	}
+	binary, err := os.ReadFile("/proc/self/exe")
+	if err != nil {
+		t.Fatalf("failed to read test binary: %v", err)
+	}
+	testBinary := filepath.Join(dir, "container.test")
+	if err := os.WriteFile(testBinary, binary, 0755); err != nil {
+		t.Fatalf("failed to copy test binary: %v", err)
+	}
+
+	cmd := exec.Command(testBinary)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: 65534, Gid: 65534},
+	}
+	return cmd
+}
+
+func TestUserNamespaceWithoutPrivileges(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to drop privileges")
+	}
+
+	out, err := unprivilegedTestCommand(t, "SPOCKER_TEST_USERNS=1").CombinedOutput()
+	if err != nil {
+		t.Fatalf("unprivileged user namespace test failed to run: %v (%s)", err, out)
+	}
+	got := strings.TrimSpace(string(out))
+	if strings.Contains(got, "unsupported:") {
+		t.Skipf("unprivileged user namespaces are not available: %s", got)
+	}
+	if got != "preflight: <nil>\nuid: 0" {
+		t.Errorf("expected the container process to pass preflight and run as root in its user namespace, got %q", got)
+	}
+}
+
+func TestPreflightWithoutPrivileges(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to drop privileges")
+	}
+
+	cmd := unprivilegedTestCommand(t, "SPOCKER_TEST_PREFLIGHT=1")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("unprivileged preflight failed to run: %v (%s)", err, out)
+	}
+
+	got := string(out)
+	if !strings.Contains(got, "requires CAP_SYS_ADMIN") || !strings.Contains(got, "run it as root") || !strings.Contains(got, "-userns") {
+		t.Errorf("expected a friendly privilege error, got %q", got)
+	}
+	if strings.Contains(got, "operation not permitted") {
+		t.Errorf("expected the privilege problem to be caught before EPERM, got %q", got)
+	}
+
+	if err := PreflightCheck(&Config{Network: &network.Config{Mode: network.ModeNone}}); err != nil {
+		t.Errorf("PreflightCheck failed as root: %v", err)
+	}
+}
+
+func TestRunRemove(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to create cgroups and namespaces")
+	}
+
+	for _, remove := range []bool{true, false} {
+		marker := filepath.Join(t.TempDir(), "ran")
+		config := createTestConfig(t, marker)
+		config.Remove = remove
+		cgroupPath := filepath.Join("/sys/fs/cgroup", config.Cgroup.Name)
+
+		if err := Run(config); err != nil {
+			t.Fatalf("Run returned an error: %v", err)
+		}
+		if _, err := os.Stat(marker); err != nil {
+			t.Fatalf("the container's command did not run: %v", err)
+		}
+
+		state, stateErr := LoadState(config.ID)
+		_, cgroupErr := os.Stat(cgroupPath)
+		if remove {
+			if stateErr == nil {
+				t.Error("expected the state of a -rm container to be removed")
+			}
+			if !os.IsNotExist(cgroupErr) {
+				t.Errorf("expected the cgroup of a -rm container to be removed, got %v", cgroupErr)
+			}
+			assertClean(t, config.ID, config)
+			continue
+		}
+
+		if stateErr != nil || state.Status != StatusStopped {
+			t.Errorf("expected the stopped container's state to persist, got %+v (%v)", state, stateErr)
+		}
+		if cgroupErr != nil {
+			t.Errorf("expected the stopped container's cgroup to persist, got %v", cgroupErr)
+		}
+		if err := Remove(config.ID); err != nil {
+			t.Fatalf("Remove returned an error: %v", err)
+		}
+		if _, err := os.Stat(cgroupPath); !os.IsNotExist(err) {
+			t.Errorf("expected Remove to delete the cgroup, got %v", err)
+		}
+		assertClean(t, config.ID, config)
+	}
+}
+
+func TestRunContextCancel(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to create cgroups and namespaces")
+	}
+
+	config := createTestConfig(t, filepath.Join(t.TempDir(), "unused"))
+	config.Cmd = exec.Command("sleep", "60")
+	config.Remove = true
+	// sleep runs as the namespace's PID 1, which ignores the stop signal, so only the kill ends it.
+	defer func(timeout time.Duration) { cancelStopTimeout = timeout }(cancelStopTimeout)
+	cancelStopTimeout = 300 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := RunContext(ctx, config)
+	if err == nil || !strings.Contains(err.Error(), "cancelled") {
+		t.Errorf("expected RunContext to report the cancellation, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("RunContext took %s, the container was not killed when its context was done", elapsed)
+	}
+	if _, err := LoadState(config.ID); err == nil {
+		t.Error("expected the cancelled -rm container to be removed")
+	}
+	assertClean(t, config.ID, config)
+}
+
+func TestRunVerifyNetwork(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to create cgroups, namespaces, and bridges")
+	}
+	if _, err := iptables.New(); err != nil {
+		t.Skipf("iptables is not available to masquerade the network: %v", err)
+	}
+
+	marker := filepath.Join(t.TempDir(), "ran")
+	config := createTestConfig(t, marker)
+	config.Network = &network.Config{
+		Mode:    network.ModeBridge,
+		IPNet:   &net.IPNet{IP: net.IPv4(10, 202, 0, 0).To4(), Mask: net.CIDRMask(24, 32)},
+		Gateway: net.IPv4(10, 202, 0, 1).To4(),
+	}
+	config.VerifyNetwork = true
+	config.Remove = true
+
+	if err := Run(config); err != nil {
+		t.Fatalf("Run returned an error for a verified bridge network: %v", err)
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Fatalf("the container's command did not run: %v", err)
+	}
+	assertClean(t, config.ID, config)
+}
+
+func TestStackStartOrder(t *testing.T) {
+	stack := &Stack{
+		Name: "shop",
+		Services: map[string]*Service{
+			"web":    {Command: []string{"web"}, DependsOn: []string{"api", "cache"}},
+			"api":    {Command: []string{"api"}, DependsOn: []string{"db"}},
+			"cache":  {Command: []string{"cache"}},
+			"db":     {Command: []string{"db"}},
+			"worker": {Command: []string{"worker"}, DependsOn: []string{"db"}},
+		},
+	}
+
+	order, err := stack.StartOrder()
+	if err != nil {
+		t.Fatalf("StartOrder returned an error: %v", err)
+	}
+	want := []string{"cache", "db", "api", "web", "worker"}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("expected start order %v, got %v", want, order)
+	}
+}
+
+func TestStackRejectsCycles(t *testing.T) {
+	tests := []struct {
+		name     string
+		services map[string]*Service
+		want     string
+	}{
+		{
+			"cycle",
+			map[string]*Service{
+				"a": {Command: []string{"a"}, DependsOn: []string{"c"}},
+				"b": {Command: []string{"b"}, DependsOn: []string{"a"}},
+				"c": {Command: []string{"c"}, DependsOn: []string{"b"}},
+				"d": {Command: []string{"d"}},
+			},
+			"dependency cycle between services a, b, c",
+		},
+		{
+			"self dependency",
+			map[string]*Service{"a": {Command: []string{"a"}, DependsOn: []string{"a"}}},
+			"dependency cycle between services a",
+		},
+		{
+			"unknown dependency",
+			map[string]*Service{"a": {Command: []string{"a"}, DependsOn: []string{"b"}}},
+			"depends on unknown service b",
+		},
+	}
+
+	for _, tt := range tests {
+		stack := &Stack{Name: "test", Services: tt.services}
+		if err := stack.Validate(); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: expected an error containing %q, got %v", tt.name, tt.want, err)
+		}
+		if err := Up(stack); err == nil {
+			t.Errorf("%s: Up accepted an invalid stack", tt.name)
+		}
+	}
+}
+
+func TestLoadStack(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shop.yaml")
+	data := `network:
+  subnet: 10.10.0.0/24
+services:
+  db:
+    rootfs: /srv/db
+    command: ["/usr/bin/db", "--port", "5432"]
+    profile: large
+  web:
+    command: ["/usr/bin/web"]
+    memory: 268435456
+    depends_on: [db]
+`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatalf("failed to write stack file: %v", err)
+	}
+
+	stack, err := LoadStack(path)
+	if err != nil {
+		t.Fatalf("LoadStack returned an error: %v", err)
+	}
+	if stack.Name != "shop" {
+		t.Errorf("expected the stack to be named after its file, got %q", stack.Name)
+	}
+	if web := stack.Services["web"]; web == nil || web.Memory != 268435456 || !reflect.DeepEqual(web.DependsOn, []string{"db"}) {
+		t.Errorf("unexpected web service: %+v", web)
+	}
+
+	config, err := stack.serviceConfig("web", "0123456789abcdef")
+	if err != nil {
+		t.Fatalf("serviceConfig returned an error: %v", err)
+	}
+	if config.Cgroup.Resources.Memory.Limit != 268435456 || config.Cgroup.Resources.CPU.Shares != 1024 {
+		t.Errorf("expected the memory override on the medium profile, got %+v", config.Cgroup.Resources)
+	}
+	if config.Network.Mode != network.ModeBridge || config.Network.IPNet.String() != "10.10.0.0/24" || !config.Network.Gateway.Equal(net.ParseIP("10.10.0.1")) {
+		t.Errorf("expected the stack's shared network, got %+v", config.Network)
+	}
+	if config.Labels[StackLabel] != "shop" || config.Labels[ServiceLabel] != "web" {
+		t.Errorf("expected stack labels, got %v", config.Labels)
+	}
+}
+
+func TestUpDown(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to create cgroups and namespaces")
+	}
+	stack := &Stack{
+		Name: "test" + strconv.Itoa(os.Getpid()),
+		Services: map[string]*Service{
+			// sleep runs as the PID namespace's init, which ignores SIGTERM, so it is killed after its stop timeout
+			"db":  {Rootfs: "/", Command: []string{"sleep", "30"}, StopTimeout: 100 * time.Millisecond},
+			"web": {Rootfs: "/", Command: []string{"sleep", "30"}, DependsOn: []string{"db"}, StopTimeout: 100 * time.Millisecond},
+		},
+	}
+	setupTestContainers(t, "spocker-"+stack.Name+"-db", "spocker-"+stack.Name+"-web")
+
+	if err := Up(stack); err != nil {
+		t.Fatalf("Up returned an error: %v", err)
+	}
+	states, err := stackContainers(stack.Name)
+	if err != nil {
+		t.Fatalf("failed to list the stack's containers: %v", err)
+	}
+	if len(states) != 2 {
+		t.Fatalf("expected 2 containers, got %d", len(states))
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].CreatedAt.Before(states[j].CreatedAt) })
+	if states[0].Labels[ServiceLabel] != "db" || states[1].Labels[ServiceLabel] != "web" {
+		t.Errorf("expected db to be started before web, got %s then %s", states[0].Labels[ServiceLabel], states[1].Labels[ServiceLabel])
+	}
+	for _, state := range states {
+		if state.Status != StatusRunning || checkRunning(state) != nil {
+			t.Errorf("expected service %s to be running, got %+v", state.Labels[ServiceLabel], state)
+		}
+	}
+	if err := Up(stack); err == nil {
+		t.Error("starting a stack that is already up succeeded")
+	}
+
+	if err := Down(stack); err != nil {
+		t.Fatalf("Down returned an error: %v", err)
+	}
+	if remaining, err := ListStates(); err != nil || len(remaining) != 0 {
+		t.Errorf("expected Down to remove every container, got %d (%v)", len(remaining), err)
+	}
+	for _, state := range states {
+		if _, err := os.Stat(state.CgroupPath); !os.IsNotExist(err) {
+			t.Errorf("expected the cgroup %s to be removed, got %v", state.CgroupPath, err)
+		}
+		if err := syscall.Kill(state.PID, 0); err == nil {
+			if startTime, err := process.ProcessStartTime(state.PID); err == nil && startTime == state.StartTime {
+				t.Errorf("expected the process of service %s to be stopped", state.Labels[ServiceLabel])
+			}
+		}
+	}
+}
+
+func TestStackNetwork(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to create cgroups, namespaces, and bridges")
+	}
+	if _, err := iptables.New(); err != nil {
+		t.Skipf("iptables is not available to masquerade the network: %v", err)
+	}
+	stack := &Stack{
+		Name:    "test" + strconv.Itoa(os.Getpid()),
+		Network: &StackNetwork{Subnet: "10.204.0.0/24"},
+		Services: map[string]*Service{
+			"db":  {Rootfs: "/", Command: []string{os.Args[0], "listen", ":5432"}, StopTimeout: 100 * time.Millisecond},
+			"web": {Rootfs: "/", Command: []string{"sleep", "30"}, DependsOn: []string{"db"}, StopTimeout: 100 * time.Millisecond},
+		},
+	}
+	setupTestContainers(t, "spocker-"+stack.Name+"-db", "spocker-"+stack.Name+"-web")
+
+	if err := Up(stack); err != nil {
+		t.Fatalf("Up returned an error: %v", err)
+	}
+	defer Down(stack)
+	states, err := stackContainers(stack.Name)
+	if err != nil {
+		t.Fatalf("failed to list the stack's containers: %v", err)
+	}
+	services := map[string]*ContainerState{}
+	for _, state := range states {
+		services[state.Labels[ServiceLabel]] = state
+	}
+	db, web := services["db"], services["web"]
+	if db == nil || web == nil || db.Network == nil || web.Network == nil {
+		t.Fatalf("expected db and web on the stack's network, got %+v", services)
+	}
+	if db.Network.Bridge == "" || db.Network.Bridge != web.Network.Bridge {
+		t.Errorf("expected db and web on one bridge, got %q and %q", db.Network.Bridge, web.Network.Bridge)
+	}
+
+	// web reaches db at its address from inside its own network namespace
+	address := net.JoinHostPort(db.Network.IP.String(), "5432")
+	var stderr bytes.Buffer
+	code, err := runExec(context.Background(), web.ID, &process.ProcessSpec{Path: os.Args[0], Args: []string{"dial", address}}, false, nil, io.Discard, &stderr)
+	if err != nil || code != 0 {
+		t.Errorf("web could not reach db at %s: exit code %d, %v (stderr: %s)", address, code, err, stderr.String())
+	}
+
+	if err := Down(stack); err != nil {
+		t.Fatalf("Down returned an error: %v", err)
+	}
+	if _, err := net.InterfaceByName(db.Network.Bridge); err == nil {
+		t.Errorf("expected the stack's bridge %s to be removed with its last service", db.Network.Bridge)
+	}
+}
+
+func TestDownStopOrder(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to create cgroups and namespaces")
+	}
+	stopped := filepath.Join(t.TempDir(), "stopped")
+	// Each service records that it was asked to stop; the stubborn one then keeps running until it is killed
+	stopsOnTerm := func(name string) []string {
+		return []string{"sh", "-c", fmt.Sprintf(`trap 'echo %s >> %s; exit 0' TERM; while :; do sleep 0.05; done`, name, stopped)}
+	}
+	stack := &Stack{
+		Name: "test" + strconv.Itoa(os.Getpid()),
+		Services: map[string]*Service{
+			"db":  {Rootfs: "/", Command: stopsOnTerm("db")},
+			"web": {Rootfs: "/", Command: stopsOnTerm("web"), DependsOn: []string{"api"}},
+			"api": {
+				Rootfs:      "/",
+				Command:     []string{"sh", "-c", fmt.Sprintf(`trap 'echo api >> %s' TERM; while :; do sleep 0.05; done`, stopped)},
+				DependsOn:   []string{"db"},
+				StopTimeout: 300 * time.Millisecond,
+			},
+		},
+	}
+	setupTestContainers(t, "spocker-"+stack.Name+"-db", "spocker-"+stack.Name+"-api", "spocker-"+stack.Name+"-web")
+
+	if err := Up(stack); err != nil {
+		t.Fatalf("Up returned an error: %v", err)
+	}
+	// Give the shells time to set their traps
+	time.Sleep(200 * time.Millisecond)
+
+	start := time.Now()
+	if err := Down(stack); err != nil {
+		t.Fatalf("Down returned an error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Down took %v; the stubborn service should have been killed after its stop timeout", elapsed)
+	}
+
+	data, err := os.ReadFile(stopped)
+	if err != nil {
+		t.Fatalf("failed to read the stop log: %v", err)
+	}
+	if got, want := strings.Fields(string(data)), []string{"web", "api", "db"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected services to be stopped in order %v, got %v", want, got)
+	}
+	if remaining, err := ListStates(); err != nil || len(remaining) != 0 {
+		t.Errorf("expected Down to remove every container, got %d (%v)", len(remaining), err)
+	}
+}
+
+func TestEnviron(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to create cgroups and namespaces")
+	}
+	config := createTestConfig(t, filepath.Join(t.TempDir(), "unused"))
+	config.Cmd = exec.Command("sleep", "30")
+	config.Cmd.Env = []string{"PATH=/usr/bin:/bin", "SPOCKER_TEST=environ"}
+
+	id, err := Create(config)
+	if err != nil {
+		t.Fatalf("Create returned an error: %v", err)
+	}
+	defer func() {
+		state, err := LoadState(id)
+		if err == nil {
+			_ = killContainer(state)
+		}
+		_ = Remove(id)
+	}()
+	if _, err := Environ(id); err == nil {
+		t.Error("expected an error for a container that is not running")
+	}
+	if err := Start(id); err != nil {
+		t.Fatalf("Start returned an error: %v", err)
+	}
+
+	env, err := Environ(id)
+	if err != nil {
+		t.Fatalf("Environ returned an error: %v", err)
+	}
+	found := false
+	for _, variable := range env {
+		if variable == "SPOCKER_TEST=environ" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected SPOCKER_TEST=environ in the container's environment, got %q", env)
+	}
+}
+
+func TestStopSignal(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to create cgroups and namespaces")
+	}
+	marker := filepath.Join(t.TempDir(), "received")
+	config := createTestConfig(t, marker)
+	config.Cmd = exec.Command("sh", "-c", fmt.Sprintf(`trap 'echo QUIT > %s; exit 0' QUIT; trap 'echo TERM > %s; exit 0' TERM; while :; do sleep 0.05; done`, marker, marker))
+	config.StopSignal = "SIGQUIT"
+
+	id, err := Create(config)
+	if err != nil {
+		t.Fatalf("Create returned an error: %v", err)
+	}
+	defer func() { _ = Remove(id) }()
+	if err := Start(id); err != nil {
+		t.Fatalf("Start returned an error: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	if err := Stop(id, 5*time.Second); err != nil {
+		t.Fatalf("Stop returned an error: %v", err)
+	}
+	if received, err := os.ReadFile(marker); err != nil || strings.TrimSpace(string(received)) != "QUIT" {
+		t.Errorf("expected the container to receive its stop signal, SIGQUIT, got %q (%v)", received, err)
+	}
+	state, err := LoadState(id)
+	if err != nil || state.Status != StatusStopped || state.ExitCode != 0 {
+		t.Errorf("expected the container to be recorded as stopped with exit code 0, got %+v (%v)", state, err)
+	}
+	if err := Stop(id, time.Second); err == nil {
+		t.Error("stopping a stopped container succeeded")
+	}
+
+	config.Cmd = exec.Command("sleep", "30")
+	config.ID = ""
+	if config.StopSignal = "SIGNOPE"; Run(config) == nil {
+		t.Error("expected an invalid stop signal to be rejected")
+	}
+}
+
+func TestKeepOnFailure(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to create cgroups and namespaces")
+	}
+	config := createTestConfig(t, filepath.Join(t.TempDir(), "unused"))
+	// The sysctl is valid but its value is not, so setup fails after the container's process has started
+	config.Sysctls = map[string]string{"net.ipv4.ip_forward": "not-a-number"}
+	config.KeepOnFailure = true
+	cgroupPath := filepath.Join("/sys/fs/cgroup", config.Cgroup.Name)
+
+	if _, err := Create(config); err == nil {
+		t.Fatal("expected Create to fail on the invalid sysctl value")
+	}
+	state, err := LoadState(config.ID)
+	if err != nil {
+		t.Fatalf("expected the failed container's state to be kept: %v", err)
+	}
+	if state.Status != StatusFailed || !strings.Contains(state.Error, "sysctl") {
+		t.Errorf("expected a failed container with the sysctl error recorded, got status %s and error %q", state.Status, state.Error)
+	}
+	if _, err := os.Stat(cgroupPath); err != nil {
+		t.Errorf("expected the failed container's cgroup to be kept: %v", err)
+	}
+	if startTime, err := process.ProcessStartTime(state.PID); err != nil || startTime != state.StartTime {
+		t.Errorf("expected the failed container's process to be kept alive with its namespaces: %v", err)
+	}
+
+	if err := Remove(config.ID); err != nil {
+		t.Fatalf("Remove returned an error: %v", err)
+	}
+	if _, err := LoadState(config.ID); err == nil {
+		t.Error("expected Remove to delete the failed container's state")
+	}
+	if _, err := os.Stat(cgroupPath); !os.IsNotExist(err) {
+		t.Errorf("expected Remove to delete the failed container's cgroup, got %v", err)
+	}
+
+	// Without the option the failed container is torn down
+	config.ID = ""
+	config.KeepOnFailure = false
+	if _, err := Create(config); err == nil {
+		t.Fatal("expected Create to fail on the invalid sysctl value")
+	}
+	if states, err := ListStates(); err != nil || len(states) != 0 {
+		t.Errorf("expected no state to be left behind, got %d (%v)", len(states), err)
+	}
+}
+
+func TestJoinNamespaces(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to create cgroups and namespaces")
+	}
+	dir := t.TempDir()
+	target := createTestConfig(t, filepath.Join(dir, "unused"))
+	target.Cmd = exec.Command("sleep", "30")
+
+	// A sidecar config that does not join anything is refused in network mode container
+	sidecar := *target
+	sidecar.ID = ""
+	sidecar.Network = &network.Config{Mode: network.ModeContainer}
+	sidecar.Cmd = exec.Command("true")
+	if _, err := Create(&sidecar); err == nil {
+		t.Error("expected network mode container without a container to join to be rejected")
+	}
+	sidecar.NetNamespaceOf = "0123456789abcdef"
+	if _, err := Create(&sidecar); err == nil || !strings.Contains(err.Error(), "cannot join") {
+		t.Errorf("expected joining a container that does not exist to be rejected, got %v", err)
+	}
+
+	targetID, err := Create(target)
+	if err != nil {
+		t.Fatalf("Create returned an error: %v", err)
+	}
+	defer func() {
+		_ = Stop(targetID, time.Second)
+		_ = Remove(targetID)
+	}()
+	sidecar.NetNamespaceOf = targetID
+	sidecar.PIDNamespaceOf = targetID
+	if _, err := Create(&sidecar); err == nil {
+		t.Error("expected joining a container that is not running to be rejected")
+	}
+	if err := Start(targetID); err != nil {
+		t.Fatalf("Start returned an error: %v", err)
+	}
+	targetState, err := LoadState(targetID)
+	if err != nil {
+		t.Fatalf("LoadState returned an error: %v", err)
+	}
+
+	// The sidecar records the interfaces and processes it sees
+	sidecar.Cmd = exec.Command("sh", "-c", fmt.Sprintf("cat /proc/net/dev > %s/interfaces; ls /proc > %s/processes; echo $$ > %s/pid; sleep 30", dir, dir, dir))
+	sidecar.Cgroup = &cgroup.Spec{Name: target.Cgroup.Name + "-sidecar", Resources: target.Cgroup.Resources}
+	removeTestCgroups(t, sidecar.Cgroup.Name)
+	sidecarID, err := Create(&sidecar)
+	if err != nil {
+		t.Fatalf("Create returned an error for the sidecar: %v", err)
+	}
+	defer func() {
+		_ = Stop(sidecarID, time.Second)
+		_ = Remove(sidecarID)
+	}()
+	if err := Start(sidecarID); err != nil {
+		t.Fatalf("Start returned an error for the sidecar: %v", err)
+	}
+	sidecarState, err := LoadState(sidecarID)
+	if err != nil {
+		t.Fatalf("LoadState returned an error: %v", err)
+	}
+
+	for _, name := range []string{"net", "pid"} {
+		ours, _ := os.Readlink(filepath.Join("/proc", strconv.Itoa(sidecarState.PID), "ns", name))
+		theirs, _ := os.Readlink(filepath.Join("/proc", strconv.Itoa(targetState.PID), "ns", name))
+		if ours == "" || ours != theirs {
+			t.Errorf("expected the sidecar to share the %s namespace, got %q and %q", name, ours, theirs)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(filepath.Join(dir, "pid")); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the sidecar did not record what it sees")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	interfaces, _ := os.ReadFile(filepath.Join(dir, "interfaces"))
+	targetInterfaces, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(targetState.PID), "net", "dev"))
+	if err != nil {
+		t.Fatalf("failed to read the target's interfaces: %v", err)
+	}
+	if names, want := interfaceNames(string(interfaces)), interfaceNames(string(targetInterfaces)); !reflect.DeepEqual(names, want) || !reflect.DeepEqual(want, []string{"lo"}) {
+		t.Errorf("expected the sidecar to see the target's interfaces, only loopback, got %v and %v", names, want)
+	}
+	processes, _ := os.ReadFile(filepath.Join(dir, "processes"))
+	pid, _ := os.ReadFile(filepath.Join(dir, "pid"))
+	if !strings.Contains("\n"+string(processes), "\n1\n") || strings.TrimSpace(string(pid)) == "1" {
+		t.Errorf("expected the sidecar to see the target as PID 1 and not be PID 1 itself, got processes %q and PID %s", processes, pid)
+	}
+}
+
+// interfaceNames returns the names of the interfaces listed in the contents of /proc/net/dev.
+func interfaceNames(dev string) []string {
+	var names []string
+	for _, line := range strings.Split(dev, "\n") {
+		if name, _, ok := strings.Cut(line, ":"); ok && !strings.Contains(name, "|") {
+			names = append(names, strings.TrimSpace(name))
+		}
+	}
+	return names
+}
+
+func TestMaxConcurrentStarts(t *testing.T) {
+	const limit, starts = 3, 20
+	if err := SetMaxConcurrentStarts(limit); err != nil {
+		t.Fatal(err)
+	}
+	defer SetMaxConcurrentStarts(0)
+
+	var inFlight, maxInFlight, completed atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < starts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := acquireStartSlot(context.Background())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer release()
+
+			current := inFlight.Add(1)
+			for {
+				seen := maxInFlight.Load()
+				if current <= seen || maxInFlight.CompareAndSwap(seen, current) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			inFlight.Add(-1)
+			completed.Add(1)
+		}()
+	}
+	wg.Wait()
+
+	if got := maxInFlight.Load(); got > limit {
+		t.Errorf("%d starts were in flight at once, want at most %d", got, limit)
+	}
+	if got := completed.Load(); got != starts {
+		t.Errorf("%d of %d starts completed", got, starts)
+	}
+
+	if err := SetMaxConcurrentStarts(-1); err == nil {
+		t.Error("a negative limit should be rejected")
+	}
+}
+
+func TestPIDFileHelpers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "container.pid")
+
+	if err := writePIDFile(path, 12345); err != nil {
+		t.Fatalf("writePIDFile returned an error: %v", err)
+	}
+	if pid, err := readPIDFile(path); err != nil || pid != 12345 {
+		t.Errorf("expected the pidfile to hold 12345, got %d (%v)", pid, err)
+	}
+
+	// A pidfile held by a live process is refused and left untouched
+	if err := os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkPIDFile(path); err == nil {
+		t.Error("expected a pidfile of a running process to be refused")
+	}
+	if err := writePIDFile(path, 12345); err == nil {
+		t.Error("expected writing over a pidfile of a running process to fail")
+	}
+	if err := removePIDFile(path, 12345); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Error("expected a pidfile holding another PID to be left in place")
+	}
+
+	// A pidfile left behind by a process that is gone is replaced
+	exited := exec.Command("true")
+	if err := exited.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(strconv.Itoa(exited.Process.Pid)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writePIDFile(path, 12345); err != nil {
+		t.Errorf("expected a stale pidfile to be replaced, got %v", err)
+	}
+	if err := removePIDFile(path, 12345); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the pidfile to be removed, got %v", err)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 0 {
+		t.Errorf("expected no temporary files to be left behind, got %d entries", len(entries))
+	}
+}
+
+func TestPIDFile(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to create cgroups and namespaces")
+	}
+	pidFile := filepath.Join(t.TempDir(), "container.pid")
+	config := createTestConfig(t, filepath.Join(t.TempDir(), "unused"))
+	config.Cmd = exec.Command("sleep", "30")
+	config.PIDFile = pidFile
+
+	id, err := Create(config)
+	if err != nil {
+		t.Fatalf("Create returned an error: %v", err)
+	}
+	defer func() { _ = Remove(id) }()
+	if _, err := os.Stat(pidFile); !os.IsNotExist(err) {
+		t.Errorf("expected no pidfile before the container is started, got %v", err)
+	}
+	if err := Start(id); err != nil {
+		t.Fatalf("Start returned an error: %v", err)
+	}
+	state, err := LoadState(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pid, err := readPIDFile(pidFile); err != nil || pid != state.PID {
+		t.Errorf("expected the pidfile to hold the container's PID %d, got %d (%v)", state.PID, pid, err)
+	}
+
+	// A second container may not take over the pidfile while the first is running
+	second := *config
+	second.ID = ""
+	if _, err := Create(&second); err == nil {
+		t.Error("expected a pidfile of a running container to be refused")
+	}
+
+	if err := Stop(id, time.Second); err != nil {
+		t.Fatalf("Stop returned an error: %v", err)
+	}
+	if _, err := os.Stat(pidFile); !os.IsNotExist(err) {
+		t.Errorf("expected the pidfile to be removed once the container stopped, got %v", err)
+	}
+
+	// Run removes the pidfile when the container exits
+	marker := filepath.Join(t.TempDir(), "pid")
+	config.ID = ""
+	config.Cmd = exec.Command("sh", "-c", fmt.Sprintf("cat %s > %s", pidFile, marker))
+	if err := Run(config); err != nil {
+		t.Fatalf("Run returned an error: %v", err)
+	}
+	if written, err := os.ReadFile(marker); err != nil || strings.TrimSpace(string(written)) == "" {
+		t.Errorf("expected the pidfile to exist while the container was running, got %q (%v)", written, err)
+	}
+	if _, err := os.Stat(pidFile); !os.IsNotExist(err) {
+		t.Errorf("expected Run to remove the pidfile once the container exited, got %v", err)
+	}
+	_ = Remove(config.ID)
+}
+
+// startNetnsProcess starts a process in a network namespace of its own and records it as a running container
+// with the given labels and rootfs, returning the container's state.
+func startNetnsProcess(t *testing.T, labels map[string]string) *ContainerState {
+	t.Helper()
+	cmd := exec.Command("sleep", "60")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNET}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start process: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+
+	id, err := NewID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime, err := process.ProcessStartTime(cmd.Process.Pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := &ContainerState{
+		ID:        id,
+		PID:       cmd.Process.Pid,
+		StartTime: startTime,
+		Status:    StatusRunning,
+		Rootfs:    t.TempDir(),
+		Labels:    labels,
+	}
+	if err := SaveState(state); err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+func TestJoinLabeledNetwork(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to create bridges and network namespaces")
+	}
+	StateDir = t.TempDir()
+	NetworkLabel = "app"
+	defer func() { NetworkLabel = "" }()
+
+	web1 := startNetnsProcess(t, map[string]string{"app": "web"})
+	web2 := startNetnsProcess(t, map[string]string{"app": "web"})
+	db := startNetnsProcess(t, map[string]string{"app": "db"})
+	unlabeled := startNetnsProcess(t, map[string]string{"tier": "backend"})
+	web2.Aliases = []string{"api"}
+	if err := SaveState(web2); err != nil {
+		t.Fatal(err)
+	}
+	for _, state := range []*ContainerState{web1, web2, db, unlabeled} {
+		if err := JoinLabeledNetwork(state.ID, state.Labels); err != nil {
+			t.Fatalf("JoinLabeledNetwork returned an error: %v", err)
+		}
+		defer leaveLabeledNetworks(state.ID)
+	}
+	// Joining again is a no-op
+	if err := JoinLabeledNetwork(web1.ID, web1.Labels); err != nil {
+		t.Fatalf("JoinLabeledNetwork returned an error on a second join: %v", err)
+	}
+
+	networks, err := loadLabeledNetworks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(networks) != 2 {
+		t.Fatalf("expected a network for app=web and one for app=db, got %d", len(networks))
+	}
+	web := networks[labeledBridgeName("app=web")]
+	if web == nil || len(web.Members) != 2 || web.Members[web1.ID] == "" || web.Members[web2.ID] == "" {
+		t.Fatalf("expected both web containers on the app=web network, got %+v", web)
+	}
+	if other := networks[labeledBridgeName("app=db")]; other == nil || other.Subnet == web.Subnet {
+		t.Errorf("expected the app=db network on a subnet of its own, got %+v", other)
+	}
+
+	// Each web container resolves the other by ID, and is addressed inside its own namespace
+	for _, pair := range [][2]*ContainerState{{web1, web2}, {web2, web1}} {
+		self, other := pair[0], pair[1]
+		hosts, err := os.ReadFile(filepath.Join(self.Rootfs, "etc/hosts"))
+		if err != nil {
+			t.Fatalf("failed to read hosts file: %v", err)
+		}
+		if want := web.Members[other.ID] + "\t" + other.ID; !strings.Contains(string(hosts), want) {
+			t.Errorf("hosts file of %s does not resolve %s:\n%s", self.ID, other.ID, hosts)
+		}
+		addrs, err := exec.Command("nsenter", "--target", strconv.Itoa(self.PID), "--net", "ip", "-4", "-o", "addr").CombinedOutput()
+		if err != nil {
+			t.Fatalf("failed to list addresses in the container: %v: %s", err, addrs)
+		}
+		if !strings.Contains(string(addrs), web.Members[self.ID]+"/24") {
+			t.Errorf("expected %s inside the container, got:\n%s", web.Members[self.ID], addrs)
+		}
+	}
+
+	// The network's resolver answers for the containers' aliases, and every container uses it
+	_, subnet, err := net.ParseCIDR(web.Subnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gateway := hostAddress(subnet, 1)
+	if resolvConf, err := os.ReadFile(filepath.Join(web1.Rootfs, "etc/resolv.conf")); err != nil || string(resolvConf) != "nameserver "+gateway.String()+"\n" {
+		t.Errorf("expected the resolv.conf of %s to point at %s, got %q (%v)", web1.ID, gateway, resolvConf, err)
+	}
+	resolver := &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "udp", net.JoinHostPort(gateway.String(), "53"))
+	}}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if addrs, err := resolver.LookupHost(ctx, "api"); err != nil || len(addrs) != 1 || addrs[0] != web.Members[web2.ID] {
+		t.Errorf("expected the alias api to resolve to %s, got %v (%v)", web.Members[web2.ID], addrs, err)
+	}
+	resolverPID := web.ResolverPID
+
+	// The addresses are leased from the same ledger as those of bridge networks
+	ledger := ipAllocator(subnet, gateway)
+	if leased, err := ledger.Leased(); err != nil || len(leased) != 2 {
+		t.Errorf("expected the addresses of both web containers leased, got %v (%v)", leased, err)
+	}
+
+	// The last container to leave takes the network and its bridge with it
+	if err := leaveLabeledNetworks(web1.ID); err != nil {
+		t.Fatal(err)
+	}
+	if hosts, err := os.ReadFile(filepath.Join(web2.Rootfs, "etc/hosts")); err != nil || strings.Contains(string(hosts), web1.ID) {
+		t.Errorf("expected %s dropped from the hosts file of %s, got %q (%v)", web1.ID, web2.ID, hosts, err)
+	}
+	if err := leaveLabeledNetworks(web2.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := net.InterfaceByName(web.Bridge); err == nil {
+		t.Errorf("expected bridge %s to be deleted with the network", web.Bridge)
+	}
+	if leased, err := ledger.Leased(); err != nil || len(leased) != 0 {
+		t.Errorf("expected the addresses of the web containers released, got %v (%v)", leased, err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for syscall.Kill(resolverPID, 0) == nil && !processIsZombie(resolverPID) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if syscall.Kill(resolverPID, 0) == nil && !processIsZombie(resolverPID) {
+		t.Errorf("expected resolver %d to be stopped with the network", resolverPID)
+	}
+}
+
+func TestJoinLabeledNetworkFailure(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to create bridges and network namespaces")
+	}
+	StateDir = t.TempDir()
+	NetworkLabel = "app"
+	defer func() { NetworkLabel = "" }()
+
+	// A hosts file that cannot be written fails the join after the container is attached
+	state := startNetnsProcess(t, map[string]string{"app": "broken"})
+	if err := os.MkdirAll(filepath.Join(state.Rootfs, "etc/hosts"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := JoinLabeledNetwork(state.ID, state.Labels); err == nil {
+		leaveLabeledNetworks(state.ID)
+		t.Fatal("expected JoinLabeledNetwork to fail when the hosts file cannot be written")
+	}
+
+	if _, err := net.InterfaceByName("veth" + state.ID[:8]); err == nil {
+		t.Errorf("expected the container's veth to be deleted")
+	}
+	bridge := labeledBridgeName("app=broken")
+	if _, err := net.InterfaceByName(bridge); err == nil {
+		t.Errorf("expected bridge %s of the network without containers to be deleted", bridge)
+	}
+	if networks, err := loadLabeledNetworks(); err != nil || len(networks) != 0 {
+		t.Errorf("expected no network records, got %v (%v)", networks, err)
+	}
+	subnet, err := freeLabeledSubnet(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leased, err := ipAllocator(subnet, hostAddress(subnet, 1)).Leased(); err != nil || len(leased) != 0 {
+		t.Errorf("expected the container's address released, got %v (%v)", leased, err)
+	}
+}
+
+// processIsZombie reports whether the process with the given PID has exited but not been reaped.
+func processIsZombie(pid int) bool {
+	stat, err := process.ReadProcStat(pid)
+	return err == nil && stat.State == 'Z'
+}
@@ -0,0 +1,369 @@
+package container
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"spocker/internal/container/cgroup"
+	"spocker/internal/container/namespace"
+	"spocker/internal/container/network"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// These labels record which stack and service a container was started for, so Down can find it again.
+const (
+	StackLabel   = "spocker.stack"
+	ServiceLabel = "spocker.service"
+)
+
+// defaultServiceProfile is the resource profile of services that do not name one.
+const defaultServiceProfile = "medium"
+
+// Stack describes a group of services that are started together on a shared network, as read from a stack file:
+//
+//	name: shop
+//	network:
+//	  subnet: 10.10.0.0/24
+//	  gateway: 10.10.0.1
+//	services:
+//	  db:
+//	    rootfs: /srv/rootfs/db
+//	    command: ["/usr/bin/db", "--listen", "5432"]
+//	    profile: large
+//	  web:
+//	    rootfs: /srv/rootfs/web
+//	    command: ["/usr/bin/web"]
+//	    memory: 268435456
+//	    depends_on: [db]
+//
+// Without a network the services get a loopback-only network each.
+type Stack struct {
+	Name     string              `yaml:"name"`
+	Network  *StackNetwork       `yaml:"network"`
+	Services map[string]*Service `yaml:"services"`
+}
+
+// StackNetwork is the network shared by the services of a stack. Every service gets an address on Subnet and an
+// interface on the subnet's bridge, so the services reach each other by address, and the gateway is the bridge.
+type StackNetwork struct {
+	Subnet  string `yaml:"subnet"`
+	Gateway string `yaml:"gateway"`
+}
+
+// Service describes one container of a stack. Its resources come from Profile, which defaults to medium, with
+// any of Memory, CPUShares, and BlkioWeight that are set taking precedence. DependsOn names the services that
+// must be started before it, and are stopped after it. StopTimeout, e.g. "30s", is how long Down gives the service
+// to exit after its stop signal before killing it, DefaultStopTimeout if it is not set.
+type Service struct {
+	Rootfs      string        `yaml:"rootfs"`
+	Command     []string      `yaml:"command"`
+	Profile     string        `yaml:"profile"`
+	Memory      int           `yaml:"memory"`
+	CPUShares   int           `yaml:"cpu_shares"`
+	BlkioWeight int           `yaml:"blkio_weight"`
+	DependsOn   []string      `yaml:"depends_on"`
+	StopTimeout time.Duration `yaml:"stop_timeout"`
+}
+
+// LoadStack reads a stack file. A stack without a name is named after the file, without its extension.
+func LoadStack(path string) (*Stack, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read stack file %s: %v", path, err)
+	}
+
+	stack := &Stack{}
+	if err := yaml.Unmarshal(data, stack); err != nil {
+		return nil, fmt.Errorf("failed to parse stack file %s: %v", path, err)
+	}
+	if stack.Name == "" {
+		stack.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	if err := stack.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid stack file %s: %v", path, err)
+	}
+	return stack, nil
+}
+
+// Validate checks that the stack is named, that every service has a command, and that the dependencies between
+// services refer to services of the stack and do not form a cycle.
+func (s *Stack) Validate() error {
+	if s.Name == "" || strings.ContainsAny(s.Name, "/ ") {
+		return fmt.Errorf("invalid stack name: %q", s.Name)
+	}
+	if len(s.Services) == 0 {
+		return fmt.Errorf("stack %s has no services", s.Name)
+	}
+	for name, service := range s.Services {
+		if service == nil || len(service.Command) == 0 {
+			return fmt.Errorf("service %s of stack %s has no command", name, s.Name)
+		}
+		if service.StopTimeout < 0 {
+			return fmt.Errorf("service %s of stack %s has a negative stop timeout", name, s.Name)
+		}
+	}
+	if s.Network != nil {
+		if _, _, err := s.subnet(); err != nil {
+			return err
+		}
+	}
+	_, err := s.StartOrder()
+	return err
+}
+
+// StartOrder returns the services in an order that starts every service after the services it depends on.
+// Services that do not depend on each other are ordered by name, so the order is the same on every call.
+// A dependency on an unknown service or a dependency cycle is an error.
+func (s *Stack) StartOrder() ([]string, error) {
+	names := make([]string, 0, len(s.Services))
+	for name := range s.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// pending counts the dependencies of each service that have not been started yet
+	pending := map[string]int{}
+	dependents := map[string][]string{}
+	for _, name := range names {
+		for _, dependency := range s.Services[name].DependsOn {
+			if _, ok := s.Services[dependency]; !ok {
+				return nil, fmt.Errorf("service %s depends on unknown service %s", name, dependency)
+			}
+			pending[name]++
+			dependents[dependency] = append(dependents[dependency], name)
+		}
+	}
+
+	var ready, order []string
+	for _, name := range names {
+		if pending[name] == 0 {
+			ready = append(ready, name)
+		}
+	}
+	for len(ready) > 0 {
+		name := ready[0]
+		ready = ready[1:]
+		order = append(order, name)
+		for _, dependent := range dependents[name] {
+			if pending[dependent]--; pending[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+		sort.Strings(ready)
+	}
+
+	if len(order) != len(names) {
+		var cycle []string
+		for _, name := range names {
+			if pending[name] > 0 {
+				cycle = append(cycle, name)
+			}
+		}
+		return nil, fmt.Errorf("dependency cycle between services %s", strings.Join(cycle, ", "))
+	}
+	return order, nil
+}
+
+// subnet parses the subnet and gateway of the stack's network. The gateway defaults to the subnet's first address.
+func (s *Stack) subnet() (*net.IPNet, net.IP, error) {
+	_, ipNet, err := net.ParseCIDR(s.Network.Subnet)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid subnet %q for stack %s: %v", s.Network.Subnet, s.Name, err)
+	}
+	if s.Network.Gateway == "" {
+		gateway := make(net.IP, len(ipNet.IP))
+		copy(gateway, ipNet.IP)
+		gateway[len(gateway)-1]++
+		return ipNet, gateway, nil
+	}
+	gateway := net.ParseIP(s.Network.Gateway)
+	if gateway == nil || !ipNet.Contains(gateway) {
+		return nil, nil, fmt.Errorf("invalid gateway %q for subnet %s of stack %s", s.Network.Gateway, ipNet, s.Name)
+	}
+	return ipNet, gateway, nil
+}
+
+// serviceConfig returns the config of the container for the named service, with the given container ID. With a
+// stack network, the service is given a bridge network on the stack's subnet, which create attaches to the bridge
+// the other services of the stack are on.
+func (s *Stack) serviceConfig(name, id string) (*Config, error) {
+	service := s.Services[name]
+
+	profileName := service.Profile
+	if profileName == "" {
+		profileName = defaultServiceProfile
+	}
+	profile, ok := cgroup.DefaultProfiles()[profileName]
+	if !ok {
+		return nil, fmt.Errorf("unknown resource profile %s for service %s", profileName, name)
+	}
+	resources := cgroup.MergeResources(profile, &cgroup.Resources{
+		Memory: &cgroup.Memory{Limit: service.Memory},
+		CPU:    &cgroup.CPU{Shares: service.CPUShares},
+		BlkIO:  &cgroup.BlkIO{Weight: service.BlkioWeight},
+	})
+
+	networkConfig := &network.Config{Mode: network.ModeNone}
+	if s.Network != nil {
+		ipNet, gateway, err := s.subnet()
+		if err != nil {
+			return nil, err
+		}
+		hostVeth, _, err := network.VethNames(id)
+		if err != nil {
+			return nil, err
+		}
+		networkConfig = &network.Config{
+			Mode:    network.ModeBridge,
+			Name:    hostVeth,
+			IPNet:   ipNet,
+			Gateway: gateway,
+		}
+	}
+
+	rootfs := service.Rootfs
+	if rootfs == "" {
+		rootfs = "/"
+	}
+	return &Config{
+		ID:        id,
+		Cmd:       exec.Command(service.Command[0], service.Command[1:]...),
+		Cgroup:    &cgroup.Spec{Name: "spocker-" + s.Name + "-" + name, Resources: resources},
+		Namespace: &namespace.NamespaceSpec{Name: s.Name + "-" + name},
+		FSRoot:    rootfs,
+		Network:   networkConfig,
+		Labels:    map[string]string{StackLabel: s.Name, ServiceLabel: name},
+	}, nil
+}
+
+// Up starts the services of the stack in dependency order, each in its own container, and returns once they are
+// all running. If a service fails to start, the containers already started for the stack are removed again.
+func Up(spec *Stack) (err error) {
+	if err := spec.Validate(); err != nil {
+		return err
+	}
+	order, err := spec.StartOrder()
+	if err != nil {
+		return err
+	}
+	existing, err := stackContainers(spec.Name)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return fmt.Errorf("stack %s is already up", spec.Name)
+	}
+
+	defer func() {
+		if err != nil {
+			if downErr := Down(spec); downErr != nil {
+				err = fmt.Errorf("%v (and failed to remove the services already started: %v)", err, downErr)
+			}
+		}
+	}()
+
+	for _, name := range order {
+		id, err := NewID()
+		if err != nil {
+			return err
+		}
+		config, err := spec.serviceConfig(name, id)
+		if err != nil {
+			return err
+		}
+		if _, err := Create(config); err != nil {
+			return fmt.Errorf("failed to create service %s: %v", name, err)
+		}
+		if err := Start(id); err != nil {
+			return fmt.Errorf("failed to start service %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// Down stops and removes every container started for the stack, in the reverse of the stack's start order, so each
+// service is stopped before the services it depends on. Each service is asked to exit with its stop signal and
+// killed if it is still running after its stop timeout. Containers of services that are no longer in the stack,
+// or of a stack whose dependencies no longer resolve, are stopped last, newest first. A container that cannot be
+// stopped or removed does not stop the others from being removed; the first error is returned.
+func Down(spec *Stack) error {
+	logger, _ := zap.NewProduction()
+	defer func() {
+		if syncErr := logger.Sync(); syncErr != nil {
+			fmt.Printf("Error syncing logger: %v\n", syncErr)
+		}
+	}()
+
+	states, err := stackContainers(spec.Name)
+	if err != nil {
+		return err
+	}
+	// rank is higher for services that start later, which stop earlier; unknown services rank 0
+	rank := map[string]int{}
+	if order, err := spec.StartOrder(); err == nil {
+		for i, name := range order {
+			rank[name] = i + 1
+		}
+	}
+	sort.SliceStable(states, func(i, j int) bool {
+		ri, rj := rank[states[i].Labels[ServiceLabel]], rank[states[j].Labels[ServiceLabel]]
+		if ri != rj {
+			return ri > rj
+		}
+		return states[i].CreatedAt.After(states[j].CreatedAt)
+	})
+
+	var firstErr error
+	for _, state := range states {
+		service := state.Labels[ServiceLabel]
+		if err := stopAndRemove(state, spec.stopTimeout(service)); err != nil {
+			logger.Error("Failed to remove service", zap.String("stack", spec.Name), zap.String("service", service), zap.Error(err))
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to remove service %s: %v", service, err)
+			}
+		}
+	}
+	return firstErr
+}
+
+// stackContainers returns the state of every container started for the named stack.
+func stackContainers(stack string) ([]*ContainerState, error) {
+	states, err := ListStates()
+	if err != nil {
+		return nil, err
+	}
+	var members []*ContainerState
+	for _, state := range states {
+		if state.Labels[StackLabel] == stack {
+			members = append(members, state)
+		}
+	}
+	return members, nil
+}
+
+// stopTimeout returns how long the named service is given to exit after its stop signal.
+func (s *Stack) stopTimeout(name string) time.Duration {
+	if service, ok := s.Services[name]; ok && service != nil && service.StopTimeout > 0 {
+		return service.StopTimeout
+	}
+	return DefaultStopTimeout
+}
+
+// stopAndRemove stops the container if it is still running, killing it if it has not exited after timeout, and
+// removes the container.
+func stopAndRemove(state *ContainerState, timeout time.Duration) error {
+	if checkRunning(state) == nil {
+		if err := Stop(state.ID, timeout); err != nil {
+			return err
+		}
+	}
+	return Remove(state.ID)
+}
@@ -0,0 +1,48 @@
+package container
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// startLimit bounds how many containers this process sets up at the same time; nil means there is no limit.
+var (
+	startLimitMu sync.Mutex
+	startLimit   *semaphore.Weighted
+)
+
+// SetMaxConcurrentStarts limits how many containers are set up at the same time by Run and Create in this
+// process to n, so that launching many containers at once does not overload netlink and the mount subsystem.
+// Containers beyond the limit wait for a slot before their cgroup, namespaces, network, and rootfs are set up.
+// A limit of 0 removes the limit. Setups already waiting or in progress keep the limit they started with.
+func SetMaxConcurrentStarts(n int) error {
+	if n < 0 {
+		return fmt.Errorf("invalid maximum number of concurrent starts: %d", n)
+	}
+	startLimitMu.Lock()
+	defer startLimitMu.Unlock()
+	if n == 0 {
+		startLimit = nil
+		return nil
+	}
+	startLimit = semaphore.NewWeighted(int64(n))
+	return nil
+}
+
+// acquireStartSlot waits until the container may be set up under the current limit and returns a function that
+// gives the slot back. Waiting is given up when ctx is done.
+func acquireStartSlot(ctx context.Context) (func(), error) {
+	startLimitMu.Lock()
+	limit := startLimit
+	startLimitMu.Unlock()
+	if limit == nil {
+		return func() {}, nil
+	}
+	if err := limit.Acquire(ctx, 1); err != nil {
+		return nil, fmt.Errorf("failed to wait for a start slot: %v", err)
+	}
+	return func() { limit.Release(1) }, nil
+}
@@ -0,0 +1,213 @@
+package container
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"spocker/internal/container/network"
+)
+
+// StateDir is the directory under which each container's state is kept, one subdirectory per container ID.
+var StateDir = "/run/spocker"
+
+// maxLastExits is the number of exit times kept in a container's state.
+const maxLastExits = 10
+
+// stateFileName is the name of the state file inside a container's state directory.
+const stateFileName = "state.json"
+
+// Status is the lifecycle status of a container.
+type Status string
+
+// These constants define the statuses a container moves through.
+const (
+	StatusCreated Status = "created"
+	StatusRunning Status = "running"
+	StatusStopped Status = "stopped"
+	// StatusFailed is a container that failed to be created or started and was kept for debugging.
+	StatusFailed Status = "failed"
+)
+
+// ContainerState records what spocker knows about a container so other commands can find and inspect it.
+// StartTime is the process start time from /proc, which lets process.WaitPID tell the container's PID apart from
+// a later process that reused it.
+type ContainerState struct {
+	ID        string                 `json:"id"`
+	PID       int                    `json:"pid,omitempty"`
+	StartTime uint64                 `json:"startTime,omitempty"`
+	Status    Status                 `json:"status"`
+	Rootfs    string                 `json:"rootfs"`
+	Network   *network.NetworkResult `json:"network,omitempty"`
+	CreatedAt time.Time              `json:"createdAt"`
+	Labels    map[string]string      `json:"labels,omitempty"`
+	Aliases   []string               `json:"aliases,omitempty"`
+
+	// Error is the reason a failed container failed.
+	Error string `json:"error,omitempty"`
+
+	// StopSignal is the signal the container is asked to stop with, empty for SIGTERM.
+	StopSignal string `json:"stopSignal,omitempty"`
+
+	// PIDFile is the file the container's PID is written to once it is started, if any.
+	PIDFile string `json:"pidFile,omitempty"`
+
+	// Ports are the container's published ports, each with the host port it was given.
+	Ports []network.PortMapping `json:"ports,omitempty"`
+
+	// ExitCode is the exit code of the container's last run, and LastExits the times of its most recent exits,
+	// oldest first, bounded by maxLastExits. RestartCount counts the times it was restarted after exiting.
+	ExitCode     int         `json:"exitCode"`
+	RestartCount int         `json:"restartCount"`
+	LastExits    []time.Time `json:"lastExits,omitempty"`
+
+	// CgroupPath is the host path of the container's cgroup, so it can be removed after the creating process is gone.
+	CgroupPath string `json:"cgroupPath,omitempty"`
+
+	// UpperDir and LowerDir are the overlay layers behind Rootfs, if it is an overlay mount.
+	// LowerDir may list several layers separated by colons, as in the overlay lowerdir option.
+	UpperDir string `json:"upperDir,omitempty"`
+	LowerDir string `json:"lowerDir,omitempty"`
+
+	// Hostname is the container's hostname, empty for containers created before it was recorded.
+	Hostname string `json:"hostname,omitempty"`
+
+	// Caps are the capabilities the container's command runs with, which commands exec'd into it get as well.
+	Caps []string `json:"caps,omitempty"`
+}
+
+// hostname returns the container's hostname, falling back to the one derived from its ID.
+func (s *ContainerState) hostname() string {
+	if s.Hostname != "" {
+		return s.Hostname
+	}
+	return containerHostname(s.ID)
+}
+
+// RecordExit records that the container exited with code at the given time, keeping only the most recent
+// exit times. When restarting is set the container is about to be restarted, so the restart count goes up.
+func (s *ContainerState) RecordExit(code int, at time.Time, restarting bool) {
+	s.ExitCode = code
+	s.LastExits = append(s.LastExits, at)
+	if len(s.LastExits) > maxLastExits {
+		s.LastExits = append([]time.Time(nil), s.LastExits[len(s.LastExits)-maxLastExits:]...)
+	}
+	if restarting {
+		s.RestartCount++
+	}
+}
+
+// NewID returns a random 64 character hex container ID.
+func NewID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate container ID: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// stateDir returns the state directory of the container with the given ID.
+func stateDir(id string) (string, error) {
+	if id == "" || filepath.Base(id) != id || id == "." || id == ".." {
+		return "", fmt.Errorf("invalid container ID: %q", id)
+	}
+	return filepath.Join(StateDir, id), nil
+}
+
+// SaveState writes the container state atomically, so readers never observe a partially written file.
+func SaveState(state *ContainerState) error {
+	dir, err := stateDir(state.ID)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create state directory %s: %v", dir, err)
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode state for container %s: %v", state.ID, err)
+	}
+
+	tmp, err := os.CreateTemp(dir, stateFileName+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary state file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write state for container %s: %v", state.ID, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close state file for container %s: %v", state.ID, err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, stateFileName)); err != nil {
+		return fmt.Errorf("failed to save state for container %s: %v", state.ID, err)
+	}
+	return nil
+}
+
+// LoadState reads the state of the container with the given ID.
+func LoadState(id string) (*ContainerState, error) {
+	dir, err := stateDir(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, stateFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no such container: %s", id)
+		}
+		return nil, fmt.Errorf("failed to read state for container %s: %v", id, err)
+	}
+
+	state := &ContainerState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to decode state for container %s: %v", id, err)
+	}
+	return state, nil
+}
+
+// ListStates returns the state of every container in StateDir, ordered by ID.
+// Directories in StateDir without a state file are skipped.
+func ListStates() ([]*ContainerState, error) {
+	entries, err := os.ReadDir(StateDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list containers: %v", err)
+	}
+
+	var states []*ContainerState
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(StateDir, entry.Name(), stateFileName)); os.IsNotExist(err) {
+			continue
+		}
+		state, err := LoadState(entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+// RemoveState deletes the state directory of the container with the given ID.
+func RemoveState(id string) error {
+	dir, err := stateDir(id)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("failed to remove state for container %s: %v", id, err)
+	}
+	return nil
+}
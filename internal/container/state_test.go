@@ -0,0 +1,672 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"spocker/internal/container/cgroup"
+	"spocker/internal/container/filesystem"
+	"spocker/internal/container/network"
+	"spocker/internal/container/process"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	StateDir = t.TempDir()
+
+	id, err := NewID()
+	if err != nil {
+		t.Fatalf("NewID returned an error: %v", err)
+	}
+	if len(id) != 64 {
+		t.Errorf("expected a 64 character ID, got %d characters", len(id))
+	}
+
+	state := &ContainerState{
+		ID:     id,
+		PID:    1234,
+		Status: StatusRunning,
+		Rootfs: "/var/lib/spocker/rootfs",
+		Network: &network.NetworkResult{
+			IP:        net.ParseIP("10.0.0.2"),
+			PrefixLen: 24,
+			Interface: "eth0",
+			MAC:       "02:42:ac:11:00:02",
+		},
+	}
+	if err := SaveState(state); err != nil {
+		t.Fatalf("SaveState returned an error: %v", err)
+	}
+
+	loaded, err := LoadState(id)
+	if err != nil {
+		t.Fatalf("LoadState returned an error: %v", err)
+	}
+	if loaded.PID != state.PID || loaded.Status != state.Status || loaded.Rootfs != state.Rootfs {
+		t.Errorf("loaded state %+v does not match saved state %+v", loaded, state)
+	}
+	if !loaded.Network.IP.Equal(state.Network.IP) || loaded.Network.MAC != state.Network.MAC {
+		t.Errorf("loaded network %+v does not match saved network %+v", loaded.Network, state.Network)
+	}
+
+	if err := RemoveState(id); err != nil {
+		t.Fatalf("RemoveState returned an error: %v", err)
+	}
+	if _, err := LoadState(id); err == nil {
+		t.Error("expected an error loading a removed container")
+	}
+}
+
+func TestStateRejectsInvalidID(t *testing.T) {
+	StateDir = t.TempDir()
+
+	for _, id := range []string{"", ".", "..", "../escape", "a/b"} {
+		if _, err := LoadState(id); err == nil {
+			t.Errorf("LoadState(%q) should fail", id)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to mount overlay filesystems")
+	}
+	StateDir = t.TempDir()
+
+	base := t.TempDir()
+	lower, upper, work, merged := filepath.Join(base, "lower"), filepath.Join(base, "upper"), filepath.Join(base, "work"), filepath.Join(base, "merged")
+	for _, dir := range []string{lower, upper, work, merged, filepath.Join(lower, "etc")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("failed to create %s: %v", dir, err)
+		}
+	}
+	for _, name := range []string{"etc/hostname", "etc/passwd"} {
+		if err := os.WriteFile(filepath.Join(lower, name), []byte("original\n"), 0644); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lower, upper, work)
+	if err := syscall.Mount("overlay", merged, "overlay", 0, options); err != nil {
+		t.Skipf("overlay filesystem not available: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(merged, "new.txt"), []byte("new\n"), 0644); err != nil {
+		t.Fatalf("failed to add file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(merged, "etc/hostname"), []byte("changed\n"), 0644); err != nil {
+		t.Fatalf("failed to modify file: %v", err)
+	}
+	if err := os.Remove(filepath.Join(merged, "etc/passwd")); err != nil {
+		t.Fatalf("failed to delete file: %v", err)
+	}
+	if err := syscall.Unmount(merged, 0); err != nil {
+		t.Fatalf("failed to unmount overlay: %v", err)
+	}
+
+	state := &ContainerState{ID: "diff-test", Status: StatusStopped, Rootfs: merged, UpperDir: upper, LowerDir: lower}
+	if err := SaveState(state); err != nil {
+		t.Fatalf("SaveState returned an error: %v", err)
+	}
+
+	changes, err := Diff(state.ID)
+	if err != nil {
+		t.Fatalf("Diff returned an error: %v", err)
+	}
+	expected := []Change{
+		{Path: "/etc", Kind: ChangeModified},
+		{Path: "/etc/hostname", Kind: ChangeModified},
+		{Path: "/etc/passwd", Kind: ChangeDeleted},
+		{Path: "/new.txt", Kind: ChangeAdded},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("expected changes %v, got %v", expected, changes)
+	}
+}
+
+func TestDiffRequiresOverlay(t *testing.T) {
+	StateDir = t.TempDir()
+
+	state := &ContainerState{ID: "plain", Status: StatusStopped, Rootfs: "/var/lib/spocker/rootfs"}
+	if err := SaveState(state); err != nil {
+		t.Fatalf("SaveState returned an error: %v", err)
+	}
+	if _, err := Diff(state.ID); err == nil {
+		t.Error("expected an error diffing a container without overlay layers")
+	}
+}
+
+func TestRecordExit(t *testing.T) {
+	StateDir = t.TempDir()
+
+	state := &ContainerState{ID: "crashloop", Status: StatusRunning}
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	exits := maxLastExits + 5
+	for i := 0; i < exits; i++ {
+		state.RecordExit(i, start.Add(time.Duration(i)*time.Second), i < exits-1)
+	}
+
+	if state.ExitCode != exits-1 {
+		t.Errorf("expected the last exit code %d, got %d", exits-1, state.ExitCode)
+	}
+	if state.RestartCount != exits-1 {
+		t.Errorf("expected %d restarts, got %d", exits-1, state.RestartCount)
+	}
+	if len(state.LastExits) != maxLastExits {
+		t.Fatalf("expected %d exit times, got %d", maxLastExits, len(state.LastExits))
+	}
+	if !state.LastExits[0].Equal(start.Add(5*time.Second)) || !state.LastExits[maxLastExits-1].Equal(start.Add(time.Duration(exits-1)*time.Second)) {
+		t.Errorf("expected the most recent exit times, got %v", state.LastExits)
+	}
+
+	if err := SaveState(state); err != nil {
+		t.Fatalf("SaveState returned an error: %v", err)
+	}
+	loaded, err := LoadState(state.ID)
+	if err != nil {
+		t.Fatalf("LoadState returned an error: %v", err)
+	}
+	if loaded.ExitCode != state.ExitCode || loaded.RestartCount != state.RestartCount || !reflect.DeepEqual(loaded.LastExits, state.LastExits) {
+		t.Errorf("loaded exit history %+v does not match saved %+v", loaded, state)
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	cmd := exec.Command("sh", "-c", "exit 7")
+	if err := cmd.Run(); err == nil {
+		t.Fatal("expected a non-zero exit")
+	}
+	if code := exitStatus(cmd.ProcessState); code != 7 {
+		t.Errorf("expected exit code 7, got %d", code)
+	}
+
+	cmd = exec.Command("sleep", "10")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start process: %v", err)
+	}
+	_ = cmd.Process.Kill()
+	_ = cmd.Wait()
+	if code := exitStatus(cmd.ProcessState); code != 128+int(syscall.SIGKILL) {
+		t.Errorf("expected exit code %d for a killed process, got %d", 128+int(syscall.SIGKILL), code)
+	}
+}
+
+func TestTempDir(t *testing.T) {
+	StateDir = t.TempDir()
+	TempBaseDir = t.TempDir()
+
+	live := &ContainerState{ID: "live", Status: StatusRunning}
+	if err := SaveState(live); err != nil {
+		t.Fatalf("SaveState returned an error: %v", err)
+	}
+
+	dir, cleanup, err := TempDir(live.ID)
+	if err != nil {
+		t.Fatalf("TempDir returned an error: %v", err)
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		t.Fatalf("expected TempDir to create a directory, got %v", err)
+	}
+	if filepath.Dir(dir) != filepath.Join(TempBaseDir, live.ID) {
+		t.Errorf("temporary directory %s is not under the container's directory", dir)
+	}
+	cleanup()
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("expected cleanup to remove %s, got %v", dir, err)
+	}
+
+	// A directory left behind by an operation that never cleaned up is kept while its container exists.
+	kept, _, err := TempDir(live.ID)
+	if err != nil {
+		t.Fatalf("TempDir returned an error: %v", err)
+	}
+	orphaned, _, err := TempDir("dead")
+	if err != nil {
+		t.Fatalf("TempDir returned an error: %v", err)
+	}
+
+	removed, err := GCTempDirs()
+	if err != nil {
+		t.Fatalf("GCTempDirs returned an error: %v", err)
+	}
+	if !reflect.DeepEqual(removed, []string{"dead"}) {
+		t.Errorf("GCTempDirs removed %v, want [dead]", removed)
+	}
+	if _, err := os.Stat(orphaned); !os.IsNotExist(err) {
+		t.Errorf("expected the orphaned directory %s to be removed, got %v", orphaned, err)
+	}
+	if _, err := os.Stat(kept); err != nil {
+		t.Errorf("expected the live container's directory to be kept, got %v", err)
+	}
+
+	if _, _, err := TempDir("../escape"); err == nil {
+		t.Error("expected an error for an invalid container ID")
+	}
+
+	// A base another user could have planted is refused: a symlink, or a directory others can write to
+	target := t.TempDir()
+	TempBaseDir = filepath.Join(t.TempDir(), "link")
+	if err := os.Symlink(target, TempBaseDir); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := TempDir(live.ID); err == nil || !strings.Contains(err.Error(), "not a directory") {
+		t.Errorf("expected a symlinked base to be refused, got %v", err)
+	}
+	TempBaseDir = t.TempDir()
+	if err := os.Chmod(TempBaseDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GCTempDirs(); err == nil || !strings.Contains(err.Error(), "writable by other users") {
+		t.Errorf("expected a world-writable base to be refused, got %v", err)
+	}
+
+	// A missing base is created for the user spocker runs as only
+	TempBaseDir = filepath.Join(t.TempDir(), "spocker", "tmp")
+	if _, _, err := TempDir(live.ID); err != nil {
+		t.Fatalf("TempDir returned an error: %v", err)
+	}
+	if info, err := os.Stat(TempBaseDir); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("expected the base to be created with mode 0700, got %v (%v)", info, err)
+	}
+}
+
+func TestGCLoopDevices(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to attach loop devices")
+	}
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 is not installed")
+	}
+	StateDir = t.TempDir()
+	TempBaseDir = t.TempDir()
+
+	live := &ContainerState{ID: "live", Status: StatusStopped}
+	if err := SaveState(live); err != nil {
+		t.Fatalf("SaveState returned an error: %v", err)
+	}
+	devices := map[string]string{}
+	for _, id := range []string{"live", "dead"} {
+		image, err := LoopbackImagePath(id)
+		if err != nil {
+			t.Fatalf("LoopbackImagePath returned an error: %v", err)
+		}
+		if err := os.MkdirAll(filepath.Dir(image), 0700); err != nil {
+			t.Fatal(err)
+		}
+		device, err := filesystem.CreateLoopbackFS(image, filesystem.MinLoopbackSize)
+		if err != nil {
+			t.Fatalf("CreateLoopbackFS returned an error: %v", err)
+		}
+		defer filesystem.DetachLoopDevice(device)
+		devices[id] = device
+	}
+
+	detached, err := GCLoopDevices()
+	if err != nil {
+		t.Fatalf("GCLoopDevices returned an error: %v", err)
+	}
+	if !reflect.DeepEqual(detached, []string{devices["dead"]}) {
+		t.Errorf("GCLoopDevices detached %v, want [%s]", detached, devices["dead"])
+	}
+
+	if err := Remove("live"); err != nil {
+		t.Fatalf("Remove returned an error: %v", err)
+	}
+	attached, err := filesystem.ListLoopDevices()
+	if err != nil {
+		t.Fatalf("ListLoopDevices returned an error: %v", err)
+	}
+	for _, device := range attached {
+		if device.Device == devices["live"] {
+			t.Errorf("Remove left %s attached", device.Device)
+		}
+	}
+}
+
+func TestWritableLayer(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to attach loop devices and mount")
+	}
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 is not installed")
+	}
+	StateDir = t.TempDir()
+	TempBaseDir = t.TempDir()
+	const id = "rw-layer"
+	if err := os.MkdirAll(filepath.Join(StateDir, id), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	layers, err := mountWritableLayer(id, 8<<20)
+	if err != nil {
+		t.Fatalf("mountWritableLayer returned an error: %v", err)
+	}
+	lower := t.TempDir()
+	fs := &filesystem.Filesystem{Root: lower}
+	upper, err := mountOverlayRootfs(fs, id, layers)
+	if err != nil {
+		_ = unmountWritableLayer(id)
+		t.Skipf("overlay filesystem not available: %v", err)
+	}
+	state := &ContainerState{ID: id, Rootfs: fs.Root, LowerDir: lower, UpperDir: upper}
+	if filepath.Dir(upper) != layers {
+		t.Errorf("expected the upper layer on the writable layer %s, got %s", layers, upper)
+	}
+
+	// Writes land on the image, which caps them at its size
+	if err := os.WriteFile(filepath.Join(fs.Root, "small"), []byte("data\n"), 0644); err != nil {
+		t.Fatalf("failed to write to the rootfs: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(upper, "small")); err != nil {
+		t.Errorf("expected the write in the upper layer: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(fs.Root, "big"), make([]byte, 16<<20), 0644); !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("expected writing past the image size to fail with ENOSPC, got %v", err)
+	}
+
+	if err := unmountOverlayRootfs(state); err != nil {
+		t.Fatalf("unmountOverlayRootfs returned an error: %v", err)
+	}
+	if err := unmountWritableLayer(id); err != nil {
+		t.Fatalf("unmountWritableLayer returned an error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(StateDir, id, overlayDirName)); !os.IsNotExist(err) {
+		t.Errorf("expected the overlay directory to be removed, got %v", err)
+	}
+	image, _ := LoopbackImagePath(id)
+	if _, err := os.Stat(image); !os.IsNotExist(err) {
+		t.Errorf("expected the loopback image to be removed, got %v", err)
+	}
+	devices, err := filesystem.ListLoopDevices()
+	if err != nil {
+		t.Fatalf("ListLoopDevices returned an error: %v", err)
+	}
+	for _, device := range devices {
+		if device.BackingFile == image {
+			t.Errorf("%s is still attached to the loopback image", device.Device)
+		}
+	}
+	// Containers without a writable layer are left alone
+	if err := unmountWritableLayer(id); err != nil {
+		t.Errorf("unmountWritableLayer returned an error without a writable layer: %v", err)
+	}
+}
+
+func TestInspectAll(t *testing.T) {
+	StateDir = t.TempDir()
+	cgroupRoot := t.TempDir()
+	version, err := cgroup.CgroupVersion()
+	if err != nil {
+		t.Skipf("cannot tell the cgroup version of this host: %v", err)
+	}
+
+	// writeUsage creates a fake cgroup with the given memory usage, where this host's cgroup version keeps it.
+	writeUsage := func(name, usage string) string {
+		dir := filepath.Join(cgroupRoot, name)
+		usageFile := filepath.Join(dir, "memory.current")
+		if version == 1 {
+			usageFile = filepath.Join(cgroupRoot, "memory", name, "memory.usage_in_bytes")
+		}
+		if err := os.MkdirAll(filepath.Dir(usageFile), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(usageFile, []byte(usage+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+
+	self, err := process.ProcessStartTime(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	states := []*ContainerState{
+		{ID: "a-running", PID: os.Getpid(), StartTime: self, Status: StatusRunning, CgroupPath: writeUsage("a", "4096")},
+		{ID: "b-bad-cgroup", Status: StatusStopped, CgroupPath: filepath.Join(cgroupRoot, "missing")},
+		{ID: "c-created", Status: StatusCreated},
+		{ID: "e-exited", PID: os.Getpid(), StartTime: self + 1, Status: StatusRunning},
+	}
+	for _, state := range states {
+		if err := SaveState(state); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(StateDir, "d-corrupt"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(StateDir, "d-corrupt", stateFileName), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	infos, err := InspectAll(false)
+	if err != nil {
+		t.Fatalf("InspectAll returned an error: %v", err)
+	}
+	byID := map[string]*ContainerInfo{}
+	for _, info := range infos {
+		byID[info.ID] = info
+	}
+	if len(infos) != 5 || len(byID) != 5 {
+		t.Fatalf("expected all 5 containers, got %d", len(infos))
+	}
+
+	if info := byID["a-running"]; !info.Running || info.MemoryUsage != 4096 || len(info.Errors) != 0 {
+		t.Errorf("expected a running container using 4096 bytes, got running %v, usage %d, errors %q", info.Running, info.MemoryUsage, info.Errors)
+	}
+	if info := byID["b-bad-cgroup"]; len(info.Errors) != 1 || !strings.Contains(info.Errors[0], "memory usage") {
+		t.Errorf("expected the unreadable cgroup to be reported in the container's errors, got %q", info.Errors)
+	}
+	if info := byID["c-created"]; info.Running || len(info.Errors) != 0 {
+		t.Errorf("expected a created container without errors, got running %v, errors %q", info.Running, info.Errors)
+	}
+	if info := byID["d-corrupt"]; len(info.Errors) != 1 || !strings.Contains(info.Errors[0], "decode") {
+		t.Errorf("expected the corrupt state to be reported in the container's errors, got %q", info.Errors)
+	}
+	if info := byID["e-exited"]; info.Running {
+		t.Error("expected a container whose PID was reused to not be running")
+	}
+}
+
+func TestAssignHostPorts(t *testing.T) {
+	StateDir = t.TempDir()
+	other := &ContainerState{
+		ID:     "other",
+		Status: StatusCreated,
+		Ports:  []network.PortMapping{{HostPort: 18080, ContainerPort: 80, Protocol: "tcp"}},
+	}
+	if err := SaveState(other); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := assignHostPorts([]network.PortMapping{{ContainerPort: 8080, Protocol: "tcp"}, {HostPort: 18081, ContainerPort: 80, Protocol: "tcp"}})
+	if err != nil {
+		t.Fatalf("assignHostPorts returned an error: %v", err)
+	}
+	defer releaseHostPorts(first)
+	second, err := assignHostPorts([]network.PortMapping{{ContainerPort: 8080, Protocol: "tcp"}})
+	if err != nil {
+		t.Fatalf("assignHostPorts returned an error: %v", err)
+	}
+	defer releaseHostPorts(second)
+
+	if first[0].HostPort == 0 || first[0].HostPort == second[0].HostPort {
+		t.Errorf("expected two different concrete host ports, got %s and %s", first[0], second[0])
+	}
+	if first[1].HostPort != 18081 {
+		t.Errorf("expected the given host port to be kept, got %s", first[1])
+	}
+
+	if _, err := assignHostPorts([]network.PortMapping{{HostPort: 18080, ContainerPort: 80, Protocol: "tcp"}}); err == nil {
+		t.Error("expected a host port published by another container to be refused")
+	}
+	if _, err := assignHostPorts([]network.PortMapping{{HostPort: 18081, ContainerPort: 80, Protocol: "tcp"}}); err == nil {
+		t.Error("expected a host port that is already allocated to be refused")
+	}
+}
+
+func TestPublishHostPorts(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to change iptables rules")
+	}
+	ipt, err := iptables.New()
+	if err != nil {
+		t.Skipf("iptables is not available: %v", err)
+	}
+
+	containerIP := net.ParseIP("10.233.0.2")
+	ports := []network.PortMapping{
+		{HostPort: 18082, ContainerPort: 80, Protocol: "tcp"},
+		{HostPort: 18083, ContainerPort: 53, Protocol: "udp"},
+	}
+	dnatRules := func() []string {
+		rules, err := ipt.List("nat", "PREROUTING")
+		if err != nil {
+			t.Fatalf("failed to list rules: %v", err)
+		}
+		var found []string
+		for _, rule := range rules {
+			if strings.Contains(rule, "DNAT") && strings.Contains(rule, "--to-destination "+containerIP.String()+":") {
+				found = append(found, rule)
+			}
+		}
+		return found
+	}
+
+	if err := publishHostPorts(containerIP, ports); err != nil {
+		t.Fatalf("publishHostPorts returned an error: %v", err)
+	}
+	defer unpublishHostPorts(containerIP, ports)
+	rules := strings.Join(dnatRules(), "\n")
+	for _, want := range []string{"-p tcp -m tcp --dport 18082 -j DNAT --to-destination 10.233.0.2:80", "-p udp -m udp --dport 18083 -j DNAT --to-destination 10.233.0.2:53"} {
+		if !strings.Contains(rules, want) {
+			t.Errorf("expected a PREROUTING rule %q, got:\n%s", want, rules)
+		}
+	}
+
+	if err := unpublishHostPorts(containerIP, ports); err != nil {
+		t.Fatalf("unpublishHostPorts returned an error: %v", err)
+	}
+	if left := dnatRules(); len(left) != 0 {
+		t.Errorf("expected no DNAT rules to the container after unpublishing, got %q", left)
+	}
+}
+
+func TestMasqueradeNetwork(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to change iptables rules")
+	}
+	ipt, err := iptables.New()
+	if err != nil {
+		t.Skipf("iptables is not available: %v", err)
+	}
+	outbound, err := network.DefaultRouteInterface()
+	if err != nil {
+		t.Skipf("no outbound interface to masquerade through: %v", err)
+	}
+
+	_, subnet, _ := net.ParseCIDR("10.236.0.0/24")
+	n := &network.Network{Name: "vethmasq", IPNet: &net.IPNet{IP: net.ParseIP("10.236.0.2"), Mask: subnet.Mask}}
+	if err := masqueradeNetwork(n); err != nil {
+		t.Fatalf("masqueradeNetwork returned an error: %v", err)
+	}
+	rule := []string{"-s", subnet.String(), "!", "-d", subnet.String(), "-o", outbound.Name, "-j", "MASQUERADE"}
+	defer ipt.DeleteIfExists("nat", "POSTROUTING", rule...)
+	if n.Masquerade != outbound.Name {
+		t.Errorf("expected the network to record masquerading through %s, got %q", outbound.Name, n.Masquerade)
+	}
+	if exists, err := ipt.Exists("nat", "POSTROUTING", rule...); err != nil || !exists {
+		t.Errorf("masquerade rule is missing after masqueradeNetwork (%v)", err)
+	}
+
+	if err := network.TeardownNetwork(0, n); err != nil {
+		t.Fatalf("TeardownNetwork returned an error: %v", err)
+	}
+	if exists, err := ipt.Exists("nat", "POSTROUTING", rule...); err != nil || exists {
+		t.Errorf("masquerade rule still exists after the network was torn down (%v)", err)
+	}
+}
+
+func TestTop(t *testing.T) {
+	StateDir = t.TempDir()
+
+	sleeper := exec.Command("sleep", "30")
+	if err := sleeper.Start(); err != nil {
+		t.Fatalf("failed to start sleep: %v", err)
+	}
+	defer func() {
+		_ = sleeper.Process.Kill()
+		_ = sleeper.Wait()
+	}()
+	exited := exec.Command("true")
+	if err := exited.Run(); err != nil {
+		t.Fatalf("failed to run true: %v", err)
+	}
+
+	// A thread of this process, as cgroup v1 lists them, stands for the process it belongs to
+	threads, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		t.Fatal(err)
+	}
+	thread := os.Getpid()
+	for _, entry := range threads {
+		if tid, err := strconv.Atoi(entry.Name()); err == nil && tid != os.Getpid() {
+			thread = tid
+			break
+		}
+	}
+
+	// The exited process stands in for one that is gone by the time it is read
+	cgroupPath := t.TempDir()
+	procs := fmt.Sprintf("%d\n%d\n%d\n", exited.Process.Pid, sleeper.Process.Pid, thread)
+	for _, name := range []string{"cgroup.procs", "tasks"} {
+		if err := os.WriteFile(filepath.Join(cgroupPath, name), []byte(procs), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := SaveState(&ContainerState{ID: "top", Status: StatusRunning, CgroupPath: cgroupPath}); err != nil {
+		t.Fatal(err)
+	}
+
+	processes, err := Top("top")
+	if err != nil {
+		t.Fatalf("Top returned an error: %v", err)
+	}
+	if len(processes) != 2 || processes[0].PID > processes[1].PID {
+		t.Fatalf("expected the sleeping process and this one, ordered by PID, got %+v", processes)
+	}
+	var p ProcessInfo
+	listed := false
+	for _, info := range processes {
+		if info.PID == os.Getpid() {
+			listed = true
+		} else {
+			p = info
+		}
+	}
+	if !listed {
+		t.Errorf("expected the thread to be listed as process %d, got %+v", os.Getpid(), processes)
+	}
+	if p.PID != sleeper.Process.Pid || p.Command != "sleep 30" || p.PPID != os.Getpid() {
+		t.Errorf("unexpected process %+v", p)
+	}
+	if p.User == "" || p.RSS == 0 {
+		t.Errorf("expected the process's user and memory, got %+v", p)
+	}
+
+	if err := SaveState(&ContainerState{ID: "no-cgroup", Status: StatusCreated}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Top("no-cgroup"); err == nil {
+		t.Error("expected Top of a container without a cgroup to fail")
+	}
+}
@@ -0,0 +1,63 @@
+package container
+
+import (
+	"go.uber.org/zap"
+)
+
+// teardownStage orders the steps that undo a container's setup.
+// Stages run from first to last, so the process is gone before the resources it was using are released.
+type teardownStage int
+
+// These constants define the teardown stages in the order they run.
+const (
+	stageProcess teardownStage = iota
+	stageCgroup
+	stageNetwork
+	stageFilesystem
+	stageState
+	numTeardownStages
+)
+
+// teardownStep is a single named cleanup action.
+type teardownStep struct {
+	name string
+	fn   func() error
+}
+
+// teardown collects cleanup steps as a container is set up and runs them in stage order.
+// Within a stage, steps run in reverse order of registration, like deferred calls.
+type teardown struct {
+	logger *zap.Logger
+	stages [numTeardownStages][]teardownStep
+}
+
+// newTeardown creates an empty teardown that logs failed steps to logger.
+func newTeardown(logger *zap.Logger) *teardown {
+	return &teardown{logger: logger}
+}
+
+// add registers fn to run during the given stage.
+func (t *teardown) add(stage teardownStage, name string, fn func() error) {
+	t.stages[stage] = append(t.stages[stage], teardownStep{name: name, fn: fn})
+}
+
+// cleanup runs every registered step. A failing step is logged and does not stop the remaining steps.
+// Steps are cleared as they run, so calling cleanup again is a no-op.
+func (t *teardown) cleanup() {
+	for stage := range t.stages {
+		steps := t.stages[stage]
+		t.stages[stage] = nil
+		for i := len(steps) - 1; i >= 0; i-- {
+			if err := steps[i].fn(); err != nil {
+				t.logger.Error("Cleanup step failed", zap.String("step", steps[i].name), zap.Error(err))
+			}
+		}
+	}
+}
+
+// discard drops every registered step without running it, leaving what they would have undone in place.
+func (t *teardown) discard() {
+	for stage := range t.stages {
+		t.stages[stage] = nil
+	}
+}
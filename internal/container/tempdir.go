@@ -0,0 +1,108 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// TempBaseDir is the directory under which each container's temporary directories are created, one
+// subdirectory per container ID. It is kept apart from StateDir, which is usually in memory, so it can live on a
+// larger filesystem. It is not in a world-writable directory like /tmp, where another user could create it first.
+var TempBaseDir = "/var/lib/spocker/tmp"
+
+// TempDir creates a new temporary directory for an operation on the container with the given ID, such as
+// extracting a tar or taking a snapshot, and returns it with a function that removes it.
+// Anything the cleanup function is not called for, e.g. because spocker crashed mid-operation, is removed
+// along with the container by Remove, or by GCTempDirs once the container is gone.
+func TempDir(id string) (string, func(), error) {
+	base, err := containerTempDir(id)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := os.Mkdir(base, 0700); err != nil && !os.IsExist(err) {
+		return "", nil, fmt.Errorf("failed to create temporary directory for container %s: %v", id, err)
+	}
+	dir, err := os.MkdirTemp(base, "tmp-")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create temporary directory for container %s: %v", id, err)
+	}
+	return dir, func() { _ = os.RemoveAll(dir) }, nil
+}
+
+// GCTempDirs removes the temporary directories of containers that no longer exist and returns their IDs.
+func GCTempDirs() ([]string, error) {
+	base, err := tempBaseDir()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(base)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list temporary directories: %v", err)
+	}
+
+	var removed []string
+	for _, entry := range entries {
+		id := entry.Name()
+		dir, err := stateDir(id)
+		if err != nil {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, stateFileName)); err == nil || !os.IsNotExist(err) {
+			continue
+		}
+		if err := removeTempDirs(id); err != nil {
+			return removed, err
+		}
+		removed = append(removed, id)
+	}
+	return removed, nil
+}
+
+// containerTempDir returns the directory holding the temporary directories of the container with the given ID.
+func containerTempDir(id string) (string, error) {
+	if _, err := stateDir(id); err != nil {
+		return "", err
+	}
+	base, err := tempBaseDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(base, id), nil
+}
+
+// tempBaseDir returns TempBaseDir, creating it with mode 0700 if it does not exist. Directories are created and
+// removed in it as root, so it is refused unless it is a directory, not a symlink, that belongs to the user spocker
+// runs as and that no one else can write to; otherwise another user could redirect what is created or removed.
+func tempBaseDir() (string, error) {
+	if err := os.MkdirAll(TempBaseDir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create temporary directory base %s: %v", TempBaseDir, err)
+	}
+	info, err := os.Lstat(TempBaseDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to check temporary directory base %s: %v", TempBaseDir, err)
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("temporary directory base %s is not a directory", TempBaseDir)
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); !ok || int(stat.Uid) != os.Geteuid() {
+		return "", fmt.Errorf("temporary directory base %s is not owned by uid %d", TempBaseDir, os.Geteuid())
+	}
+	if info.Mode().Perm()&0022 != 0 {
+		return "", fmt.Errorf("temporary directory base %s is writable by other users", TempBaseDir)
+	}
+	return TempBaseDir, nil
+}
+
+// removeTempDirs removes all temporary directories of the container with the given ID.
+func removeTempDirs(id string) error {
+	dir, err := containerTempDir(id)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("failed to remove temporary directories of container %s: %v", id, err)
+	}
+	return nil
+}
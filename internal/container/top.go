@@ -0,0 +1,172 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"spocker/internal/container/cgroup"
+	"spocker/internal/container/process"
+)
+
+// clockTicks is the number of clock ticks per second the times in /proc/<pid>/stat are counted in. It is fixed at
+// 100 for userspace on every Linux architecture.
+const clockTicks = 100
+
+// ProcessInfo describes a process running in a container, as `spocker top` lists it.
+type ProcessInfo struct {
+	// PID is the process's ID on the host, and NSPID its ID in the container's PID namespace, which is the same as
+	// PID for a container sharing the host's.
+	PID   int    `json:"pid"`
+	NSPID int    `json:"nsPid"`
+	PPID  int    `json:"ppid"`
+	User  string `json:"user"`
+	// CPUPercent is the share of one CPU the process has used on average since it started.
+	CPUPercent float64 `json:"cpuPercent"`
+	// RSS is the process's resident memory in bytes, and MemPercent its share of the host's memory.
+	RSS        uint64  `json:"rss"`
+	MemPercent float64 `json:"memPercent"`
+	// Command is the process's command line, or its name in brackets if it has none, like a kernel thread.
+	Command string `json:"command"`
+}
+
+// Top lists the processes in the cgroup of the container with the given ID, ordered by PID. Processes that exit
+// while they are being read are left out.
+func Top(id string) ([]ProcessInfo, error) {
+	state, err := LoadState(id)
+	if err != nil {
+		return nil, err
+	}
+	if state.CgroupPath == "" {
+		return nil, fmt.Errorf("container %s has no cgroup", id)
+	}
+	ids, err := cgroup.ListCgroupProcesses(&cgroup.DefaultFileHandler{}, state.CgroupPath)
+	if err != nil {
+		return nil, err
+	}
+	pids := processIDs(ids)
+
+	uptime, err := systemUptime()
+	if err != nil {
+		return nil, err
+	}
+	memTotal, err := memoryTotal()
+	if err != nil {
+		return nil, err
+	}
+	processes := []ProcessInfo{}
+	for _, pid := range pids {
+		info, err := readProcessInfo(pid, uptime, memTotal)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		processes = append(processes, *info)
+	}
+	return processes, nil
+}
+
+// processIDs maps the IDs in a cgroup's processes file, which on cgroup v1 lists threads, to the processes they
+// belong to, sorted and without duplicates. Threads that are gone are dropped.
+func processIDs(ids []int) []int {
+	seen := map[int]bool{}
+	var pids []int
+	for _, id := range ids {
+		status, err := process.ReadProcStatus(id)
+		if err != nil {
+			continue
+		}
+		if !seen[status.Tgid] {
+			seen[status.Tgid] = true
+			pids = append(pids, status.Tgid)
+		}
+	}
+	sort.Ints(pids)
+	return pids
+}
+
+// readProcessInfo reads what `spocker top` shows about the process with the given PID from /proc. If the process
+// is gone the error wraps os.ErrNotExist.
+func readProcessInfo(pid int, uptime float64, memTotal uint64) (*ProcessInfo, error) {
+	stat, err := process.ReadProcStat(pid)
+	if err != nil {
+		return nil, err
+	}
+	status, err := process.ReadProcStatus(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &ProcessInfo{PID: pid, NSPID: pid, PPID: stat.PPID, RSS: status.VmRSS, Command: "[" + stat.Comm + "]"}
+	if len(status.NSpid) > 0 {
+		info.NSPID = status.NSpid[len(status.NSpid)-1]
+	}
+	if len(status.UIDs) > 0 {
+		uid := strconv.Itoa(status.UIDs[0])
+		info.User = uid
+		if u, err := user.LookupId(uid); err == nil {
+			info.User = u.Username
+		}
+	}
+	if memTotal > 0 {
+		info.MemPercent = float64(info.RSS) / float64(memTotal) * 100
+	}
+	if elapsed := uptime - float64(stat.StartTime)/clockTicks; elapsed > 0 {
+		info.CPUPercent = float64(stat.UTime+stat.STime) / clockTicks / elapsed * 100
+	}
+
+	cmdline, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cmdline"))
+	if err != nil {
+		return nil, err
+	}
+	if args := strings.Fields(strings.ReplaceAll(string(cmdline), "\x00", " ")); len(args) > 0 {
+		info.Command = strings.Join(args, " ")
+	}
+	return info, nil
+}
+
+// systemUptime returns the seconds since the host booted, from /proc/uptime.
+func systemUptime() (float64, error) {
+	data, err := os.ReadFile("/proc/uptime")
+	if err != nil {
+		return 0, fmt.Errorf("failed to read uptime: %v", err)
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("invalid uptime: %q", data)
+	}
+	uptime, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid uptime: %v", err)
+	}
+	return uptime, nil
+}
+
+// memoryTotal returns the host's memory in bytes, from /proc/meminfo.
+func memoryTotal() (uint64, error) {
+	data, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0, fmt.Errorf("failed to read meminfo: %v", err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if name, value, ok := strings.Cut(line, ":"); ok && name == "MemTotal" {
+			fields := strings.Fields(value)
+			if len(fields) == 0 {
+				break
+			}
+			kb, err := strconv.ParseUint(fields[0], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid MemTotal in meminfo: %v", err)
+			}
+			return kb * 1024, nil
+		}
+	}
+	return 0, fmt.Errorf("no MemTotal in meminfo")
+}
@@ -0,0 +1,91 @@
+// daemon package serves container operations to unprivileged clients over a unix socket.
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"spocker/internal/container"
+)
+
+// Client sends requests to a daemon.
+type Client struct {
+	dial func() (net.Conn, error)
+}
+
+// NewClient returns a client of the daemon listening at host, e.g. unix:///run/spocker.sock.
+func NewClient(host string) (*Client, error) {
+	path, err := SocketPath(host)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{dial: func() (net.Conn, error) { return net.Dial("unix", path) }}, nil
+}
+
+// Run asks the daemon to run the container described by config with the command and arguments in args, and
+// returns its ID. The container runs in the background; its output is read with Logs.
+func (c *Client) Run(config *container.Config, args []string) (string, error) {
+	resp, err := c.call(&Request{Op: OpRun, Config: config, Args: args})
+	if err != nil {
+		return "", err
+	}
+	return resp.ID, nil
+}
+
+// Stop asks the daemon to stop the container, killing it if it has not exited after timeout.
+func (c *Client) Stop(id string, timeout time.Duration) error {
+	_, err := c.call(&Request{Op: OpStop, ID: id, Timeout: timeout})
+	return err
+}
+
+// List returns the info of every container of the daemon.
+func (c *Client) List() ([]*container.ContainerInfo, error) {
+	resp, err := c.call(&Request{Op: OpPs})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Containers, nil
+}
+
+// Inspect returns the info of the container.
+func (c *Client) Inspect(id string) (*container.ContainerInfo, error) {
+	resp, err := c.call(&Request{Op: OpInspect, ID: id})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Container, nil
+}
+
+// Logs returns the output of the container so far.
+func (c *Client) Logs(id string) ([]byte, error) {
+	resp, err := c.call(&Request{Op: OpLogs, ID: id})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Logs, nil
+}
+
+// call sends req to the daemon on a new connection and returns its response. A failed operation is returned as
+// an error.
+func (c *Client) call(req *Request) (*Response, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the daemon: %v", err)
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, fmt.Errorf("failed to send %s request: %v", req.Op, err)
+	}
+	resp := &Response{}
+	if err := json.NewDecoder(conn).Decode(resp); err != nil {
+		return nil, fmt.Errorf("failed to read response to %s request: %v", req.Op, err)
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return resp, nil
+}
@@ -0,0 +1,270 @@
+// daemon package serves container operations to unprivileged clients over a unix socket.
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"spocker/internal/container"
+
+	"go.uber.org/zap"
+)
+
+// DefaultHost is the socket the daemon listens on and clients connect to when no other is given.
+const DefaultHost = "unix:///run/spocker.sock"
+
+// SocketMode is the permission of the daemon's socket: the daemon runs containers as root, so only root and the
+// socket's group may connect.
+const SocketMode os.FileMode = 0660
+
+// logFileName is the name of the file, in a container's state directory, that the output of a container run by
+// the daemon goes to.
+const logFileName = "output.log"
+
+// The operations a Request can ask for.
+const (
+	OpRun     = "run"
+	OpStop    = "stop"
+	OpPs      = "ps"
+	OpInspect = "inspect"
+	OpLogs    = "logs"
+)
+
+// Request is what a client sends the daemon, as one JSON object per connection.
+type Request struct {
+	Op string `json:"op"`
+	// ID is the container stop, inspect, and logs act on.
+	ID string `json:"id,omitempty"`
+	// Config and Args describe the container to run: the command and its arguments are in Args, since the
+	// config's Cmd is not sent.
+	Config *container.Config `json:"config,omitempty"`
+	Args   []string          `json:"args,omitempty"`
+	// Timeout is how long stop waits for the container to exit before killing it.
+	Timeout time.Duration `json:"timeout,omitempty"`
+}
+
+// Response is what the daemon answers a Request with. Error is set if the operation failed; otherwise the field
+// for the operation is: ID for run, Containers for ps, Container for inspect, and Logs for logs.
+type Response struct {
+	Error      string                     `json:"error,omitempty"`
+	ID         string                     `json:"id,omitempty"`
+	Containers []*container.ContainerInfo `json:"containers,omitempty"`
+	Container  *container.ContainerInfo   `json:"container,omitempty"`
+	Logs       []byte                     `json:"logs,omitempty"`
+}
+
+// Backend carries out the operations the daemon serves.
+type Backend interface {
+	Run(config *container.Config, args []string) (string, error)
+	Stop(id string, timeout time.Duration) error
+	List() ([]*container.ContainerInfo, error)
+	Inspect(id string) (*container.ContainerInfo, error)
+	Logs(id string) ([]byte, error)
+}
+
+// DefaultBackend is the Backend that runs containers on this host with the container package.
+type DefaultBackend struct{}
+
+// Run creates and starts a container running args, and returns its ID without waiting for it to exit. The
+// container's output goes to a log file in its state directory, which Logs reads.
+func (DefaultBackend) Run(config *container.Config, args []string) (string, error) {
+	if len(args) == 0 {
+		return "", fmt.Errorf("no command given")
+	}
+	if config.ID == "" {
+		id, err := container.NewID()
+		if err != nil {
+			return "", err
+		}
+		config.ID = id
+	}
+	logPath, err := LogPath(config.ID)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(logPath), 0700); err != nil {
+		return "", fmt.Errorf("failed to create state directory for container %s: %v", config.ID, err)
+	}
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return "", fmt.Errorf("failed to create log file for container %s: %v", config.ID, err)
+	}
+	// The container's process has its own copy of the file once it is created
+	defer logFile.Close()
+
+	config.Cmd = exec.Command(args[0], args[1:]...)
+	config.Cmd.Stdout = logFile
+	config.Cmd.Stderr = logFile
+	id, err := container.Create(config)
+	if err != nil {
+		return "", err
+	}
+	if err := container.Start(id); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// Stop stops the container as container.Stop does.
+func (DefaultBackend) Stop(id string, timeout time.Duration) error {
+	return container.Stop(id, timeout)
+}
+
+// List returns the info of every container, as container.InspectAll does.
+func (DefaultBackend) List() ([]*container.ContainerInfo, error) {
+	return container.InspectAll(false)
+}
+
+// Inspect returns the info of the container, as container.Inspect does.
+func (DefaultBackend) Inspect(id string) (*container.ContainerInfo, error) {
+	return container.Inspect(id, false)
+}
+
+// Logs returns the output of a container run by the daemon so far.
+func (DefaultBackend) Logs(id string) ([]byte, error) {
+	logPath, err := LogPath(id)
+	if err != nil {
+		return nil, err
+	}
+	logs, err := os.ReadFile(logPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			if _, err := container.LoadState(id); err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("container %s has no logs: it was not run by the daemon", id)
+		}
+		return nil, fmt.Errorf("failed to read logs of container %s: %v", id, err)
+	}
+	return logs, nil
+}
+
+// LogPath returns the path of the log file of the container with the given ID.
+func LogPath(id string) (string, error) {
+	if id == "" || filepath.Base(id) != id || id == "." || id == ".." {
+		return "", fmt.Errorf("invalid container ID: %q", id)
+	}
+	return filepath.Join(container.StateDir, id, logFileName), nil
+}
+
+// SocketPath returns the path of the socket of host, which is a URL like unix:///run/spocker.sock.
+func SocketPath(host string) (string, error) {
+	path, ok := strings.CutPrefix(host, "unix://")
+	if !ok || !filepath.IsAbs(path) {
+		return "", fmt.Errorf("invalid host %q: only unix:///absolute/path sockets are supported", host)
+	}
+	return path, nil
+}
+
+// Listen creates the daemon's socket at path with SocketMode permissions. A socket left behind by a daemon that is
+// gone is replaced, but one another daemon is listening on, or a file that is not a socket, is refused.
+func Listen(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("another daemon is listening on %s", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket %s: %v", path, err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create socket directory: %v", err)
+	}
+
+	// The socket is created without any permissions for others, so no client can connect before it is restricted
+	oldMask := syscall.Umask(0777 &^ int(SocketMode))
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(oldMask)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", path, err)
+	}
+	if err := os.Chmod(path, SocketMode); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to set permissions of %s: %v", path, err)
+	}
+	return listener, nil
+}
+
+// Server answers requests from clients with a Backend.
+type Server struct {
+	backend Backend
+	logger  *zap.Logger
+}
+
+// NewServer returns a server that carries out requests with backend and logs them to logger.
+func NewServer(backend Backend, logger *zap.Logger) *Server {
+	return &Server{backend: backend, logger: logger}
+}
+
+// Serve answers the clients that connect to listener, each on its own goroutine, until listener is closed.
+func (s *Server) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("failed to accept connection: %v", err)
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn reads one request from conn, answers it, and closes conn.
+func (s *Server) ServeConn(conn net.Conn) {
+	defer conn.Close()
+
+	req := &Request{}
+	resp := &Response{}
+	if err := json.NewDecoder(conn).Decode(req); err != nil {
+		resp.Error = fmt.Sprintf("invalid request: %v", err)
+	} else {
+		s.logger.Info("Handling request", zap.String("op", req.Op), zap.String("id", req.ID))
+		if err := s.handle(req, resp); err != nil {
+			s.logger.Error("Request failed", zap.String("op", req.Op), zap.String("id", req.ID), zap.Error(err))
+			resp.Error = err.Error()
+		}
+	}
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		s.logger.Warn("Failed to send response", zap.String("op", req.Op), zap.Error(err))
+	}
+}
+
+// handle carries out req and fills in resp with the result.
+func (s *Server) handle(req *Request, resp *Response) error {
+	var err error
+	switch req.Op {
+	case OpRun:
+		if req.Config == nil {
+			return fmt.Errorf("run request without a container config")
+		}
+		resp.ID, err = s.backend.Run(req.Config, req.Args)
+	case OpStop:
+		timeout := req.Timeout
+		if timeout == 0 {
+			timeout = container.DefaultStopTimeout
+		}
+		err = s.backend.Stop(req.ID, timeout)
+	case OpPs:
+		resp.Containers, err = s.backend.List()
+	case OpInspect:
+		resp.Container, err = s.backend.Inspect(req.ID)
+	case OpLogs:
+		resp.Logs, err = s.backend.Logs(req.ID)
+	default:
+		err = fmt.Errorf("unknown operation %q", req.Op)
+	}
+	return err
+}
@@ -0,0 +1,155 @@
+package daemon
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"spocker/internal/container"
+	"spocker/internal/container/cgroup"
+
+	"go.uber.org/zap"
+)
+
+// fakeBackend records the operations it is asked for and answers them with canned results.
+type fakeBackend struct {
+	calls  []string
+	config *container.Config
+	args   []string
+	fail   error
+}
+
+func (f *fakeBackend) Run(config *container.Config, args []string) (string, error) {
+	f.calls = append(f.calls, "run")
+	f.config, f.args = config, args
+	return "c1", f.fail
+}
+
+func (f *fakeBackend) Stop(id string, timeout time.Duration) error {
+	f.calls = append(f.calls, "stop "+id+" "+timeout.String())
+	return f.fail
+}
+
+func (f *fakeBackend) List() ([]*container.ContainerInfo, error) {
+	f.calls = append(f.calls, "ps")
+	return []*container.ContainerInfo{{ContainerState: &container.ContainerState{ID: "c1", Status: container.StatusRunning}, Running: true}}, f.fail
+}
+
+func (f *fakeBackend) Inspect(id string) (*container.ContainerInfo, error) {
+	f.calls = append(f.calls, "inspect "+id)
+	return &container.ContainerInfo{ContainerState: &container.ContainerState{ID: id, PID: 42}}, f.fail
+}
+
+func (f *fakeBackend) Logs(id string) ([]byte, error) {
+	f.calls = append(f.calls, "logs "+id)
+	return []byte("hello\n"), f.fail
+}
+
+// pipeClient returns a client whose every connection is served by server over an in-process pipe.
+func pipeClient(server *Server) *Client {
+	return &Client{dial: func() (net.Conn, error) {
+		clientConn, serverConn := net.Pipe()
+		go server.ServeConn(serverConn)
+		return clientConn, nil
+	}}
+}
+
+func TestClientServer(t *testing.T) {
+	backend := &fakeBackend{}
+	client := pipeClient(NewServer(backend, zap.NewNop()))
+
+	config := &container.Config{
+		ID:     "c1",
+		FSRoot: "/srv/rootfs",
+		Cgroup: &cgroup.Spec{Name: "c1", Resources: &cgroup.Resources{Memory: &cgroup.Memory{Limit: 1 << 20}}},
+		Labels: map[string]string{"app": "web"},
+	}
+	id, err := client.Run(config, []string{"/bin/echo", "hello"})
+	if err != nil || id != "c1" {
+		t.Fatalf("Run = %q, %v, want c1", id, err)
+	}
+	if backend.config.FSRoot != "/srv/rootfs" || backend.config.Cgroup.Resources.Memory.Limit != 1<<20 || backend.config.Labels["app"] != "web" {
+		t.Errorf("config did not arrive intact: %+v", backend.config)
+	}
+	if !reflect.DeepEqual(backend.args, []string{"/bin/echo", "hello"}) {
+		t.Errorf("unexpected args %q", backend.args)
+	}
+
+	if err := client.Stop("c1", 0); err != nil {
+		t.Fatalf("Stop returned an error: %v", err)
+	}
+	infos, err := client.List()
+	if err != nil || len(infos) != 1 || infos[0].ID != "c1" || !infos[0].Running {
+		t.Fatalf("List = %+v, %v", infos, err)
+	}
+	info, err := client.Inspect("c1")
+	if err != nil || info.PID != 42 {
+		t.Fatalf("Inspect = %+v, %v", info, err)
+	}
+	logs, err := client.Logs("c1")
+	if err != nil || string(logs) != "hello\n" {
+		t.Fatalf("Logs = %q, %v", logs, err)
+	}
+
+	want := []string{"run", "stop c1 " + container.DefaultStopTimeout.String(), "ps", "inspect c1", "logs c1"}
+	if !reflect.DeepEqual(backend.calls, want) {
+		t.Errorf("backend calls = %q, want %q", backend.calls, want)
+	}
+
+	backend.fail = errors.New("no such container: c2")
+	if err := client.Stop("c2", time.Second); err == nil || err.Error() != "no such container: c2" {
+		t.Errorf("expected the backend's error to reach the client, got %v", err)
+	}
+	if _, err := client.call(&Request{Op: "pause"}); err == nil || !strings.Contains(err.Error(), "unknown operation") {
+		t.Errorf("expected an unknown operation to be refused, got %v", err)
+	}
+}
+
+func TestListen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run", "spocker.sock")
+	listener, err := Listen(path)
+	if err != nil {
+		t.Fatalf("Listen returned an error: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != SocketMode {
+		t.Errorf("expected a socket with mode %v, got %v", SocketMode, info.Mode())
+	}
+
+	if _, err := Listen(path); err == nil {
+		t.Error("expected a second daemon on the same socket to be refused")
+	}
+
+	backend := &fakeBackend{}
+	go func() { _ = NewServer(backend, zap.NewNop()).Serve(listener) }()
+	client, err := NewClient("unix://" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.List(); err != nil {
+		t.Fatalf("List over the socket returned an error: %v", err)
+	}
+	listener.Close()
+
+	notSocket := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(notSocket, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Listen(notSocket); err == nil {
+		t.Error("expected a path that is not a socket to be refused")
+	}
+
+	for _, host := range []string{"tcp://localhost:2375", "unix://relative.sock", "/run/spocker.sock"} {
+		if _, err := NewClient(host); err == nil {
+			t.Errorf("NewClient(%q) should fail", host)
+		}
+	}
+}